@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/load"
+)
+
+// A monitoring agent must not make an overload worse. While the host's load
+// per CPU reaches degrade_load, or the pressure stall information (PSI) of
+// CPU, memory or I/O reaches degrade_psi, the agent is degraded: it collects
+// every degrade_slowdown intervals instead of every interval and skips the
+// expensive collectors. It recovers once both are below degradeRecover of
+// their thresholds, so it does not flap around them.
+
+const procPressure = "/proc/pressure"
+
+const degradeRecover = 0.8
+
+// pressureResources are the PSI files checked. The "some" line's avg10 is
+// the share of the last 10s in which at least one task stalled on it.
+var pressureResources = []string{"cpu", "memory", "io"}
+
+var degraded = struct {
+	sync.Mutex
+	active bool
+	reason string
+	since  time.Time
+}{}
+
+// updateDegraded checks the host's load and pressure and enters or leaves
+// degraded mode.
+func updateDegraded() {
+	cfg := currentConfig()
+	if cfg.DegradeLoad <= 0 && cfg.DegradePSI <= 0 {
+		setDegraded(false, "")
+		return
+	}
+
+	over, calm := []string{}, true
+	if cfg.DegradeLoad > 0 {
+		if perCPU, ok := loadPerCPU(); ok {
+			if perCPU >= cfg.DegradeLoad {
+				over = append(over, fmt.Sprintf("load %.2f per CPU", perCPU))
+			}
+			calm = calm && perCPU < cfg.DegradeLoad*degradeRecover
+		}
+	}
+	if cfg.DegradePSI > 0 {
+		for _, resource := range pressureResources {
+			stalled, ok := pressureSome(resource)
+			if !ok {
+				continue
+			}
+			if stalled >= float64(cfg.DegradePSI) {
+				over = append(over, fmt.Sprintf("%s pressure %.1f%%", resource, stalled))
+			}
+			calm = calm && stalled < float64(cfg.DegradePSI)*degradeRecover
+		}
+	}
+
+	switch {
+	case len(over) > 0:
+		setDegraded(true, strings.Join(over, ", "))
+	case calm:
+		setDegraded(false, "")
+	}
+}
+
+func setDegraded(active bool, reason string) {
+	cfg := currentConfig()
+	degraded.Lock()
+	defer degraded.Unlock()
+	switch {
+	case active && !degraded.active:
+		degraded.since = time.Now()
+		logger.Warn("agent.degraded", "Host overloaded, collecting less often and skipping expensive collectors", Fields{
+			"reason":   reason,
+			"slowdown": cfg.DegradeSlowdown,
+		})
+	case !active && degraded.active:
+		logger.Info("agent.recovered", "Host load back to normal, collecting as usual", Fields{
+			"degraded_for": time.Since(degraded.since).Round(time.Second),
+		})
+	}
+	degraded.active = active
+	if active {
+		degraded.reason = reason
+	} else {
+		degraded.reason = ""
+	}
+}
+
+// isDegraded reports whether the agent is degraded, and why.
+func isDegraded() (bool, string) {
+	degraded.Lock()
+	defer degraded.Unlock()
+	return degraded.active, degraded.reason
+}
+
+// degradedInterval is the collection interval, stretched while degraded.
+func degradedInterval(interval time.Duration) time.Duration {
+	cfg := currentConfig()
+	if active, _ := isDegraded(); active && cfg.DegradeSlowdown > 1 {
+		return interval * time.Duration(cfg.DegradeSlowdown)
+	}
+	return interval
+}
+
+// skipWhileDegraded reports whether collector is left out of this cycle.
+func skipWhileDegraded(collector Collector) bool {
+	active, _ := isDegraded()
+	return active && collector.Expensive
+}
+
+// degradedMetric is the degraded-mode flag sent every cycle.
+func degradedMetric() Metric {
+	active, reason := isDegraded()
+	m := Metric{
+		MetricType: "agent",
+		MetricName: "degraded",
+		Unit:       "bool",
+		Timestamp:  time.Now(),
+	}
+	if active {
+		m.Value = 1
+		m.Metadata = map[string]interface{}{"reason": reason}
+	}
+	return m
+}
+
+func loadPerCPU() (float64, bool) {
+	avg, err := load.Avg()
+	if err != nil {
+		return 0, false
+	}
+	count, err := cpu.Counts(true)
+	if err != nil || count == 0 {
+		return 0, false
+	}
+	return avg.Load1 / float64(count), true
+}
+
+// pressureSome returns the "some avg10" of a PSI file, in percent. Kernels
+// without PSI (before 4.20, or booted with psi=0) have no such file.
+func pressureSome(resource string) (float64, bool) {
+	f, err := os.Open(filepath.Join(procPressure, resource))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		value, ok := strings.CutPrefix(fields[1], "avg10=")
+		if !ok {
+			return 0, false
+		}
+		stalled, err := strconv.ParseFloat(value, 64)
+		return stalled, err == nil
+	}
+	return 0, false
+}
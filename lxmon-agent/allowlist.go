@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// The local listeners (listen_addr, prometheus_listen and statsd_listen)
+// bind to the address they are given, where the host may also be the name
+// of a network interface (mgmt0:9273) to bind to its address. Each takes an
+// allowlist of CIDRs or addresses, local_api_allow, prometheus_allow and
+// statsd_allow, so they can be exposed on a management network only:
+// connections and packets from elsewhere are dropped before they are read.
+// Loopback clients are always let in, so the host itself is never locked
+// out. An empty allowlist lets everyone in.
+
+// parseAllowList checks a comma-separated list of CIDRs and addresses.
+func parseAllowList(value string, dst *[]string) error {
+	entries := parseList(value)
+	for _, entry := range entries {
+		if _, err := allowPrefix(entry); err != nil {
+			return err
+		}
+	}
+	*dst = entries
+	return nil
+}
+
+// allowPrefix parses an allowlist entry, an address standing for itself.
+func allowPrefix(entry string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR or address %q", entry)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// allowed reports whether a client at addr may use a listener with the
+// given allowlist.
+func allowed(allow []string, addr net.Addr) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(addrIP(addr))
+	if !ok {
+		// Unix socket peers are local
+		return true
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range allow {
+		if prefix, err := allowPrefix(entry); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// clientAllowed checks a client against an allowlist of the configuration,
+// logging the refusals once per client.
+func clientAllowed(listener string, allow func(Config) []string, addr net.Addr) bool {
+	ok := allowed(allow(currentConfig()), addr)
+	if !ok {
+		noteRefused(listener, addr)
+	}
+	return ok
+}
+
+// refusedClients remembers who was refused, so that a scanner or a
+// misconfigured client sending every second logs once.
+var refusedClients = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+func noteRefused(listener string, addr net.Addr) {
+	key := listener + " " + addrIP(addr).String()
+	refusedClients.Lock()
+	seen := refusedClients.seen[key]
+	if !seen && len(refusedClients.seen) < 1024 {
+		refusedClients.seen[key] = true
+	}
+	refusedClients.Unlock()
+	if !seen {
+		logger.Warn("listener.refused", "Refused a client not in the listener's allowlist", Fields{"listener": listener, "remote": addr.String()})
+	}
+}
+
+// allowListener drops the connections the allowlist does not let in.
+type allowListener struct {
+	net.Listener
+	name  string
+	allow func(Config) []string
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if clientAllowed(l.name, l.allow, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// listenAddress resolves a listen address whose host is the name of a
+// network interface to the interface's address, IPv4 first. Other
+// addresses are returned as they are.
+func listenAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil || strings.HasPrefix(addr, localUnixPrefix) {
+		return addr, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		// A host name, such as localhost
+		return addr, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %w", host, err)
+	}
+	var found net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			found = ipnet.IP
+			break
+		}
+		if found == nil {
+			found = ipnet.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("interface %s has no address to listen on", host)
+	}
+	return net.JoinHostPort(found.String(), port), nil
+}
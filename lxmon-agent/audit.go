@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The audit log records every command the agent ran, in the state dir, so
+// that what was done on a host can be told from the host itself, even when
+// the result never reached the server. Each line is a JSON object; the
+// output of commands is not kept, only what ran and how it ended.
+const (
+	auditFile    = "audit.log"
+	auditVersion = 1
+	// auditMaxSize is where audit.log is rotated to audit.log.1, so the
+	// log keeps between one and two of these of history.
+	auditMaxSize = 1 << 20
+)
+
+type auditEntry struct {
+	Version         int       `json:"v"`
+	Time            time.Time `json:"time"`
+	CommandID       int       `json:"command_id"`
+	Command         string    `json:"command,omitempty"`
+	Script          string    `json:"script,omitempty"`
+	Control         string    `json:"control,omitempty"`
+	ExitCode        int       `json:"exit_code"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ResultSent      bool      `json:"result_sent"`
+}
+
+var auditLock sync.Mutex
+
+// auditCommand appends a command's entry to the audit log.
+func auditCommand(cmd PendingCommand, exitCode int, duration float64, sent bool) {
+	cfg := currentConfig()
+	if cfg.StateDir == "" || cfg.DryRun {
+		return
+	}
+	entry := auditEntry{
+		Version:         auditVersion,
+		Time:            time.Now().UTC(),
+		CommandID:       cmd.ID,
+		ExitCode:        exitCode,
+		DurationSeconds: roundSeconds(duration),
+		ResultSent:      sent,
+	}
+	switch {
+	case cmd.Control != nil:
+		entry.Control = cmd.Control.Action
+	case cmd.Script != nil:
+		entry.Script = fmt.Sprintf("%d@%d", cmd.Script.ID, cmd.Script.Version)
+	default:
+		entry.Command = cmd.Command
+	}
+	data, _ := json.Marshal(entry)
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	path := filepath.Join(cfg.StateDir, auditFile)
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(data)) > auditMaxSize {
+		os.Rename(path, path+".1")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Warn("audit.write_failed", "Failed to write the audit log", Fields{"error": err, "command_id": cmd.ID})
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Warn("audit.write_failed", "Failed to write the audit log", Fields{"error": err, "command_id": cmd.ID})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// retryBackoff is the longest wait before the retry that follows attempt
+// (1-based): retry_delay, doubled per attempt, capped at retry_max_delay.
+func retryBackoff(cfg Config, attempt int) time.Duration {
+	wait := cfg.RetryDelay
+	for i := 1; i < attempt && wait < cfg.RetryMaxDelay; i++ {
+		wait *= 2
+	}
+	if wait > cfg.RetryMaxDelay {
+		wait = cfg.RetryMaxDelay
+	}
+	return wait
+}
+
+// retryWait is how long to sleep after attempt failed with err. The backoff
+// is randomized between half and all of it, so agents that failed together
+// (a server restart) do not retry in lockstep. A Retry-After from the server
+// is waited out, up to retry_max_delay. A request refused for its signature
+// timestamp waits at least a second, so it is signed with another one.
+func retryWait(cfg Config, attempt int, err error) time.Duration {
+	backoff := retryBackoff(cfg, attempt)
+	wait := backoff / 2
+	if half := int64(backoff - wait); half > 0 {
+		wait += time.Duration(rand.Int63n(half + 1))
+	}
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && serverErr.RetryAfter > wait {
+		wait = min(serverErr.RetryAfter, cfg.RetryMaxDelay)
+	}
+	if errors.As(err, &serverErr) && (serverErr.Code == errorCodeSignatureExpired || serverErr.Code == errorCodeReplayedRequest) {
+		wait = max(wait, time.Second)
+	}
+	return wait
+}
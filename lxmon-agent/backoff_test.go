@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := Config{RetryDelay: time.Second, RetryMaxDelay: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := retryBackoff(cfg, i+1); got != w {
+			t.Errorf("attempt %d: backoff %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	cfg := Config{RetryDelay: time.Second, RetryMaxDelay: 10 * time.Second}
+
+	for i := 0; i < 100; i++ {
+		if wait := retryWait(cfg, 2, ErrServerUnavailable); wait < time.Second || wait > 2*time.Second {
+			t.Fatalf("attempt 2: wait %s, want between 1s and 2s", wait)
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  *ServerError
+		want time.Duration
+	}{
+		{"retry-after", &ServerError{RetryAfter: 5 * time.Second}, 5 * time.Second},
+		{"retry-after capped", &ServerError{RetryAfter: time.Hour}, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if wait := retryWait(cfg, 1, tt.err); wait != tt.want {
+			t.Errorf("%s: wait %s, want %s", tt.name, wait, tt.want)
+		}
+	}
+
+	quick := Config{RetryDelay: 10 * time.Millisecond, RetryMaxDelay: time.Second}
+	for _, code := range []string{errorCodeSignatureExpired, errorCodeReplayedRequest} {
+		if wait := retryWait(quick, 1, &ServerError{Code: code}); wait < time.Second {
+			t.Errorf("%s: wait %s, want at least 1s", code, wait)
+		}
+	}
+}
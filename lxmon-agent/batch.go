@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBatchMetrics flushes a batch early before it reaches the server's
+// default per-payload limit (MAX_METRICS_PER_PAYLOAD).
+const maxBatchMetrics = 5000
+
+// batch holds the metrics of cycles not sent yet when batch_cycles or
+// batch_max_age combine several cycles into one request.
+var batch = struct {
+	sync.Mutex
+	metrics []Metric
+	cycles  int
+	started time.Time
+}{}
+
+func batchingEnabled() bool {
+	cfg := currentConfig()
+	return cfg.BatchCycles != 1 || cfg.BatchMaxAge > 0
+}
+
+// batchDelay is the longest batching holds metrics back beyond the cycle
+// that collected them.
+func batchDelay() time.Duration {
+	cfg := currentConfig()
+	if !batchingEnabled() {
+		return 0
+	}
+	delay := cfg.BatchMaxAge
+	if cfg.BatchCycles > 1 {
+		if byCycles := time.Duration(cfg.BatchCycles-1) * cfg.Interval; cfg.BatchMaxAge == 0 || byCycles < delay {
+			delay = byCycles
+		}
+	}
+	return delay
+}
+
+// batchMetrics adds one cycle's metrics to the batch. Once the batch is due
+// it returns all of them, oldest first, and starts a new batch; until then
+// it returns false.
+func batchMetrics(cfg Config, metrics []Metric) ([]Metric, bool) {
+	if !batchingEnabled() {
+		return metrics, true
+	}
+	batch.Lock()
+	defer batch.Unlock()
+	if batch.cycles == 0 {
+		batch.started = time.Now()
+	}
+	batch.metrics = append(batch.metrics, metrics...)
+	batch.cycles++
+
+	due := len(batch.metrics) >= maxBatchMetrics ||
+		(cfg.BatchCycles > 0 && batch.cycles >= cfg.BatchCycles) ||
+		(cfg.BatchMaxAge > 0 && time.Since(batch.started) >= cfg.BatchMaxAge)
+	health.setBatched(batch.cycles)
+	if !due {
+		logger.Debug("metrics.batched", "Metrics held for the next batch", Fields{"cycles": batch.cycles, "count": len(batch.metrics)})
+		return nil, false
+	}
+	return takeBatch(), true
+}
+
+// takeBatch empties the batch and returns what it held. Callers hold the
+// batch lock.
+func takeBatch() []Metric {
+	metrics := batch.metrics
+	batch.metrics, batch.cycles = nil, 0
+	health.setBatched(0)
+	return metrics
+}
+
+// flushBatch sends the metrics still batched, so stopping the agent does
+// not lose them.
+func flushBatch() {
+	batch.Lock()
+	metrics := takeBatch()
+	batch.Unlock()
+	if len(metrics) == 0 || health.authHalted() {
+		return
+	}
+	logger.Info("metrics.batch_flush", "Sending batched metrics before stopping", Fields{"count": len(metrics)})
+	cfg := currentConfig()
+	deliverMetrics(cfg, newMetricsPayload(cfg, metrics), 0)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chaos mode injects network faults into requests to the server, so QA can
+// watch retries, backoff, failover, the spool and batching deal with a bad
+// network. It is off unless one of the chaos_* settings is set, and the
+// server cannot turn it on.
+
+// errChaosLoss stands in for a connection lost on the way.
+var errChaosLoss = errors.New("chaos: injected packet loss")
+
+// chaosClock is the offset the clock the agent signs requests with has
+// jumped by.
+var chaosClock = struct {
+	sync.Mutex
+	offset time.Duration
+}{}
+
+func chaosEnabled() bool {
+	cfg := currentConfig()
+	return cfg.ChaosLatency > 0 || cfg.ChaosLoss > 0 || cfg.Chaos5xx > 0 || cfg.ChaosClockJump > 0
+}
+
+func warnChaos() {
+	cfg := currentConfig()
+	if !chaosEnabled() {
+		return
+	}
+	logger.Warn("agent.chaos", "Chaos mode: injecting faults into server requests, do not use in production", Fields{
+		"latency":    cfg.ChaosLatency,
+		"loss":       cfg.ChaosLoss,
+		"5xx":        cfg.Chaos5xx,
+		"clock_jump": cfg.ChaosClockJump,
+	})
+}
+
+// chance reports true with the given percent probability.
+func chance(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
+
+// chaosRoundTrip sends req through next with the configured faults: a random
+// delay up to chaos_latency, then chaos_5xx percent of requests answered
+// with a 503 that never reached the server, and chaos_loss percent lost,
+// half of them before the server saw them and half on the way back.
+func chaosRoundTrip(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	cfg := currentConfig()
+	if cfg.ChaosLatency > 0 {
+		delay := time.Duration(rand.Int63n(int64(cfg.ChaosLatency) + 1))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			closeRequestBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	if chance(cfg.Chaos5xx) {
+		closeRequestBody(req)
+		logger.Debug("chaos.5xx", "Injected a 503 response", Fields{"path": req.URL.Path})
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"detail":"chaos: injected 503"}`)),
+			Request:    req,
+		}, nil
+	}
+	if chance(cfg.ChaosLoss) {
+		if rand.Intn(2) == 0 {
+			closeRequestBody(req)
+			logger.Debug("chaos.loss", "Dropped a request", Fields{"path": req.URL.Path})
+			return nil, errChaosLoss
+		}
+		resp, err := next(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		logger.Debug("chaos.loss", "Dropped a response", Fields{"path": req.URL.Path})
+		return nil, errChaosLoss
+	}
+	return next(req)
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// requestTime is the time requests are signed with. With chaos_clock_jump
+// set, the clock jumps now and then (on about one request in ten) to up to
+// that far ahead or behind, and stays there until the next jump.
+func requestTime() time.Time {
+	cfg := currentConfig()
+	if cfg.ChaosClockJump <= 0 {
+		return time.Now()
+	}
+	chaosClock.Lock()
+	defer chaosClock.Unlock()
+	if chance(10) {
+		jump := int64(cfg.ChaosClockJump)
+		chaosClock.offset = time.Duration(rand.Int63n(2*jump+1) - jump)
+		logger.Debug("chaos.clock_jump", "Clock jumped", Fields{"offset": chaosClock.offset})
+	}
+	return time.Now().Add(chaosClock.offset)
+}
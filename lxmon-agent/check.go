@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+// checkResult is the outcome of one request made by `lxmon-agent check`.
+type checkResult struct {
+	Name       string
+	Method     string
+	URL        string
+	StatusCode int
+	Body       []byte
+	Err        error
+
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	Total   time.Duration
+	TLSInfo *tls.ConnectionState
+}
+
+// runCheck walks through the requests the agent makes against the server
+// (registration, an empty metrics submission, a commands poll that takes
+// none of them) and prints
+// status, timings and TLS details for each, so a silently failing agent can
+// be diagnosed from the host. It exits 1 if any request fails.
+func runCheck(args []string) int {
+	if err := loadConfig(args); err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 2
+	}
+	cfg := currentConfig()
+	fmt.Printf("server:   %s\nhostname: %s\n\n", cfg.ServerURL, cfg.Hostname)
+
+	results := []checkResult{
+		checkRequest("register", "POST", "/api/agent/register", nil, registrationPayload(cfg)),
+		// An empty metrics list exercises auth and routing without storing anything
+		checkRequest("metrics", "POST", "/api/agent/metrics", nil, newMetricsPayload(cfg, []Metric{})),
+		// peek leaves the pending commands queued for the running agent
+		checkRequest("commands", "GET", "/api/agent/commands", url.Values{"hostname": {cfg.Hostname}, "peek": {"1"}}, nil),
+	}
+
+	failed := false
+	for _, result := range results {
+		printCheckResult(result)
+		if result.Err != nil || result.StatusCode < 200 || result.StatusCode >= 300 {
+			failed = true
+		}
+	}
+
+	// A server without peek hands the commands out anyway, and only once
+	commandsResult := results[len(results)-1]
+	var commands []PendingCommand
+	if commandsResult.Err == nil && json.Unmarshal(commandsResult.Body, &commands) == nil && len(commands) > 0 {
+		fmt.Printf("warning: the server handed out %d pending command(s), which the check does not run; queue them again\n", len(commands))
+		for _, cmd := range commands {
+			fmt.Printf("  %d: %s\n", cmd.ID, cmd.Command)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func checkRequest(name, method, path string, query url.Values, body interface{}) checkResult {
+	cfg := currentConfig()
+	result := checkResult{Name: name, Method: method, URL: cfg.ServerURL + path}
+	if query != nil {
+		result.URL += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, result.URL, reader)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	signRequest(req, cfg.APIKey, data)
+
+	var dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { result.DNS = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { result.Connect = time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			result.TLS = time.Since(tlsStart)
+			if err == nil {
+				result.TLSInfo = &state
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	// The agent's TLS settings, without keep-alives so every check pays (and
+	// shows) the full DNS, connect and TLS cost.
+	transport, err := newServerTransport(cfg)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	transport.DisableKeepAlives = true
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		result.Total = time.Since(start)
+		return result
+	}
+	defer resp.Body.Close()
+	result.Body, _ = io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	result.Total = time.Since(start)
+	result.StatusCode = resp.StatusCode
+	return result
+}
+
+func printCheckResult(r checkResult) {
+	status := "FAIL"
+	if r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300 {
+		status = "OK"
+	}
+	fmt.Printf("[%s] %s: %s %s\n", status, r.Name, r.Method, r.URL)
+	if r.Err != nil {
+		fmt.Printf("  error:   %v\n", r.Err)
+	} else {
+		fmt.Printf("  status:  %d %s\n", r.StatusCode, http.StatusText(r.StatusCode))
+		if status == "FAIL" {
+			fmt.Printf("  body:    %s (%v)\n", truncate(string(r.Body), 200), classifyStatus(r.StatusCode, ""))
+		}
+	}
+	fmt.Printf("  timing:  dns %s, connect %s, tls %s, total %s\n",
+		formatCheckDuration(r.DNS), formatCheckDuration(r.Connect), formatCheckDuration(r.TLS), formatCheckDuration(r.Total))
+	if r.TLSInfo != nil {
+		fmt.Printf("  tls:     %s, %s\n", tls.VersionName(r.TLSInfo.Version), tls.CipherSuiteName(r.TLSInfo.CipherSuite))
+		if len(r.TLSInfo.PeerCertificates) > 0 {
+			cert := r.TLSInfo.PeerCertificates[0]
+			fmt.Printf("  cert:    %s, issuer %s, expires %s\n",
+				cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	fmt.Println()
+}
+
+func formatCheckDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Microsecond * 100).String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The circuit breaker keeps an agent from hammering a server that is down.
+// After circuit_breaker_failures requests in a row failed (no answer, 5xx or
+// 429), the circuit opens: for circuit_breaker_cooldown, requests to the
+// server fail at once without going out, and metrics are spooled as when
+// the server is unreachable. After the cool-down the circuit is half open:
+// one request goes through as a probe while the others still fail. If the
+// server answers the probe the circuit closes and traffic resumes, the
+// spool first; otherwise it opens for another cool-down.
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+var circuit = struct {
+	sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}{state: circuitClosed}
+
+func circuitEnabled() bool {
+	return currentConfig().CircuitBreakerFailures > 0
+}
+
+// circuitState returns the state of the circuit for /health, or "" when the
+// breaker is disabled.
+func circuitState() string {
+	if !circuitEnabled() {
+		return ""
+	}
+	circuit.Lock()
+	defer circuit.Unlock()
+	return circuit.state
+}
+
+// circuitAllow returns errCircuitOpen when a request may not go to the
+// server now. Once the cool-down has passed it lets one probe through.
+func circuitAllow() error {
+	cfg := currentConfig()
+	if !circuitEnabled() {
+		return nil
+	}
+	circuit.Lock()
+	defer circuit.Unlock()
+	switch circuit.state {
+	case circuitOpen:
+		if time.Since(circuit.openedAt) < cfg.CircuitBreakerCooldown {
+			return errCircuitOpen
+		}
+		circuit.state = circuitHalfOpen
+		circuit.probing = true
+		logger.Info("server.circuit_probe", "Circuit breaker cool-down over, probing the server", nil)
+	case circuitHalfOpen:
+		if circuit.probing {
+			return errCircuitOpen
+		}
+		circuit.probing = true
+	}
+	return nil
+}
+
+// circuitRecord counts the outcome of a request circuitAllow let through.
+// Any answer but a 5xx or 429 shows the server is up.
+func circuitRecord(resp *http.Response, err error) {
+	cfg := currentConfig()
+	if !circuitEnabled() {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// Says nothing about the server, but a canceled probe must not
+		// keep the circuit half open for good
+		circuit.Lock()
+		circuit.probing = false
+		circuit.Unlock()
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	// Enough to try every server max_retries times before giving up on them
+	threshold := max(cfg.CircuitBreakerFailures, serverAttempts())
+
+	circuit.Lock()
+	previous := circuit.state
+	circuit.probing = false
+	if !failed {
+		circuit.state, circuit.failures = circuitClosed, 0
+		circuit.Unlock()
+		if previous != circuitClosed {
+			logger.Info("server.circuit_closed", "Server answered, circuit breaker closed", nil)
+			emitEvent(Event{Type: "server_circuit_closed", Source: "agent", Message: "server answered, resuming requests"})
+		}
+		return
+	}
+	circuit.failures++
+	if previous == circuitClosed && circuit.failures < threshold {
+		circuit.Unlock()
+		return
+	}
+	circuit.state, circuit.openedAt = circuitOpen, time.Now()
+	failures := circuit.failures
+	circuit.Unlock()
+
+	if previous == circuitHalfOpen {
+		logger.Debug("server.circuit_probe_failed", "Server still unavailable, circuit breaker open again", Fields{"cooldown": cfg.CircuitBreakerCooldown})
+		return
+	}
+	logger.Warn("server.circuit_open", "Server unavailable, circuit breaker open", Fields{"failures": failures, "cooldown": cfg.CircuitBreakerCooldown})
+	emitEvent(Event{
+		Type:     "server_circuit_open",
+		Source:   "agent",
+		Severity: "warning",
+		Message:  fmt.Sprintf("%d requests in a row failed, pausing requests for %s", failures, cfg.CircuitBreakerCooldown),
+		Fields:   map[string]interface{}{"failures": failures, "cooldown_seconds": cfg.CircuitBreakerCooldown.Seconds()},
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cluster identities give an active/passive pair continuous series across
+// failovers. Each is a host of its own on the server, active on the node that
+// holds its VIP (db-cluster=10.0.0.100) or whose keepalived instance is
+// MASTER (lb=vrrp:VI_1). While active, a node sends the metrics selected by
+// cluster_metrics a second time, as that host. Both nodes send them under
+// the same agent ID, derived from the identity's name and the API key, so the
+// server keeps one record whichever node is active, and fleets with other
+// keys that use the same names get other IDs. The host's tags are not added to
+// the metadata, as they may differ between the nodes.
+
+const clusterVRRPPrefix = "vrrp:"
+
+var clusterState = struct {
+	sync.Mutex
+	active map[string]bool
+	// registered identities have been registered since they became active,
+	// with this node's address and version
+	registered map[string]bool
+}{active: map[string]bool{}, registered: map[string]bool{}}
+
+func clusterIdentitiesEnabled() bool {
+	cfg := currentConfig()
+	return len(cfg.ClusterIdentities) > 0 && len(cfg.ClusterMetrics) > 0 && !mqttEnabled()
+}
+
+// clusterIdentityID is the agent ID of a cluster identity, the same on
+// every node with the same API key. Keyed, it cannot be computed from the
+// name alone.
+func clusterIdentityID(apiKey, name string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte("lxmon-cluster-id:" + name))
+	var b [16]byte
+	copy(b[:], mac.Sum(nil))
+	return formatUUID(b, 8)
+}
+
+// activeClusterIdentities returns the identities this node holds now. An
+// identity whose condition cannot be checked counts as inactive: a gap in
+// its series is better than two nodes sending them.
+func activeClusterIdentities() []string {
+	cfg := currentConfig()
+	var local map[string]bool
+	var vrrp map[string]string
+	var localErr, vrrpErr error
+	for _, condition := range cfg.ClusterIdentities {
+		if _, ok := strings.CutPrefix(condition, clusterVRRPPrefix); ok {
+			if vrrp == nil && vrrpErr == nil {
+				if vrrp, vrrpErr = keepalivedStates(); vrrpErr == nil && vrrp == nil {
+					vrrp = map[string]string{}
+				}
+			}
+		} else if local == nil && localErr == nil {
+			local, localErr = localAddresses()
+		}
+	}
+
+	var active []string
+	for name, condition := range cfg.ClusterIdentities {
+		held := false
+		if instance, ok := strings.CutPrefix(condition, clusterVRRPPrefix); ok {
+			held = vrrpErr == nil && vrrp[instance] == "MASTER"
+		} else {
+			held = localErr == nil && local[condition]
+		}
+		if held {
+			active = append(active, name)
+		}
+
+		clusterState.Lock()
+		was := clusterState.active[name]
+		clusterState.active[name] = held
+		if !held {
+			clusterState.registered[name] = false
+		}
+		clusterState.Unlock()
+		if held != was {
+			if held {
+				logger.Info("cluster.active", "This node is active for a cluster identity", Fields{"identity": name, "condition": condition})
+			} else {
+				logger.Info("cluster.inactive", "This node is no longer active for a cluster identity", Fields{"identity": name, "condition": condition})
+			}
+		}
+	}
+	if localErr != nil || vrrpErr != nil {
+		logger.Warn("cluster.check_failed", "Failed to check the cluster identities", Fields{"addresses_error": localErr, "keepalived_error": vrrpErr})
+	}
+	sort.Strings(active)
+	return active
+}
+
+// newClusterPayloads returns a payload for each active identity with the
+// selected metrics. It copies them, as newMetricsPayload changes the
+// metrics of the host's own payload in place.
+func newClusterPayloads(cfg Config, metrics []Metric) []MetricsPayload {
+	active := activeClusterIdentities()
+	if len(active) == 0 {
+		return nil
+	}
+	var selected []Metric
+	for _, m := range finiteMetrics(copyMetrics(metrics)) {
+		if clusterMetricSelected(cfg, m) {
+			selected = append(selected, m)
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	selected = applyMetricNames(cfg, selected)
+
+	payloads := make([]MetricsPayload, 0, len(active))
+	for _, name := range active {
+		payloads = append(payloads, MetricsPayload{
+			Hostname: name,
+			Metrics:  selected,
+			APIKey:   cfg.APIKey,
+			Tags:     cfg.Tags,
+			agentID:  clusterIdentityID(cfg.APIKey, name),
+		})
+	}
+	return payloads
+}
+
+// clusterMetricSelected matches a metric's canonical type, or type.name,
+// against cluster_metrics.
+func clusterMetricSelected(cfg Config, m Metric) bool {
+	m, _ = canonicalMetric(m)
+	for _, pattern := range cfg.ClusterMetrics {
+		if ok, _ := path.Match(pattern, m.MetricType); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, m.MetricType+"."+m.MetricName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sendClusterPayloads sends each identity's payload, registering it first
+// when it just became active. A payload that fails is dropped, not spooled:
+// by the time it could be replayed, the other node may be sending.
+func sendClusterPayloads(cfg Config, payloads []MetricsPayload) {
+	var limited []MetricsPayload
+	for _, payload := range payloads {
+		limited = append(limited, payloadParts(payload)...)
+	}
+	for _, payload := range limited {
+		clusterState.Lock()
+		registered := clusterState.registered[payload.Hostname]
+		clusterState.Unlock()
+		if !registered {
+			if err := registerClusterIdentity(cfg, payload.Hostname); err != nil {
+				logger.Warn("cluster.register_failed", "Failed to register a cluster identity", Fields{"identity": payload.Hostname, "error": err})
+				continue
+			}
+			clusterState.Lock()
+			clusterState.registered[payload.Hostname] = true
+			clusterState.Unlock()
+		}
+
+		if err := sendMetricsWithRetry(cfg, payload); err != nil {
+			var serverErr *ServerError
+			if errors.As(err, &serverErr) && serverErr.StatusCode == http.StatusNotFound {
+				// Deleted on the server meanwhile: registered again next time
+				clusterState.Lock()
+				clusterState.registered[payload.Hostname] = false
+				clusterState.Unlock()
+			}
+			logger.Error("cluster.send_failed", "Failed to send metrics of a cluster identity", Fields{"identity": payload.Hostname, "error": err, "count": len(payload.Metrics)})
+			continue
+		}
+		logger.Debug("cluster.sent", "Sent metrics of a cluster identity", Fields{"identity": payload.Hostname, "count": len(payload.Metrics)})
+	}
+}
+
+// registerClusterIdentity registers an identity as a host of its own, with
+// the VIP, if it has one, as its address.
+func registerClusterIdentity(cfg Config, name string) error {
+	payload := registrationPayload(cfg)
+	payload["hostname"] = name
+	payload["agent_id"] = clusterIdentityID(cfg.APIKey, name)
+	if ip := net.ParseIP(cfg.ClusterIdentities[name]); ip != nil {
+		payload["ip_address"] = ip.String()
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if dryRun("/api/agent/register", jsonData) {
+		return nil
+	}
+	if err := postRegistration(cfg, jsonData, clusterIdentityID(cfg.APIKey, name)); err != nil {
+		return err
+	}
+	logger.Info("cluster.registered", "Registered a cluster identity", Fields{"identity": name})
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runCollect runs the collectors without the daemon around them: no
+// registration, command polling or local API. With --stdout the payload is
+// printed instead of sent, which is handy when debugging a collector; with
+// --once it exits after a single cycle, for hosts that run the agent from
+// cron.
+func runCollect(args []string) int {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	once := fs.Bool("once", false, "collect a single time and exit")
+	stdout := fs.Bool("stdout", false, "print the metrics payload as JSON instead of sending it")
+	own, rest := subcommandArgs(fs, args)
+	if err := fs.Parse(own); err != nil {
+		return 2
+	}
+	if err := loadConfig(rest); err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 1
+	}
+	cfg := currentConfig()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := collectOnce(cfg, *stdout); err != nil && *once {
+			return 1
+		}
+		if *once {
+			return 0
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return 0
+		}
+	}
+}
+
+func collectOnce(cfg Config, stdout bool) error {
+	metrics, _ := collectMetrics()
+	metrics = append(metrics, drainEventMetrics()...)
+	payload := newMetricsPayload(cfg, metrics)
+
+	if stdout {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(redactSecrets(data), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if err := sendMetricsWithRetry(cfg, payload); err != nil {
+		logger.Error("metrics.send_failed", "Failed to send metrics", Fields{"error": err})
+		if errors.Is(err, ErrPayloadRejected) {
+			quarantinePayload("/api/agent/metrics", payload, err)
+		}
+		return err
+	}
+	logger.Info("metrics.sent", "Sent metrics", Fields{"count": len(metrics)})
+	return nil
+}
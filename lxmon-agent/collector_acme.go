@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	certbotLiveDir = "/etc/letsencrypt/live"
+	certbotLog     = "/var/log/letsencrypt/letsencrypt.log"
+	acmeShHome     = "/root/.acme.sh"
+
+	// certbot renews certificates with less than 30 days left; a day of
+	// slack covers hosts whose timer runs only twice a day.
+	certbotRenewBefore = 29 * 24 * time.Hour
+)
+
+// acmeCert is one certificate managed by certbot or acme.sh.
+type acmeCert struct {
+	Name      string
+	Source    string
+	Path      string
+	RenewDue  time.Time // zero if unknown
+	RenewFail bool
+}
+
+// collectACME reports, for every certbot and acme.sh certificate (plus any
+// acme_cert_dirs), days until expiry, time since the last renewal and
+// whether renewal is overdue or failed on the last run. Unlike a plain
+// expiry check this catches a broken renewal timer weeks before the
+// certificate actually expires.
+func collectACME() ([]Metric, error) {
+	cfg := currentConfig()
+	certs := certbotCerts()
+	certs = append(certs, acmeShCerts()...)
+	for _, dir := range cfg.ACMECertDirs {
+		certs = append(certs, acmeCert{Name: filepath.Base(dir), Source: "custom", Path: findCertFile(dir)})
+	}
+	if len(certs) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	for _, cert := range certs {
+		parsed, err := readCertificate(cert.Path)
+		if err != nil {
+			logger.Debug("acme.cert_unreadable", "Cannot read certificate", Fields{"path": cert.Path, "error": err})
+			continue
+		}
+		metadata := map[string]interface{}{
+			"name":   cert.Name,
+			"source": cert.Source,
+			"path":   cert.Path,
+		}
+		renewDue := cert.RenewDue
+		if renewDue.IsZero() {
+			renewDue = parsed.NotAfter.Add(-certbotRenewBefore)
+		}
+		failing := 0.0
+		if now.After(renewDue) || cert.RenewFail {
+			failing = 1
+		}
+		metrics = append(metrics,
+			Metric{
+				MetricType: "certificate",
+				MetricName: "days_to_expiry",
+				Value:      parsed.NotAfter.Sub(now).Hours() / 24,
+				Unit:       "days",
+				Metadata:   metadata,
+				Timestamp:  now,
+			},
+			Metric{
+				MetricType: "certificate",
+				MetricName: "last_renewal_age",
+				Value:      now.Sub(parsed.NotBefore).Seconds(),
+				Unit:       "seconds",
+				Metadata:   metadata,
+				Timestamp:  now,
+			},
+			Metric{
+				MetricType: "certificate",
+				MetricName: "renewal_failing",
+				Value:      failing,
+				Unit:       "bool",
+				Metadata:   metadata,
+				Timestamp:  now,
+			},
+		)
+	}
+	return metrics, nil
+}
+
+// certbotCerts lists /etc/letsencrypt/live and marks certificates that the
+// most recent certbot run (letsencrypt.log is rotated per run) failed to
+// renew.
+func certbotCerts() []acmeCert {
+	entries, err := os.ReadDir(certbotLiveDir)
+	if err != nil {
+		return nil
+	}
+	failed := certbotFailedRenewals()
+	certs := []acmeCert{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		certs = append(certs, acmeCert{
+			Name:      entry.Name(),
+			Source:    "certbot",
+			Path:      filepath.Join(certbotLiveDir, entry.Name(), "cert.pem"),
+			RenewFail: failed[entry.Name()],
+		})
+	}
+	return certs
+}
+
+func certbotFailedRenewals() map[string]bool {
+	failed := map[string]bool{}
+	file, err := os.Open(certbotLog)
+	if err != nil {
+		return failed
+	}
+	defer file.Close()
+
+	// "Failed to renew certificate example.com with error: ..."
+	const marker = "Failed to renew certificate "
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		_, rest, ok := strings.Cut(scanner.Text(), marker)
+		if !ok {
+			continue
+		}
+		if name, _, _ := strings.Cut(rest, " "); name != "" {
+			failed[name] = true
+		}
+	}
+	return failed
+}
+
+// acmeShCerts reads acme.sh's per-domain <domain>.conf, which records when
+// the next renewal is due (Le_NextRenewTime, unix seconds).
+func acmeShCerts() []acmeCert {
+	entries, err := os.ReadDir(acmeShHome)
+	if err != nil {
+		return nil
+	}
+	certs := []acmeCert{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		dir := filepath.Join(acmeShHome, name)
+		settings, err := readShellAssignments(filepath.Join(dir, strings.TrimSuffix(name, "_ecc")+".conf"))
+		if err != nil {
+			continue
+		}
+		cert := acmeCert{
+			Name:   strings.TrimSuffix(name, "_ecc"),
+			Source: "acme.sh",
+			Path:   filepath.Join(dir, strings.TrimSuffix(name, "_ecc")+".cer"),
+		}
+		if next, err := strconv.ParseInt(settings["Le_NextRenewTime"], 10, 64); err == nil {
+			// acme.sh's cron runs daily; allow one missed day
+			cert.RenewDue = time.Unix(next, 0).Add(24 * time.Hour)
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// readShellAssignments parses KEY='value' lines as written by acme.sh.
+func readShellAssignments(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		values[key] = strings.Trim(value, `'"`)
+	}
+	return values, nil
+}
+
+// findCertFile picks the leaf certificate in a live directory.
+func findCertFile(dir string) string {
+	for _, name := range []string{"cert.pem", "fullchain.pem", "tls.crt"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, "cert.pem")
+}
+
+// readCertificate parses the first certificate in a PEM file. Its NotBefore
+// is when it was last renewed.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
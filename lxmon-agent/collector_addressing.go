@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dhclientLeaseGlobs covers ISC dhclient and NetworkManager's dhclient backend.
+var dhclientLeaseGlobs = []string{
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/dhclient/*.lease*",
+	"/var/lib/NetworkManager/*.lease",
+}
+
+// networkdLeaseDir holds systemd-networkd leases, one file per ifindex.
+const networkdLeaseDir = "/run/systemd/netif/leases"
+
+type dhcpLease struct {
+	Interface string
+	Address   string
+	Expires   time.Time
+}
+
+// staticDrift remembers which static interfaces were already reported as
+// drifted so an event is emitted once per change, not every cycle.
+var staticDrift = struct {
+	sync.Mutex
+	drifted map[string]string
+}{drifted: map[string]string{}}
+
+// collectAddressing reports remaining DHCP lease time per interface and
+// checks interfaces configured with static_addresses for address drift.
+func collectAddressing() ([]Metric, error) {
+	cfg := currentConfig()
+	now := time.Now()
+	metrics := []Metric{}
+
+	for _, lease := range currentLeases() {
+		metrics = append(metrics, Metric{
+			MetricType: "network",
+			MetricName: "dhcp_lease_remaining",
+			Value:      lease.Expires.Sub(now).Seconds(),
+			Unit:       "seconds",
+			Metadata: map[string]interface{}{
+				"interface": lease.Interface,
+				"address":   lease.Address,
+			},
+			Timestamp: now,
+		})
+	}
+
+	for iface, expected := range cfg.StaticAddresses {
+		actual, err := interfaceAddresses(iface)
+		match := 0.0
+		if err == nil && containsString(actual, expected) {
+			match = 1
+		}
+		metrics = append(metrics, Metric{
+			MetricType: "network",
+			MetricName: "static_address_match",
+			Value:      match,
+			Unit:       "bool",
+			Metadata: map[string]interface{}{
+				"interface": iface,
+				"expected":  expected,
+				"actual":    strings.Join(actual, ","),
+			},
+			Timestamp: now,
+		})
+		checkStaticDrift(iface, expected, actual, match == 1)
+	}
+	return metrics, nil
+}
+
+func checkStaticDrift(iface, expected string, actual []string, match bool) {
+	staticDrift.Lock()
+	defer staticDrift.Unlock()
+
+	current := strings.Join(actual, ",")
+	previous, wasDrifted := staticDrift.drifted[iface]
+	switch {
+	case !match && (!wasDrifted || previous != current):
+		staticDrift.drifted[iface] = current
+		emitEvent(Event{
+			Type:     "static_address_drift",
+			Source:   "addressing",
+			Severity: "warning",
+			Message:  fmt.Sprintf("%s expected %s, has %s", iface, expected, current),
+			Fields:   map[string]interface{}{"interface": iface, "expected": expected, "actual": current},
+		})
+	case match && wasDrifted:
+		delete(staticDrift.drifted, iface)
+		emitEvent(Event{
+			Type:    "static_address_restored",
+			Source:  "addressing",
+			Message: fmt.Sprintf("%s has %s again", iface, expected),
+			Fields:  map[string]interface{}{"interface": iface, "expected": expected},
+		})
+	}
+}
+
+// interfaceAddresses returns the IPs (without prefix length) bound to iface.
+func interfaceAddresses(iface string) ([]string, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// currentLeases returns the lease with the latest expiry for each interface.
+func currentLeases() []dhcpLease {
+	latest := map[string]dhcpLease{}
+	keep := func(lease dhcpLease) {
+		if lease.Interface == "" || lease.Expires.IsZero() {
+			return
+		}
+		if existing, ok := latest[lease.Interface]; !ok || lease.Expires.After(existing.Expires) {
+			latest[lease.Interface] = lease
+		}
+	}
+
+	for _, pattern := range dhclientLeaseGlobs {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			for _, lease := range parseDhclientLeases(file) {
+				keep(lease)
+			}
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(networkdLeaseDir, "*"))
+	for _, file := range files {
+		if lease, ok := parseNetworkdLease(file); ok {
+			keep(lease)
+		}
+	}
+
+	leases := make([]dhcpLease, 0, len(latest))
+	for _, lease := range latest {
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+// parseDhclientLeases reads dhclient's lease blocks:
+//
+//	lease {
+//	  interface "eth0";
+//	  fixed-address 10.0.0.5;
+//	  expire 4 2024/01/04 12:00:00;
+//	}
+func parseDhclientLeases(path string) []dhcpLease {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var leases []dhcpLease
+	var current dhcpLease
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "lease"):
+			current = dhcpLease{}
+		case line == "}":
+			leases = append(leases, current)
+		case len(fields) >= 2 && fields[0] == "interface":
+			current.Interface = strings.Trim(fields[1], `"`)
+		case len(fields) >= 2 && fields[0] == "fixed-address":
+			current.Address = fields[1]
+		case len(fields) >= 4 && fields[0] == "expire":
+			if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				current.Expires = t
+			}
+		}
+	}
+	return leases
+}
+
+// parseNetworkdLease reads a systemd-networkd lease file. networkd stores the
+// lease lifetime rather than an absolute expiry, so the file's modification
+// time (when the lease was written) is used as the acquisition time.
+func parseNetworkdLease(path string) (dhcpLease, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return dhcpLease{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return dhcpLease{}, false
+	}
+
+	lease := dhcpLease{}
+	if ifindex, err := strconv.Atoi(filepath.Base(path)); err == nil {
+		if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+			lease.Interface = iface.Name
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ADDRESS":
+			lease.Address = value
+		case "LIFETIME":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				lease.Expires = info.ModTime().Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	return lease, lease.Interface != "" && !lease.Expires.IsZero()
+}
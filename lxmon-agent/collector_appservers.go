@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// phpFPMStatus is the JSON form of the php-fpm status page (?json).
+type phpFPMStatus struct {
+	Pool               string  `json:"pool"`
+	AcceptedConn       float64 `json:"accepted conn"`
+	ListenQueue        float64 `json:"listen queue"`
+	MaxListenQueue     float64 `json:"max listen queue"`
+	ListenQueueLen     float64 `json:"listen queue len"`
+	IdleProcesses      float64 `json:"idle processes"`
+	ActiveProcesses    float64 `json:"active processes"`
+	TotalProcesses     float64 `json:"total processes"`
+	MaxChildrenReached float64 `json:"max children reached"`
+	SlowRequests       float64 `json:"slow requests"`
+}
+
+// uwsgiStats is the part of the uWSGI stats server output we report.
+type uwsgiStats struct {
+	ListenQueue       float64 `json:"listen_queue"`
+	ListenQueueErrors float64 `json:"listen_queue_errors"`
+	Workers           []struct {
+		Status        string  `json:"status"`
+		HarakiriCount float64 `json:"harakiri_count"`
+	} `json:"workers"`
+}
+
+// collectAppServers reports worker and queue metrics for the php-fpm pools
+// in phpfpm_status and the uWSGI stats servers in uwsgi_stats.
+func collectAppServers() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.PHPFPMStatus) == 0 && len(cfg.UWSGIStats) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	var errs []string
+	for _, target := range cfg.PHPFPMStatus {
+		status, err := fetchPHPFPMStatus(target)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("php-fpm %s: %v", target, err))
+			continue
+		}
+		metadata := map[string]interface{}{"pool": status.Pool, "target": target}
+		for name, value := range map[string]float64{
+			"active_workers":       status.ActiveProcesses,
+			"idle_workers":         status.IdleProcesses,
+			"total_workers":        status.TotalProcesses,
+			"listen_queue":         status.ListenQueue,
+			"max_listen_queue":     status.MaxListenQueue,
+			"listen_queue_len":     status.ListenQueueLen,
+			"accepted_connections": status.AcceptedConn,
+			"max_children_reached": status.MaxChildrenReached,
+			"slow_requests":        status.SlowRequests,
+		} {
+			metrics = append(metrics, Metric{MetricType: "phpfpm", MetricName: name, Value: value, Unit: "count", Metadata: metadata, Timestamp: now})
+		}
+	}
+
+	for _, target := range cfg.UWSGIStats {
+		stats, err := fetchUWSGIStats(target)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("uwsgi %s: %v", target, err))
+			continue
+		}
+		var busy, idle, harakiri float64
+		for _, worker := range stats.Workers {
+			switch worker.Status {
+			case "busy":
+				busy++
+			case "idle":
+				idle++
+			}
+			harakiri += worker.HarakiriCount
+		}
+		metadata := map[string]interface{}{"target": target}
+		for name, value := range map[string]float64{
+			"active_workers":      busy,
+			"idle_workers":        idle,
+			"total_workers":       float64(len(stats.Workers)),
+			"listen_queue":        stats.ListenQueue,
+			"listen_queue_errors": stats.ListenQueueErrors,
+			"harakiri_count":      harakiri,
+		} {
+			metrics = append(metrics, Metric{MetricType: "uwsgi", MetricName: name, Value: value, Unit: "count", Metadata: metadata, Timestamp: now})
+		}
+	}
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// fetchPHPFPMStatus reads a pool's status page. http(s) URLs go through the
+// web server; anything else is the pool's FastCGI listen address
+// ("unix:/run/php/php-fpm.sock" or "127.0.0.1:9000") queried for /status.
+func fetchPHPFPMStatus(target string) (phpFPMStatus, error) {
+	var status phpFPMStatus
+	var body []byte
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		statusURL := target
+		switch {
+		case strings.Contains(statusURL, "json"):
+		case strings.Contains(statusURL, "?"):
+			statusURL += "&json"
+		default:
+			statusURL += "?json"
+		}
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(statusURL)
+		if err != nil {
+			return status, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return status, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if body, err = io.ReadAll(io.LimitReader(resp.Body, 1024*1024)); err != nil {
+			return status, err
+		}
+	} else {
+		network, address := "tcp", target
+		if path, ok := strings.CutPrefix(target, "unix:"); ok {
+			network, address = "unix", path
+		}
+		var err error
+		if body, err = fastCGIGet(network, address, "/status", "json"); err != nil {
+			return status, err
+		}
+	}
+	err := json.Unmarshal(body, &status)
+	return status, err
+}
+
+// fastCGIGet performs a single FastCGI GET request and returns the response
+// body without headers. It implements just enough of the protocol for
+// php-fpm's status page.
+func fastCGIGet(network, address, path, query string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const (
+		fcgiBeginRequest = 1
+		fcgiEndRequest   = 3
+		fcgiParams       = 4
+		fcgiStdin        = 5
+		fcgiStdout       = 6
+		fcgiResponder    = 1
+	)
+	writeRecord := func(recordType byte, content []byte) error {
+		header := []byte{1, recordType, 0, 1, byte(len(content) >> 8), byte(len(content)), 0, 0}
+		_, err := conn.Write(append(header, content...))
+		return err
+	}
+
+	var params bytes.Buffer
+	for _, kv := range [][2]string{
+		{"SCRIPT_NAME", path},
+		{"SCRIPT_FILENAME", path},
+		{"REQUEST_URI", path + "?" + query},
+		{"QUERY_STRING", query},
+		{"REQUEST_METHOD", "GET"},
+		{"SERVER_PROTOCOL", "HTTP/1.1"},
+	} {
+		// Names and values here are short, so single-byte lengths suffice
+		params.WriteByte(byte(len(kv[0])))
+		params.WriteByte(byte(len(kv[1])))
+		params.WriteString(kv[0])
+		params.WriteString(kv[1])
+	}
+	for _, record := range []struct {
+		recordType byte
+		content    []byte
+	}{
+		{fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}},
+		{fcgiParams, params.Bytes()},
+		{fcgiParams, nil},
+		{fcgiStdin, nil},
+	} {
+		if err := writeRecord(record.recordType, record.content); err != nil {
+			return nil, err
+		}
+	}
+
+	var stdout bytes.Buffer
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		content := make([]byte, int(length)+int(header[6]))
+		if _, err := io.ReadFull(conn, content); err != nil {
+			return nil, err
+		}
+		switch header[1] {
+		case fcgiStdout:
+			stdout.Write(content[:length])
+		case fcgiEndRequest:
+			response := stdout.Bytes()
+			if i := bytes.Index(response, []byte("\r\n\r\n")); i >= 0 {
+				return response[i+4:], nil
+			}
+			return response, nil
+		}
+	}
+}
+
+// fetchUWSGIStats reads the JSON document a uWSGI stats server writes on
+// connect ("unix:/run/uwsgi/stats.sock" or "127.0.0.1:1717").
+func fetchUWSGIStats(target string) (uwsgiStats, error) {
+	var stats uwsgiStats
+	network, address := "tcp", target
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		network, address = "unix", path
+	}
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = json.NewDecoder(io.LimitReader(conn, 16*1024*1024)).Decode(&stats)
+	return stats, err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupCheckInterval limits how often backup targets are inspected. Asking
+// a remote restic/borg repository or walking a large backup tree every cycle
+// would cost more than a fresher age is worth.
+const backupCheckInterval = 15 * time.Minute
+
+// backupStatus is the last inspection result for one backup target.
+type backupStatus struct {
+	checkedAt  time.Time
+	lastBackup time.Time
+	size       float64
+	err        error
+}
+
+var backupState = struct {
+	sync.Mutex
+	targets map[string]backupStatus
+}{targets: map[string]backupStatus{}}
+
+// collectBackups reports, for every backup_paths entry and backup_repos
+// repository, the age of the newest backup and the backup size. Repository
+// passwords come from the agent's environment (RESTIC_PASSWORD_FILE,
+// BORG_PASSCOMMAND, ...), like for any other restic/borg invocation.
+func collectBackups() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.BackupPaths) == 0 && len(cfg.BackupRepos) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	for _, path := range cfg.BackupPaths {
+		status := cachedBackupStatus("path:"+path, func() backupStatus { return inspectBackupPath(path) })
+		metrics = append(metrics, backupMetrics("path", path, status, now)...)
+	}
+	for _, repo := range cfg.BackupRepos {
+		kind, location, _ := strings.Cut(repo, ":")
+		inspect := inspectResticRepo
+		if kind == "borg" {
+			inspect = inspectBorgRepo
+		}
+		status := cachedBackupStatus(repo, func() backupStatus { return inspect(location) })
+		metrics = append(metrics, backupMetrics(kind, location, status, now)...)
+	}
+	return metrics, nil
+}
+
+func cachedBackupStatus(key string, inspect func() backupStatus) backupStatus {
+	backupState.Lock()
+	status, ok := backupState.targets[key]
+	backupState.Unlock()
+	if ok && time.Since(status.checkedAt) < backupCheckInterval {
+		return status
+	}
+
+	status = inspect()
+	status.checkedAt = time.Now()
+	backupState.Lock()
+	backupState.targets[key] = status
+	backupState.Unlock()
+	return status
+}
+
+func backupMetrics(kind, target string, status backupStatus, now time.Time) []Metric {
+	metadata := map[string]interface{}{"kind": kind, "target": target}
+	ok := 1.0
+	if status.err != nil {
+		ok = 0
+		metadata = map[string]interface{}{"kind": kind, "target": target, "error": status.err.Error()}
+	}
+	metrics := []Metric{{
+		MetricType: "backup",
+		MetricName: "check_ok",
+		Value:      ok,
+		Unit:       "bool",
+		Metadata:   metadata,
+		Timestamp:  now,
+	}}
+	if status.err != nil || status.lastBackup.IsZero() {
+		return metrics
+	}
+	return append(metrics,
+		Metric{
+			MetricType: "backup",
+			MetricName: "last_backup_age",
+			Value:      now.Sub(status.lastBackup).Seconds(),
+			Unit:       "seconds",
+			Metadata:   metadata,
+			Timestamp:  now,
+		},
+		Metric{
+			MetricType: "backup",
+			MetricName: "size",
+			Value:      status.size,
+			Unit:       "bytes",
+			Metadata:   metadata,
+			Timestamp:  now,
+		},
+	)
+}
+
+// inspectBackupPath finds the newest regular file below path (or path itself
+// if it is a file) and sums the file sizes.
+func inspectBackupPath(path string) backupStatus {
+	var status backupStatus
+	status.err = filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		status.size += float64(info.Size())
+		if info.ModTime().After(status.lastBackup) {
+			status.lastBackup = info.ModTime()
+		}
+		return nil
+	})
+	if status.err == nil && status.lastBackup.IsZero() {
+		status.err = fmt.Errorf("no files in %s", path)
+	}
+	return status
+}
+
+func inspectResticRepo(repo string) backupStatus {
+	var status backupStatus
+	out, err := commandOutputTimeout(time.Minute, "restic", "-r", repo, "--no-lock", "snapshots", "--json", "--latest", "1")
+	if err != nil {
+		status.err = fmt.Errorf("restic snapshots: %w", err)
+		return status
+	}
+	var snapshots []struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(out), &snapshots); err != nil {
+		status.err = fmt.Errorf("restic snapshots: %w", err)
+		return status
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Time.After(status.lastBackup) {
+			status.lastBackup = snapshot.Time
+		}
+	}
+
+	out, err = commandOutputTimeout(time.Minute, "restic", "-r", repo, "--no-lock", "stats", "--json", "--mode", "raw-data")
+	if err != nil {
+		status.err = fmt.Errorf("restic stats: %w", err)
+		return status
+	}
+	var stats struct {
+		TotalSize float64 `json:"total_size"`
+	}
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		status.err = fmt.Errorf("restic stats: %w", err)
+		return status
+	}
+	status.size = stats.TotalSize
+	return status
+}
+
+func inspectBorgRepo(repo string) backupStatus {
+	var status backupStatus
+	out, err := commandOutputTimeout(time.Minute, "borg", "info", "--json", "--last", "1", repo)
+	if err != nil {
+		status.err = fmt.Errorf("borg info: %w", err)
+		return status
+	}
+	var info struct {
+		Archives []struct {
+			End string `json:"end"`
+		} `json:"archives"`
+		Cache struct {
+			Stats struct {
+				UniqueCompressedSize float64 `json:"unique_csize"`
+			} `json:"stats"`
+		} `json:"cache"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		status.err = fmt.Errorf("borg info: %w", err)
+		return status
+	}
+	for _, archive := range info.Archives {
+		// borg reports archive times in local time without a zone
+		end, err := time.ParseInLocation("2006-01-02T15:04:05.999999", archive.End, time.Local)
+		if err == nil && end.After(status.lastBackup) {
+			status.lastBackup = end
+		}
+	}
+	status.size = info.Cache.Stats.UniqueCompressedSize
+	return status
+}
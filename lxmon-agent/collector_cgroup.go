@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// unlimitedCgroupMemory is the value cgroup v1 reports for "no limit"
+// (rounded down to the page size, so anything this large is treated alike).
+const unlimitedCgroupMemory = 1 << 62
+
+// collectContainer reports the agent's own cgroup CPU quota, throttling and
+// memory limit/usage when the agent runs inside a container. The host-wide
+// collectors keep reporting what the kernel sees; these metrics carry
+// metric_type "container" and scope=container so the two are never confused.
+func collectContainer() ([]Metric, error) {
+	if !runningInContainer() {
+		return nil, nil
+	}
+
+	var stats cgroupStats
+	if cgroupPath, ok := cgroupV2Path(); ok {
+		stats = readCgroupV2(filepath.Join(cgroupRoot, cgroupPath))
+	} else {
+		stats = readCgroupV1()
+	}
+
+	now := time.Now()
+	metadata := map[string]interface{}{"scope": "container", "cgroup_version": stats.Version}
+	metric := func(name string, value float64, unit string) Metric {
+		return Metric{
+			MetricType: "container",
+			MetricName: name,
+			Value:      value,
+			Unit:       unit,
+			Metadata:   metadata,
+			Timestamp:  now,
+		}
+	}
+
+	metrics := []Metric{}
+	if stats.CPUQuotaCores > 0 {
+		metrics = append(metrics, metric("cpu_quota_cores", stats.CPUQuotaCores, "cores"))
+	}
+	if stats.HasThrottling {
+		metrics = append(metrics,
+			metric("cpu_throttled_periods", float64(stats.ThrottledPeriods), "count"),
+			metric("cpu_throttled_seconds", stats.ThrottledSeconds, "seconds"),
+		)
+	}
+	if stats.MemoryUsage > 0 {
+		metrics = append(metrics, metric("memory_usage", float64(stats.MemoryUsage), "bytes"))
+	}
+	if stats.MemoryLimit > 0 {
+		metrics = append(metrics, metric("memory_limit", float64(stats.MemoryLimit), "bytes"))
+		if stats.MemoryUsage > 0 {
+			metrics = append(metrics, metric("memory_usage_percent", float64(stats.MemoryUsage)/float64(stats.MemoryLimit)*100, "percent"))
+		}
+	}
+	return metrics, nil
+}
+
+type cgroupStats struct {
+	Version          int
+	CPUQuotaCores    float64
+	HasThrottling    bool
+	ThrottledPeriods uint64
+	ThrottledSeconds float64
+	MemoryLimit      uint64
+	MemoryUsage      uint64
+}
+
+// runningInContainer uses the usual markers left by Docker, Podman and
+// Kubernetes.
+func runningInContainer() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	content := string(data)
+	for _, hint := range []string{"docker", "kubepods", "containerd", "libpod", "lxc"} {
+		if strings.Contains(content, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupV2Path returns our path in the unified hierarchy ("0::/path").
+func cgroupV2Path() (string, bool) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", false
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "/", true
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			// Inside a cgroup namespace the container's cgroup is mounted at
+			// the root, but the path may still be relative to the host.
+			if _, err := os.Stat(filepath.Join(cgroupRoot, path, "cpu.max")); err == nil {
+				return path, true
+			}
+			return "/", true
+		}
+	}
+	return "/", true
+}
+
+func readCgroupV2(dir string) cgroupStats {
+	stats := cgroupStats{Version: 2}
+
+	// cpu.max: "<quota> <period>" or "max <period>"
+	if fields := strings.Fields(readCgroupFile(filepath.Join(dir, "cpu.max"))); len(fields) == 2 && fields[0] != "max" {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			stats.CPUQuotaCores = quota / period
+		}
+	}
+
+	cpuStat := readKeyValueFile(filepath.Join(dir, "cpu.stat"))
+	if periods, ok := cpuStat["nr_throttled"]; ok {
+		stats.HasThrottling = true
+		stats.ThrottledPeriods = periods
+		stats.ThrottledSeconds = float64(cpuStat["throttled_usec"]) / 1e6
+	}
+
+	if limit, err := strconv.ParseUint(readCgroupFile(filepath.Join(dir, "memory.max")), 10, 64); err == nil {
+		stats.MemoryLimit = limit
+	}
+	if usage, err := strconv.ParseUint(readCgroupFile(filepath.Join(dir, "memory.current")), 10, 64); err == nil {
+		stats.MemoryUsage = usage
+	}
+	return stats
+}
+
+func readCgroupV1() cgroupStats {
+	stats := cgroupStats{Version: 1}
+
+	quota, err1 := strconv.ParseFloat(readCgroupFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us")), 64)
+	period, err2 := strconv.ParseFloat(readCgroupFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us")), 64)
+	if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+		stats.CPUQuotaCores = quota / period
+	}
+
+	cpuStat := readKeyValueFile(filepath.Join(cgroupRoot, "cpu", "cpu.stat"))
+	if periods, ok := cpuStat["nr_throttled"]; ok {
+		stats.HasThrottling = true
+		stats.ThrottledPeriods = periods
+		stats.ThrottledSeconds = float64(cpuStat["throttled_time"]) / 1e9
+	}
+
+	if limit, err := strconv.ParseUint(readCgroupFile(filepath.Join(cgroupRoot, "memory", "memory.limit_in_bytes")), 10, 64); err == nil && limit < unlimitedCgroupMemory {
+		stats.MemoryLimit = limit
+	}
+	if usage, err := strconv.ParseUint(readCgroupFile(filepath.Join(cgroupRoot, "memory", "memory.usage_in_bytes")), 10, 64); err == nil {
+		stats.MemoryUsage = usage
+	}
+	return stats
+}
+
+func readCgroupFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readKeyValueFile parses "key value" lines such as cgroup cpu.stat.
+func readKeyValueFile(path string) map[string]uint64 {
+	values := map[string]uint64{}
+	file, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values
+}
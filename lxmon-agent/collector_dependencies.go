@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// dependencyDialTimeout bounds each TCP connect probe.
+const dependencyDialTimeout = 3 * time.Second
+
+// collectDependencies probes each configured critical dependency (host:port):
+// whether a TCP connection can be opened, how long that took, and how many
+// connections this host currently has established to it.
+func collectDependencies() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.Dependencies) == 0 {
+		return nil, nil
+	}
+
+	conns, connErr := readTCPConnections()
+	now := time.Now()
+	metrics := []Metric{}
+
+	for _, endpoint := range cfg.Dependencies {
+		metadata := map[string]interface{}{"endpoint": endpoint}
+
+		reachable := 0.0
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", endpoint, dependencyDialTimeout)
+		latency := time.Since(start).Seconds()
+		if err == nil {
+			conn.Close()
+			reachable = 1
+			metrics = append(metrics, Metric{
+				MetricType: "dependency",
+				MetricName: "connect_latency",
+				Value:      latency,
+				Unit:       "seconds",
+				Metadata:   metadata,
+				Timestamp:  now,
+			})
+		} else {
+			metadata = map[string]interface{}{"endpoint": endpoint, "error": err.Error()}
+		}
+		metrics = append(metrics, Metric{
+			MetricType: "dependency",
+			MetricName: "reachable",
+			Value:      reachable,
+			Unit:       "bool",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+
+		if connErr == nil {
+			if count, ok := establishedTo(conns, endpoint); ok {
+				metrics = append(metrics, Metric{
+					MetricType: "dependency",
+					MetricName: "established_connections",
+					Value:      float64(count),
+					Unit:       "count",
+					Metadata:   map[string]interface{}{"endpoint": endpoint},
+					Timestamp:  now,
+				})
+			}
+		}
+	}
+	return metrics, connErr
+}
+
+// establishedTo counts established TCP connections to any address the
+// endpoint's host resolves to.
+func establishedTo(conns []tcpConn, endpoint string) (int, bool) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dependencyDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return 0, false
+	}
+
+	count := 0
+	for _, conn := range conns {
+		if conn.State != tcpEstablished || conn.RemotePort != port {
+			continue
+		}
+		for _, addr := range addrs {
+			if conn.RemoteIP.Equal(addr.IP) {
+				count++
+				break
+			}
+		}
+	}
+	return count, true
+}
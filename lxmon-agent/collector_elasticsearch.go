@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterStatusValues maps the health color to a value that can be graphed
+// and alerted on (higher is worse).
+var clusterStatusValues = map[string]float64{"green": 0, "yellow": 1, "red": 2}
+
+// searchClusterStatus remembers each cluster's last color so changes are
+// emitted as events once.
+var searchClusterStatus = struct {
+	sync.Mutex
+	status map[string]string
+}{status: map[string]string{}}
+
+// collectElasticsearch reports heap usage of the local node and cluster
+// health for every Elasticsearch/OpenSearch URL in elasticsearch.
+func collectElasticsearch() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.Elasticsearch) == 0 {
+		return nil, nil
+	}
+
+	metrics := []Metric{}
+	var errs []string
+	for _, baseURL := range cfg.Elasticsearch {
+		collected, err := collectSearchNode(strings.TrimSuffix(baseURL, "/"))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", redactURL(baseURL), err))
+		}
+		metrics = append(metrics, collected...)
+	}
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+func collectSearchNode(baseURL string) ([]Metric, error) {
+	var health struct {
+		ClusterName         string  `json:"cluster_name"`
+		Status              string  `json:"status"`
+		NumberOfNodes       float64 `json:"number_of_nodes"`
+		ActiveShards        float64 `json:"active_shards"`
+		RelocatingShards    float64 `json:"relocating_shards"`
+		InitializingShards  float64 `json:"initializing_shards"`
+		UnassignedShards    float64 `json:"unassigned_shards"`
+		PendingTasks        float64 `json:"number_of_pending_tasks"`
+		ActiveShardsPercent float64 `json:"active_shards_percent_as_number"`
+	}
+	if err := fetchJSON(baseURL+"/_cluster/health?local=true", &health); err != nil {
+		return nil, fmt.Errorf("cluster health: %w", err)
+	}
+
+	now := time.Now()
+	clusterMetadata := map[string]interface{}{"cluster": health.ClusterName, "status": health.Status}
+	metric := func(name string, value float64, unit string, metadata map[string]interface{}) Metric {
+		return Metric{MetricType: "elasticsearch", MetricName: name, Value: value, Unit: unit, Metadata: metadata, Timestamp: now}
+	}
+	metrics := []Metric{
+		metric("number_of_nodes", health.NumberOfNodes, "count", clusterMetadata),
+		metric("active_shards", health.ActiveShards, "count", clusterMetadata),
+		metric("relocating_shards", health.RelocatingShards, "count", clusterMetadata),
+		metric("initializing_shards", health.InitializingShards, "count", clusterMetadata),
+		metric("unassigned_shards", health.UnassignedShards, "count", clusterMetadata),
+		metric("pending_tasks", health.PendingTasks, "count", clusterMetadata),
+		metric("active_shards_percent", health.ActiveShardsPercent, "percent", clusterMetadata),
+	}
+	if value, ok := clusterStatusValues[health.Status]; ok {
+		metrics = append(metrics, metric("cluster_status", value, "status", clusterMetadata))
+	}
+	trackClusterStatus(health.ClusterName, health.Status)
+
+	var stats struct {
+		Nodes map[string]struct {
+			Name string `json:"name"`
+			JVM  struct {
+				Mem struct {
+					HeapUsedInBytes float64 `json:"heap_used_in_bytes"`
+					HeapUsedPercent float64 `json:"heap_used_percent"`
+					HeapMaxInBytes  float64 `json:"heap_max_in_bytes"`
+				} `json:"mem"`
+			} `json:"jvm"`
+		} `json:"nodes"`
+	}
+	if err := fetchJSON(baseURL+"/_nodes/_local/stats/jvm", &stats); err != nil {
+		return metrics, fmt.Errorf("node stats: %w", err)
+	}
+	for _, node := range stats.Nodes {
+		nodeMetadata := map[string]interface{}{"cluster": health.ClusterName, "node": node.Name}
+		metrics = append(metrics,
+			metric("heap_used", node.JVM.Mem.HeapUsedInBytes, "bytes", nodeMetadata),
+			metric("heap_max", node.JVM.Mem.HeapMaxInBytes, "bytes", nodeMetadata),
+			metric("heap_used_percent", node.JVM.Mem.HeapUsedPercent, "percent", nodeMetadata),
+		)
+	}
+	return metrics, nil
+}
+
+func trackClusterStatus(cluster, status string) {
+	searchClusterStatus.Lock()
+	previous, known := searchClusterStatus.status[cluster]
+	searchClusterStatus.status[cluster] = status
+	searchClusterStatus.Unlock()
+	if !known || previous == status {
+		return
+	}
+
+	severity := "info"
+	if clusterStatusValues[status] > clusterStatusValues[previous] {
+		severity = "warning"
+		if status == "red" {
+			severity = "critical"
+		}
+	}
+	emitEvent(Event{
+		Type:     "search_cluster_status_changed",
+		Source:   "elasticsearch",
+		Severity: severity,
+		Message:  fmt.Sprintf("cluster %s changed from %s to %s", cluster, previous, status),
+		Fields:   map[string]interface{}{"cluster": cluster, "from": previous, "to": status},
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"golang.org/x/sys/unix"
+)
+
+const sysClassBlock = "/sys/class/block"
+
+// collectEncryption reports how many dm-crypt (LUKS or plain) volumes exist
+// and, for every mounted local filesystem, whether it sits on an encrypted
+// device anywhere down its device-mapper/MD stack.
+func collectEncryption() ([]Metric, error) {
+	entries, err := os.ReadDir(sysClassBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	luks := 0
+	plain := 0
+	for _, entry := range entries {
+		switch uuid := dmUUID(entry.Name()); {
+		case strings.HasPrefix(uuid, "CRYPT-LUKS"):
+			luks++
+		case strings.HasPrefix(uuid, "CRYPT-"):
+			plain++
+		}
+	}
+	metrics := []Metric{
+		{
+			MetricType: "security",
+			MetricName: "encrypted_volumes",
+			Value:      float64(luks),
+			Unit:       "count",
+			Metadata:   map[string]interface{}{"kind": "luks"},
+			Timestamp:  now,
+		},
+		{
+			MetricType: "security",
+			MetricName: "encrypted_volumes",
+			Value:      float64(plain),
+			Unit:       "count",
+			Metadata:   map[string]interface{}{"kind": "plain"},
+			Timestamp:  now,
+		},
+	}
+
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return metrics, err
+	}
+	for _, partition := range partitions {
+		name, err := blockDeviceName(partition.Device)
+		if err != nil {
+			continue
+		}
+		encrypted := 0.0
+		if isEncryptedDevice(name, 0) {
+			encrypted = 1
+		}
+		metrics = append(metrics, Metric{
+			MetricType: "security",
+			MetricName: "mount_encrypted",
+			Value:      encrypted,
+			Unit:       "bool",
+			Metadata: map[string]interface{}{
+				"mountpoint": partition.Mountpoint,
+				"device":     partition.Device,
+			},
+			Timestamp: now,
+		})
+	}
+	return metrics, nil
+}
+
+// dmUUID returns the device-mapper UUID of a block device, e.g.
+// "CRYPT-LUKS2-<uuid>-cryptroot", or "" for non-dm devices.
+func dmUUID(name string) string {
+	data, err := os.ReadFile(filepath.Join(sysClassBlock, name, "dm", "uuid"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// isEncryptedDevice walks the slaves of a stacked device (LVM on LUKS, RAID
+// on LUKS, ...) looking for a dm-crypt layer.
+func isEncryptedDevice(name string, depth int) bool {
+	if depth > 8 {
+		return false
+	}
+	if strings.HasPrefix(dmUUID(name), "CRYPT-") {
+		return true
+	}
+	slaves, err := os.ReadDir(filepath.Join(sysClassBlock, name, "slaves"))
+	if err != nil {
+		return false
+	}
+	for _, slave := range slaves {
+		if isEncryptedDevice(slave.Name(), depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockDeviceName maps a device path such as /dev/mapper/vg-root to its
+// kernel name (dm-1) via the device number.
+func blockDeviceName(device string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		return "", err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", device)
+	}
+	link := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const procConntrack = "/proc/net/nf_conntrack"
+
+// flowKey identifies a connection by its original-direction tuple.
+type flowKey struct {
+	Proto string
+	Src   string
+	Dst   string
+	SPort string
+	DPort string
+}
+
+// flowState keeps the byte counters from the previous cycle so each cycle
+// reports traffic during the interval, not since the connection opened.
+var flowState = struct {
+	sync.Mutex
+	previous map[flowKey]uint64
+}{}
+
+// collectFlows samples connection tracking and reports the top_flows flows
+// that moved the most bytes since the previous cycle. Byte counters require
+// net.netfilter.nf_conntrack_acct=1.
+func collectFlows() ([]Metric, error) {
+	cfg := currentConfig()
+	if cfg.TopFlows <= 0 {
+		return nil, nil
+	}
+
+	current, err := readConntrack()
+	if err != nil {
+		return nil, err
+	}
+
+	flowState.Lock()
+	previous := flowState.previous
+	flowState.previous = current
+	flowState.Unlock()
+	if previous == nil {
+		// First sample only establishes the baseline
+		return nil, nil
+	}
+
+	type flowDelta struct {
+		key   flowKey
+		bytes uint64
+	}
+	deltas := make([]flowDelta, 0, len(current))
+	for key, total := range current {
+		if before, ok := previous[key]; ok && total >= before {
+			total -= before
+		}
+		if total > 0 {
+			deltas = append(deltas, flowDelta{key: key, bytes: total})
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].bytes > deltas[j].bytes })
+	if len(deltas) > cfg.TopFlows {
+		deltas = deltas[:cfg.TopFlows]
+	}
+
+	now := time.Now()
+	metrics := make([]Metric, 0, len(deltas))
+	for rank, flow := range deltas {
+		metrics = append(metrics, Metric{
+			MetricType: "network",
+			MetricName: "flow_bytes",
+			Value:      float64(flow.bytes),
+			Unit:       "bytes",
+			Metadata: map[string]interface{}{
+				"rank":  rank + 1,
+				"proto": flow.key.Proto,
+				"src":   flow.key.Src,
+				"dst":   flow.key.Dst,
+				"sport": flow.key.SPort,
+				"dport": flow.key.DPort,
+			},
+			Timestamp: now,
+		})
+	}
+	return metrics, nil
+}
+
+// readConntrack returns total bytes (both directions) per tracked flow, from
+// procfs when available, otherwise from the conntrack tool.
+func readConntrack() (map[flowKey]uint64, error) {
+	if file, err := os.Open(procConntrack); err == nil {
+		defer file.Close()
+		return parseConntrack(file), nil
+	}
+	if !commandAvailable("conntrack") {
+		return nil, fmt.Errorf("connection tracking unavailable: no %s and no conntrack tool", procConntrack)
+	}
+	out, err := commandOutput("conntrack", "-L", "-o", "extended")
+	if err != nil {
+		return nil, fmt.Errorf("conntrack -L: %w", err)
+	}
+	return parseConntrack(strings.NewReader(out)), nil
+}
+
+// parseConntrack reads lines like:
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=5555 dport=22 packets=10 bytes=1000 src=10.0.0.2 ... bytes=2000 [ASSURED] ...
+//
+// The first src/dst/sport/dport group is the original direction.
+func parseConntrack(r io.Reader) map[flowKey]uint64 {
+	flows := map[flowKey]uint64{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		key := flowKey{Proto: fields[2]}
+		var bytes uint64
+		for _, field := range fields {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			switch name {
+			case "src":
+				if key.Src == "" {
+					key.Src = value
+				}
+			case "dst":
+				if key.Dst == "" {
+					key.Dst = value
+				}
+			case "sport":
+				if key.SPort == "" {
+					key.SPort = value
+				}
+			case "dport":
+				if key.DPort == "" {
+					key.DPort = value
+				}
+			case "bytes":
+				if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+					bytes += n
+				}
+			}
+		}
+		if key.Src != "" {
+			flows[key] += bytes
+		}
+	}
+	return flows
+}
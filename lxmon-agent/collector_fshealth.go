@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const (
+	sysFSExt4 = "/sys/fs/ext4"
+	sysFSXFS  = "/sys/fs/xfs"
+)
+
+// xfsLogStats names the fields of the "log" line in an XFS stats file.
+var xfsLogStats = []string{"log_writes", "log_blocks", "log_noiclogs", "log_forces", "log_force_sleeps"}
+
+// collectFilesystemHealth reports the error counters ext4 keeps per
+// filesystem and the journal counters of each XFS filesystem. A non-zero
+// ext4 error count means the kernel already found corruption, usually long
+// before an application notices.
+func collectFilesystemHealth() ([]Metric, error) {
+	mountpoints := mountpointsByKernelName()
+	now := time.Now()
+	metrics := []Metric{}
+
+	ext4Devices, _ := os.ReadDir(sysFSExt4)
+	for _, entry := range ext4Devices {
+		if entry.Name() == "features" {
+			continue
+		}
+		dir := filepath.Join(sysFSExt4, entry.Name())
+		metadata := map[string]interface{}{
+			"device":     entry.Name(),
+			"mountpoint": mountpoints[entry.Name()],
+		}
+		if lastError := readSysfsInt(filepath.Join(dir, "last_error_time")); lastError > 0 {
+			metadata["last_error_time"] = time.Unix(lastError, 0).UTC().Format(time.RFC3339)
+			metadata["last_error_func"] = readSysfsString(filepath.Join(dir, "last_error_func"))
+		}
+		metrics = append(metrics,
+			Metric{MetricType: "disk", MetricName: "ext4_errors", Value: float64(readSysfsInt(filepath.Join(dir, "errors_count"))), Unit: "count", Metadata: metadata, Timestamp: now},
+			Metric{MetricType: "disk", MetricName: "ext4_warnings", Value: float64(readSysfsInt(filepath.Join(dir, "warning_count"))), Unit: "count", Metadata: metadata, Timestamp: now},
+		)
+	}
+
+	xfsDevices, _ := os.ReadDir(sysFSXFS)
+	for _, entry := range xfsDevices {
+		data, err := os.ReadFile(filepath.Join(sysFSXFS, entry.Name(), "stats", "stats"))
+		if err != nil {
+			continue
+		}
+		metadata := map[string]interface{}{
+			"device":     entry.Name(),
+			"mountpoint": mountpoints[entry.Name()],
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] != "log" {
+				continue
+			}
+			for i, name := range xfsLogStats {
+				if i+1 >= len(fields) {
+					break
+				}
+				value, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					continue
+				}
+				metrics = append(metrics, Metric{
+					MetricType: "disk",
+					MetricName: "xfs_" + name,
+					Value:      value,
+					Unit:       "count",
+					Metadata:   metadata,
+					Timestamp:  now,
+				})
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// mountpointsByKernelName maps kernel block device names (sda1, dm-0) to
+// where they are mounted.
+func mountpointsByKernelName() map[string]string {
+	result := map[string]string{}
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return result
+	}
+	for _, partition := range partitions {
+		if name, err := blockDeviceName(partition.Device); err == nil {
+			if _, ok := result[name]; !ok {
+				result[name] = partition.Mountpoint
+			}
+		}
+	}
+	return result
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysfsInt(path string) int64 {
+	value, _ := strconv.ParseInt(readSysfsString(path), 10, 64)
+	return value
+}
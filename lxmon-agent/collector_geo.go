@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxGeoGroups caps how many countries/ASNs are reported per cycle.
+const maxGeoGroups = 10
+
+// geoRecord covers both the Country and the ASN MaxMind databases; fields
+// the opened database does not have stay empty.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+var geoDBs = struct {
+	sync.Mutex
+	paths   string
+	readers []*maxminddb.Reader
+}{}
+
+// collectGeo summarizes outbound established TCP connections by destination
+// country and ASN using local MMDB files (geoip_db). Only aggregate counts
+// are reported, never individual addresses.
+func collectGeo() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.GeoIPDatabases) == 0 {
+		return nil, nil
+	}
+	readers, err := openGeoDBs(cfg.GeoIPDatabases)
+	if err != nil {
+		return nil, err
+	}
+	conns, err := readTCPConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	listening := map[int]bool{}
+	for _, conn := range conns {
+		if conn.State == tcpListen {
+			listening[conn.LocalPort] = true
+		}
+	}
+
+	byCountry := map[string]int{}
+	byASN := map[string]int{}
+	asOrgs := map[string]string{}
+	for _, conn := range conns {
+		// Inbound connections terminate on one of our listening ports.
+		if conn.State != tcpEstablished || listening[conn.LocalPort] || !isPublicIP(conn.RemoteIP) {
+			continue
+		}
+		var merged geoRecord
+		for _, reader := range readers {
+			var record geoRecord
+			if err := reader.Lookup(conn.RemoteIP, &record); err != nil {
+				continue
+			}
+			if record.Country.ISOCode != "" {
+				merged.Country = record.Country
+			}
+			if record.ASN != 0 {
+				merged.ASN, merged.ASOrg = record.ASN, record.ASOrg
+			}
+		}
+
+		country := merged.Country.ISOCode
+		if country == "" {
+			country = "unknown"
+		}
+		byCountry[country]++
+		if merged.ASN != 0 {
+			asn := fmt.Sprintf("AS%d", merged.ASN)
+			byASN[asn]++
+			asOrgs[asn] = merged.ASOrg
+		}
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	for _, country := range topKeys(byCountry, maxGeoGroups) {
+		metrics = append(metrics, Metric{
+			MetricType: "network",
+			MetricName: "egress_connections_by_country",
+			Value:      float64(byCountry[country]),
+			Unit:       "count",
+			Metadata:   map[string]interface{}{"country": country},
+			Timestamp:  now,
+		})
+	}
+	for _, asn := range topKeys(byASN, maxGeoGroups) {
+		metrics = append(metrics, Metric{
+			MetricType: "network",
+			MetricName: "egress_connections_by_asn",
+			Value:      float64(byASN[asn]),
+			Unit:       "count",
+			Metadata:   map[string]interface{}{"asn": asn, "as_org": asOrgs[asn]},
+			Timestamp:  now,
+		})
+	}
+	return metrics, nil
+}
+
+// openGeoDBs opens the configured databases once and reuses the readers
+// until the configured paths change.
+func openGeoDBs(paths []string) ([]*maxminddb.Reader, error) {
+	geoDBs.Lock()
+	defer geoDBs.Unlock()
+
+	key := strings.Join(paths, ",")
+	if key == geoDBs.paths && geoDBs.readers != nil {
+		return geoDBs.readers, nil
+	}
+	for _, reader := range geoDBs.readers {
+		reader.Close()
+	}
+	geoDBs.readers = nil
+
+	readers := make([]*maxminddb.Reader, 0, len(paths))
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			for _, opened := range readers {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("open %s: %w", path, err)
+		}
+		readers = append(readers, reader)
+	}
+	geoDBs.paths = key
+	geoDBs.readers = readers
+	return readers, nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified() || ip.IsMulticast())
+}
+
+// topKeys returns up to n keys with the highest counts.
+func topKeys(counts map[string]int, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
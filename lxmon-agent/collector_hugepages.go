@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// collectHugepages reports the static hugepage pool, transparent hugepage
+// usage and /dev/shm usage. A pool that is reserved but never used, or one
+// too small for the database that expects it, silently wastes or starves
+// memory without showing up in the regular memory metrics.
+func collectHugepages() ([]Metric, error) {
+	memInfo, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	used := memInfo.HugePagesTotal - memInfo.HugePagesFree
+	metrics := []Metric{
+		{MetricType: "memory", MetricName: "hugepages_total", Value: float64(memInfo.HugePagesTotal), Unit: "pages", Timestamp: now},
+		{MetricType: "memory", MetricName: "hugepages_used", Value: float64(used), Unit: "pages", Timestamp: now},
+		{MetricType: "memory", MetricName: "hugepages_reserved", Value: float64(memInfo.HugePagesRsvd), Unit: "pages", Timestamp: now},
+		{MetricType: "memory", MetricName: "hugepages_surplus", Value: float64(memInfo.HugePagesSurp), Unit: "pages", Timestamp: now},
+		{MetricType: "memory", MetricName: "hugepage_size", Value: float64(memInfo.HugePageSize), Unit: "bytes", Timestamp: now},
+		{MetricType: "memory", MetricName: "anon_hugepages", Value: float64(memInfo.AnonHugePages), Unit: "bytes", Timestamp: now},
+	}
+	if memInfo.HugePagesTotal > 0 {
+		metrics = append(metrics, Metric{
+			MetricType: "memory",
+			MetricName: "hugepages_used_percent",
+			Value:      float64(used) / float64(memInfo.HugePagesTotal) * 100,
+			Unit:       "percent",
+			Timestamp:  now,
+		})
+	}
+
+	if shm, err := disk.Usage("/dev/shm"); err == nil {
+		metrics = append(metrics,
+			Metric{MetricType: "memory", MetricName: "shm_total", Value: float64(shm.Total), Unit: "bytes", Timestamp: now},
+			Metric{MetricType: "memory", MetricName: "shm_used", Value: float64(shm.Used), Unit: "bytes", Timestamp: now},
+			Metric{MetricType: "memory", MetricName: "shm_used_percent", Value: shm.UsedPercent, Unit: "percent", Timestamp: now},
+		)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jolokiaRequests is the bulk read sent to every JVM. The order matters:
+// collectJVM indexes the responses by position.
+var jolokiaRequests = []map[string]interface{}{
+	{"type": "read", "mbean": "java.lang:type=Memory", "attribute": "HeapMemoryUsage"},
+	{"type": "read", "mbean": "java.lang:type=Memory", "attribute": "NonHeapMemoryUsage"},
+	{"type": "read", "mbean": "java.lang:type=GarbageCollector,name=*", "attribute": []string{"CollectionCount", "CollectionTime"}},
+	{"type": "read", "mbean": "java.lang:type=Threading", "attribute": []string{"ThreadCount", "DaemonThreadCount", "PeakThreadCount"}},
+}
+
+type jolokiaResponse struct {
+	Status int             `json:"status"`
+	Error  string          `json:"error"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type jvmMemoryUsage struct {
+	Used      float64 `json:"used"`
+	Committed float64 `json:"committed"`
+	Max       float64 `json:"max"`
+}
+
+// collectJVM reads heap, GC and thread figures from the Jolokia agents in
+// jolokia (name=url pairs), e.g. orders=http://127.0.0.1:8778/jolokia.
+func collectJVM() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.Jolokia) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(cfg.Jolokia))
+	for name := range cfg.Jolokia {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []Metric{}
+	var errs []string
+	for _, name := range names {
+		collected, err := collectJolokia(name, cfg.Jolokia[name])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+		metrics = append(metrics, collected...)
+	}
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+func collectJolokia(name, url string) ([]Metric, error) {
+	body, err := json.Marshal(jolokiaRequests)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(url, "/")+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var responses []jolokiaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		return nil, err
+	}
+	if len(responses) != len(jolokiaRequests) {
+		return nil, fmt.Errorf("expected %d responses, got %d", len(jolokiaRequests), len(responses))
+	}
+	for _, r := range responses {
+		if r.Status != http.StatusOK {
+			return nil, fmt.Errorf("jolokia status %d: %s", r.Status, r.Error)
+		}
+	}
+
+	now := time.Now()
+	metadata := map[string]interface{}{"jvm": name}
+	metric := func(metricName string, value float64, unit string, meta map[string]interface{}) Metric {
+		return Metric{MetricType: "jvm", MetricName: metricName, Value: value, Unit: unit, Metadata: meta, Timestamp: now}
+	}
+	metrics := []Metric{}
+
+	var heap, nonHeap jvmMemoryUsage
+	if err := json.Unmarshal(responses[0].Value, &heap); err != nil {
+		return nil, fmt.Errorf("heap usage: %w", err)
+	}
+	if err := json.Unmarshal(responses[1].Value, &nonHeap); err != nil {
+		return nil, fmt.Errorf("non-heap usage: %w", err)
+	}
+	metrics = append(metrics,
+		metric("heap_used", heap.Used, "bytes", metadata),
+		metric("heap_committed", heap.Committed, "bytes", metadata),
+		metric("nonheap_used", nonHeap.Used, "bytes", metadata),
+	)
+	// max is -1 when the heap is unbounded
+	if heap.Max > 0 {
+		metrics = append(metrics,
+			metric("heap_max", heap.Max, "bytes", metadata),
+			metric("heap_used_percent", heap.Used/heap.Max*100, "percent", metadata),
+		)
+	}
+
+	// Keyed by MBean name, e.g. "java.lang:name=G1 Young Generation,type=GarbageCollector"
+	var collectors map[string]struct {
+		CollectionCount float64 `json:"CollectionCount"`
+		CollectionTime  float64 `json:"CollectionTime"`
+	}
+	if err := json.Unmarshal(responses[2].Value, &collectors); err != nil {
+		return nil, fmt.Errorf("garbage collectors: %w", err)
+	}
+	for mbean, gc := range collectors {
+		gcName := mbean
+		for _, part := range strings.Split(strings.TrimPrefix(mbean, "java.lang:"), ",") {
+			if value, ok := strings.CutPrefix(part, "name="); ok {
+				gcName = value
+			}
+		}
+		gcMetadata := map[string]interface{}{"jvm": name, "collector": gcName}
+		metrics = append(metrics,
+			metric("gc_collections", gc.CollectionCount, "count", gcMetadata),
+			metric("gc_time", gc.CollectionTime/1000, "seconds", gcMetadata),
+		)
+	}
+
+	var threads struct {
+		ThreadCount       float64 `json:"ThreadCount"`
+		DaemonThreadCount float64 `json:"DaemonThreadCount"`
+		PeakThreadCount   float64 `json:"PeakThreadCount"`
+	}
+	if err := json.Unmarshal(responses[3].Value, &threads); err != nil {
+		return nil, fmt.Errorf("threads: %w", err)
+	}
+	metrics = append(metrics,
+		metric("threads", threads.ThreadCount, "count", metadata),
+		metric("daemon_threads", threads.DaemonThreadCount, "count", metadata),
+		metric("peak_threads", threads.PeakThreadCount, "count", metadata),
+	)
+	return metrics, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	keepalivedPidFile = "/run/keepalived.pid"
+	// keepalivedDataFile is where keepalived dumps its state on SIGUSR1
+	keepalivedDataFile = "/tmp/keepalived.data"
+)
+
+// loadBalancerState remembers VIP ownership and VRRP states so failovers are
+// emitted as events once, when they happen.
+var loadBalancerState = struct {
+	sync.Mutex
+	vips  map[string]bool
+	vrrp  map[string]string
+	known bool
+}{}
+
+// collectLoadBalancer reports HAProxy backend health from the stats sockets
+// in haproxy_sockets, whether this node holds each address in vips, and the
+// keepalived VRRP instance states when keepalived is enabled.
+func collectLoadBalancer() ([]Metric, error) {
+	cfg := currentConfig()
+	if len(cfg.HAProxySockets) == 0 && len(cfg.VIPs) == 0 && !cfg.Keepalived {
+		return nil, nil
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	var errs []string
+
+	for _, socket := range cfg.HAProxySockets {
+		collected, err := collectHAProxy(socket, now)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("haproxy %s: %v", socket, err))
+		}
+		metrics = append(metrics, collected...)
+	}
+
+	vips := map[string]bool{}
+	if len(cfg.VIPs) > 0 {
+		local, err := localAddresses()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("vips: %v", err))
+		} else {
+			for _, vip := range cfg.VIPs {
+				held := local[vip]
+				vips[vip] = held
+				value := 0.0
+				if held {
+					value = 1
+				}
+				metrics = append(metrics, Metric{
+					MetricType: "vrrp",
+					MetricName: "vip_held",
+					Value:      value,
+					Unit:       "bool",
+					Metadata:   map[string]interface{}{"vip": vip},
+					Timestamp:  now,
+				})
+			}
+		}
+	}
+
+	var vrrp map[string]string
+	if cfg.Keepalived {
+		var err error
+		vrrp, err = keepalivedStates()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("keepalived: %v", err))
+		}
+		for instance, state := range vrrp {
+			value := 0.0
+			if state == "MASTER" {
+				value = 1
+			}
+			metrics = append(metrics, Metric{
+				MetricType: "vrrp",
+				MetricName: "vrrp_master",
+				Value:      value,
+				Unit:       "bool",
+				Metadata:   map[string]interface{}{"instance": instance, "state": state},
+				Timestamp:  now,
+			})
+		}
+	}
+
+	emitLoadBalancerChanges(vips, vrrp)
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// collectHAProxy runs "show stat" on a stats socket ("unix:/run/haproxy/admin.sock"
+// or "127.0.0.1:9999") and reports, per backend, how many servers are up and
+// down and whether the backend itself is up.
+func collectHAProxy(socket string, now time.Time) ([]Metric, error) {
+	network, address := "tcp", socket
+	if path, ok := strings.CutPrefix(socket, "unix:"); ok {
+		network, address = "unix", path
+	}
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("show stat\n")); err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(io.LimitReader(conn, 16*1024*1024))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	column := map[string]int{}
+	for i, name := range header {
+		column[strings.TrimPrefix(strings.TrimSpace(name), "# ")] = i
+	}
+	for _, name := range []string{"pxname", "svname", "status"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("stats output has no %s column", name)
+		}
+	}
+
+	type backendHealth struct {
+		up, down, maint float64
+		backendUp       float64
+		hasBackend      bool
+	}
+	backends := map[string]*backendHealth{}
+	var order []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) <= column["status"] {
+			continue
+		}
+		proxy, server, status := record[column["pxname"]], record[column["svname"]], record[column["status"]]
+		if server == "FRONTEND" {
+			continue
+		}
+		health, ok := backends[proxy]
+		if !ok {
+			health = &backendHealth{}
+			backends[proxy] = health
+			order = append(order, proxy)
+		}
+		// Statuses look like "UP", "DOWN", "UP 1/3" (going down), "NOLB",
+		// "MAINT", "MAINT (via ...)" or "no check"
+		word, _, _ := strings.Cut(status, " ")
+		if server == "BACKEND" {
+			health.hasBackend = true
+			if word == "UP" {
+				health.backendUp = 1
+			}
+			continue
+		}
+		switch word {
+		case "UP", "NOLB", "no":
+			health.up++
+		case "MAINT", "DRAIN":
+			health.maint++
+		default:
+			health.down++
+		}
+	}
+
+	metrics := []Metric{}
+	for _, proxy := range order {
+		health := backends[proxy]
+		if !health.hasBackend {
+			continue
+		}
+		metadata := map[string]interface{}{"backend": proxy, "socket": socket}
+		metrics = append(metrics,
+			Metric{MetricType: "haproxy", MetricName: "backend_up", Value: health.backendUp, Unit: "bool", Metadata: metadata, Timestamp: now},
+			Metric{MetricType: "haproxy", MetricName: "servers_up", Value: health.up, Unit: "count", Metadata: metadata, Timestamp: now},
+			Metric{MetricType: "haproxy", MetricName: "servers_down", Value: health.down, Unit: "count", Metadata: metadata, Timestamp: now},
+			Metric{MetricType: "haproxy", MetricName: "servers_maint", Value: health.maint, Unit: "count", Metadata: metadata, Timestamp: now},
+		)
+	}
+	return metrics, nil
+}
+
+func localAddresses() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	local := map[string]bool{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	return local, nil
+}
+
+// keepalivedStates asks keepalived to dump its state (SIGUSR1) and returns
+// the state of every VRRP instance, e.g. VI_1=MASTER. It returns nil when
+// keepalived is not running.
+func keepalivedStates() (map[string]string, error) {
+	data, err := os.ReadFile(keepalivedPidFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("pid file %s: %w", keepalivedPidFile, err)
+	}
+
+	var previous time.Time
+	if info, err := os.Stat(keepalivedDataFile); err == nil {
+		previous = info.ModTime()
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+		if err == syscall.ESRCH {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// keepalived writes the dump asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		info, err := os.Stat(keepalivedDataFile)
+		if err == nil && info.ModTime().After(previous) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no dump in %s after SIGUSR1", keepalivedDataFile)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	file, err := os.Open(keepalivedDataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseKeepalivedData(file)
+}
+
+// parseKeepalivedData reads instance states from a keepalived data dump:
+//
+//	VRRP Instance = VI_1
+//	  State = MASTER
+func parseKeepalivedData(r io.Reader) (map[string]string, error) {
+	states := map[string]string{}
+	instance := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " = ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "VRRP Instance":
+			instance = value
+		case "State":
+			if instance != "" {
+				states[instance] = value
+				instance = ""
+			}
+		}
+	}
+	return states, scanner.Err()
+}
+
+func emitLoadBalancerChanges(vips map[string]bool, vrrp map[string]string) {
+	loadBalancerState.Lock()
+	previousVIPs, previousVRRP, known := loadBalancerState.vips, loadBalancerState.vrrp, loadBalancerState.known
+	loadBalancerState.vips, loadBalancerState.vrrp, loadBalancerState.known = vips, vrrp, true
+	loadBalancerState.Unlock()
+	if !known {
+		return
+	}
+
+	for vip, held := range vips {
+		was, ok := previousVIPs[vip]
+		if !ok || was == held {
+			continue
+		}
+		eventType, message := "vip_released", fmt.Sprintf("this node released VIP %s", vip)
+		if held {
+			eventType, message = "vip_acquired", fmt.Sprintf("this node took over VIP %s", vip)
+		}
+		emitEvent(Event{
+			Type:     eventType,
+			Source:   "loadbalancer",
+			Severity: "warning",
+			Message:  message,
+			Fields:   map[string]interface{}{"vip": vip},
+		})
+	}
+	for instance, state := range vrrp {
+		was, ok := previousVRRP[instance]
+		if !ok || was == state {
+			continue
+		}
+		emitEvent(Event{
+			Type:     "vrrp_state_changed",
+			Source:   "loadbalancer",
+			Severity: "warning",
+			Message:  fmt.Sprintf("VRRP instance %s changed from %s to %s", instance, was, state),
+			Fields:   map[string]interface{}{"instance": instance, "from": was, "to": state},
+		})
+	}
+}
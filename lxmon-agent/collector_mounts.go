@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// mountState remembers the options each mountpoint had in the previous cycle.
+var mountState = struct {
+	sync.Mutex
+	options map[string]string
+}{options: map[string]string{}}
+
+// mountOptions returns the sorted, comma-joined options and whether the
+// filesystem is mounted read-only.
+func mountOptions(opts []string) (string, bool) {
+	sorted := append([]string(nil), opts...)
+	sort.Strings(sorted)
+	readOnly := false
+	for _, opt := range sorted {
+		if opt == "ro" {
+			readOnly = true
+		}
+	}
+	return strings.Join(sorted, ","), readOnly
+}
+
+// trackMountOptions emits an event when a mountpoint's options differ from
+// the previous cycle, e.g. a filesystem remounted read-only after I/O errors
+// or a remount that dropped nodev.
+func trackMountOptions(mountpoint, device, options string, readOnly bool) {
+	mountState.Lock()
+	previous, seen := mountState.options[mountpoint]
+	mountState.options[mountpoint] = options
+	mountState.Unlock()
+
+	if !seen || previous == options {
+		return
+	}
+	severity := "info"
+	if readOnly {
+		severity = "warning"
+	}
+	emitEvent(Event{
+		Type:     "mount_options_changed",
+		Source:   "disk",
+		Severity: severity,
+		Message:  fmt.Sprintf("%s options changed from %s to %s", mountpoint, previous, options),
+		Fields: map[string]interface{}{
+			"mountpoint": mountpoint,
+			"device":     device,
+			"previous":   previous,
+			"options":    options,
+			"read_only":  readOnly,
+		},
+	})
+}
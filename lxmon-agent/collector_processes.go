@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The top_processes heaviest processes by CPU are reported with what is
+// needed to tell what they are without logging in: the command line, with
+// credentials redacted, and the cgroup, systemd unit and container they run
+// in.
+
+// topProcesses is shared across cycles so per-process CPU is measured over
+// the collection interval.
+var topProcesses = newProcessSampler()
+
+// processCmdlineMax caps the command line sent, in bytes.
+const processCmdlineMax = 512
+
+var (
+	// processSecretArg matches the names of options and variables holding
+	// credentials, as in --password, PGPASSWORD= or api_key=.
+	processSecretArg = regexp.MustCompile(`(?i)(pass(word|wd)?|pwd|secret|token|api[-_]?key|credential|auth)`)
+	// processSecretHeader matches an HTTP header given as an argument, as
+	// in curl -H "Authorization: Bearer ...".
+	processSecretHeader = regexp.MustCompile(`^(-H|--header=)?([A-Za-z0-9_-]+):\s*\S`)
+	// containerIDPattern matches a container ID in a cgroup path, as in
+	// /docker/<id> or cri-containerd-<id>.scope.
+	containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+// collectProcesses reports the top_processes heaviest processes by CPU (ties
+// broken by memory).
+func collectProcesses() ([]Metric, error) {
+	cfg := currentConfig()
+	if cfg.TopProcesses <= 0 {
+		return nil, nil
+	}
+
+	processes := topProcesses.sample()
+	sort.Slice(processes, func(i, j int) bool {
+		if processes[i].CPU != processes[j].CPU {
+			return processes[i].CPU > processes[j].CPU
+		}
+		return processes[i].RSS > processes[j].RSS
+	})
+	if len(processes) > cfg.TopProcesses {
+		processes = processes[:cfg.TopProcesses]
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	for rank, p := range processes {
+		metadata := map[string]interface{}{"pid": p.PID, "process": p.Name, "user": p.User, "rank": rank + 1}
+		// Read for the reported processes only: a process that exited
+		// meanwhile is still reported, without them
+		if cmdline := processCmdline(p.PID); cmdline != "" {
+			metadata["cmdline"] = cmdline
+		}
+		if cgroup := processCgroup(p.PID); cgroup != "" {
+			metadata["cgroup"] = cgroup
+			if unit := systemdUnit(cgroup); unit != "" {
+				metadata["unit"] = unit
+			}
+			if id := containerIDPattern.FindString(cgroup); id != "" {
+				metadata["container_id"] = id
+			}
+		}
+		metrics = append(metrics, Metric{
+			MetricType: "process",
+			MetricName: "cpu_percent",
+			Value:      p.CPU,
+			Unit:       "percent",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+		metrics = append(metrics, Metric{
+			MetricType: "process",
+			MetricName: "memory_rss",
+			Value:      float64(p.RSS),
+			Unit:       "bytes",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+	}
+	return metrics, nil
+}
+
+// processCmdline returns a process's command line with its credentials
+// redacted, or "" for kernel threads and processes that are gone.
+func processCmdline(pid int32) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/cmdline")
+	if err != nil {
+		return ""
+	}
+	return sanitizeCmdline(strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"))
+}
+
+// processSecretOptions are the options of common tools whose value is a
+// credential although their name does not say so: true if the value may be a
+// separate argument (redis-cli -a pw) as well as attached (-apw). mysql's -p
+// only takes an attached password; alone it prompts, and the next argument
+// is the database.
+var processSecretOptions = map[string]map[string]bool{
+	"mysql":         {"-p": false},
+	"mysqldump":     {"-p": false},
+	"mysqladmin":    {"-p": false},
+	"mysqlcheck":    {"-p": false},
+	"mysqlimport":   {"-p": false},
+	"mariadb":       {"-p": false},
+	"mariadb-dump":  {"-p": false},
+	"curl":          {"-u": true, "-U": true, "--user": true, "--proxy-user": true},
+	"redis-cli":     {"-a": true},
+	"sshpass":       {"-p": true},
+	"mongo":         {"-p": true},
+	"mongosh":       {"-p": true},
+	"mongodump":     {"-p": true},
+	"mongorestore":  {"-p": true},
+	"ldapsearch":    {"-w": true},
+	"ldapmodify":    {"-w": true},
+	"ldapadd":       {"-w": true},
+	"rabbitmqadmin": {"-p": true},
+}
+
+// secretOption reports whether arg is a credential option of the tool: with
+// its value attached (-pSECRET, --user=a:b), or to be taken from the next
+// argument.
+func secretOption(options map[string]bool, arg string) (attached string, next bool) {
+	for option, separate := range options {
+		switch {
+		case arg == option:
+			return "", separate
+		case strings.HasPrefix(option, "--") && strings.HasPrefix(arg, option+"="):
+			return option + "=", false
+		case !strings.HasPrefix(option, "--") && strings.HasPrefix(arg, option) && len(arg) > len(option):
+			return option, false
+		}
+	}
+	return "", false
+}
+
+// sanitizeCmdline joins arguments into a command line, redacting the values
+// of options and variables named like credentials, the credential options of
+// common tools (processSecretOptions), credential headers and the passwords
+// of URLs, and replacing control characters. The result is cut at
+// processCmdlineMax bytes.
+func sanitizeCmdline(args []string) string {
+	sanitized := make([]string, 0, len(args))
+	var options map[string]bool
+	if len(args) > 0 {
+		options = processSecretOptions[path.Base(args[0])]
+	}
+	redactNext := false
+	for i, arg := range args {
+		attached, next := "", false
+		if i > 0 && !redactNext {
+			attached, next = secretOption(options, arg)
+		}
+		header := processSecretHeader.FindStringSubmatch(arg)
+		switch {
+		case redactNext:
+			arg = "REDACTED"
+			redactNext = false
+		case attached != "":
+			// mysql -pSECRET, curl --user=a:b
+			arg = attached + "REDACTED"
+		case next:
+			// redis-cli -a SECRET
+			redactNext = true
+		case i > 0 && header != nil && processSecretArg.MatchString(header[2]):
+			// curl -H "Authorization: Bearer ..."
+			arg = header[1] + header[2] + ": REDACTED"
+		case i > 0 && strings.Contains(arg, "="):
+			// --password=x, PGPASSWORD=x
+			name, _, _ := strings.Cut(arg, "=")
+			if processSecretArg.MatchString(name) {
+				arg = name + "=REDACTED"
+			}
+		case i > 0 && strings.HasPrefix(arg, "-") && processSecretArg.MatchString(arg):
+			// --password x
+			redactNext = true
+		}
+		if strings.Contains(arg, "://") && strings.Contains(arg, "@") {
+			if u, err := url.Parse(arg); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), "REDACTED")
+					arg = u.String()
+				}
+			}
+		}
+		sanitized = append(sanitized, arg)
+	}
+
+	cmdline := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, strings.Join(sanitized, " "))
+	if len(cmdline) > processCmdlineMax {
+		cmdline = strings.ToValidUTF8(cmdline[:processCmdlineMax], "")
+	}
+	return cmdline
+}
+
+// processCgroup returns a process's cgroup: its path in the unified
+// hierarchy, or in systemd's or another controller's under cgroup v1. The
+// root cgroup says nothing and is left out.
+func processCgroup(pid int32) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	unified, systemd, other := "", "", ""
+	for _, line := range strings.Split(string(data), "\n") {
+		hierarchy := strings.SplitN(line, ":", 3)
+		if len(hierarchy) != 3 || hierarchy[2] == "/" {
+			continue
+		}
+		switch {
+		case hierarchy[0] == "0" && hierarchy[1] == "":
+			unified = hierarchy[2]
+		case hierarchy[1] == "name=systemd":
+			systemd = hierarchy[2]
+		case other == "":
+			other = hierarchy[2]
+		}
+	}
+	for _, path := range []string{unified, systemd, other} {
+		if path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// systemdUnit returns the systemd unit a cgroup belongs to: its innermost
+// service or scope, as in system.slice/nginx.service.
+func systemdUnit(cgroup string) string {
+	parts := strings.Split(cgroup, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(parts[i], ".service") || strings.HasSuffix(parts[i], ".scope") {
+			return parts[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// TestSanitizeCmdline checks the credential forms of common tools.
+func TestSanitizeCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/usr/bin/mysql", "-uroot", "-pSECRET", "db"}, "/usr/bin/mysql -uroot -pREDACTED db"},
+		// Alone, -p prompts and the next argument is the database
+		{[]string{"mysql", "-p", "db"}, "mysql -p db"},
+		{[]string{"curl", "-u", "user:pass", "https://example.com"}, "curl -u REDACTED https://example.com"},
+		{[]string{"curl", "-uuser:pass", "https://example.com"}, "curl -uREDACTED https://example.com"},
+		{[]string{"curl", "--user=user:pass", "https://example.com"}, "curl --user=REDACTED https://example.com"},
+		{[]string{"curl", "-H", "Authorization: Bearer abc.def", "https://example.com"}, "curl -H Authorization: REDACTED https://example.com"},
+		{[]string{"curl", "--header=X-Api-Key: abc", "https://example.com"}, "curl --header=X-Api-Key: REDACTED https://example.com"},
+		{[]string{"curl", "-H", "Accept: application/json", "https://example.com"}, "curl -H Accept: application/json https://example.com"},
+		{[]string{"redis-cli", "-a", "pw", "-h", "cache"}, "redis-cli -a REDACTED -h cache"},
+		{[]string{"redis-cli", "-apw"}, "redis-cli -aREDACTED"},
+		{[]string{"sshpass", "-p", "pw", "ssh", "host"}, "sshpass -p REDACTED ssh host"},
+		{[]string{"sshpass", "-ppw", "ssh", "host"}, "sshpass -pREDACTED ssh host"},
+		// Options of other tools are left alone
+		{[]string{"tar", "-p", "-a", "x.tar"}, "tar -p -a x.tar"},
+		{[]string{"app", "--password", "hunter2", "API_KEY=k"}, "app --password REDACTED API_KEY=REDACTED"},
+	} {
+		if got := sanitizeCmdline(tc.args); got != tc.want {
+			t.Errorf("sanitizeCmdline(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type rabbitQueue struct {
+	Name                   string  `json:"name"`
+	VHost                  string  `json:"vhost"`
+	Messages               float64 `json:"messages"`
+	MessagesReady          float64 `json:"messages_ready"`
+	MessagesUnacknowledged float64 `json:"messages_unacknowledged"`
+	Consumers              float64 `json:"consumers"`
+}
+
+// collectRabbitMQ reports queue depths and connection counts from the
+// RabbitMQ management API at rabbitmq, for the vhosts in rabbitmq_vhosts
+// (all vhosts when empty).
+func collectRabbitMQ() ([]Metric, error) {
+	cfg := currentConfig()
+	if cfg.RabbitMQ == "" {
+		return nil, nil
+	}
+	baseURL := strings.TrimSuffix(cfg.RabbitMQ, "/")
+
+	vhosts := cfg.RabbitMQVHosts
+	if len(vhosts) == 0 {
+		var all []struct {
+			Name string `json:"name"`
+		}
+		if err := fetchJSON(baseURL+"/api/vhosts?columns=name", &all); err != nil {
+			return nil, fmt.Errorf("%s: vhosts: %w", redactURL(baseURL), err)
+		}
+		for _, vhost := range all {
+			vhosts = append(vhosts, vhost.Name)
+		}
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	var errs []string
+	for _, vhost := range vhosts {
+		var queues []rabbitQueue
+		err := fetchJSON(baseURL+"/api/queues/"+url.PathEscape(vhost)+
+			"?columns=name,vhost,messages,messages_ready,messages_unacknowledged,consumers", &queues)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("vhost %s: %v", vhost, err))
+			continue
+		}
+		for _, queue := range queues {
+			metadata := map[string]interface{}{"vhost": queue.VHost, "queue": queue.Name}
+			for name, value := range map[string]float64{
+				"queue_messages":       queue.Messages,
+				"queue_messages_ready": queue.MessagesReady,
+				"queue_unacked":        queue.MessagesUnacknowledged,
+				"queue_consumers":      queue.Consumers,
+			} {
+				metrics = append(metrics, Metric{MetricType: "rabbitmq", MetricName: name, Value: value, Unit: "count", Metadata: metadata, Timestamp: now})
+			}
+		}
+	}
+
+	var connections []struct {
+		VHost string `json:"vhost"`
+	}
+	if err := fetchJSON(baseURL+"/api/connections?columns=vhost", &connections); err != nil {
+		errs = append(errs, fmt.Sprintf("connections: %v", err))
+	} else {
+		perVHost := map[string]float64{}
+		for _, vhost := range vhosts {
+			perVHost[vhost] = 0
+		}
+		for _, connection := range connections {
+			if _, ok := perVHost[connection.VHost]; ok {
+				perVHost[connection.VHost]++
+			}
+		}
+		for vhost, count := range perVHost {
+			metrics = append(metrics, Metric{
+				MetricType: "rabbitmq",
+				MetricName: "connections",
+				Value:      count,
+				Unit:       "count",
+				Metadata:   map[string]interface{}{"vhost": vhost},
+				Timestamp:  now,
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s: %s", redactURL(baseURL), strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runtimeCheckInterval limits how often the runtimes are detected. Versions
+// change with package upgrades, not between cycles, and detecting java can
+// start a JVM.
+const runtimeCheckInterval = time.Hour
+
+// installedRuntime is a runtime found on the host.
+type installedRuntime struct {
+	Name    string
+	Version string
+	Path    string
+}
+
+var runtimeState = struct {
+	sync.Mutex
+	checkedAt time.Time
+}{}
+
+var (
+	// runtimeVersionPattern matches a version such as 3.0.2, 1.1.1w or
+	// 17.0.9+9.
+	runtimeVersionPattern = regexp.MustCompile(`\d+(\.\d+)+[a-z]?`)
+	opensslLibraryPattern = regexp.MustCompile(`Library: OpenSSL (\S+)`)
+	javaReleasePattern    = regexp.MustCompile(`(?m)^JAVA_VERSION="([^"]+)"`)
+)
+
+// runtimeDetectors find the version of each runtime reported, from its
+// command line tool. They return "" when the runtime is not installed.
+var runtimeDetectors = []struct {
+	Name   string
+	Detect func() (version, path string)
+}{
+	{"openssl", detectOpenSSL},
+	{"glibc", detectGlibc},
+	{"musl", detectMusl},
+	{"node", func() (string, string) { return detectVersionFlag("node", "--version") }},
+	{"python", func() (string, string) { return detectVersionFlag("python3", "--version") }},
+	{"java", detectJava},
+}
+
+// collectRuntimes reports the versions of the runtimes installed on the host
+// (openssl, glibc or musl, node, python, java), as runtime.installed with
+// the version in the metadata, so vulnerable versions can be found across the
+// fleet. They are sent when detected, once per runtimeCheckInterval, rather
+// than repeated every cycle.
+func collectRuntimes() ([]Metric, error) {
+	runtimeState.Lock()
+	checkedAt := runtimeState.checkedAt
+	runtimeState.Unlock()
+	if !checkedAt.IsZero() && time.Since(checkedAt) < runtimeCheckInterval {
+		return nil, nil
+	}
+	runtimes := detectRuntimes()
+	runtimeState.Lock()
+	runtimeState.checkedAt = time.Now()
+	runtimeState.Unlock()
+
+	now := time.Now()
+	metrics := make([]Metric, 0, len(runtimes))
+	for _, runtime := range runtimes {
+		metrics = append(metrics, Metric{
+			MetricType: "runtime",
+			MetricName: "installed",
+			Value:      1,
+			Unit:       "bool",
+			Metadata:   map[string]interface{}{"runtime": runtime.Name, "version": runtime.Version, "path": runtime.Path},
+			Timestamp:  now,
+		})
+	}
+	return metrics, nil
+}
+
+func detectRuntimes() []installedRuntime {
+	var runtimes []installedRuntime
+	for _, detector := range runtimeDetectors {
+		if version, path := detector.Detect(); version != "" {
+			runtimes = append(runtimes, installedRuntime{Name: detector.Name, Version: version, Path: path})
+		}
+	}
+	return runtimes
+}
+
+// runtimeOutput runs a runtime's tool and returns stdout and stderr
+// together, as several print their version on stderr.
+func runtimeOutput(name string, args ...string) (output, path string) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	return string(out), path
+}
+
+// detectVersionFlag returns the first version in the output of a tool's
+// version flag, as in "v18.19.0" or "Python 3.10.12".
+func detectVersionFlag(name string, args ...string) (string, string) {
+	out, path := runtimeOutput(name, args...)
+	return runtimeVersionPattern.FindString(out), path
+}
+
+// detectOpenSSL prefers the version of the library, which the services use,
+// over that of the openssl tool when they differ.
+func detectOpenSSL() (string, string) {
+	out, path := runtimeOutput("openssl", "version")
+	if m := opensslLibraryPattern.FindStringSubmatch(out); m != nil {
+		return m[1], path
+	}
+	// OpenSSL 1.1.1w  11 Sep 2023
+	if fields := strings.Fields(out); len(fields) >= 2 && fields[0] == "OpenSSL" {
+		return fields[1], path
+	}
+	return "", ""
+}
+
+// detectGlibc reads the version from ldd, as in
+// "ldd (Ubuntu GLIBC 2.35-0ubuntu3.4) 2.35".
+func detectGlibc() (string, string) {
+	out, path := runtimeOutput("ldd", "--version")
+	first, _, _ := strings.Cut(out, "\n")
+	if !strings.Contains(first, "GLIBC") && !strings.Contains(first, "GNU libc") {
+		return "", ""
+	}
+	fields := strings.Fields(first)
+	return runtimeVersionPattern.FindString(fields[len(fields)-1]), path
+}
+
+// detectMusl reads the version from musl's ldd, which prints
+// "musl libc (x86_64)\nVersion 1.2.4".
+func detectMusl() (string, string) {
+	out, path := runtimeOutput("ldd", "--version")
+	if !strings.HasPrefix(out, "musl libc") {
+		return "", ""
+	}
+	_, version, ok := strings.Cut(out, "Version ")
+	if !ok {
+		return "", ""
+	}
+	return runtimeVersionPattern.FindString(version), path
+}
+
+// detectJava reads the release file of the JDK or JRE java belongs to, and
+// only runs java -version, which starts a JVM, without one.
+func detectJava() (string, string) {
+	path, err := exec.LookPath("java")
+	if err != nil {
+		return "", ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		// <home>/bin/java
+		release, err := os.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(resolved)), "release"))
+		if m := javaReleasePattern.FindSubmatch(release); err == nil && m != nil {
+			return string(m[1]), resolved
+		}
+	}
+	// openjdk version "17.0.9" 2023-10-17
+	out, _ := runtimeOutput("java", "-version")
+	if _, rest, ok := strings.Cut(out, `version "`); ok {
+		version, _, _ := strings.Cut(rest, `"`)
+		return version, path
+	}
+	return "", ""
+}
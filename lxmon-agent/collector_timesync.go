@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 (NTP era 0)
+// and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// timeSyncStatus is what we learn from the local time synchronization daemon.
+type timeSyncStatus struct {
+	Source       string
+	Synchronized bool
+	Stratum      float64
+	HasStratum   bool
+	Offset       float64
+	HasOffset    bool
+	LastSync     time.Time
+}
+
+// collectTimeSync reports the health of chronyd, ntpd or systemd-timesyncd,
+// whichever is present. Hosts without any of them report nothing.
+func collectTimeSync() ([]Metric, error) {
+	var status *timeSyncStatus
+	var err error
+	switch {
+	case commandAvailable("chronyc"):
+		status, err = chronyStatus()
+	case commandAvailable("ntpq"):
+		status, err = ntpqStatus()
+	case commandAvailable("timedatectl"):
+		status, err = timedatectlStatus()
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	metadata := map[string]interface{}{"source": status.Source}
+	synchronized := 0.0
+	if status.Synchronized {
+		synchronized = 1
+	}
+	metrics := []Metric{{
+		MetricType: "timesync",
+		MetricName: "synchronized",
+		Value:      synchronized,
+		Unit:       "bool",
+		Metadata:   metadata,
+		Timestamp:  now,
+	}}
+	if status.HasStratum {
+		metrics = append(metrics, Metric{
+			MetricType: "timesync",
+			MetricName: "stratum",
+			Value:      status.Stratum,
+			Unit:       "stratum",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+	}
+	if status.HasOffset {
+		metrics = append(metrics, Metric{
+			MetricType: "timesync",
+			MetricName: "offset",
+			Value:      status.Offset,
+			Unit:       "seconds",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+	}
+	if !status.LastSync.IsZero() {
+		metrics = append(metrics, Metric{
+			MetricType: "timesync",
+			MetricName: "last_sync_age",
+			Value:      now.Sub(status.LastSync).Seconds(),
+			Unit:       "seconds",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+	}
+	return metrics, nil
+}
+
+// chronyStatus parses `chronyc -c tracking`:
+// refid,name,stratum,ref_time,system_offset,last_offset,...,leap_status
+func chronyStatus() (*timeSyncStatus, error) {
+	out, err := commandOutput("chronyc", "-c", "tracking")
+	if err != nil {
+		return nil, fmt.Errorf("chronyc tracking: %w", err)
+	}
+	fields := strings.Split(strings.TrimSpace(out), ",")
+	if len(fields) < 14 {
+		return nil, fmt.Errorf("unexpected chronyc output: %q", out)
+	}
+
+	status := &timeSyncStatus{Source: "chrony"}
+	if stratum, err := strconv.ParseFloat(fields[2], 64); err == nil {
+		status.Stratum, status.HasStratum = stratum, true
+	}
+	if refTime, err := strconv.ParseFloat(fields[3], 64); err == nil && refTime > 0 {
+		status.LastSync = time.Unix(0, int64(refTime*float64(time.Second)))
+	}
+	if offset, err := strconv.ParseFloat(fields[4], 64); err == nil {
+		status.Offset, status.HasOffset = offset, true
+	}
+	leap := fields[len(fields)-1]
+	status.Synchronized = leap != "Not synchronised" && status.Stratum > 0 && status.Stratum < 16
+	return status, nil
+}
+
+// ntpqStatus parses the system variables printed by `ntpq -c rv`.
+func ntpqStatus() (*timeSyncStatus, error) {
+	out, err := commandOutput("ntpq", "-c", "rv 0 leap,stratum,offset,reftime")
+	if err != nil {
+		return nil, fmt.Errorf("ntpq rv: %w", err)
+	}
+
+	vars := map[string]string{}
+	for _, field := range strings.Split(strings.ReplaceAll(out, "\n", ","), ",") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok {
+			vars[key] = strings.TrimSpace(value)
+		}
+	}
+
+	status := &timeSyncStatus{Source: "ntpd"}
+	if stratum, err := strconv.ParseFloat(vars["stratum"], 64); err == nil {
+		status.Stratum, status.HasStratum = stratum, true
+	}
+	if offset, err := strconv.ParseFloat(vars["offset"], 64); err == nil {
+		// ntpq reports the offset in milliseconds
+		status.Offset, status.HasOffset = offset/1000, true
+	}
+	// reftime looks like "e3a1b2c3.12345678  Mon, Jan  1 2024 ..."
+	if ref := strings.Fields(vars["reftime"]); len(ref) > 0 {
+		if seconds, err := strconv.ParseUint(strings.SplitN(ref[0], ".", 2)[0], 16, 64); err == nil && seconds > ntpEpochOffset {
+			status.LastSync = time.Unix(int64(seconds-ntpEpochOffset), 0)
+		}
+	}
+	leap := vars["leap"]
+	status.Synchronized = leap != "" && leap != "11" && leap != "3" && status.Stratum > 0 && status.Stratum < 16
+	return status, nil
+}
+
+// timedatectlStatus falls back to systemd's view, which only knows whether
+// the clock is synchronized.
+func timedatectlStatus() (*timeSyncStatus, error) {
+	out, err := commandOutput("timedatectl", "show", "--property=NTPSynchronized", "--value")
+	if err != nil {
+		return nil, fmt.Errorf("timedatectl show: %w", err)
+	}
+	return &timeSyncStatus{
+		Source:       "timedatectl",
+		Synchronized: strings.TrimSpace(out) == "yes",
+	}, nil
+}
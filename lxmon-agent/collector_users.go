@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// userProcesses is shared across cycles so per-user CPU is measured over the
+// collection interval.
+var userProcesses = newProcessSampler()
+
+type userUsage struct {
+	User      string
+	CPU       float64
+	RSS       uint64
+	Processes int
+}
+
+// collectUsers aggregates process CPU and resident memory by user and reports
+// the top_users heaviest users by CPU (ties broken by memory).
+func collectUsers() ([]Metric, error) {
+	cfg := currentConfig()
+	if cfg.TopUsers <= 0 {
+		return nil, nil
+	}
+
+	byUser := map[string]*userUsage{}
+	for _, p := range userProcesses.sample() {
+		user := p.User
+		if user == "" {
+			user = "unknown"
+		}
+		usage, ok := byUser[user]
+		if !ok {
+			usage = &userUsage{User: user}
+			byUser[user] = usage
+		}
+		usage.CPU += p.CPU
+		usage.RSS += p.RSS
+		usage.Processes++
+	}
+
+	users := make([]*userUsage, 0, len(byUser))
+	for _, usage := range byUser {
+		users = append(users, usage)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CPU != users[j].CPU {
+			return users[i].CPU > users[j].CPU
+		}
+		return users[i].RSS > users[j].RSS
+	})
+	if len(users) > cfg.TopUsers {
+		users = users[:cfg.TopUsers]
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	for rank, usage := range users {
+		metadata := map[string]interface{}{"user": usage.User, "rank": rank + 1}
+		metrics = append(metrics, Metric{
+			MetricType: "user",
+			MetricName: "cpu_percent",
+			Value:      usage.CPU,
+			Unit:       "percent",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+		metrics = append(metrics, Metric{
+			MetricType: "user",
+			MetricName: "memory_rss",
+			Value:      float64(usage.RSS),
+			Unit:       "bytes",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+		metrics = append(metrics, Metric{
+			MetricType: "user",
+			MetricName: "process_count",
+			Value:      float64(usage.Processes),
+			Unit:       "count",
+			Metadata:   metadata,
+			Timestamp:  now,
+		})
+	}
+	return metrics, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// collectorRun is the outcome of a collector's most recent run.
+type collectorRun struct {
+	At        time.Time
+	Duration  time.Duration
+	Metrics   int
+	Err       error
+	LastErr   error
+	LastErrAt time.Time
+}
+
+var collectorRuns = struct {
+	sync.Mutex
+	runs map[string]collectorRun
+}{runs: map[string]collectorRun{}}
+
+// CollectorStatus describes one collector for GET /local/collectors.
+type CollectorStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// ok, failing, idle (ran but found nothing to collect on this host),
+	// disabled or pending (not run yet)
+	State               string     `json:"state"`
+	Reason              string     `json:"reason,omitempty"`
+	Interval            string     `json:"interval"`
+	LastRun             *time.Time `json:"last_run,omitempty"`
+	LastDurationSeconds float64    `json:"last_duration_seconds"`
+	LastMetrics         int        `json:"last_metrics"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+}
+
+// runCollector runs a collector and records its duration and outcome. For
+// collectors that had something to collect it adds the agent's
+// collector_duration and collector_up metrics, so the server sees
+// per-collector health too.
+func runCollector(collector Collector) ([]Metric, error) {
+	start := time.Now()
+	collected, err := collector.Collect()
+	duration := time.Since(start)
+
+	collectorRuns.Lock()
+	run := collectorRuns.runs[collector.Name]
+	run.At, run.Duration, run.Metrics, run.Err = start, duration, len(collected), err
+	if err != nil {
+		run.LastErr, run.LastErrAt = err, start
+	}
+	collectorRuns.runs[collector.Name] = run
+	collectorRuns.Unlock()
+
+	if err == nil && len(collected) == 0 {
+		return collected, nil
+	}
+	metadata := map[string]interface{}{"collector": collector.Name}
+	up := 1.0
+	if err != nil {
+		up = 0
+		metadata = map[string]interface{}{"collector": collector.Name, "error": err.Error()}
+	}
+	now := time.Now()
+	collected = append(collected,
+		Metric{MetricType: "agent", MetricName: "collector_duration", Value: duration.Seconds(), Unit: "seconds", Metadata: metadata, Timestamp: now},
+		Metric{MetricType: "agent", MetricName: "collector_up", Value: up, Unit: "bool", Metadata: metadata, Timestamp: now},
+	)
+	return collected, err
+}
+
+// collectorStatuses reports every collector in run order.
+func collectorStatuses() []CollectorStatus {
+	cfg := currentConfig()
+	collectorRuns.Lock()
+	defer collectorRuns.Unlock()
+
+	statuses := make([]CollectorStatus, 0, len(collectors))
+	for _, collector := range collectors {
+		status := CollectorStatus{
+			Name:     collector.Name,
+			Enabled:  collectorEnabled(collector.Name),
+			Interval: cfg.Interval.String(),
+		}
+		if interval, ok := collectorInterval(collector.Name); ok {
+			status.Interval = interval.String()
+		}
+
+		run, ran := collectorRuns.runs[collector.Name]
+		if ran {
+			at := run.At
+			status.LastRun = &at
+			status.LastDurationSeconds = run.Duration.Seconds()
+			status.LastMetrics = run.Metrics
+			if run.LastErr != nil {
+				errAt := run.LastErrAt
+				status.LastError = run.LastErr.Error()
+				status.LastErrorAt = &errAt
+			}
+		}
+
+		switch {
+		case !status.Enabled:
+			status.State, status.Reason = "disabled", "turned off in the collectors setting"
+		case !ran:
+			status.State = "pending"
+		case run.Err != nil:
+			status.State, status.Reason = "failing", run.Err.Error()
+		case run.Metrics == 0:
+			status.State, status.Reason = "idle", "nothing to collect on this host (not configured or not applicable)"
+		default:
+			status.State = "ok"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func handleLocalCollectors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := collectorStatuses()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gzipServers remembers, per server base URL, whether the server accepts
+// gzip request bodies. Servers announce it with an Accept-Encoding response
+// header (RFC 7694); until one has, bodies are sent uncompressed, so older
+// servers keep working.
+var gzipServers = struct {
+	sync.Mutex
+	accepts map[string]bool
+}{accepts: map[string]bool{}}
+
+// noteAcceptEncoding records whether the server at base accepts gzip bodies,
+// from the Accept-Encoding header of any response it sent.
+func noteAcceptEncoding(base string, resp *http.Response) {
+	header := resp.Header.Get("Accept-Encoding")
+	if header == "" && resp.StatusCode != http.StatusUnsupportedMediaType {
+		return
+	}
+	accepts := false
+	for _, coding := range strings.Split(header, ",") {
+		if name, _, _ := strings.Cut(strings.TrimSpace(coding), ";"); strings.EqualFold(name, "gzip") {
+			accepts = true
+		}
+	}
+
+	gzipServers.Lock()
+	changed := gzipServers.accepts[base] != accepts
+	gzipServers.accepts[base] = accepts
+	gzipServers.Unlock()
+	if changed {
+		logger.Debug("compress.negotiated", "Server gzip support changed", Fields{"server_url": base, "gzip": accepts})
+	}
+}
+
+// compressBody gzips data for base when it is at least compress_threshold
+// bytes and the server accepts gzip. It returns the body and its
+// Content-Encoding ("" when sent as is).
+func compressBody(base string, data []byte) ([]byte, string) {
+	cfg := currentConfig()
+	if cfg.CompressThreshold <= 0 || len(data) < cfg.CompressThreshold {
+		return data, ""
+	}
+	gzipServers.Lock()
+	accepts := gzipServers.accepts[base]
+	gzipServers.Unlock()
+	if !accepts || !serverSupports(base, capabilityGzip) {
+		return data, ""
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return data, ""
+	}
+	if err := zw.Close(); err != nil {
+		return data, ""
+	}
+	return buf.Bytes(), "gzip"
+}
+
+// postCompressed POSTs the JSON body data to base+path, signed with apiKey and
+// compressed when compressBody allows. A non-empty agentID sends it for
+// another host than this agent's own. If the server answers 415 to a compressed body (say,
+// after a failover to an older server), it is marked as not accepting gzip
+// and the body is sent again as is.
+func postCompressed(base, path, apiKey, agentID string, data []byte) (*http.Response, error) {
+	body, encoding := compressBody(base, data)
+	for {
+		req, err := http.NewRequest("POST", base+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		if agentID != "" {
+			req.Header.Set("X-LXMON-Agent-ID", agentID)
+		}
+		signRequest(req, apiKey, data)
+		resp, err := serverDo(req, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		noteAcceptEncoding(base, resp)
+		if resp.StatusCode != http.StatusUnsupportedMediaType || encoding == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+		logger.Info("compress.rejected", "Server rejected a gzip body, resending uncompressed", Fields{"server_url": base})
+		body, encoding = data, ""
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lxmon.yaml")
+	if err := os.WriteFile(path, []byte("interval: 30s\nmax_retries: 7\nlog_level: warn\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--config", path, "--api-key", "k", "--hostname", "h", "--state-dir", t.TempDir()}
+
+	load := func(extra ...string) Config {
+		t.Helper()
+		loaded, err := buildConfig(append(append([]string{}, args...), extra...))
+		if err != nil {
+			t.Fatalf("buildConfig: %v", err)
+		}
+		return loaded.cfg
+	}
+
+	if cfg := load(); cfg.Interval != 30*time.Second || cfg.MaxRetries != 7 || cfg.RetryDelay != defaultConfig().RetryDelay {
+		t.Errorf("file over defaults: interval %s, max_retries %d, retry_delay %s", cfg.Interval, cfg.MaxRetries, cfg.RetryDelay)
+	}
+
+	t.Setenv("LXMON_INTERVAL", "20s")
+	if cfg := load(); cfg.Interval != 20*time.Second || cfg.MaxRetries != 7 {
+		t.Errorf("env over file: interval %s, max_retries %d", cfg.Interval, cfg.MaxRetries)
+	}
+
+	if cfg := load("--interval", "10s"); cfg.Interval != 10*time.Second {
+		t.Errorf("flag over env: interval %s", cfg.Interval)
+	}
+
+	t.Setenv("LXMON_INTERVAL", "soon")
+	if _, err := buildConfig(args); err == nil {
+		t.Error("invalid env value accepted")
+	}
+}
+
+func TestBuildConfigServerOverrides(t *testing.T) {
+	serverOverrides.Lock()
+	saved := serverOverrides.current
+	serverOverrides.current = serverSettings{Settings: map[string]interface{}{"log_level": "error", "interval": "1s"}}
+	serverOverrides.Unlock()
+	t.Cleanup(func() {
+		serverOverrides.Lock()
+		serverOverrides.current = saved
+		serverOverrides.Unlock()
+	})
+
+	loaded, err := buildConfig([]string{"--api-key", "k", "--hostname", "h", "--log-level", "debug", "--interval", "45s"})
+	if err != nil {
+		t.Fatalf("buildConfig: %v", err)
+	}
+	// Managed settings win over flags; the rest stay with the host
+	if loaded.cfg.LogLevel != "error" || loaded.cfg.Interval != 45*time.Second {
+		t.Errorf("log_level %q, interval %s", loaded.cfg.LogLevel, loaded.cfg.Interval)
+	}
+}
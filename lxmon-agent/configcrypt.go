@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decryptConfigFile returns the plaintext of an encrypted config file and
+// the extension that names its format. Two forms are supported:
+//
+//   - agent.yaml.age: the whole file encrypted with age; keyPath is the age
+//     identity file that decrypts it.
+//   - SOPS files (a top-level "sops" key), where the whole file or just the
+//     sensitive fields are encrypted with age or a cloud KMS. keyPath, if
+//     set, is passed to sops as the age identity; KMS credentials come from
+//     the usual cloud environment.
+//
+// Decryption goes through the age and sops binaries. Unencrypted files are
+// returned unchanged.
+func decryptConfigFile(path string, data []byte, keyPath string) ([]byte, string, error) {
+	ext := filepath.Ext(path)
+	if ext == ".age" {
+		if keyPath == "" {
+			return nil, "", fmt.Errorf("%s is encrypted: set --config-key (LXMON_CONFIG_KEY) to the age identity file", path)
+		}
+		plain, err := runDecrypt(nil, "age", "--decrypt", "--identity", keyPath, path)
+		if err != nil {
+			return nil, "", fmt.Errorf("decrypt %s: %w", path, err)
+		}
+		return plain, filepath.Ext(strings.TrimSuffix(path, ext)), nil
+	}
+
+	if !isSopsDocument(data, ext) {
+		return data, ext, nil
+	}
+	format := "yaml"
+	if strings.ToLower(ext) == ".json" {
+		format = "json"
+	}
+	var env []string
+	if keyPath != "" {
+		env = append(env, "SOPS_AGE_KEY_FILE="+keyPath)
+	}
+	plain, err := runDecrypt(env, "sops", "--decrypt", "--input-type", format, "--output-type", format, path)
+	if err != nil {
+		return nil, "", fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	return plain, ext, nil
+}
+
+// isSopsDocument reports whether a YAML or JSON document carries the
+// metadata block sops adds when encrypting.
+func isSopsDocument(data []byte, ext string) bool {
+	values := map[string]interface{}{}
+	var err error
+	switch strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".toml":
+		return false // not a format sops writes
+	default:
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return false
+	}
+	_, ok := values["sops"].(map[string]interface{})
+	return ok
+}
+
+func runDecrypt(env []string, name string, args ...string) ([]byte, error) {
+	if !commandAvailable(name) {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() > 0 {
+			return nil, errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// configKeyFromArgs finds --config-key (or LXMON_CONFIG_KEY), needed before
+// the config file is read.
+func configKeyFromArgs(args []string) string {
+	if value, ok := flagValueFromArgs(args, "config-key"); ok {
+		return value
+	}
+	return os.Getenv("LXMON_CONFIG_KEY")
+}
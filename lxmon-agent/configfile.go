@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile loads a YAML, TOML or JSON file (chosen by extension,
+// YAML otherwise) whose top-level keys are the option keys from
+// configOptions, e.g.
+//
+//	server_url: https://lxmon.example.com
+//	interval: 30s
+//	dependencies: [db:5432, cache:6379]
+//	static_addresses: {eth0: 10.0.0.5}
+//
+// Values go through the same Apply functions as env vars and flags, so the
+// file accepts exactly what they accept. Encrypted files are decrypted with
+// keyPath first (see decryptConfigFile).
+func applyConfigFile(cfg *Config, path, keyPath string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	data, ext, err := decryptConfigFile(path, data, keyPath)
+	if err != nil {
+		return err
+	}
+	if err := applyConfigData(cfg, data, ext, "config file "+path); err != nil {
+		return err
+	}
+	cfg.ConfigFile = path
+	return nil
+}
+
+// applyConfigData applies a config document in the format given by ext
+// (".json", ".toml", anything else is YAML). source names the document in
+// error messages.
+func applyConfigData(cfg *Config, data []byte, ext, source string) error {
+	values := map[string]interface{}{}
+	var err error
+	switch strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", source, err)
+	}
+
+	options := map[string]configOption{}
+	for _, opt := range configOptions {
+		options[opt.Key] = opt
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opt, ok := options[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", source, key)
+		}
+		if err := opt.Apply(cfg, configValueString(values[key])); err != nil {
+			return fmt.Errorf("%s: invalid %s: %w", source, key, err)
+		}
+	}
+	return nil
+}
+
+// configValueString flattens a decoded file value into the string form used
+// by env vars: lists become "a,b" and maps become "k=v,k=v".
+func configValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, configValueString(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+"="+configValueString(v[key]))
+		}
+		return strings.Join(pairs, ",")
+	case float64:
+		// JSON numbers are float64; %v would turn 1000000 into 1e+06,
+		// which parseInt refuses
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// configFileFromArgs finds --config/-config in the raw arguments so the file
+// can be applied before env vars and the remaining flags.
+func configFileFromArgs(args []string) string {
+	if value, ok := flagValueFromArgs(args, "config"); ok {
+		return value
+	}
+	return os.Getenv("LXMON_CONFIG")
+}
+
+// flagValueFromArgs returns the value of --name/-name (as "--name value" or
+// "--name=value") from raw arguments, before the flag set parses them.
+func flagValueFromArgs(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		flagName := strings.TrimLeft(arg, "-")
+		if flagName == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(flagName, name+"="); ok {
+			return value, true
+		}
+		if flagName == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxLogLevelOverride bounds how long a control command can keep the log
+// level changed, so a forgotten debug session does not run for days.
+const maxLogLevelOverride = 24 * time.Hour
+
+// ControlCommand is a structured instruction the agent carries out itself
+// instead of running a shell command.
+type ControlCommand struct {
+	// log_level: use Level for DurationSeconds, then revert
+	Action          string `json:"action"`
+	Level           string `json:"level,omitempty"`
+	DurationSeconds int    `json:"duration_seconds,omitempty"`
+}
+
+// runControl carries out a control command and returns a line describing
+// what was done for the command result.
+func runControl(control ControlCommand) (string, error) {
+	switch control.Action {
+	case "log_level":
+		level := -1
+		for value, name := range levelNames {
+			if strings.EqualFold(control.Level, name) {
+				level = value
+			}
+		}
+		if level < 0 {
+			return "", fmt.Errorf("unknown log level %q (want debug, info, warn or error)", control.Level)
+		}
+		duration := time.Duration(control.DurationSeconds) * time.Second
+		if duration <= 0 || duration > maxLogLevelOverride {
+			return "", fmt.Errorf("duration_seconds must be between 1 and %d", int(maxLogLevelOverride.Seconds()))
+		}
+		until := overrideLogLevel(level, duration)
+		logger.Info("log.level_override", "Log level changed by control command", Fields{"level": levelNames[level], "until": until.Format(time.RFC3339)})
+		return fmt.Sprintf("log level %s until %s\n", levelNames[level], until.Format(time.RFC3339)), nil
+	default:
+		return "", fmt.Errorf("unknown control action %q", control.Action)
+	}
+}
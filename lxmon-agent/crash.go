@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// maxCrashReports bounds how many unsent crash reports are kept on disk.
+const maxCrashReports = 10
+
+// CrashReport captures enough context to diagnose a field crash without
+// shell access to the host.
+type CrashReport struct {
+	Hostname   string          `json:"hostname"`
+	CrashedAt  time.Time       `json:"crashed_at"`
+	Panic      string          `json:"panic"`
+	Stack      string          `json:"stack"`
+	GoVersion  string          `json:"go_version"`
+	Config     json.RawMessage `json:"config"`
+	LastCycle  HealthStatus    `json:"last_cycle"`
+	Goroutines int             `json:"goroutines"`
+}
+
+func crashDir() string {
+	return filepath.Join(currentConfig().StateDir, "crash")
+}
+
+// crashGuard must be deferred at the top of every agent goroutine. It writes
+// a crash report for a panic and then re-panics so the process still dies
+// and the supervisor restarts it.
+func crashGuard() {
+	if r := recover(); r != nil {
+		writeCrashReport(r, debug.Stack())
+		panic(r)
+	}
+}
+
+func writeCrashReport(recovered interface{}, stack []byte) {
+	cfg := currentConfig()
+	if cfg.StateDir == "" {
+		return
+	}
+
+	configJSON, err := effectiveConfigJSON(cfg)
+	if err != nil {
+		configJSON = []byte("null")
+	}
+	report := CrashReport{
+		Hostname:   cfg.Hostname,
+		CrashedAt:  time.Now().UTC(),
+		Panic:      fmt.Sprint(recovered),
+		Stack:      string(stack),
+		GoVersion:  runtime.Version(),
+		Config:     configJSON,
+		LastCycle:  health.status(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	dir := crashDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		logger.Error("crash.write_failed", "Failed to create crash directory", Fields{"dir": dir, "error": err})
+		return
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	path := filepath.Join(dir, report.CrashedAt.Format("20060102T150405.000000000")+".json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		logger.Error("crash.write_failed", "Failed to write crash report", Fields{"path": path, "error": err})
+		return
+	}
+	logger.Error("crash.recorded", "Agent panicked, crash report written", Fields{"path": path, "panic": report.Panic})
+}
+
+// sendPendingCrashReports uploads crash reports left by previous runs and
+// removes them once the server has accepted them. In dry run, or when the
+// agent talks to an MQTT broker, exports over OTLP or is scraped by
+// Prometheus instead of the server, they are kept for the next run that reaches the server.
+func sendPendingCrashReports(cfg Config) {
+	if cfg.StateDir == "" || cfg.DryRun || mqttEnabled() || serverless() {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(crashDir(), "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+
+	for i, file := range files {
+		if i < len(files)-maxCrashReports {
+			os.Remove(file)
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if err := sendCrashReport(cfg, data); err != nil {
+			logger.Warn("crash.upload_failed", "Failed to upload crash report", Fields{"path": file, "error": err})
+			continue
+		}
+		os.Remove(file)
+		logger.Info("crash.uploaded", "Uploaded crash report from previous run", Fields{"path": file})
+	}
+}
+
+func sendCrashReport(cfg Config, data []byte) error {
+	req, err := http.NewRequest("POST", serverURL()+"/api/agent/crash-report", bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create crash report request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	req.URL.RawQuery = url.Values{"hostname": {cfg.Hostname}}.Encode()
+	signRequest(req, cfg.APIKey, data)
+
+	resp, err := serverDo(req, 30*time.Second)
+	if err != nil {
+		return unavailable("crash report", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse("crash report", resp)
+}
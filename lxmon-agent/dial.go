@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Connections to the server resolve both its A and AAAA records and race
+// the two families (Happy Eyeballs, RFC 8305): the preferred family is tried
+// first and, when it has not connected after dial_fallback_delay, the other
+// one in parallel. A host whose IPv6 is broken thus connects over IPv4 a
+// fraction of a second later instead of timing out on every send. ip_family
+// pins one family instead. dns_servers replaces the nameservers of
+// /etc/resolv.conf for the server's names and server_srv.
+
+const (
+	ipFamilyAuto = "auto"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// serverDialTimeout bounds connecting to the server, both families included.
+const serverDialTimeout = 30 * time.Second
+
+// serverDialer returns the DialContext of the server transport for cfg.
+func serverDialer(cfg Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       serverDialTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: cfg.DialFallbackDelay,
+		Resolver:      newResolver(cfg.DNSServers),
+	}
+	family := cfg.IPFamily
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch family {
+		case ipFamilyIPv4:
+			network = "tcp4"
+		case ipFamilyIPv6:
+			network = "tcp6"
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// newResolver returns a resolver asking the given nameservers in turn, or
+// the system resolver without any.
+func newResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// Each attempt goes to the next server, so one that is down
+			// costs a retry rather than every lookup
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// parseDNSServers parses nameserver addresses, with port 53 by default.
+func parseDNSServers(value string, dst *[]string) error {
+	var servers []string
+	for _, server := range parseList(value) {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("%q is not an IP address", server)
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	*dst = servers
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// discoveryRule detects one kind of service by a running process and/or a
+// local listening port, and enables monitoring for it. enable receives the
+// address the port is reachable on (empty when the rule has no port) and
+// returns false if the service did not answer the way its collector needs,
+// in which case nothing is changed.
+type discoveryRule struct {
+	Name      string
+	Processes []string
+	Port      int
+	Enable    func(cfg *Config, addr string) bool
+}
+
+var discoveryRules = []discoveryRule{
+	{Name: "elasticsearch", Port: 9200, Enable: func(cfg *Config, addr string) bool {
+		if len(cfg.Elasticsearch) > 0 {
+			return false
+		}
+		url := "http://" + addr
+		var health map[string]interface{}
+		if fetchJSON(url+"/_cluster/health?local=true", &health) != nil {
+			return false
+		}
+		cfg.Elasticsearch = []string{url}
+		return true
+	}},
+	{Name: "rabbitmq", Port: 15672, Enable: func(cfg *Config, addr string) bool {
+		if cfg.RabbitMQ != "" {
+			return false
+		}
+		// The default guest account only works over loopback, which is
+		// where the management plugin is found here.
+		url := "http://guest:guest@" + addr
+		var overview map[string]interface{}
+		if fetchJSON(url+"/api/overview", &overview) != nil {
+			return false
+		}
+		cfg.RabbitMQ = url
+		return true
+	}},
+	{Name: "jvm", Port: 8778, Enable: func(cfg *Config, addr string) bool {
+		if len(cfg.Jolokia) > 0 {
+			return false
+		}
+		url := "http://" + addr + "/jolokia"
+		var version map[string]interface{}
+		if fetchJSON(url+"/version", &version) != nil {
+			return false
+		}
+		cfg.Jolokia = map[string]string{"jvm": url}
+		return true
+	}},
+	{Name: "haproxy", Processes: []string{"haproxy"}, Enable: func(cfg *Config, _ string) bool {
+		if len(cfg.HAProxySockets) > 0 {
+			return false
+		}
+		for _, path := range []string{"/run/haproxy/admin.sock", "/var/run/haproxy/admin.sock", "/var/lib/haproxy/stats"} {
+			if _, err := os.Stat(path); err == nil {
+				cfg.HAProxySockets = []string{"unix:" + path}
+				return true
+			}
+		}
+		return false
+	}},
+	{Name: "keepalived", Processes: []string{"keepalived"}, Enable: func(cfg *Config, _ string) bool {
+		if cfg.Keepalived {
+			return false
+		}
+		cfg.Keepalived = true
+		return true
+	}},
+	{Name: "php-fpm", Processes: []string{"php-fpm"}, Enable: func(cfg *Config, _ string) bool {
+		if len(cfg.PHPFPMStatus) > 0 {
+			return false
+		}
+		// Only pools with pm.status_path = /status answer
+		sockets, _ := filepath.Glob("/run/php/*.sock")
+		for _, socket := range sockets {
+			if _, err := fetchPHPFPMStatus("unix:" + socket); err == nil {
+				cfg.PHPFPMStatus = append(cfg.PHPFPMStatus, "unix:"+socket)
+			}
+		}
+		return len(cfg.PHPFPMStatus) > 0
+	}},
+	// No dedicated collectors: probe that they accept connections
+	{Name: "nginx", Processes: []string{"nginx"}, Port: 80, Enable: addDependency},
+	{Name: "postgres", Processes: []string{"postgres", "postmaster"}, Port: 5432, Enable: addDependency},
+	{Name: "mysql", Processes: []string{"mysqld", "mariadbd"}, Port: 3306, Enable: addDependency},
+	{Name: "redis", Processes: []string{"redis-server"}, Port: 6379, Enable: addDependency},
+	{Name: "memcached", Processes: []string{"memcached"}, Port: 11211, Enable: addDependency},
+	{Name: "docker", Processes: []string{"dockerd"}, Enable: func(cfg *Config, _ string) bool {
+		// The container collector covers hosts running inside containers;
+		// on a Docker host, report the daemon itself as discovered.
+		return true
+	}},
+}
+
+func addDependency(cfg *Config, addr string) bool {
+	for _, existing := range cfg.Dependencies {
+		if existing == addr {
+			return false
+		}
+	}
+	cfg.Dependencies = append(cfg.Dependencies, addr)
+	return true
+}
+
+// applyDiscovery detects the services in discoveryRules on this host and
+// fills in the settings of their collectors. Settings already configured
+// are left alone, so discovery only ever adds monitoring; use collectors
+// to switch a discovered collector off. The names of the services that were
+// enabled are recorded in cfg.Discovered.
+func applyDiscovery(cfg *Config) {
+	processes := runningProcessNames()
+	listening := listeningAddresses()
+
+	var found []string
+	for _, rule := range discoveryRules {
+		if len(rule.Processes) > 0 && !anyProcessRunning(processes, rule.Processes) {
+			continue
+		}
+		addr := ""
+		if rule.Port > 0 {
+			var ok bool
+			if addr, ok = listening[rule.Port]; !ok {
+				continue
+			}
+		}
+		if rule.Enable(cfg, addr) {
+			found = append(found, rule.Name)
+		}
+	}
+	cfg.Discovered = found
+}
+
+func anyProcessRunning(running map[string]bool, names []string) bool {
+	for _, name := range names {
+		if running[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// runningProcessNames returns the command names (/proc/<pid>/comm) of all
+// processes.
+func runningProcessNames() map[string]bool {
+	names := map[string]bool{}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return names
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSpace(string(comm))
+		// php-fpm names its processes "php-fpm8.2" and the like
+		if strings.HasPrefix(name, "php-fpm") {
+			name = "php-fpm"
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// listeningAddresses maps each listening TCP port to a host:port the agent
+// can connect to, preferring loopback for sockets bound to all addresses.
+func listeningAddresses() map[int]string {
+	addrs := map[int]string{}
+	conns, err := readTCPConnections()
+	if err != nil {
+		return addrs
+	}
+	for _, conn := range conns {
+		if conn.State != tcpListen {
+			continue
+		}
+		host := conn.LocalIP.String()
+		if conn.LocalIP.IsUnspecified() {
+			host = "127.0.0.1"
+			if conn.LocalIP.To4() == nil {
+				host = "::1"
+			}
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(conn.LocalPort))
+		// Keep the IPv4 address when a port is bound on both families
+		if existing, ok := addrs[conn.LocalPort]; ok && !strings.HasPrefix(existing, "[") {
+			continue
+		}
+		addrs[conn.LocalPort] = addr
+	}
+	return addrs
+}
@@ -0,0 +1,18 @@
+package main
+
+// dryRun reports whether dry_run is on, in which case the request to
+// endpoint is not made and its payload is logged instead.
+func dryRun(endpoint string, payload []byte) bool {
+	cfg := currentConfig()
+	if !cfg.DryRun {
+		return false
+	}
+	logDryRun(endpoint, payload)
+	return true
+}
+
+// logDryRun logs the payload of a request dry_run does not make, for callers
+// that checked dry_run on their own copy of the configuration.
+func logDryRun(endpoint string, payload []byte) {
+	logger.Info("dry_run.payload", "Dry run: not sending request", Fields{"endpoint": endpoint, "payload": string(redactSecrets(payload))})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// defaultEnrollmentRetry is how often a pending agent asks again when the
+// server does not say.
+const defaultEnrollmentRetry = time.Minute
+
+// PendingApprovalError means the server accepted the registration but holds
+// the host in its enrollment queue until an admin approves it.
+type PendingApprovalError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *PendingApprovalError) Error() string {
+	return "registration pending approval: " + e.Message
+}
+
+// checkPendingApproval turns a 202 "pending_approval" answer to a
+// registration into a PendingApprovalError.
+func checkPendingApproval(status int, data []byte) error {
+	if status != http.StatusAccepted {
+		return nil
+	}
+	var body struct {
+		Status     string `json:"status"`
+		Message    string `json:"message"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Status != "pending_approval" {
+		return nil
+	}
+	pending := &PendingApprovalError{Message: body.Message, RetryAfter: time.Duration(body.RetryAfter) * time.Second}
+	if pending.RetryAfter <= 0 {
+		pending.RetryAfter = defaultEnrollmentRetry
+	}
+	return pending
+}
+
+// registerUntilApproved registers the agent, asking again for as long as the
+// server holds it for approval. It returns false if the agent was told to
+// shut down while waiting.
+func registerUntilApproved() (bool, error) {
+	for waiting := false; ; waiting = true {
+		cfg := currentConfig()
+		err := registerAgentWithRetry(cfg)
+		var pending *PendingApprovalError
+		if !errors.As(err, &pending) {
+			return true, err
+		}
+		health.setPendingApproval()
+		if !waiting {
+			logger.Warn("register.pending", "Server holds this host for enrollment approval, waiting", Fields{
+				"message":     pending.Message,
+				"retry_after": pending.RetryAfter,
+			})
+		} else {
+			logger.Debug("register.still_pending", "Enrollment still pending approval", nil)
+		}
+
+		select {
+		case <-time.After(jitteredInterval(pending.RetryAfter, cfg.Jitter)):
+		case <-shutdownCh:
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error classes for server communication. Every error returned by the send
+// path wraps exactly one of these, so callers can decide with errors.Is
+// whether to retry, halt or quarantine.
+var (
+	// ErrAuth means the server rejected the agent's credentials. Retrying
+	// with the same key cannot succeed.
+	ErrAuth = errors.New("authentication rejected")
+	// ErrServerUnavailable covers network failures, timeouts, 5xx and
+	// throttling responses. These are worth retrying.
+	ErrServerUnavailable = errors.New("server unavailable")
+	// ErrPayloadRejected means the server understood the request but refused
+	// its content (4xx). Resending the same payload will fail again.
+	ErrPayloadRejected = errors.New("payload rejected")
+)
+
+// ServerError describes a non-2xx response from the lxmon server. Code and
+// Details are set when the server sent a structured error
+// ({"error_code": ..., "details": {...}}), RetryAfter when it asked the
+// agent to back off.
+type ServerError struct {
+	Op         string
+	StatusCode int
+	Body       string
+	Kind       error
+	Code       string
+	Details    map[string]interface{}
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s failed with status %d (%v): %s", e.Op, e.StatusCode, e.Kind, e.Body)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Kind
+}
+
+// checkResponse returns nil for 2xx responses and a classified *ServerError
+// otherwise. The response body is consumed in the error case.
+func checkResponse(op string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var structured struct {
+		ErrorCode string                 `json:"error_code"`
+		Details   map[string]interface{} `json:"details"`
+	}
+	json.Unmarshal(body, &structured)
+	if structured.ErrorCode == errorCodeSignatureExpired {
+		learnServerClock(resp.Header.Get("Date"))
+	}
+	return &ServerError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Kind:       classifyStatus(resp.StatusCode, structured.ErrorCode),
+		Code:       structured.ErrorCode,
+		Details:    structured.Details,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// Error codes of a request whose signature the server refused for its
+// timestamp rather than its key. A request signed again may pass.
+const (
+	errorCodeSignatureExpired = "SIGNATURE_EXPIRED"
+	errorCodeReplayedRequest  = "REPLAYED_REQUEST"
+)
+
+func classifyStatus(code int, errorCode string) error {
+	switch {
+	case errorCode == errorCodeSignatureExpired || errorCode == errorCodeReplayedRequest:
+		// Every attempt is signed anew, with the server's clock once known
+		return ErrServerUnavailable
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrAuth
+	case code == http.StatusNotImplemented || code == http.StatusHTTPVersionNotSupported:
+		// The server will not handle this request, however often it is sent
+		return ErrPayloadRejected
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500:
+		return ErrServerUnavailable
+	default:
+		return ErrPayloadRejected
+	}
+}
+
+// unavailable wraps a transport-level failure as ErrServerUnavailable.
+func unavailable(op string, err error) error {
+	return fmt.Errorf("%s request failed: %w: %w", op, ErrServerUnavailable, err)
+}
+
+// isRetryable reports whether an error from the send path may succeed if the
+// same request is attempted again.
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrServerUnavailable)
+}
+
+// haltOnAuthError stops all server traffic after the server rejected the API
+// key: retrying with the same credentials only floods the server with 401s.
+// The health endpoint reports the failure so orchestrators can alert on it.
+func haltOnAuthError(err error) {
+	if health.authHalted() {
+		return
+	}
+	health.recordAuthFailure(err)
+	logger.Error("auth.rejected", "Server rejected the agent API key, halting server communication", Fields{"error": err})
+}
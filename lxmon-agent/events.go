@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxQueuedEvents bounds the in-memory event queue; the oldest events are
+// dropped when it is full.
+const maxQueuedEvents = 1000
+
+// Event is a discrete occurrence on the host (a deploy, a finished backup, a
+// configuration drift) as opposed to a sampled value. Events are forwarded
+// with the next metrics payload as metric_type "event" so they land next to
+// the metrics they explain.
+type Event struct {
+	Type      string                 `json:"type"`
+	Source    string                 `json:"source,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Severity  string                 `json:"severity,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+type eventBuffer struct {
+	mu      sync.Mutex
+	events  []Event
+	dropped int
+}
+
+var eventQueue = &eventBuffer{}
+
+// emitEvent queues an event for forwarding with the next metrics payload.
+func emitEvent(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Severity == "" {
+		event.Severity = "info"
+	}
+
+	eventQueue.mu.Lock()
+	defer eventQueue.mu.Unlock()
+	if len(eventQueue.events) >= maxQueuedEvents {
+		eventQueue.events = eventQueue.events[1:]
+		eventQueue.dropped++
+	}
+	eventQueue.events = append(eventQueue.events, event)
+	logger.Debug("event.queued", "Event queued", Fields{"type": event.Type, "source": event.Source})
+}
+
+// drainEventMetrics empties the queue and returns the events as metrics.
+func drainEventMetrics() []Metric {
+	eventQueue.mu.Lock()
+	events := eventQueue.events
+	dropped := eventQueue.dropped
+	eventQueue.events = nil
+	eventQueue.dropped = 0
+	eventQueue.mu.Unlock()
+
+	metrics := make([]Metric, 0, len(events)+1)
+	for _, event := range events {
+		metadata := map[string]interface{}{
+			"severity": event.Severity,
+		}
+		if event.Source != "" {
+			metadata["source"] = event.Source
+		}
+		if event.Message != "" {
+			metadata["message"] = event.Message
+		}
+		for key, value := range event.Fields {
+			metadata[key] = value
+		}
+		metrics = append(metrics, Metric{
+			MetricType: "event",
+			MetricName: event.Type,
+			Value:      1,
+			Unit:       "count",
+			Metadata:   metadata,
+			Timestamp:  event.Timestamp,
+		})
+	}
+	if dropped > 0 {
+		metrics = append(metrics, Metric{
+			MetricType: "agent",
+			MetricName: "events_dropped",
+			Value:      float64(dropped),
+			Unit:       "count",
+			Timestamp:  time.Now(),
+		})
+	}
+	return metrics
+}
+
+// handleLocalEvents implements POST /local/events, letting other tools on the
+// host (deploy hooks, backup scripts) inject events.
+func handleLocalEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var event Event
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&event); err != nil {
+		http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if event.Type == "" {
+		http.Error(w, "event type is required", http.StatusBadRequest)
+		return
+	}
+	if event.Source == "" {
+		event.Source = "local"
+	}
+	emitEvent(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "queued"})
+}
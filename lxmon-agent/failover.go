@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// failbackInterval is how often the primary is probed after a failover.
+const failbackInterval = time.Minute
+
+// serverFailover tracks which of server_url (or the servers found through
+// server_srv) and failover_urls requests go to. The list is replaced on every
+// configuration load and SRV refresh; the active server stays active as long
+// as it is still listed.
+var serverFailover = struct {
+	sync.Mutex
+	urls     []string
+	active   int
+	failures int
+}{}
+
+func setServerURLs(urls []string) {
+	serverFailover.Lock()
+	defer serverFailover.Unlock()
+	if len(urls) == len(serverFailover.urls) {
+		same := true
+		for i := range urls {
+			same = same && urls[i] == serverFailover.urls[i]
+		}
+		if same {
+			return
+		}
+	}
+	active := ""
+	if len(serverFailover.urls) > 0 {
+		active = serverFailover.urls[serverFailover.active]
+	}
+	serverFailover.urls = urls
+	serverFailover.active = 0
+	serverFailover.failures = 0
+	for i, url := range urls {
+		if url == active {
+			serverFailover.active = i
+		}
+	}
+}
+
+// serverURL returns the base URL of the server requests currently go to.
+func serverURL() string {
+	cfg := currentConfig()
+	serverFailover.Lock()
+	defer serverFailover.Unlock()
+	if len(serverFailover.urls) == 0 {
+		return cfg.ServerURL
+	}
+	return serverFailover.urls[serverFailover.active]
+}
+
+// serverAttempts is how many attempts reach every configured server with
+// max_retries attempts each.
+func serverAttempts() int {
+	cfg := currentConfig()
+	serverFailover.Lock()
+	defer serverFailover.Unlock()
+	if len(serverFailover.urls) == 0 {
+		return cfg.MaxRetries
+	}
+	return cfg.MaxRetries * len(serverFailover.urls)
+}
+
+// recordServerResult counts a request made to base, and fails over to the
+// next server after max_retries requests in a row found it unavailable. An
+// answer of any kind shows the server is up.
+func recordServerResult(base string, err error) {
+	cfg := currentConfig()
+	serverFailover.Lock()
+	if len(serverFailover.urls) < 2 || serverFailover.urls[serverFailover.active] != base {
+		serverFailover.Unlock()
+		return
+	}
+	if err == nil || !isRetryable(err) {
+		serverFailover.failures = 0
+		serverFailover.Unlock()
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		// Not sent, so it says nothing about this server
+		serverFailover.Unlock()
+		return
+	}
+	serverFailover.failures++
+	if serverFailover.failures < cfg.MaxRetries {
+		serverFailover.Unlock()
+		return
+	}
+	serverFailover.active = (serverFailover.active + 1) % len(serverFailover.urls)
+	serverFailover.failures = 0
+	next := serverFailover.urls[serverFailover.active]
+	serverFailover.Unlock()
+
+	logger.Warn("server.failover", "Server unavailable, failing over", Fields{"from": base, "to": next, "error": err})
+	emitEvent(Event{
+		Type:     "server_failover",
+		Source:   "agent",
+		Severity: "warning",
+		Message:  fmt.Sprintf("failed over from %s to %s", base, next),
+		Fields:   map[string]interface{}{"from": base, "to": next, "error": err.Error()},
+	})
+}
+
+// failBack probes the primary server every failbackInterval while the agent
+// is failed over, and switches back once it answers its health check.
+func failBack(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(failbackInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		serverFailover.Lock()
+		failedOver := serverFailover.active != 0
+		var primary, current string
+		if failedOver {
+			primary, current = serverFailover.urls[0], serverFailover.urls[serverFailover.active]
+		}
+		serverFailover.Unlock()
+		if !failedOver {
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", primary+"/health", nil)
+		if err != nil {
+			continue
+		}
+		resp, err := sendServerRequest(req, 10*time.Second)
+		if err != nil {
+			logger.Debug("server.failback_probe_failed", "Primary server still unavailable", Fields{"server_url": primary, "error": err})
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logger.Debug("server.failback_probe_failed", "Primary server still unhealthy", Fields{"server_url": primary, "status": resp.StatusCode})
+			continue
+		}
+
+		serverFailover.Lock()
+		switched := len(serverFailover.urls) > 0 && serverFailover.urls[0] == primary && serverFailover.active != 0
+		if switched {
+			serverFailover.active = 0
+			serverFailover.failures = 0
+		}
+		serverFailover.Unlock()
+		if switched {
+			logger.Info("server.failback", "Primary server is back, failing back", Fields{"from": current, "to": primary})
+			emitEvent(Event{
+				Type:     "server_failback",
+				Source:   "agent",
+				Severity: "info",
+				Message:  fmt.Sprintf("failed back from %s to %s", current, primary),
+				Fields:   map[string]interface{}{"from": current, "to": primary},
+			})
+		}
+	}
+}
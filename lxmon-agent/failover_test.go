@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecordServerResultFailsOver(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		setServerURLs(nil)
+		drainEventMetrics()
+	})
+	config.MaxRetries = 2
+	setServerURLs([]string{"https://a.example.com", "https://b.example.com"})
+
+	down := unavailable("metrics submission", errors.New("connection refused"))
+	if n := serverAttempts(); n != 4 {
+		t.Errorf("serverAttempts = %d, want 4", n)
+	}
+
+	// An answer in between resets the count
+	recordServerResult("https://a.example.com", down)
+	recordServerResult("https://a.example.com", nil)
+	recordServerResult("https://a.example.com", down)
+	if got := serverURL(); got != "https://a.example.com" {
+		t.Fatalf("failed over after non-consecutive failures, to %s", got)
+	}
+
+	// Neither a rejected request nor one the open circuit kept back counts
+	recordServerResult("https://a.example.com", ErrPayloadRejected)
+	recordServerResult("https://a.example.com", down)
+	recordServerResult("https://a.example.com", unavailable("metrics submission", errCircuitOpen))
+	if got := serverURL(); got != "https://a.example.com" {
+		t.Fatalf("failed over on a rejected or unsent request, to %s", got)
+	}
+
+	recordServerResult("https://a.example.com", down)
+	if got := serverURL(); got != "https://b.example.com" {
+		t.Fatalf("serverURL after max_retries failures = %s", got)
+	}
+
+	// A late result for the previous server changes nothing
+	recordServerResult("https://a.example.com", down)
+	recordServerResult("https://a.example.com", down)
+	if got := serverURL(); got != "https://b.example.com" {
+		t.Errorf("result for an inactive server moved the agent to %s", got)
+	}
+
+	// A reload listing the same servers keeps the active one
+	setServerURLs([]string{"https://c.example.com", "https://a.example.com", "https://b.example.com"})
+	if got := serverURL(); got != "https://b.example.com" {
+		t.Errorf("serverURL after the list changed = %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The agent can also append its metrics to a local file, one JSON object
+// per metric and line, for a log shipper to pick up or to keep a local
+// record. Lines have the fields of the server's metrics plus the hostname;
+// names follow metric_names and the tags are in the metadata, as in the
+// payload to the server. The file is opened for each write, so logrotate can
+// move it away without copytruncate.
+
+type fileOutputLine struct {
+	Hostname string `json:"hostname"`
+	Metric
+}
+
+func fileOutputEnabled() bool {
+	return currentConfig().FileOutput != ""
+}
+
+// encodeFileOutput encodes a cycle's metrics, as collected, as JSON lines.
+func encodeFileOutput(cfg Config, metrics []Metric) sinkBatch {
+	// Renamed and tagged on a copy: the metrics are sent on to the server as
+	// they are
+	var b bytes.Buffer
+	payload := newMetricsPayload(cfg, copyMetrics(metrics))
+	encoder := json.NewEncoder(&b)
+	count := 0
+	for _, m := range payload.Metrics {
+		if err := encoder.Encode(fileOutputLine{Hostname: payload.Hostname, Metric: m}); err != nil {
+			logger.Debug("file_output.encode_failed", "Failed to encode a metric for the output file", Fields{"type": m.MetricType, "name": m.MetricName, "error": err})
+			continue
+		}
+		count++
+	}
+	return sinkBatch{body: b.Bytes(), count: count}
+}
+
+// sendFileOutput appends a batch to the file. Every failure is retried:
+// a full disk or a wrong permission does not last.
+func sendFileOutput(cfg Config, batch sinkBatch) error {
+	if err := os.MkdirAll(filepath.Dir(cfg.FileOutput), 0755); err != nil {
+		return fmt.Errorf("file output: %w", err)
+	}
+	f, err := os.OpenFile(cfg.FileOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("file output: %w", err)
+	}
+	if _, err := f.Write(batch.body); err != nil {
+		f.Close()
+		return fmt.Errorf("file output: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("file output: %w", err)
+	}
+	return nil
+}
+
+// copyMetrics copies metrics with their metadata, so they can be changed
+// without changing the originals.
+func copyMetrics(metrics []Metric) []Metric {
+	copied := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		if m.Metadata != nil {
+			metadata := make(map[string]interface{}, len(m.Metadata))
+			for key, value := range m.Metadata {
+				metadata[key] = value
+			}
+			m.Metadata = metadata
+		}
+		copied[i] = m
+	}
+	return copied
+}
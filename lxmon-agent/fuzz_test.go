@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// The fuzz targets run their seed corpus with go test; go test -fuzz=FuzzX
+// explores further.
+
+// validJSONString is what s becomes after a JSON round trip: every byte of
+// invalid UTF-8 is replaced by U+FFFD.
+func validJSONString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+func FuzzMetricRoundTrip(f *testing.F) {
+	f.Add("cpu", "usage_percent", 12.5, "percent", "core", "0", int64(1700000000000000000))
+	f.Add("", "", 0.0, "", "", "", int64(0))
+	f.Add("disk", "free\x00bytes", math.Inf(1), "B", "mount\xff", "/", int64(-1))
+	f.Add("mem", "used", math.NaN(), "", "k", " ", int64(math.MaxInt64))
+	f.Add("net", "rx", -0.0, "B/s", "", "", int64(math.MinInt64))
+	f.Fuzz(func(t *testing.T, metricType, name string, value float64, unit, key, label string, unixNano int64) {
+		in := Metric{
+			MetricType: metricType,
+			MetricName: name,
+			Value:      value,
+			Unit:       unit,
+			Metadata:   map[string]interface{}{key: label},
+			Timestamp:  time.Unix(0, unixNano).UTC(),
+		}
+		payload := newMetricsPayload(config, []Metric{in})
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("payload with %v does not marshal: %v", value, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			if len(payload.Metrics) != 0 {
+				t.Fatalf("non-finite value %v kept", value)
+			}
+			return
+		}
+
+		var out MetricsPayload
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("payload does not unmarshal: %v\n%s", err, data)
+		}
+		if len(out.Metrics) != 1 {
+			t.Fatalf("got %d metrics back, want 1", len(out.Metrics))
+		}
+		got := out.Metrics[0]
+		if got.MetricType != validJSONString(metricType) || got.MetricName != validJSONString(name) || got.Unit != validJSONString(unit) {
+			t.Errorf("names changed: %+v", got)
+		}
+		if got.Value != value {
+			t.Errorf("value = %v, want %v", got.Value, value)
+		}
+		if !got.Timestamp.Equal(in.Timestamp) {
+			t.Errorf("timestamp = %s, want %s", got.Timestamp, in.Timestamp)
+		}
+		if got.Metadata[validJSONString(key)] != validJSONString(label) {
+			t.Errorf("metadata = %v", got.Metadata)
+		}
+	})
+}
+
+func FuzzCommandResultRoundTrip(f *testing.F) {
+	f.Add(1, 0, "hello\n", "", 0.25)
+	f.Add(-1, 255, "\x1b[31mred\x1b[0m", "bad \xc3\x28 utf-8", 0.0)
+	f.Add(math.MaxInt32, -1, strings.Repeat("x", 4096), "\u0000", 1e300)
+	f.Fuzz(func(t *testing.T, id, exitCode int, stdout, stderr string, duration float64) {
+		if math.IsNaN(duration) || math.IsInf(duration, 0) {
+			// Durations come from time.Since and are always finite
+			return
+		}
+		in := CommandResult{
+			CommandID: id,
+			ExitCode:  exitCode,
+			Stdout:    stdout,
+			Stderr:    stderr,
+			Duration:  duration,
+			Timestamp: time.Unix(1700000000, 123456789).UTC(),
+		}
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("result does not marshal: %v", err)
+		}
+		var out CommandResult
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("result does not unmarshal: %v\n%s", err, data)
+		}
+		want := in
+		want.Stdout, want.Stderr = validJSONString(stdout), validJSONString(stderr)
+		if !out.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("timestamp = %s, want %s", out.Timestamp, want.Timestamp)
+		}
+		out.Timestamp = want.Timestamp
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("round trip = %+v, want %+v", out, want)
+		}
+	})
+}
+
+func FuzzDecodeCommands(f *testing.F) {
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[{"id":7,"command":"echo hello"}]`))
+	f.Add([]byte(`[{"id":1,"control":{"action":"reload"}},{"id":2,"script":{"id":3,"sha256":"00","args":["-v"]}}]`))
+	f.Add([]byte(`[{"id":"7"}]`))
+	f.Add([]byte(`{"detail":"Not authenticated"}`))
+	f.Add([]byte(`[{"id":1e400}]`))
+	f.Add([]byte(`[{"id":1,"command":"x"}] trailing`))
+	f.Add([]byte(`<html>502 Bad Gateway</html>`))
+	f.Add([]byte(strings.Repeat("[", 20000)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		commands, err := decodeCommands(strings.NewReader(string(data)))
+		if err != nil {
+			if commands != nil {
+				t.Errorf("commands %v returned with error %v", commands, err)
+			}
+			return
+		}
+		// Whatever was accepted must survive being handled and echoed back
+		for _, cmd := range commands {
+			if _, err := json.Marshal(cmd); err != nil {
+				t.Errorf("decoded command %+v does not marshal: %v", cmd, err)
+			}
+		}
+	})
+}
+
+// endlessReader never ends, like a server or proxy that streams garbage.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+func TestDecodeCommandsBounded(t *testing.T) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := decodeCommands(io.MultiReader(strings.NewReader("["), endlessReader{}))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("endless response decoded without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decodeCommands did not return on an endless response")
+	}
+}
@@ -2,7 +2,13 @@ module lxmon-agent
 
 go 1.21.5
 
-require github.com/shirou/gopsutil/v3 v3.24.5
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/shirou/gopsutil/v3 v3.24.5
+	golang.org/x/sys v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
@@ -12,5 +18,4 @@ require (
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/sys v0.20.0 // indirect
 )
@@ -0,0 +1,666 @@
+package main
+
+// Integration test harness: a mock lxmon server and the agent running
+// against it as a separate process. The agent is this test binary started
+// again with LXMON_INTEGRATION_AGENT=1, so it runs main() with the given
+// flags and no go toolchain or prebuilt binary is needed.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "integration-key"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("LXMON_INTEGRATION_AGENT") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// recordedRequest is a request the mock server received, with the body
+// decompressed.
+type recordedRequest struct {
+	Method         string
+	Path           string
+	Query          string
+	Header         http.Header
+	Body           []byte
+	SignatureValid bool
+	At             time.Time
+}
+
+// decode unmarshals the body into v, failing on fields v does not have, so
+// payload schema changes show up as test failures.
+func (r recordedRequest) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(r.Body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("%s %s: decode body: %v\n%s", r.Method, r.Path, err, r.Body)
+	}
+}
+
+// responder answers the call-th (from 1) request to a path.
+type responder func(call int, req recordedRequest) (status int, body interface{})
+
+// mockServer stands in for lxmon-server. Every request is recorded and
+// checked against the request signature; paths without a responder get the
+// answers of a healthy server.
+type mockServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	requests   []recordedRequest
+	calls      map[string]int
+	responders map[string]responder
+	commands   []PendingCommand
+	channels   chan *mockChannel
+}
+
+func newMockServer(t *testing.T) *mockServer {
+	s := &mockServer{calls: map[string]int{}, responders: map[string]responder{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// respond sets the responder for path.
+func (s *mockServer) respond(path string, fn responder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responders[path] = fn
+}
+
+// queueCommand hands cmd to the agent on its next commands poll.
+func (s *mockServer) queueCommand(cmd PendingCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, cmd)
+}
+
+// enableChannel makes the server accept the command channel, and returns
+// where the channels the agent opens arrive.
+func (s *mockServer) enableChannel() <-chan *mockChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = make(chan *mockChannel, 4)
+	return s.channels
+}
+
+// disableChannel refuses the command channel again, as a server without it
+// would.
+func (s *mockServer) disableChannel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = nil
+}
+
+func (s *mockServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	signed := body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			signed, _ = io.ReadAll(zr)
+		}
+	}
+	req := recordedRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+		Body:   signed,
+		At:     time.Now(),
+	}
+	if signature := r.Header.Get("X-LXMON-Signature"); signature != "" {
+		expected := "v1=" + requestSignature(testAPIKey, r.Header.Get("X-LXMON-Timestamp"), r.Method, signedPath(r.URL), signed)
+		req.SignatureValid = signature == expected
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.calls[req.Path]++
+	call := s.calls[req.Path]
+	fn := s.responders[req.Path]
+	var commands []PendingCommand
+	if req.Path == "/api/agent/commands" {
+		commands, s.commands = s.commands, nil
+	}
+	channels := s.channels
+	s.mu.Unlock()
+
+	if req.Path == "/api/agent/ws" && channels != nil && fn == nil {
+		channels <- acceptChannel(w, r)
+		return
+	}
+
+	status, out := http.StatusOK, interface{}(map[string]interface{}{})
+	switch {
+	case fn != nil:
+		status, out = fn(call, req)
+	case req.Path == "/api/agent/register":
+		out = map[string]string{"status": "registered"}
+	case req.Path == "/api/agent/commands":
+		if commands == nil {
+			commands = []PendingCommand{}
+		}
+		out = commands
+	case req.Path == "/api/agent/config":
+		out = serverSettings{Settings: map[string]interface{}{}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Accept-Encoding", "gzip")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// mockChannel is the server end of the agent's command channel.
+type mockChannel struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// acceptChannel completes the WebSocket handshake of r.
+func acceptChannel(w http.ResponseWriter, r *http.Request) *mockChannel {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	rw.Flush()
+	return &mockChannel{conn: conn, br: rw.Reader}
+}
+
+// send writes msg to the agent as an unmasked text frame.
+func (c *mockChannel) send(t *testing.T, msg channelMessage) {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	frame := []byte{0x80 | wsText}
+	if len(data) < 126 {
+		frame = append(frame, byte(len(data)))
+	} else {
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	}
+	if _, err := c.conn.Write(append(frame, data...)); err != nil {
+		t.Fatalf("send on command channel: %v", err)
+	}
+}
+
+// receive returns the next text message from the agent, skipping control
+// frames, and fails the test if none comes within timeout.
+func (c *mockChannel) receive(t *testing.T, timeout time.Duration, v interface{}) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			t.Fatalf("receive on command channel: %v", err)
+		}
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(c.br, ext[:])
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(c.br, ext[:])
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		var mask [4]byte
+		if head[1]&0x80 == 0 {
+			t.Fatalf("unmasked frame from the agent")
+		}
+		io.ReadFull(c.br, mask[:])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			t.Fatalf("receive on command channel: %v", err)
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		if head[0]&0x0F != wsText {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			t.Fatalf("decode command channel message: %v\n%s", err, payload)
+		}
+		return
+	}
+}
+
+// received returns the requests to path so far.
+func (s *mockServer) received(path string) []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matches []recordedRequest
+	for _, req := range s.requests {
+		if req.Path == path {
+			matches = append(matches, req)
+		}
+	}
+	return matches
+}
+
+// all returns every request so far.
+func (s *mockServer) all() []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedRequest(nil), s.requests...)
+}
+
+// waitFor polls cond until it holds or timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitForRequests waits until path received at least n requests.
+func (s *mockServer) waitForRequests(t *testing.T, path string, n int, timeout time.Duration) []recordedRequest {
+	t.Helper()
+	waitFor(t, timeout, "requests to "+path, func() bool { return len(s.received(path)) >= n })
+	return s.received(path)
+}
+
+// lockedBuffer collects the agent's output from its process.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type agentProcess struct {
+	cmd       *exec.Cmd
+	output    *lockedBuffer
+	stateDir  string
+	healthURL string
+	done      chan struct{}
+}
+
+// startAgent runs the agent against server with a fresh state dir, a 2s
+// interval, quick retries, no jitter and no degraded mode (so a busy test
+// machine does not slow the agent down). args are added to (and override)
+// those flags. The agent is stopped when the test ends, and its log is
+// printed if the test failed.
+func startAgent(t *testing.T, serverURL string, args ...string) *agentProcess {
+	t.Helper()
+	stateDir := t.TempDir()
+	listenAddr := freeAddr(t)
+	flags := append([]string{
+		"--server-url", serverURL,
+		"--api-key", testAPIKey,
+		"--hostname", "itest-" + strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")),
+		"--state-dir", stateDir,
+		"--listen-addr", listenAddr,
+		"--interval", "2s",
+		"--retry-delay", "100ms",
+		"--update-check", "0",
+		"--degrade-load", "0",
+		"--degrade-psi", "0",
+	}, args...)
+
+	agent := &agentProcess{
+		cmd:       exec.Command(os.Args[0], flags...),
+		output:    &lockedBuffer{},
+		stateDir:  stateDir,
+		healthURL: "http://" + listenAddr + "/health",
+		done:      make(chan struct{}),
+	}
+	// Only what the agent needs, so LXMON_* settings of the machine running
+	// the tests do not leak in
+	agent.cmd.Env = []string{
+		"LXMON_INTEGRATION_AGENT=1",
+		"LXMON_JITTER=0",
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + stateDir,
+	}
+	agent.cmd.Stdout = agent.output
+	agent.cmd.Stderr = agent.output
+	if err := agent.cmd.Start(); err != nil {
+		t.Fatalf("start agent: %v", err)
+	}
+	go func() {
+		agent.cmd.Wait()
+		close(agent.done)
+	}()
+	t.Cleanup(func() {
+		agent.stop(t)
+		if t.Failed() {
+			t.Logf("agent log:\n%s", agent.output.String())
+		}
+	})
+	return agent
+}
+
+// stop shuts the agent down as a service manager would, killing it if it
+// does not exit within 10s.
+func (a *agentProcess) stop(t *testing.T) {
+	select {
+	case <-a.done:
+		return
+	default:
+	}
+	a.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-a.done:
+	case <-time.After(10 * time.Second):
+		a.cmd.Process.Kill()
+		<-a.done
+		t.Errorf("agent did not stop within 10s of SIGTERM")
+	}
+}
+
+// health returns the agent's /health document.
+func (a *agentProcess) health(t *testing.T) HealthStatus {
+	t.Helper()
+	var status HealthStatus
+	resp, err := http.Get(a.healthURL)
+	if err != nil {
+		return status
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&status)
+	return status
+}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// kafkaRecord is a record the mock broker was sent.
+type kafkaRecord struct {
+	Partition int32
+	Key       []byte
+	Value     []byte
+}
+
+// mockKafka is a single Kafka broker leading every partition of every topic.
+// It answers Metadata v1 and Produce v3 and keeps the records produced.
+type mockKafka struct {
+	Addr       string
+	partitions int32
+
+	mu      sync.Mutex
+	records []kafkaRecord
+}
+
+func newMockKafka(t *testing.T, partitions int32) *mockKafka {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen kafka: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	k := &mockKafka{Addr: l.Addr().String(), partitions: partitions}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(t, conn)
+		}
+	}()
+	return k
+}
+
+func (k *mockKafka) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		apiKey, apiVersion := binary.BigEndian.Uint16(msg), binary.BigEndian.Uint16(msg[2:])
+		correlation := msg[4:8]
+		clientID := int(binary.BigEndian.Uint16(msg[8:]))
+		body := msg[10+clientID:]
+
+		var resp []byte
+		switch {
+		case apiKey == 3 && apiVersion == 1:
+			resp = k.metadata(body)
+		case apiKey == 0 && apiVersion == 3:
+			resp = k.produce(t, body)
+		default:
+			t.Errorf("mock kafka: unexpected request %d v%d", apiKey, apiVersion)
+			return
+		}
+		frame := binary.BigEndian.AppendUint32(nil, uint32(4+len(resp)))
+		frame = append(append(frame, correlation...), resp...)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (k *mockKafka) metadata(body []byte) []byte {
+	topic := body[6 : 6+int(binary.BigEndian.Uint16(body[4:]))]
+	host, portStr, _ := net.SplitHostPort(k.Addr)
+	var port int
+	fmt.Sscan(portStr, &port)
+
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(host)))
+	b = append(b, host...)
+	b = binary.BigEndian.AppendUint32(b, uint32(port))
+	b = binary.BigEndian.AppendUint16(b, 0xffff) // no rack
+	b = binary.BigEndian.AppendUint32(b, 0)      // controller
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(topic)))
+	b = append(b, topic...)
+	b = append(b, 0) // not internal
+	b = binary.BigEndian.AppendUint32(b, uint32(k.partitions))
+	for i := int32(0); i < k.partitions; i++ {
+		b = binary.BigEndian.AppendUint16(b, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(i))
+		b = binary.BigEndian.AppendUint32(b, 0) // leader
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = binary.BigEndian.AppendUint32(b, 0)
+	}
+	return b
+}
+
+// produce keeps the record of a request for one partition of one topic
+// with one record batch of one record, as the agent sends.
+func (k *mockKafka) produce(t *testing.T, body []byte) []byte {
+	b := body[2+2+4+4:] // transactional ID, acks, timeout, topic count
+	topic := b[2 : 2+int(binary.BigEndian.Uint16(b))]
+	b = b[2+len(topic)+4:]
+	partition := int32(binary.BigEndian.Uint32(b))
+	batch := b[8 : 8+binary.BigEndian.Uint32(b[4:])]
+
+	crc := binary.BigEndian.Uint32(batch[17:])
+	tail := batch[21:]
+	if batch[16] != 2 || crc != crc32.Checksum(tail, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("mock kafka: bad record batch (magic %d, crc %08x)", batch[16], crc)
+	}
+	record := tail[2+4+8+8+8+2+4+4:]
+	_, n := binary.Varint(record) // length
+	record = record[n+1:]         // attributes
+	_, n = binary.Varint(record)  // timestamp delta
+	record = record[n:]
+	_, n = binary.Varint(record) // offset delta
+	record = record[n:]
+	keyLen, n := binary.Varint(record)
+	key := record[n : n+int(keyLen)]
+	record = record[n+int(keyLen):]
+	valueLen, n := binary.Varint(record)
+	value := record[n : n+int(valueLen)]
+
+	k.mu.Lock()
+	k.records = append(k.records, kafkaRecord{Partition: partition, Key: key, Value: value})
+	offset := len(k.records) - 1
+	k.mu.Unlock()
+
+	var resp []byte
+	resp = binary.BigEndian.AppendUint32(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(topic)))
+	resp = append(resp, topic...)
+	resp = binary.BigEndian.AppendUint32(resp, 1)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(partition))
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = binary.BigEndian.AppendUint64(resp, uint64(offset))
+	resp = binary.BigEndian.AppendUint64(resp, 0xffffffffffffffff) // log append time
+	return binary.BigEndian.AppendUint32(resp, 0)                  // throttle
+}
+
+// waitForRecords waits until the broker was sent at least n records.
+func (k *mockKafka) waitForRecords(t *testing.T, n int, timeout time.Duration) []kafkaRecord {
+	t.Helper()
+	var records []kafkaRecord
+	waitFor(t, timeout, fmt.Sprintf("%d kafka records", n), func() bool {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		records = append([]kafkaRecord(nil), k.records...)
+		return len(records) >= n
+	})
+	return records
+}
+
+// mockDNS is a nameserver answering A and AAAA queries from a fixed table,
+// and recording the names and types asked.
+type mockDNS struct {
+	Addr string
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func newMockDNS(t *testing.T, records map[string][]net.IP) *mockDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mock DNS: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &mockDNS{Addr: conn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := d.answer(buf[:n], records); reply != nil {
+				conn.WriteTo(reply, from)
+			}
+		}
+	}()
+	return d
+}
+
+// answer builds the reply to one query, or nil for a malformed one.
+func (d *mockDNS) answer(query []byte, records map[string][]net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	off := 12
+	var labels []string
+	for off < len(query) && query[off] != 0 {
+		end := off + 1 + int(query[off])
+		if end > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[off+1:end]))
+		off = end
+	}
+	if off+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off+1:])
+	question := query[12 : off+5]
+	name := strings.ToLower(strings.Join(labels, "."))
+	d.mu.Lock()
+	d.queries = append(d.queries, fmt.Sprintf("%s/%d", name, qtype))
+	d.mu.Unlock()
+
+	var answers [][]byte
+	for _, ip := range records[name] {
+		switch {
+		case qtype == 1 && ip.To4() != nil:
+			answers = append(answers, ip.To4())
+		case qtype == 28 && ip.To4() == nil:
+			answers = append(answers, ip.To16())
+		}
+	}
+	reply := append([]byte{}, query[:2]...)
+	reply = binary.BigEndian.AppendUint16(reply, 0x8180) // response, recursion available
+	reply = binary.BigEndian.AppendUint16(reply, 1)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(answers)))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, question...)
+	for _, rdata := range answers {
+		reply = append(reply, 0xc0, 12) // the name in the question
+		reply = binary.BigEndian.AppendUint16(reply, qtype)
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint32(reply, 60)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(rdata)))
+		reply = append(reply, rdata...)
+	}
+	return reply
+}
+
+// asked returns the queries received, as name/type.
+func (d *mockDNS) asked() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.queries...)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentHealth tracks the agent's own state for the local health endpoint.
+type agentHealth struct {
+	mu              sync.Mutex
+	startedAt       time.Time
+	registered      bool
+	pending         bool
+	lastCollection  time.Time
+	lastMetricCount int
+	lastSend        time.Time
+	lastSendError   string
+	authError       string
+	quotaError      string
+	spooled         int
+	batched         int
+	shed            int
+}
+
+// HealthStatus is the JSON document served on /health.
+type HealthStatus struct {
+	Status             string                `json:"status"`
+	Hostname           string                `json:"hostname"`
+	AgentID            string                `json:"agent_id,omitempty"`
+	ServerURL          string                `json:"server_url"`
+	Registered         bool                  `json:"registered"`
+	PendingApproval    bool                  `json:"pending_approval,omitempty"`
+	UptimeSeconds      float64               `json:"uptime_seconds"`
+	LastCollection     time.Time             `json:"last_collection"`
+	LastMetricCount    int                   `json:"last_metric_count"`
+	LastSend           time.Time             `json:"last_send"`
+	LastSendError      string                `json:"last_send_error,omitempty"`
+	AuthError          string                `json:"auth_error,omitempty"`
+	QuotaError         string                `json:"quota_error,omitempty"`
+	SpooledPayloads    int                   `json:"spooled_payloads,omitempty"`
+	BatchedCycles      int                   `json:"batched_cycles,omitempty"`
+	ShedMetrics        int                   `json:"shed_metrics,omitempty"`
+	Chaos              bool                  `json:"chaos,omitempty"`
+	CommandChannel     string                `json:"command_channel"`
+	ServerCapabilities []string              `json:"server_capabilities,omitempty"`
+	MQTT               string                `json:"mqtt,omitempty"`
+	Sinks              map[string]SinkStatus `json:"sinks,omitempty"`
+	CircuitBreaker     string                `json:"circuit_breaker,omitempty"`
+	Degraded           bool                  `json:"degraded,omitempty"`
+	DegradedReason     string                `json:"degraded_reason,omitempty"`
+}
+
+var health = &agentHealth{startedAt: time.Now()}
+
+func (h *agentHealth) setRegistered() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.registered = true
+	h.pending = false
+}
+
+// setPendingApproval notes that the server holds the agent until an admin
+// approves its enrollment.
+func (h *agentHealth) setPendingApproval() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = true
+}
+
+func (h *agentHealth) recordCollection(count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCollection = time.Now()
+	h.lastMetricCount = count
+}
+
+func (h *agentHealth) recordSend() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSend = time.Now()
+	h.lastSendError = ""
+}
+
+func (h *agentHealth) recordSendError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSendError = err.Error()
+}
+
+// recordAuthFailure halts sending until the configuration changes.
+func (h *agentHealth) recordAuthFailure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.authError = err.Error()
+}
+
+// clearAuthFailure resumes sending after the credentials were reloaded.
+func (h *agentHealth) clearAuthFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.authError = ""
+}
+
+// recordQuota notes the server's latest quota report ("" when within quota)
+// and reports whether it changed.
+func (h *agentHealth) recordQuota(message string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := h.quotaError != message
+	h.quotaError = message
+	return changed
+}
+
+// setSpooled notes how many payloads wait in the spool for replay.
+func (h *agentHealth) setSpooled(count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.spooled = count
+}
+
+// setBatched notes how many cycles of metrics wait for the batch to be sent.
+func (h *agentHealth) setBatched(cycles int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batched = cycles
+}
+
+// recordShed counts metrics shed over the payload size and request limits.
+func (h *agentHealth) recordShed(count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shed += count
+}
+
+func (h *agentHealth) authHalted() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.authError != ""
+}
+
+// collectionStatus returns the heartbeat status, stalled when no collection
+// cycle completed within the last three intervals (stretched while
+// degraded), and when the last one did.
+func (h *agentHealth) collectionStatus() (string, time.Time) {
+	cfg := currentConfig()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last := h.lastCollection
+	if last.IsZero() {
+		last = h.startedAt
+	}
+	if time.Since(last) > 3*degradedInterval(cfg.Interval) {
+		return heartbeatCollectionStalled, h.lastCollection
+	}
+	return heartbeatOnline, h.lastCollection
+}
+
+// status reports the agent as healthy once it is registered and metrics have
+// been delivered within the last three intervals (stretched while degraded),
+// plus however long batching holds them back (or it is still starting up).
+func (h *agentHealth) status() HealthStatus {
+	cfg := currentConfig()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	staleAfter := 3*degradedInterval(cfg.Interval) + batchDelay()
+	healthy := h.registered && h.authError == ""
+	if h.lastSend.IsZero() {
+		healthy = healthy && time.Since(h.startedAt) < staleAfter
+	} else {
+		healthy = healthy && time.Since(h.lastSend) < staleAfter
+	}
+
+	degraded, reason := isDegraded()
+	status := "ok"
+	if !healthy {
+		status = "unhealthy"
+	}
+	return HealthStatus{
+		Status:             status,
+		Hostname:           cfg.Hostname,
+		AgentID:            agentID,
+		ServerURL:          serverURL(),
+		Registered:         h.registered,
+		PendingApproval:    h.pending,
+		UptimeSeconds:      time.Since(h.startedAt).Seconds(),
+		LastCollection:     h.lastCollection,
+		LastMetricCount:    h.lastMetricCount,
+		LastSend:           h.lastSend,
+		LastSendError:      h.lastSendError,
+		AuthError:          h.authError,
+		QuotaError:         h.quotaError,
+		SpooledPayloads:    h.spooled,
+		BatchedCycles:      h.batched,
+		ShedMetrics:        h.shed,
+		Chaos:              chaosEnabled(),
+		CommandChannel:     commandChannelState(),
+		ServerCapabilities: serverCapabilities(),
+		MQTT:               mqttState(),
+		Sinks:              sinkStatuses(),
+		CircuitBreaker:     circuitState(),
+		Degraded:           degraded,
+		DegradedReason:     reason,
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := health.status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// runHealthcheck implements `lxmon-agent healthcheck`: it queries the running
+// agent's /health endpoint and exits 0 when healthy, 1 otherwise, so it can be
+// used as a Docker HEALTHCHECK or Kubernetes exec probe.
+func runHealthcheck(args []string) int {
+	if err := loadConfig(args); err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 1
+	}
+	cfg := currentConfig()
+	if cfg.ListenAddr == "" {
+		logger.Error("healthcheck.disabled", "Local API is disabled (listen_addr is empty)", nil)
+		return 1
+	}
+
+	client, base := localAPIClient()
+	resp, err := client.Get(base + "/health")
+	if err != nil {
+		logger.Error("healthcheck.failed", "Health check failed", Fields{"error": err})
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		logger.Error("healthcheck.refused", "Local API refused the health check, see local_api_auth", Fields{"status": resp.StatusCode, "error": strings.TrimSpace(string(body))})
+		return 1
+	}
+
+	var status HealthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		logger.Error("healthcheck.invalid_response", "Invalid health response", Fields{"error": err})
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("%s (registered=%t, last_send_error=%q)\n", status.Status, status.Registered, status.LastSendError)
+		return 1
+	}
+	fmt.Println(status.Status)
+	return 0
+}
+
+// dialableAddr turns a listen address such as ":8080" or "0.0.0.0:8080" into
+// one that can be connected to from the same host.
+func dialableAddr(addr string) string {
+	if resolved, err := listenAddress(addr); err == nil {
+		addr = resolved
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
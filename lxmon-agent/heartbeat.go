@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Besides its metrics, the agent pings the server every heartbeat_interval
+// (15s by default) with a small heartbeat. Its metrics come once an
+// interval, and stop both when the host is down and when collection is
+// stuck; the heartbeat keeps coming in the second case and says so, so the
+// server tells the two apart and sees a host go down within seconds.
+
+// Heartbeat statuses.
+const (
+	heartbeatOnline            = "online"
+	heartbeatCollectionStalled = "collection_stalled"
+)
+
+// HeartbeatPayload is the body of POST /api/agent/heartbeat.
+type HeartbeatPayload struct {
+	Hostname        string     `json:"hostname"`
+	Status          string     `json:"status"`
+	AgentVersion    string     `json:"agent_version"`
+	UptimeSeconds   float64    `json:"uptime_seconds"`
+	IntervalSeconds float64    `json:"interval_seconds"`
+	LastCollection  *time.Time `json:"last_collection,omitempty"`
+}
+
+// runHeartbeat sends a heartbeat every heartbeat_interval until ctx is done.
+func runHeartbeat(ctx context.Context) {
+	failing := false
+	for {
+		cfg := currentConfig()
+
+		wait := cfg.HeartbeatInterval
+		if wait > 0 && !cfg.DryRun && !health.authHalted() {
+			err := sendHeartbeat(ctx, cfg)
+			switch {
+			case err != nil && ctx.Err() != nil:
+			case err != nil && !failing:
+				// Metrics report the server being down; once is enough here
+				failing = true
+				logger.Debug("heartbeat.failed", "Failed to send heartbeat", Fields{"error": err})
+			case err == nil && failing:
+				failing = false
+				logger.Debug("heartbeat.resumed", "Heartbeats reach the server again", nil)
+			}
+		}
+		if wait <= 0 {
+			wait = time.Minute // disabled; check again in case a reload enables it
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sendHeartbeat(ctx context.Context, cfg Config) error {
+	status, lastCollection := health.collectionStatus()
+	payload := HeartbeatPayload{
+		Hostname:        cfg.Hostname,
+		Status:          status,
+		AgentVersion:    version,
+		UptimeSeconds:   time.Since(health.startedAt).Seconds(),
+		IntervalSeconds: cfg.HeartbeatInterval.Seconds(),
+	}
+	if !lastCollection.IsZero() {
+		payload.LastCollection = &lastCollection
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	base := serverURL()
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"/api/agent/heartbeat", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create heartbeat request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	signRequest(req, cfg.APIKey, data)
+
+	// A heartbeat late by more than its interval is worth nothing
+	resp, err := serverDo(req, min(cfg.HeartbeatInterval, 30*time.Second))
+	if err != nil {
+		return unavailable("heartbeat", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("heartbeat", resp); err != nil {
+		if errors.Is(err, ErrAuth) {
+			haltOnAuthError(err)
+		}
+		return err
+	}
+	return nil
+}
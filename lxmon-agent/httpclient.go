@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverClient sends every request to the lxmon server. It is shared, so
+// connections and TLS sessions are kept alive and reused from one send to
+// the next. Timeouts are per request, see serverDo.
+var serverClient = &http.Client{Transport: serverRoundTripper{}}
+
+// serverTransport is the transport for the current configuration's TLS and
+// connection pool settings. A reload replaces it, see setServerTransport.
+var serverTransport atomic.Pointer[http.Transport]
+
+type serverRoundTripper struct{}
+
+// RoundTrip sends req on the current transport. Every request carries the
+// agent ID, so the server finds the host's record even after a rename. In
+// chaos mode the request goes through the fault injection first.
+func (serverRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if agentID != "" && req.Header.Get("X-LXMON-Agent-ID") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-LXMON-Agent-ID", agentID)
+	}
+	if chaosEnabled() {
+		return chaosRoundTrip(req, transportRoundTrip)
+	}
+	return transportRoundTrip(req)
+}
+
+func transportRoundTrip(req *http.Request) (*http.Response, error) {
+	if transport := serverTransport.Load(); transport != nil {
+		return transport.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// setServerTransport switches to transport and closes the idle connections
+// of the previous one. Requests in flight finish on their connection.
+func setServerTransport(transport *http.Transport) {
+	if previous := serverTransport.Swap(transport); previous != nil && previous != transport {
+		previous.CloseIdleConnections()
+	}
+}
+
+// serverDo sends req to the lxmon server and gives up after timeout, which
+// also bounds reading the response body. The body must be closed; closing
+// it drains what is left so the connection returns to the pool.
+// While the circuit breaker is open it fails at once with errCircuitOpen.
+func serverDo(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if err := circuitAllow(); err != nil {
+		return nil, err
+	}
+	resp, err := sendServerRequest(req, timeout)
+	circuitRecord(resp, err)
+	return resp, err
+}
+
+// sendServerRequest is serverDo without the circuit breaker, for probing a
+// server requests do not go to.
+func sendServerRequest(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := serverClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &drainingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type drainingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *drainingBody) Close() error {
+	// Larger leftovers are cheaper to drop with the connection
+	io.Copy(io.Discard, io.LimitReader(b.ReadCloser, 64*1024))
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// agentIDFile holds the agent's durable ID in the state dir. Files from
+// before agentIDVersion have no version and read as 0.
+const (
+	agentIDFile    = "agent-id.json"
+	agentIDVersion = 1
+)
+
+var machineIDPath = "/etc/machine-id"
+
+// agentID identifies this installation to the server independently of its
+// hostname, so the server can tell a renamed host from a new one.
+var agentID string
+
+type agentIdentity struct {
+	Version   int    `json:"version"`
+	ID        string `json:"id"`
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+// loadAgentID reads the agent ID from the state dir, creating it on first
+// start. The machine ID it was created on is kept with it: a state dir that
+// turns up on another machine (a cloned VM image, a copied volume) gets a
+// new ID instead of taking over the original host's record. Without a state
+// dir (or when it cannot be written) the ID is derived from the machine ID,
+// or there is none.
+func loadAgentID(stateDir string) string {
+	machineID := readMachineID()
+	if stateDir == "" {
+		return machineUUID(machineID)
+	}
+
+	path := filepath.Join(stateDir, agentIDFile)
+	var identity agentIdentity
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &identity) == nil && identity.ID != "" {
+		if identity.Version > agentIDVersion {
+			// Left for the newer agent that wrote it
+			logger.Warn("identity.unknown_version", "Agent ID file has a newer format, using the ID derived from the machine", Fields{"version": identity.Version})
+			return machineUUID(machineID)
+		}
+		if identity.MachineID == machineID {
+			return identity.ID
+		}
+		logger.Warn("identity.machine_changed", "State dir was created on another machine, generating a new agent ID", Fields{
+			"previous_id": identity.ID,
+		})
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		logger.Warn("identity.generate_failed", "Failed to generate an agent ID", Fields{"error": err})
+		return machineUUID(machineID)
+	}
+	identity = agentIdentity{Version: agentIDVersion, ID: id, MachineID: machineID}
+	data, _ := json.Marshal(identity)
+	if err := writeStateFile(path, data); err != nil {
+		// An ID that does not survive a restart would look like a new host
+		// every time
+		logger.Warn("identity.save_failed", "Failed to save the agent ID", Fields{"error": err, "path": path})
+		return machineUUID(machineID)
+	}
+	logger.Info("identity.created", "Generated agent ID", Fields{"agent_id": id})
+	return id
+}
+
+func readMachineID() string {
+	data, err := os.ReadFile(machineIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return formatUUID(b, 4), nil
+}
+
+// machineUUID derives a stable UUID from the machine ID, without exposing
+// it, or returns "" without one.
+func machineUUID(machineID string) string {
+	if machineID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("lxmon-agent-id:" + machineID))
+	var b [16]byte
+	copy(b[:], sum[:16])
+	return formatUUID(b, 8)
+}
+
+func formatUUID(b [16]byte, version byte) string {
+	b[6] = b[6]&0x0f | version<<4
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
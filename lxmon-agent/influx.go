@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The agent can also write its metrics in InfluxDB line protocol, to
+// InfluxDB (1.x /write or 2.x /api/v2/write) or to Telegraf's HTTP listener.
+// Each metric is one line:
+//
+//	<measurement>,host=<hostname>,<tags and metadata> <field>=<value> <ns>
+//
+// influx_measurement chooses the naming: "type" writes cpu usage_percent=...
+// as Telegraf's own inputs do, "metric" writes cpu.usage_percent value=...
+// Metadata are tags, renamed by influx_tag_map, except the keys listed in
+// influx_field_keys, which are fields so they do not multiply the series.
+// Names follow metric_names, like those sent to the server.
+
+const (
+	influxMeasurementType   = "type"
+	influxMeasurementMetric = "metric"
+)
+
+// influxClient sends to the InfluxDB endpoint, which is not the lxmon
+// server: it gets neither the server's TLS settings nor its request
+// signature.
+var influxClient = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", " ")
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", " ")
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+func influxEnabled() bool {
+	return currentConfig().InfluxURL != ""
+}
+
+// sendInflux makes one attempt at writing a batch.
+func sendInflux(cfg Config, batch sinkBatch) error {
+	if cfg.DryRun {
+		logDryRun(redactURL(cfg.InfluxURL), batch.body)
+		return nil
+	}
+	return postInflux(cfg, batch.body)
+}
+
+func postInflux(cfg Config, body []byte) error {
+	req, err := http.NewRequest("POST", cfg.InfluxURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create InfluxDB request: %w", err)
+	}
+	if req.URL.User != nil {
+		password, _ := req.URL.User.Password()
+		req.SetBasicAuth(req.URL.User.Username(), password)
+		req.URL.User = nil
+	}
+	if cfg.InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+cfg.InfluxToken)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "lxmon-agent/"+version)
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return unavailable("influx write", err)
+	}
+	defer resp.Body.Close()
+	return checkResponse("influx write", resp)
+}
+
+// encodeInflux encodes a cycle's metrics, as collected, as line protocol.
+func encodeInflux(cfg Config, metrics []Metric) sinkBatch {
+	// Renamed on a copy: the metrics are sent on to the server as they are
+	metrics = applyMetricNames(cfg, append([]Metric(nil), metrics...))
+
+	fieldKeys := map[string]bool{}
+	for _, key := range cfg.InfluxFieldKeys {
+		fieldKeys[key] = true
+	}
+
+	var b bytes.Buffer
+	count := 0
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		measurement, field := m.MetricType, m.MetricName
+		if cfg.InfluxMeasurement == influxMeasurementMetric {
+			measurement, field = m.MetricType+"."+m.MetricName, "value"
+		}
+
+		tags := map[string]string{}
+		for key, value := range cfg.Tags {
+			tags[influxTagName(cfg, key)] = value
+		}
+		var extra []string
+		for key, value := range m.Metadata {
+			if fieldKeys[key] {
+				extra = append(extra, influxKeyEscaper.Replace(key)+"="+influxFieldValue(value))
+				continue
+			}
+			tags[influxTagName(cfg, key)] = influxTagValue(value)
+		}
+		tags["host"] = cfg.Hostname
+
+		b.WriteString(influxMeasurementEscaper.Replace(cfg.InfluxPrefix + measurement))
+		names := make([]string, 0, len(tags))
+		for name := range tags {
+			names = append(names, name)
+		}
+		// Sorted tags are what InfluxDB stores, and cheapest for it to parse
+		sort.Strings(names)
+		for _, name := range names {
+			if tags[name] == "" {
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(influxKeyEscaper.Replace(name))
+			b.WriteByte('=')
+			b.WriteString(influxKeyEscaper.Replace(tags[name]))
+		}
+		b.WriteByte(' ')
+		b.WriteString(influxKeyEscaper.Replace(field))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		sort.Strings(extra)
+		for _, f := range extra {
+			b.WriteByte(',')
+			b.WriteString(f)
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(m.Timestamp.UnixNano(), 10))
+		b.WriteByte('\n')
+		count++
+	}
+	return sinkBatch{body: b.Bytes(), count: count}
+}
+
+// influxTagName is the tag a metadata key or a configured tag is written as.
+func influxTagName(cfg Config, key string) string {
+	if name, ok := cfg.InfluxTagMap[key]; ok {
+		return name
+	}
+	return key
+}
+
+func influxTagValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64, int, int64, bool:
+		return fmt.Sprint(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// influxFieldValue writes numbers as floats (no "i" suffix), so a field
+// keeps one type however its values look, and everything else as strings.
+func influxFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return `"` + influxStringEscaper.Replace(influxTagValue(value)) + `"`
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultUnitPath = "/etc/systemd/system/lxmon-agent.service"
+	defaultEnvFile  = "/etc/lxmon/agent.env"
+)
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=lxmon monitoring agent
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+EnvironmentFile=-{{.EnvFile}}
+ExecStart={{.ExecStart}}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+StateDirectory=lxmon
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+const envFileTemplate = `# Environment for lxmon-agent (see lxmon-agent --help for all LXMON_* settings)
+LXMON_SERVER_URL=%s
+LXMON_API_KEY=%s
+`
+
+// runInstall writes a systemd unit for this binary, creates the
+// EnvironmentFile it reads if there is none yet, and enables and starts the
+// service.
+func runInstall(args []string) int {
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	unitPath := fs.String("unit", defaultUnitPath, "systemd unit file to write")
+	envFile := fs.String("env-file", defaultEnvFile, "EnvironmentFile with LXMON_* settings")
+	configFile := fs.String("config", "", "config file passed to the agent with --config")
+	printOnly := fs.Bool("print", false, "print the unit instead of installing it")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		logger.Error("install.failed", "Cannot determine agent binary path", Fields{"error": err})
+		return 1
+	}
+	execStart := binary
+	if *configFile != "" {
+		absConfig, err := filepath.Abs(*configFile)
+		if err != nil {
+			logger.Error("install.failed", "Invalid config path", Fields{"error": err})
+			return 1
+		}
+		execStart += " --config " + absConfig
+	}
+
+	var unit strings.Builder
+	if err := unitTemplate.Execute(&unit, map[string]string{"EnvFile": *envFile, "ExecStart": execStart}); err != nil {
+		logger.Error("install.failed", "Failed to render unit", Fields{"error": err})
+		return 1
+	}
+	if *printOnly {
+		fmt.Print(unit.String())
+		return 0
+	}
+
+	if err := writeEnvFile(*envFile); err != nil {
+		logger.Error("install.failed", "Failed to write environment file", Fields{"path": *envFile, "error": err})
+		return 1
+	}
+	if err := os.WriteFile(*unitPath, []byte(unit.String()), 0644); err != nil {
+		logger.Error("install.failed", "Failed to write unit", Fields{"path": *unitPath, "error": err})
+		return 1
+	}
+	unitName := filepath.Base(*unitPath)
+	if err := systemctl("daemon-reload"); err != nil {
+		return 1
+	}
+	if err := systemctl("enable", "--now", unitName); err != nil {
+		return 1
+	}
+	fmt.Printf("installed and started %s (settings in %s)\n", unitName, *envFile)
+	return 0
+}
+
+// runUninstall stops and disables the service and removes its unit. The
+// EnvironmentFile is kept unless --purge is given, so a reinstall picks the
+// settings up again.
+func runUninstall(args []string) int {
+	fs := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	unitPath := fs.String("unit", defaultUnitPath, "systemd unit file to remove")
+	envFile := fs.String("env-file", defaultEnvFile, "EnvironmentFile removed with --purge")
+	purge := fs.Bool("purge", false, "also remove the EnvironmentFile")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	unitName := filepath.Base(*unitPath)
+	if _, err := os.Stat(*unitPath); err == nil {
+		// Keep going if the unit is already stopped or disabled
+		_ = systemctl("disable", "--now", unitName)
+		if err := os.Remove(*unitPath); err != nil {
+			logger.Error("uninstall.failed", "Failed to remove unit", Fields{"path": *unitPath, "error": err})
+			return 1
+		}
+		if err := systemctl("daemon-reload"); err != nil {
+			return 1
+		}
+	}
+	if *purge {
+		if err := os.Remove(*envFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("uninstall.failed", "Failed to remove environment file", Fields{"path": *envFile, "error": err})
+			return 1
+		}
+	}
+	fmt.Printf("removed %s\n", unitName)
+	return 0
+}
+
+// writeEnvFile creates the EnvironmentFile from the current LXMON_* values
+// (or placeholders). An existing file is left untouched.
+func writeEnvFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	serverURL := os.Getenv("LXMON_SERVER_URL")
+	if serverURL == "" {
+		serverURL = defaultConfig().ServerURL
+	}
+	apiKey := os.Getenv("LXMON_API_KEY")
+	if apiKey == "" {
+		apiKey = "change-me"
+	}
+	// The API key is a secret: readable by root only
+	return os.WriteFile(path, []byte(fmt.Sprintf(envFileTemplate, serverURL, apiKey)), 0600)
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		logger.Error("install.systemctl_failed", "systemctl failed", Fields{
+			"args":   strings.Join(args, " "),
+			"error":  err,
+			"output": strings.TrimSpace(string(out)),
+		})
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// pidFileName is the agent's PID file in the state dir. The running agent
+// holds an exclusive flock on it, so a second agent on the same state dir
+// (a manual start next to the service, a duplicated unit) refuses to start
+// instead of double-reporting and running every command twice. The lock goes
+// with the process, however it ends; the PID is cleared on a clean stop, so
+// one found in the file belonged to an agent that crashed or was killed.
+const pidFileName = "agent.pid"
+
+// instanceLock is the open, locked PID file, held until the agent stops.
+var instanceLock *os.File
+
+// ErrAlreadyRunning is returned when another agent holds the state dir.
+var ErrAlreadyRunning = errors.New("another agent is running")
+
+// acquireInstanceLock locks the state dir for this process and records its
+// PID. Without a state dir there is nothing to share and nothing is locked.
+func acquireInstanceLock(stateDir string) error {
+	if stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	path := filepath.Join(stateDir, pidFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("open PID file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		previous := readPID(f)
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return fmt.Errorf("%w (pid %s) with state dir %s", ErrAlreadyRunning, previous, stateDir)
+		}
+		return fmt.Errorf("lock PID file: %w", err)
+	}
+
+	if previous := readPID(f); previous != "" {
+		logger.Warn("instance.unclean_stop", "Previous agent did not stop cleanly, adopting its state", Fields{"previous_pid": previous})
+		adoptOrphanedState(stateDir)
+	}
+	if err := writePID(f, strconv.Itoa(os.Getpid())); err != nil {
+		f.Close()
+		return fmt.Errorf("write PID file: %w", err)
+	}
+	instanceLock = f
+	return nil
+}
+
+// releaseInstanceLock clears the PID, marking a clean stop, and unlocks.
+// The file stays: removing it would let an agent starting meanwhile lock
+// a file the next one no longer sees.
+func releaseInstanceLock() {
+	if instanceLock == nil {
+		return
+	}
+	writePID(instanceLock, "")
+	instanceLock.Close()
+	instanceLock = nil
+}
+
+// adoptOrphanedState cleans up after an agent that stopped mid-write. The
+// lock is held, so nothing else writes to the state dir: spool files the
+// crashed agent had not finished are dropped now instead of after an hour,
+// and its spooled payloads and crash reports are picked up as usual.
+func adoptOrphanedState(stateDir string) {
+	matches, _ := filepath.Glob(filepath.Join(stateDir, "spool", ".tmp-*"))
+	for _, path := range matches {
+		os.Remove(path)
+	}
+	if len(matches) > 0 {
+		logger.Info("instance.adopted", "Removed unfinished spool files of the previous agent", Fields{"count": len(matches)})
+	}
+}
+
+func readPID(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	return strings.TrimSpace(string(buf[:n]))
+}
+
+func writePID(f *os.File, pid string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if pid == "" {
+		return f.Sync()
+	}
+	if _, err := f.WriteAt([]byte(pid+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jitteredInterval spreads collection cycles by up to ±jitter (a fraction of
+// interval) so that a fleet started together does not report in lockstep.
+func jitteredInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	offset := (rand.Float64()*2 - 1) * jitter * float64(interval)
+	return interval + time.Duration(offset)
+}
+
+// initialDelay picks a random start within the first interval when jitter is
+// enabled, so agents restarted together (a config rollout, a server outage)
+// spread over the whole interval instead of hitting the server at once.
+func initialDelay(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(interval)))
+}
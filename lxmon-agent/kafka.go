@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The agent can also publish every cycle's payload to a Kafka topic, for
+// pipelines built on Kafka rather than on the lxmon server. Each cycle is one
+// record: the metrics payload without the API key, as JSON or, with a schema
+// registry, as Avro in the Confluent wire format. Records are keyed by
+// hostname and, with kafka_partitioning "hostname", go to the partition the
+// Java client would pick for that key, so a host's payloads stay in order on
+// one partition; "round_robin" spreads them instead.
+//
+// The producer speaks the Kafka protocol itself (Metadata v1 and Produce v3
+// with record batch v2, which every broker since 0.11 and 4.x accept), with
+// acks from all in-sync replicas, TLS with the server's TLS settings, and
+// SASL/PLAIN.
+
+const (
+	kafkaFormatJSON = "json"
+	kafkaFormatAvro = "avro"
+
+	kafkaPartitionHostname   = "hostname"
+	kafkaPartitionRoundRobin = "round_robin"
+
+	kafkaClientID        = "lxmon-agent"
+	kafkaTimeout         = 30 * time.Second
+	kafkaProduceTimeout  = 10 * time.Second
+	kafkaMetadataMaxAge  = 5 * time.Minute
+	kafkaMaxResponseSize = 16 << 20
+)
+
+// Kafka API keys used by the producer.
+const (
+	kafkaAPIProduce          = 0
+	kafkaAPIMetadata         = 3
+	kafkaAPISaslHandshake    = 17
+	kafkaAPISaslAuthenticate = 36
+)
+
+// kafkaRetriableErrors are the broker error codes a later attempt, with
+// fresh metadata, may get past: leadership moving, replicas catching up, a
+// topic being created.
+var kafkaRetriableErrors = map[int16]bool{
+	3: true, 5: true, 6: true, 7: true, 8: true, 9: true, 13: true, 19: true, 20: true, 56: true,
+}
+
+// kafkaError is an error code a broker answered with.
+type kafkaError struct {
+	op   string
+	code int16
+}
+
+func (e *kafkaError) Error() string {
+	return fmt.Sprintf("kafka %s: broker error code %d", e.op, e.code)
+}
+
+// kafkaPayload is the metrics payload published, without the API key.
+type kafkaPayload struct {
+	Hostname string            `json:"hostname"`
+	Metrics  []Metric          `json:"metrics"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// kafkaAvroSchema describes kafkaPayload. Metadata values are strings, as
+// Avro maps have a single value type.
+const kafkaAvroSchema = `{"type":"record","name":"MetricsPayload","namespace":"io.lxmon","fields":[` +
+	`{"name":"hostname","type":"string"},` +
+	`{"name":"tags","type":{"type":"map","values":"string"}},` +
+	`{"name":"metrics","type":{"type":"array","items":{"type":"record","name":"Metric","fields":[` +
+	`{"name":"metric_type","type":"string"},` +
+	`{"name":"metric_name","type":"string"},` +
+	`{"name":"value","type":"double"},` +
+	`{"name":"unit","type":"string"},` +
+	`{"name":"metadata","type":{"type":"map","values":"string"}},` +
+	`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}}]}}}]}`
+
+// kafkaProducer holds the broker connections and the topic's partition
+// leaders between sends. Everything is dropped on a failure and set up again
+// on the next attempt.
+var kafkaProducer = struct {
+	sync.Mutex
+	conns     map[int32]*kafkaConn
+	brokers   map[int32]string
+	leaders   []int32
+	refreshed time.Time
+	next      int
+	// schemaID is the registry's ID of kafkaAvroSchema under schemaKey
+	// (registry and subject)
+	schemaID  int32
+	schemaKey string
+}{}
+
+// kafkaRegistryClient talks to the schema registry, which is not the lxmon
+// server: it gets neither the server's TLS settings nor its request
+// signature.
+var kafkaRegistryClient = &http.Client{Timeout: 30 * time.Second}
+
+func kafkaEnabled() bool {
+	cfg := currentConfig()
+	return len(cfg.KafkaBrokers) > 0 && cfg.KafkaTopic != ""
+}
+
+// encodeKafka encodes a cycle's metrics, as collected, as a record value.
+// An Avro value gets its schema ID when it is sent.
+func encodeKafka(cfg Config, metrics []Metric) sinkBatch {
+	// Renamed and tagged on a copy: the metrics are sent on to the server as
+	// they are
+	payload := newMetricsPayload(cfg, copyMetrics(metrics))
+	if len(payload.Metrics) == 0 {
+		return sinkBatch{}
+	}
+	if cfg.KafkaFormat == kafkaFormatAvro {
+		return sinkBatch{body: encodeKafkaAvro(payload), count: len(payload.Metrics)}
+	}
+	body, err := json.Marshal(kafkaPayload{Hostname: payload.Hostname, Metrics: payload.Metrics, Tags: payload.Tags})
+	if err != nil {
+		logger.Error("kafka.encode_failed", "Failed to encode metrics for Kafka", Fields{"error": err})
+		return sinkBatch{}
+	}
+	return sinkBatch{body: body, count: len(payload.Metrics)}
+}
+
+// sendKafka makes one attempt at publishing a batch.
+func sendKafka(cfg Config, batch sinkBatch) error {
+	value := batch.body
+	if cfg.DryRun {
+		logDryRun("kafka:"+cfg.KafkaTopic, []byte(fmt.Sprintf(`{"metrics":%d}`, batch.count)))
+		return nil
+	}
+
+	kafkaProducer.Lock()
+	defer kafkaProducer.Unlock()
+	if cfg.KafkaFormat == kafkaFormatAvro {
+		id, err := kafkaSchemaID(cfg)
+		if err != nil {
+			return err
+		}
+		// Confluent wire format: magic byte, schema ID, Avro datum
+		header := []byte{0}
+		header = binary.BigEndian.AppendUint32(header, uint32(id))
+		value = append(header, value...)
+	}
+	err := kafkaProduce(cfg, []byte(cfg.Hostname), value)
+	if err == nil {
+		return nil
+	}
+	kafkaReset()
+	var brokerErr *kafkaError
+	if errors.As(err, &brokerErr) && !kafkaRetriableErrors[brokerErr.code] {
+		return err
+	}
+	return unavailable("kafka produce", err)
+}
+
+// kafkaProduce publishes one record to the partition its key, or the round
+// robin, picks. Callers hold kafkaProducer.
+func kafkaProduce(cfg Config, key, value []byte) error {
+	if kafkaProducer.leaders == nil || time.Since(kafkaProducer.refreshed) > kafkaMetadataMaxAge {
+		if err := kafkaRefreshMetadata(cfg); err != nil {
+			return err
+		}
+	}
+	partitions := len(kafkaProducer.leaders)
+	partition := 0
+	if cfg.KafkaPartitioning == kafkaPartitionRoundRobin {
+		partition = kafkaProducer.next % partitions
+		kafkaProducer.next++
+	} else {
+		partition = int(murmur2(key)&0x7fffffff) % partitions
+	}
+	leader := kafkaProducer.leaders[partition]
+	if leader < 0 {
+		return &kafkaError{op: "produce", code: 5}
+	}
+	conn, err := kafkaBroker(cfg, leader)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	body = kafkaAppendInt16(body, -1) // no transactional ID
+	body = kafkaAppendInt16(body, -1) // acks from all in-sync replicas
+	body = binary.BigEndian.AppendUint32(body, uint32(kafkaProduceTimeout.Milliseconds()))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = kafkaAppendString(body, cfg.KafkaTopic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	records := kafkaRecordBatch(key, value, time.Now())
+	body = binary.BigEndian.AppendUint32(body, uint32(len(records)))
+	body = append(body, records...)
+
+	resp, err := conn.request(kafkaAPIProduce, 3, body)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{b: resp}
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int32()
+			if code := r.int16(); code != 0 && r.err == nil {
+				return &kafkaError{op: "produce", code: code}
+			}
+			r.int64()
+			r.int64()
+		}
+	}
+	return r.err
+}
+
+// kafkaRefreshMetadata asks the bootstrap brokers, in turn, for the brokers
+// and the topic's partition leaders. Callers hold kafkaProducer.
+func kafkaRefreshMetadata(cfg Config) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = kafkaAppendString(body, cfg.KafkaTopic)
+
+	var lastErr error
+	for _, addr := range cfg.KafkaBrokers {
+		conn, err := dialKafka(cfg, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, err := conn.request(kafkaAPIMetadata, 1, body)
+		conn.close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return kafkaParseMetadata(resp, cfg.KafkaTopic)
+	}
+	return lastErr
+}
+
+func kafkaParseMetadata(resp []byte, topic string) error {
+	r := &kafkaReader{b: resp}
+	brokers := map[int32]string{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.nullableString()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller
+	var leaders []int32
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		code, name := r.int16(), r.string()
+		r.int8()
+		type partitionLeader struct{ index, leader int32 }
+		var found []partitionLeader
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int16()
+			index, leader := r.int32(), r.int32()
+			for replicas := r.int32(); replicas > 0 && r.err == nil; replicas-- {
+				r.int32()
+			}
+			for isr := r.int32(); isr > 0 && r.err == nil; isr-- {
+				r.int32()
+			}
+			found = append(found, partitionLeader{index, leader})
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			return &kafkaError{op: "metadata", code: code}
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].index < found[j].index })
+		for _, p := range found {
+			leaders = append(leaders, p.leader)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(leaders) == 0 {
+		return &kafkaError{op: "metadata", code: 3}
+	}
+	kafkaProducer.brokers, kafkaProducer.leaders, kafkaProducer.refreshed = brokers, leaders, time.Now()
+	return nil
+}
+
+// kafkaBroker returns the connection to a broker, connecting first if there
+// is none. Callers hold kafkaProducer.
+func kafkaBroker(cfg Config, id int32) (*kafkaConn, error) {
+	if conn, ok := kafkaProducer.conns[id]; ok {
+		return conn, nil
+	}
+	addr, ok := kafkaProducer.brokers[id]
+	if !ok {
+		return nil, &kafkaError{op: "produce", code: 8}
+	}
+	conn, err := dialKafka(cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+	if kafkaProducer.conns == nil {
+		kafkaProducer.conns = map[int32]*kafkaConn{}
+	}
+	kafkaProducer.conns[id] = conn
+	return conn, nil
+}
+
+// kafkaReset closes the connections and forgets the metadata, so the next
+// attempt starts afresh. Callers hold kafkaProducer.
+func kafkaReset() {
+	for _, conn := range kafkaProducer.conns {
+		conn.close()
+	}
+	kafkaProducer.conns, kafkaProducer.leaders = nil, nil
+}
+
+// kafkaSchemaID registers kafkaAvroSchema under <topic>-value with the
+// schema registry, once, and returns its ID. Callers hold kafkaProducer.
+func kafkaSchemaID(cfg Config) (int32, error) {
+	subject := cfg.KafkaTopic + "-value"
+	key := cfg.KafkaSchemaRegistry + "|" + subject
+	if kafkaProducer.schemaKey == key {
+		return kafkaProducer.schemaID, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"schema": kafkaAvroSchema})
+	endpoint := cfg.KafkaSchemaRegistry + "/subjects/" + url.PathEscape(subject) + "/versions"
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema registry request: %w", err)
+	}
+	if req.URL.User != nil {
+		password, _ := req.URL.User.Password()
+		req.SetBasicAuth(req.URL.User.Username(), password)
+		req.URL.User = nil
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("User-Agent", "lxmon-agent/"+version)
+	resp, err := kafkaRegistryClient.Do(req)
+	if err != nil {
+		return 0, unavailable("schema registry", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("schema registry", resp); err != nil {
+		return 0, err
+	}
+	var registered struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&registered); err != nil {
+		return 0, fmt.Errorf("schema registry: invalid response: %w", err)
+	}
+	kafkaProducer.schemaID, kafkaProducer.schemaKey = registered.ID, key
+	logger.Info("kafka.schema_registered", "Registered the Avro schema of the Kafka records", Fields{"subject": subject, "id": registered.ID})
+	return registered.ID, nil
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	correlation int32
+}
+
+// dialKafka connects to a broker, over TLS with kafka_tls, and
+// authenticates with SASL/PLAIN when kafka_username is set.
+func dialKafka(cfg Config, addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: kafkaTimeout}
+	var raw net.Conn
+	var err error
+	if cfg.KafkaTLS {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig.ServerName = host
+		raw, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		raw, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &kafkaConn{conn: raw, br: bufio.NewReader(raw)}
+	if cfg.KafkaUsername != "" {
+		if err := c.authenticate(cfg.KafkaUsername, cfg.KafkaPassword); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate runs the SASL/PLAIN exchange.
+func (c *kafkaConn) authenticate(username, password string) error {
+	resp, err := c.request(kafkaAPISaslHandshake, 1, kafkaAppendString(nil, "PLAIN"))
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{b: resp}
+	if code := r.int16(); code != 0 {
+		return &kafkaError{op: "sasl handshake", code: code}
+	}
+
+	token := []byte("\x00" + username + "\x00" + password)
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(token)))
+	resp, err = c.request(kafkaAPISaslAuthenticate, 0, append(body, token...))
+	if err != nil {
+		return err
+	}
+	r = &kafkaReader{b: resp}
+	if code := r.int16(); code != 0 {
+		return fmt.Errorf("%w: %s", &kafkaError{op: "sasl authenticate", code: code}, r.nullableString())
+	}
+	return r.err
+}
+
+// request sends a request with header v1 and returns the response body
+// after its correlation ID.
+func (c *kafkaConn) request(apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c.correlation++
+	var msg []byte
+	msg = kafkaAppendInt16(msg, apiKey)
+	msg = kafkaAppendInt16(msg, apiVersion)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(c.correlation))
+	msg = kafkaAppendString(msg, kafkaClientID)
+	msg = append(msg, body...)
+
+	c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	if _, err := c.conn.Write(append(frame, msg...)); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.br, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("kafka: invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.br, resp); err != nil {
+		return nil, err
+	}
+	if correlation := int32(binary.BigEndian.Uint32(resp)); correlation != c.correlation {
+		return nil, fmt.Errorf("kafka: response %d to request %d", correlation, c.correlation)
+	}
+	return resp[4:], nil
+}
+
+func (c *kafkaConn) close() {
+	c.conn.Close()
+}
+
+// kafkaRecordBatch encodes a record batch (magic 2) of one uncompressed
+// record.
+func kafkaRecordBatch(key, value []byte, at time.Time) []byte {
+	var record []byte
+	record = append(record, 0)              // attributes
+	record = binary.AppendVarint(record, 0) // timestamp delta
+	record = binary.AppendVarint(record, 0) // offset delta
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0) // headers
+
+	millis := at.UnixMilli()
+	var tail []byte // attributes to the end, covered by the CRC
+	tail = kafkaAppendInt16(tail, 0)
+	tail = binary.BigEndian.AppendUint32(tail, 0) // last offset delta
+	tail = binary.BigEndian.AppendUint64(tail, uint64(millis))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(millis))
+	tail = binary.BigEndian.AppendUint64(tail, math.MaxUint64) // no producer ID
+	tail = kafkaAppendInt16(tail, -1)                          // producer epoch
+	tail = binary.BigEndian.AppendUint32(tail, math.MaxUint32) // base sequence
+	tail = binary.BigEndian.AppendUint32(tail, 1)
+	tail = binary.AppendVarint(tail, int64(len(record)))
+	tail = append(tail, record...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0) // base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail)))
+	batch = binary.BigEndian.AppendUint32(batch, math.MaxUint32) // leader epoch
+	batch = append(batch, 2)                                     // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, crc32.MakeTable(crc32.Castagnoli)))
+	return append(batch, tail...)
+}
+
+// murmur2 is the hash the Java client partitions keys by.
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// encodeKafkaAvro encodes a payload as an Avro datum of kafkaAvroSchema.
+func encodeKafkaAvro(payload MetricsPayload) []byte {
+	var b []byte
+	b = avroAppendString(b, payload.Hostname)
+	tags := make(map[string]interface{}, len(payload.Tags))
+	for key, value := range payload.Tags {
+		tags[key] = value
+	}
+	b = avroAppendMap(b, tags)
+	if len(payload.Metrics) > 0 {
+		b = binary.AppendVarint(b, int64(len(payload.Metrics)))
+		for _, m := range payload.Metrics {
+			b = avroAppendString(b, m.MetricType)
+			b = avroAppendString(b, m.MetricName)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(m.Value))
+			b = avroAppendString(b, m.Unit)
+			b = avroAppendMap(b, m.Metadata)
+			b = binary.AppendVarint(b, m.Timestamp.UnixMilli())
+		}
+	}
+	return binary.AppendVarint(b, 0)
+}
+
+func avroAppendString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// avroAppendMap writes a map of strings in key order, as one block.
+func avroAppendMap(b []byte, values map[string]interface{}) []byte {
+	if len(values) == 0 {
+		return binary.AppendVarint(b, 0)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b = binary.AppendVarint(b, int64(len(keys)))
+	for _, key := range keys {
+		b = avroAppendString(b, key)
+		b = avroAppendString(b, influxTagValue(values[key]))
+	}
+	return binary.AppendVarint(b, 0)
+}
+
+func kafkaAppendInt16(b []byte, v int16) []byte {
+	return binary.BigEndian.AppendUint16(b, uint16(v))
+}
+
+func kafkaAppendString(b []byte, s string) []byte {
+	b = kafkaAppendInt16(b, int16(len(s)))
+	return append(b, s...)
+}
+
+// kafkaReader reads a response, keeping the first error so a message can be
+// parsed to the end before checking it.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errors.New("kafka: truncated response")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if v := r.next(1); v != nil {
+		return int8(v[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if v := r.next(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if v := r.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if v := r.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
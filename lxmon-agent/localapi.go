@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// startLocalAPI starts the agent's local HTTP API on config.ListenAddr, a
+// TCP address or unix:/path for a unix socket. It returns nil when the API
+// is disabled or cannot listen.
+func startLocalAPI() *http.Server {
+	cfg := currentConfig()
+	if cfg.ListenAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/local/events", handleLocalEvents)
+	mux.HandleFunc("/local/collectors", handleLocalCollectors)
+
+	listener, err := listenLocalAPI(cfg.ListenAddr)
+	if err != nil {
+		logger.Error("local_api.failed", "Local API failed", Fields{"error": err})
+		return nil
+	}
+	server := &http.Server{
+		Handler:           requireLocalAuth(mux),
+		ConnContext:       localPeerContext,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		defer crashGuard()
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("local_api.failed", "Local API failed", Fields{"error": err})
+		}
+	}()
+	logger.Info("local_api.listening", "Local API listening", Fields{"addr": cfg.ListenAddr, "auth": cfg.LocalAPIAuth})
+	if cfg.LocalAPIAuth == localAuthNone && !strings.HasPrefix(cfg.ListenAddr, localUnixPrefix) && !loopbackAddr(cfg.ListenAddr) {
+		logger.Warn("local_api.loopback_only", "Local API listens beyond loopback without local_api_auth, other hosts are refused", Fields{"addr": cfg.ListenAddr})
+	}
+	return server
+}
+
+// listenLocalAPI listens on a TCP address, behind local_api_allow, or a unix
+// socket. A socket left by
+// an agent that did not stop cleanly is replaced; the socket is open to
+// every user, local_api_auth decides who is served.
+func listenLocalAPI(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, localUnixPrefix)
+	if !ok {
+		addr, err := listenAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return allowListener{Listener: listener, name: "local_api", allow: func(c Config) []string { return c.LocalAPIAllow }}, nil
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// loopbackAddr reports whether a listen address binds to loopback only.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func stopLocalAPI(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The local API (health, events, collectors) is open to the host by default
+// and takes one of these authentication providers, local_api_auth, so it
+// can be exposed beyond it:
+//
+//   - none serves loopback clients and those on a unix socket only; others
+//     are refused whatever listen_addr binds to.
+//   - token needs "Authorization: Bearer <local_api_token>".
+//   - peercred needs listen_addr to be a unix socket (unix:/path) and serves
+//     the users in local_api_users, by the peer credentials the kernel
+//     gives for the connection (root and the agent's own user by default).
+
+const (
+	localAuthNone     = "none"
+	localAuthToken    = "token"
+	localAuthPeerCred = "peercred"
+
+	// localUnixPrefix marks a listen_addr that is a unix socket path.
+	localUnixPrefix = "unix:"
+)
+
+// localAuthProvider authorizes the requests of the local API. Authorize
+// returns the status to refuse a request with, and why.
+type localAuthProvider struct {
+	Name      string
+	Authorize func(r *http.Request, peer localPeer) (int, error)
+}
+
+var localAuthProviders = []localAuthProvider{
+	{Name: localAuthNone, Authorize: authorizeLocalOnly},
+	{Name: localAuthToken, Authorize: authorizeToken},
+	{Name: localAuthPeerCred, Authorize: authorizePeerCred},
+}
+
+func knownLocalAuth(name string) bool {
+	for _, provider := range localAuthProviders {
+		if provider.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// localPeer is what the connection tells about the client.
+type localPeer struct {
+	Unix bool
+	// UID is the client's user with a unix socket, or -1 when the kernel
+	// did not say
+	UID int
+}
+
+type localPeerKey struct{}
+
+// localPeerContext records the peer of each connection for the providers.
+func localPeerContext(ctx context.Context, conn net.Conn) context.Context {
+	peer := localPeer{UID: -1}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		peer.Unix = true
+		if raw, err := unixConn.SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				if cred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED); err == nil {
+					peer.UID = int(cred.Uid)
+				}
+			})
+		}
+	}
+	return context.WithValue(ctx, localPeerKey{}, peer)
+}
+
+// requireLocalAuth serves a request through the configured provider.
+func requireLocalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, _ := r.Context().Value(localPeerKey{}).(localPeer)
+		name := currentConfig().LocalAPIAuth
+		var status int
+		var err error
+		for _, provider := range localAuthProviders {
+			if provider.Name == name {
+				status, err = provider.Authorize(r, peer)
+			}
+		}
+		if err != nil {
+			logger.Debug("local_api.refused", "Refused a local API request", Fields{"path": r.URL.Path, "remote": r.RemoteAddr, "uid": peer.UID, "error": err})
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="lxmon-agent"`)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authorizeLocalOnly(r *http.Request, peer localPeer) (int, error) {
+	if peer.Unix {
+		return 0, nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return 0, nil
+	}
+	return http.StatusForbidden, errors.New("local API serves loopback clients only (local_api_auth: none)")
+}
+
+func authorizeToken(r *http.Request, _ localPeer) (int, error) {
+	cfg := currentConfig()
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" || cfg.LocalAPIToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.LocalAPIToken)) != 1 {
+		return http.StatusUnauthorized, errors.New("missing or wrong bearer token")
+	}
+	return 0, nil
+}
+
+func authorizePeerCred(_ *http.Request, peer localPeer) (int, error) {
+	cfg := currentConfig()
+	if peer.UID < 0 {
+		return http.StatusForbidden, errors.New("no peer credentials (local_api_auth: peercred needs a unix socket)")
+	}
+	for _, uid := range localAPIUIDs(cfg.LocalAPIUsers) {
+		if uid == peer.UID {
+			return 0, nil
+		}
+	}
+	return http.StatusForbidden, fmt.Errorf("user %d is not in local_api_users", peer.UID)
+}
+
+// localAPIUIDs resolves local_api_users, names or UIDs, leaving out the
+// unknown ones. Without any, root and the agent's own user are allowed.
+func localAPIUIDs(users []string) []int {
+	if len(users) == 0 {
+		return []int{0, unix.Getuid()}
+	}
+	uids := make([]int, 0, len(users))
+	for _, name := range users {
+		if uid, err := lookupUID(name); err == nil {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// lookupUID returns the UID of a user name, or of a numeric UID as is.
+func lookupUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// localAPIClient returns a client for the running agent's local API and
+// the base URL to request, with the token set when local_api_auth is token.
+func localAPIClient() (*http.Client, string) {
+	cfg := currentConfig()
+	transport := &http.Transport{}
+	base := "http://" + dialableAddr(cfg.ListenAddr)
+	if path, ok := strings.CutPrefix(cfg.ListenAddr, localUnixPrefix); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://lxmon-agent"
+	}
+	var rt http.RoundTripper = transport
+	if cfg.LocalAPIAuth == localAuthToken {
+		rt = bearerRoundTripper{token: cfg.LocalAPIToken, next: transport}
+	}
+	return &http.Client{Transport: rt, Timeout: 5 * time.Second}, base
+}
+
+type bearerRoundTripper struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (b bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return b.next.RoundTrip(req)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeToken(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	tests := []struct {
+		configured, header string
+		ok                 bool
+	}{
+		{"local-secret", "Bearer local-secret", true},
+		{"local-secret", "Bearer wrong", false},
+		{"local-secret", "Bearer ", false},
+		{"local-secret", "", false},
+		{"", "Bearer ", false},
+		{"", "Bearer x", false},
+	}
+	for _, tt := range tests {
+		config.LocalAPIToken = tt.configured
+		r := httptest.NewRequest("GET", "/health", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if _, err := authorizeToken(r, localPeer{}); (err == nil) != tt.ok {
+			t.Errorf("token %q, header %q: err = %v, want ok %v", tt.configured, tt.header, err, tt.ok)
+		}
+	}
+}
+
+func TestBuildConfigRejectsEmptyLocalAPIToken(t *testing.T) {
+	_, err := buildConfig([]string{"--api-key", "k", "--hostname", "h", "--local-api-auth", "token"})
+	if err == nil || !strings.Contains(err.Error(), "local_api_token") {
+		t.Errorf("local_api_auth token without a token: err = %v", err)
+	}
+	if _, err := buildConfig([]string{"--api-key", "k", "--hostname", "h", "--local-api-auth", "token", "--local-api-token", "s"}); err != nil {
+		t.Errorf("local_api_auth token with a token: %v", err)
+	}
+}
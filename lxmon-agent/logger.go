@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, in increasing severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[int]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Fields carries the structured context of a log event.
+type Fields map[string]interface{}
+
+// LogEvent is a single structured log record. Code is a stable, dotted
+// identifier (e.g. "metrics.send_failed") that log-based alerting can match
+// on instead of the human-readable message.
+type LogEvent struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Code    string    `json:"event"`
+	Message string    `json:"message"`
+	Fields  Fields    `json:"fields,omitempty"`
+}
+
+// eventLogger renders LogEvents either as JSON lines or for the console.
+type eventLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  int
+
+	// A temporary level set through a control command; it wins over the
+	// configured level until overrideUntil, across config reloads.
+	override      int
+	overrideUntil time.Time
+	overrideTimer *time.Timer
+}
+
+var logger = &eventLogger{out: os.Stderr, format: "console", level: levelInfo}
+
+// configureLogger applies the log level and format of cfg.
+func configureLogger(cfg Config) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	logger.level = levelInfo
+	for level, name := range levelNames {
+		if strings.EqualFold(cfg.LogLevel, name) {
+			logger.level = level
+		}
+	}
+	if cfg.EnableDebug {
+		logger.level = levelDebug
+	}
+	if time.Now().Before(logger.overrideUntil) {
+		logger.level = logger.override
+	}
+	logger.format = cfg.LogFormat
+}
+
+// overrideLogLevel switches to level for duration, then back to the
+// configured level. A new override replaces the previous one.
+func overrideLogLevel(level int, duration time.Duration) time.Time {
+	logger.mu.Lock()
+	if logger.overrideTimer != nil {
+		logger.overrideTimer.Stop()
+	}
+	logger.override = level
+	logger.overrideUntil = time.Now().Add(duration)
+	logger.overrideTimer = time.AfterFunc(duration, func() {
+		logger.mu.Lock()
+		logger.overrideUntil = time.Time{}
+		logger.mu.Unlock()
+		configureLogger(currentConfig())
+		logger.Info("log.level_reverted", "Log level override expired", Fields{"level": currentLogLevel()})
+	})
+	until := logger.overrideUntil
+	logger.mu.Unlock()
+
+	configureLogger(currentConfig())
+	return until
+}
+
+func currentLogLevel() string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return levelNames[logger.level]
+}
+
+func (l *eventLogger) Debug(code, message string, fields Fields) {
+	l.emit(levelDebug, code, message, fields)
+}
+
+func (l *eventLogger) Info(code, message string, fields Fields) {
+	l.emit(levelInfo, code, message, fields)
+}
+
+func (l *eventLogger) Warn(code, message string, fields Fields) {
+	l.emit(levelWarn, code, message, fields)
+}
+
+func (l *eventLogger) Error(code, message string, fields Fields) {
+	l.emit(levelError, code, message, fields)
+}
+
+// Fatal logs an error event and exits.
+func (l *eventLogger) Fatal(code, message string, fields Fields) {
+	l.emit(levelError, code, message, fields)
+	os.Exit(1)
+}
+
+func (l *eventLogger) emit(level int, code, message string, fields Fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	event := LogEvent{
+		Time:    time.Now(),
+		Level:   levelNames[level],
+		Code:    code,
+		Message: message,
+		Fields:  normalizeFields(fields),
+	}
+
+	if l.format == "json" {
+		data, err := json.Marshal(event)
+		if err != nil {
+			data, _ = json.Marshal(LogEvent{Time: event.Time, Level: event.Level, Code: event.Code, Message: event.Message})
+		}
+		fmt.Fprintf(l.out, "%s\n", data)
+		return
+	}
+	fmt.Fprintln(l.out, renderConsole(event))
+}
+
+// renderConsole formats an event for humans:
+// 2024/01/02 15:04:05 INFO  metrics.sent  Sent metrics count=25 duration_seconds=1.01
+func renderConsole(event LogEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s  %s", event.Time.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(event.Level), event.Code, event.Message)
+
+	keys := make([]string, 0, len(event.Fields))
+	for key := range event.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := fmt.Sprint(event.Fields[key])
+		if strings.ContainsAny(value, " \t\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	return b.String()
+}
+
+// normalizeFields converts values that do not marshal usefully (errors,
+// durations) into strings.
+func normalizeFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return nil
+	}
+	out := make(Fields, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case error:
+			out[key] = v.Error()
+		case time.Duration:
+			out[key] = v.String()
+		default:
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// roundSeconds rounds a duration in seconds to milliseconds for display.
+func roundSeconds(seconds float64) float64 {
+	return float64(int64(seconds*1000)) / 1000
+}
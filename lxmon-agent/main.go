@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -18,43 +21,73 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
-	"github.com/shirou/gopsutil/v3/load"
-	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/shirou/gopsutil/v3/process"
-	gopsutilnet "github.com/shirou/gopsutil/v3/net"
 )
 
-// Configuration
-type Config struct {
-	ServerURL     string        `json:"server_url"`
-	APIKey        string        `json:"api_key"`
-	Interval      time.Duration `json:"interval"`
-	Hostname      string        `json:"hostname"`
-	MaxTimeout    time.Duration `json:"max_timeout"`
-	MaxRetries    int           `json:"max_retries"`
-	RetryDelay    time.Duration `json:"retry_delay"`
-	LogLevel      string        `json:"log_level"`
-	EnableDebug   bool          `json:"enable_debug"`
-}
-
 // Metric data structure
 type Metric struct {
-	MetricType  string                 `json:"metric_type"`
-	MetricName  string                 `json:"metric_name"`
-	Value       float64                `json:"value"`
-	Unit        string                 `json:"unit,omitempty"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
-	Timestamp   time.Time              `json:"timestamp"`
+	MetricType string                 `json:"metric_type"`
+	MetricName string                 `json:"metric_name"`
+	Value      float64                `json:"value"`
+	Unit       string                 `json:"unit,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
 }
 
 // Metrics payload
 type MetricsPayload struct {
-	Hostname string   `json:"hostname"`
-	Metrics  []Metric `json:"metrics"`
-	APIKey   string   `json:"api_key"`
+	Hostname string            `json:"hostname"`
+	Metrics  []Metric          `json:"metrics"`
+	APIKey   string            `json:"api_key"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// A payload sent in several requests carries continuation markers: the
+	// same batch ID, and which part of how many each request is
+	BatchID string `json:"batch_id,omitempty"`
+	Part    int    `json:"part,omitempty"`
+	Parts   int    `json:"parts,omitempty"`
+
+	// agentID is the ID of the host the payload is for, if not this agent's
+	// (a cluster identity). It is not spooled.
+	agentID string
+}
+
+// newMetricsPayload wraps metrics for this host and applies the configured
+// tags to the payload and to every metric's metadata. Metadata set by a
+// collector wins over a tag with the same name. Metrics with a NaN or
+// infinite value are dropped: JSON cannot carry them, and one would fail the
+// whole payload. Names are then set as metric_names asks.
+func newMetricsPayload(cfg Config, metrics []Metric) MetricsPayload {
+	metrics = applyMetricNames(cfg, finiteMetrics(metrics))
+	for i := 0; i < len(metrics) && len(cfg.Tags) > 0; i++ {
+		if metrics[i].Metadata == nil {
+			metrics[i].Metadata = map[string]interface{}{}
+		}
+		for key, value := range cfg.Tags {
+			if _, ok := metrics[i].Metadata[key]; !ok {
+				metrics[i].Metadata[key] = value
+			}
+		}
+	}
+	return MetricsPayload{
+		Hostname: cfg.Hostname,
+		Metrics:  metrics,
+		APIKey:   cfg.APIKey,
+		Tags:     cfg.Tags,
+	}
+}
+
+// finiteMetrics drops the metrics whose value is NaN or infinite.
+func finiteMetrics(metrics []Metric) []Metric {
+	kept := metrics[:0]
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			logger.Debug("metrics.not_finite", "Dropped a metric without a finite value", Fields{"type": m.MetricType, "name": m.MetricName})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
 }
 
 // Command result
@@ -69,8 +102,10 @@ type CommandResult struct {
 
 // Pending command
 type PendingCommand struct {
-	ID      int    `json:"id"`
-	Command string `json:"command"`
+	ID      int             `json:"id"`
+	Command string          `json:"command"`
+	Control *ControlCommand `json:"control,omitempty"`
+	Script  *ScriptRef      `json:"script,omitempty"`
 }
 
 var (
@@ -79,113 +114,271 @@ var (
 	wg         sync.WaitGroup
 )
 
+// subcommands maps "lxmon-agent <name>" to its entry point. Running the
+// agent without a subcommand starts the collection daemon.
+var subcommands map[string]func(args []string) int
+
 func init() {
-	// Load configuration
-	loadConfig()
+	subcommands = map[string]func(args []string) int{
+		"check":           runCheck,
+		"collect":         runCollect,
+		"healthcheck":     runHealthcheck,
+		"install":         runInstall,
+		"mark":            runMark,
+		"metric-names":    runMetricNames,
+		"quarantine":      runQuarantine,
+		"top":             runTop,
+		"uninstall":       runUninstall,
+		"validate-config": runValidateConfig,
+		"version":         runVersion,
+	}
 
 	// Setup signal handling for graceful shutdown
 	signal.Notify(shutdownCh, syscall.SIGINT, syscall.SIGTERM)
 }
 
-func loadConfig() {
-	// Default configuration
-	config = Config{
-		ServerURL:  "http://localhost:8000",
-		APIKey:     "agent-key-1",
-		Interval:   60 * time.Second,
-		MaxTimeout: 300 * time.Second,
-		MaxRetries: 3,
-		RetryDelay: 5 * time.Second,
-		LogLevel:   "info",
-		EnableDebug: false,
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, ok := subcommands[args[0]]
+		if !ok {
+			logger.Fatal("agent.unknown_command", "Unknown command", Fields{"command": args[0]})
+		}
+		os.Exit(cmd(args[1:]))
 	}
+	runAgent(args)
+}
 
-	// Override from environment variables
-	if value := os.Getenv("LXMON_SERVER_URL"); value != "" {
-		config.ServerURL = value
-	}
-	if value := os.Getenv("LXMON_API_KEY"); value != "" {
-		config.APIKey = value
-	}
-	if value := os.Getenv("LXMON_INTERVAL"); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			config.Interval = time.Duration(intValue) * time.Second
+func runAgent(args []string) {
+	defer crashGuard()
+
+	if err := loadConfig(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
 		}
+		logger.Fatal("config.invalid", "Failed to load configuration", Fields{"error": err})
 	}
-	if value := os.Getenv("LXMON_MAX_TIMEOUT"); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			config.MaxTimeout = time.Duration(intValue) * time.Second
-		}
+	cfg := currentConfig()
+
+	// A state dir that cannot be created or locked (read-only root, a
+	// filesystem without flock) costs the features that keep state, not
+	// the metrics
+	lockErr := acquireInstanceLock(cfg.StateDir)
+	if errors.Is(lockErr, ErrAlreadyRunning) {
+		logger.Fatal("instance.running", "Another agent is running with this state dir", Fields{"error": lockErr})
+	} else if lockErr != nil {
+		logger.Warn("instance.lock_failed", "Cannot lock the state dir, running without the check for a second agent", Fields{"error": lockErr})
 	}
-	if value := os.Getenv("LXMON_MAX_RETRIES"); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			config.MaxRetries = intValue
+
+	if err := migrateStateDir(cfg.StateDir); err != nil {
+		if lockErr == nil || errors.Is(err, errStateTooNew) {
+			logger.Fatal("state.migrate_failed", "Failed to prepare the state dir", Fields{"error": err})
 		}
-	}
-	if value := os.Getenv("LXMON_DEBUG"); value == "true" {
-		config.EnableDebug = true
+		logger.Warn("state.migrate_failed", "Cannot prepare the state dir, running without state", Fields{"error": err})
 	}
 
-	// Get hostname
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Fatalf("Failed to get hostname: %v", err)
-	}
-	config.Hostname = hostname
-}
+	agentID = loadAgentID(cfg.StateDir)
 
-func main() {
-	log.Printf("🚀 Starting lxmon-agent on %s", config.Hostname)
-	log.Printf("📡 Server URL: %s", config.ServerURL)
-	log.Printf("⏱️  Collection interval: %v", config.Interval)
-	if config.EnableDebug {
-		log.Printf("🐛 Debug mode enabled")
+	logger.Info("agent.start", "Starting lxmon-agent", Fields{
+		"hostname":   cfg.Hostname,
+		"agent_id":   agentID,
+		"server_url": cfg.ServerURL,
+		"interval":   cfg.Interval,
+		"discovered": cfg.Discovered,
+	})
+	warnCleartext(append([]string{cfg.ServerURL}, cfg.FailoverURLs...))
+	if cfg.DryRun {
+		logger.Warn("agent.dry_run", "Dry run: collecting without sending anything to the server", nil)
+	}
+	warnChaos()
+	logger.Debug("agent.debug_enabled", "Debug mode enabled", nil)
+
+	// Start local API (health endpoint)
+	localAPI := startLocalAPI()
+	promListener := startPrometheusListener()
+	statsdListener := startStatsD()
+
+	// Register agent with retry, waiting for enrollment approval if needed.
+	// Exporting over OTLP or scraped by Prometheus only, there is no server
+	// to register with.
+	approved := true
+	if !serverless() {
+		var err error
+		approved, err = registerUntilApproved()
+		if err != nil {
+			logger.Fatal("register.failed", "Failed to register agent after retries", Fields{"error": err})
+		}
 	}
-
-	// Register agent with retry
-	if err := registerAgentWithRetry(); err != nil {
-		log.Fatalf("❌ Failed to register agent after retries: %v", err)
+	if !approved {
+		stopStatsD(statsdListener)
+		stopLocalAPI(promListener)
+		stopLocalAPI(localAPI)
+		releaseInstanceLock()
+		logger.Info("agent.stopped", "Agent shutdown complete", nil)
+		return
 	}
+	health.setRegistered()
 
-	// Start metrics collection
-	ticker := time.NewTicker(config.Interval)
-	defer ticker.Stop()
+	// Upload crash reports left by a previous run
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer crashGuard()
+		sendPendingCrashReports(currentConfig())
+	}()
 
-	// Initial collection
+	// Describe the metrics to the server, once per run
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		collectAndSendMetrics()
+		defer crashGuard()
+		sendMetricRegistry(currentConfig())
 	}()
 
+	// Collectors with their own interval run independently of the send cycle
+	stopScheduler := make(chan struct{})
+	startCollectorScheduler(stopScheduler)
+
+	// Other outputs than the server send from their own queues
+	stopSinks := make(chan struct{})
+	startSinks(stopSinks)
+
+	// Start metrics collection. The first cycle runs immediately, or at a
+	// random point within the first interval when jitter is enabled.
+	interval, jitter := cfg.Interval, cfg.Jitter
+	timer := time.NewTimer(initialDelay(interval, jitter))
+	defer timer.Stop()
+
+	// Reload configuration on SIGHUP
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	defer signal.Stop(reloadCh)
+	reloadedCh := make(chan struct{}, 1)
+	startReload := func(trigger string) {
+		// Reloading may reach the remote store and DNS, so run it off the
+		// main loop to keep shutdown responsive.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer crashGuard()
+			reloadConfig(args, trigger)
+			select {
+			case reloadedCh <- struct{}{}:
+			default:
+			}
+		}()
+	}
+
+	// Pick up rotated API keys, and reload when the remote_config key or the
+	// server-managed settings change
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	changedCh := make(chan string, 1)
+	notifyChanged := func(trigger string) func() {
+		return func() {
+			select {
+			case changedCh <- trigger:
+			default:
+			}
+		}
+	}
+	watchers := []func(){
+		func() { refreshSecrets(watchCtx) },
+	}
+	switch {
+	case mqttEnabled():
+		// The broker is all the agent reaches; the rest talks to the server
+		watchers = append(watchers, func() { runMQTT(watchCtx) })
+	case serverless():
+	default:
+		watchers = append(watchers,
+			func() { pollServerConfig(watchCtx, notifyChanged("server config changed")) },
+			func() { checkForUpdates(watchCtx) },
+			func() { failBack(watchCtx) },
+			func() { watchServerSRV(watchCtx) },
+			func() { runCommandChannel(watchCtx) },
+			func() { runHeartbeat(watchCtx) },
+		)
+	}
+	if cfg.RemoteConfig != "" {
+		source := cfg.RemoteConfig
+		watchers = append(watchers, func() { watchRemoteConfig(watchCtx, source, notifyChanged("remote config changed")) })
+	}
+	for _, watch := range watchers {
+		wg.Add(1)
+		go func(watch func()) {
+			defer wg.Done()
+			defer crashGuard()
+			watch()
+		}(watch)
+	}
+
 	// Main loop
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
+			timer.Reset(jitteredInterval(degradedInterval(interval), jitter))
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				collectAndSendMetrics()
-				checkAndExecuteCommands()
+				defer crashGuard()
+				cfg := currentConfig()
+				collectAndSendMetrics(cfg)
+				checkAndExecuteCommands(cfg)
 			}()
+		case <-reloadCh:
+			startReload("SIGHUP")
+		case trigger := <-changedCh:
+			startReload(trigger)
+		case <-reloadedCh:
+			cfg := currentConfig()
+			intervalChanged := cfg.Interval != interval
+			interval, jitter = cfg.Interval, cfg.Jitter
+			if intervalChanged {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(jitteredInterval(interval, jitter))
+			}
 		case <-shutdownCh:
-			log.Println("🛑 Received shutdown signal, stopping agent...")
-			ticker.Stop()
+			logger.Info("agent.stopping", "Received shutdown signal, stopping agent", nil)
+			timer.Stop()
+			stopWatch()
+			close(stopScheduler)
 			wg.Wait()
-			log.Println("✅ Agent shutdown complete")
+			flushBatch()
+			close(stopSinks)
+			waitSinks()
+			closeMQTT()
+			stopStatsD(statsdListener)
+			stopLocalAPI(promListener)
+			stopLocalAPI(localAPI)
+			releaseInstanceLock()
+			logger.Info("agent.stopped", "Agent shutdown complete", nil)
 			return
 		}
 	}
 }
 
-func registerAgentWithRetry() error {
+// registerAgentWithRetry tries every configured server before giving up.
+func registerAgentWithRetry(cfg Config) error {
 	var lastErr error
-	for attempt := 1; attempt <= config.MaxRetries; attempt++ {
-		if err := registerAgent(); err != nil {
+	attempts := serverAttempts()
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := registerAgent(cfg); err != nil {
+			var pending *PendingApprovalError
+			if errors.As(err, &pending) {
+				return err
+			}
 			lastErr = err
-			log.Printf("⚠️  Registration attempt %d failed: %v", attempt, err)
-			if attempt < config.MaxRetries {
-				time.Sleep(config.RetryDelay)
+			logger.Warn("register.attempt_failed", "Registration attempt failed", Fields{"attempt": attempt, "error": err})
+			if !isRetryable(err) {
+				return err
+			}
+			if attempt < attempts {
+				time.Sleep(retryWait(cfg, attempt, err))
 			}
 		} else {
 			return nil
@@ -194,275 +387,182 @@ func registerAgentWithRetry() error {
 	return lastErr
 }
 
-func registerAgent() error {
-	payload := map[string]interface{}{
-		"hostname":   config.Hostname,
-		"ip_address": getLocalIP(),
-		"api_key":    config.APIKey,
-		"os_info":    getOSInfo(),
+func registerAgent(cfg Config) error {
+	jsonData, err := json.Marshal(registrationPayload(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration data: %w", err)
+	}
+	if dryRun("/api/agent/register", jsonData) {
+		return nil
+	}
+	if mqttEnabled() {
+		if err := mqttPublish("register", jsonData); err != nil {
+			return err
+		}
+		logger.Info("register.ok", "Agent registered through the MQTT broker", nil)
+		return nil
 	}
 
-	jsonData, err := json.Marshal(payload)
+	if err := postRegistration(cfg, jsonData, ""); err != nil {
+		return err
+	}
+	logger.Info("register.ok", "Agent registered successfully", nil)
+	return nil
+}
+
+// postRegistration posts a registration to the server, as the host with
+// the given agent ID, or as this agent when it is empty.
+func postRegistration(cfg Config, jsonData []byte, id string) (err error) {
+	base := serverURL()
+	defer func() { recordServerResult(base, err) }()
+
+	req, err := http.NewRequest("POST", base+"/api/agent/register", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to marshal registration data: %w", err)
+		return fmt.Errorf("failed to create registration request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if id != "" {
+		req.Header.Set("X-LXMON-Agent-ID", id)
+	}
+	signRequest(req, cfg.APIKey, jsonData)
 
-	resp, err := http.Post(
-		config.ServerURL+"/api/agent/register",
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	resp, err := serverDo(req, 30*time.Second)
 	if err != nil {
-		return fmt.Errorf("registration request failed: %w", err)
+		return unavailable("registration", err)
 	}
 	defer resp.Body.Close()
+	noteAcceptEncoding(base, resp)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, string(body))
+	if err := checkResponse("registration", resp); err != nil {
+		return err
 	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	noteServerProtocol(base, data)
+	return checkPendingApproval(resp.StatusCode, data)
+}
 
-	log.Println("✅ Agent registered successfully")
-	return nil
+// registrationPayload is the body of POST /api/agent/register.
+func registrationPayload(cfg Config) map[string]interface{} {
+	return map[string]interface{}{
+		"hostname":   cfg.Hostname,
+		"agent_id":   agentID,
+		"ip_address": getLocalIP(),
+		"api_key":    cfg.APIKey,
+		"os_info":    getOSInfo(),
+		"tags":       cfg.Tags,
+
+		"enrollment_token": cfg.EnrollmentToken,
+
+		"agent_version":    version,
+		"agent_commit":     commit,
+		"agent_build_date": buildDate,
+
+		"schema_version": agentSchemaVersion,
+		"capabilities":   registeredCapabilities(),
+	}
 }
 
-func collectAndSendMetrics() {
-	startTime := time.Now()
-	metrics := []Metric{}
-
-	// CPU metrics
-	if cpuPercent, err := cpu.Percent(time.Second, false); err == nil && len(cpuPercent) > 0 {
-		metrics = append(metrics, Metric{
-			MetricType: "cpu",
-			MetricName: "usage_percent",
-			Value:      cpuPercent[0],
-			Unit:       "percent",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// CPU count
-	if cpuCount, err := cpu.Counts(true); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "cpu",
-			MetricName: "count",
-			Value:      float64(cpuCount),
-			Unit:       "cores",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Memory metrics
-	if memInfo, err := mem.VirtualMemory(); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "total",
-			Value:      float64(memInfo.Total),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "used",
-			Value:      float64(memInfo.Used),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "used_percent",
-			Value:      memInfo.UsedPercent,
-			Unit:       "percent",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "available",
-			Value:      float64(memInfo.Available),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Swap memory
-	if swapInfo, err := mem.SwapMemory(); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "swap_total",
-			Value:      float64(swapInfo.Total),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "swap_used",
-			Value:      float64(swapInfo.Used),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "memory",
-			MetricName: "swap_used_percent",
-			Value:      swapInfo.UsedPercent,
-			Unit:       "percent",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Disk metrics
-	if partitions, err := disk.Partitions(false); err == nil {
-		for _, partition := range partitions {
-			if usage, err := disk.Usage(partition.Mountpoint); err == nil {
-				metrics = append(metrics, Metric{
-					MetricType: "disk",
-					MetricName: "usage_percent",
-					Value:      usage.UsedPercent,
-					Unit:       "percent",
-					Metadata: map[string]interface{}{
-						"mountpoint": partition.Mountpoint,
-						"filesystem": partition.Fstype,
-						"device":     partition.Device,
-					},
-					Timestamp: time.Now(),
-				})
-				metrics = append(metrics, Metric{
-					MetricType: "disk",
-					MetricName: "total",
-					Value:      float64(usage.Total),
-					Unit:       "bytes",
-					Metadata: map[string]interface{}{
-						"mountpoint": partition.Mountpoint,
-					},
-					Timestamp: time.Now(),
-				})
-				metrics = append(metrics, Metric{
-					MetricType: "disk",
-					MetricName: "free",
-					Value:      float64(usage.Free),
-					Unit:       "bytes",
-					Metadata: map[string]interface{}{
-						"mountpoint": partition.Mountpoint,
-					},
-					Timestamp: time.Now(),
-				})
-			}
+func collectAndSendMetrics(cfg Config) {
+	metrics, collectionDuration := collectMetrics()
+	metrics = append(metrics, drainEventMetrics()...)
+
+	health.recordCollection(len(metrics))
+	fanOut(cfg, metrics)
+	if prometheusEnabled() {
+		updatePrometheus(cfg, metrics)
+	}
+	if serverless() {
+		return
+	}
+	if health.authHalted() {
+		logger.Debug("metrics.skipped", "Sending halted after authentication failure", nil)
+		return
+	}
+	metrics, due := batchMetrics(cfg, metrics)
+	if !due {
+		return
+	}
+	if clusterIdentitiesEnabled() {
+		if payloads := newClusterPayloads(cfg, metrics); len(payloads) > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer crashGuard()
+				sendClusterPayloads(cfg, payloads)
+			}()
 		}
 	}
+	deliverMetrics(cfg, newMetricsPayload(cfg, metrics), collectionDuration)
+}
 
-	// Network metrics
-	if netStats, err := gopsutilnet.IOCounters(false); err == nil && len(netStats) > 0 {
-		stats := netStats[0]
-		metrics = append(metrics, Metric{
-			MetricType: "network",
-			MetricName: "bytes_sent",
-			Value:      float64(stats.BytesSent),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "network",
-			MetricName: "bytes_recv",
-			Value:      float64(stats.BytesRecv),
-			Unit:       "bytes",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "network",
-			MetricName: "packets_sent",
-			Value:      float64(stats.PacketsSent),
-			Unit:       "packets",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "network",
-			MetricName: "packets_recv",
-			Value:      float64(stats.PacketsRecv),
-			Unit:       "packets",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Host info and load averages
-	if hostInfo, err := host.Info(); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "system",
-			MetricName: "uptime",
-			Value:      float64(hostInfo.Uptime),
-			Unit:       "seconds",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Load averages
-	if loadAvg, err := load.Avg(); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "system",
-			MetricName: "load_average_1m",
-			Value:      loadAvg.Load1,
-			Unit:       "load",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "system",
-			MetricName: "load_average_5m",
-			Value:      loadAvg.Load5,
-			Unit:       "load",
-			Timestamp:  time.Now(),
-		})
-		metrics = append(metrics, Metric{
-			MetricType: "system",
-			MetricName: "load_average_15m",
-			Value:      loadAvg.Load15,
-			Unit:       "load",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Process count
-	if processes, err := process.Pids(); err == nil {
-		metrics = append(metrics, Metric{
-			MetricType: "system",
-			MetricName: "process_count",
-			Value:      float64(len(processes)),
-			Unit:       "count",
-			Timestamp:  time.Now(),
-		})
-	}
-
-	// Collection duration
-	collectionDuration := time.Since(startTime).Seconds()
-	metrics = append(metrics, Metric{
-		MetricType: "agent",
-		MetricName: "collection_duration",
-		Value:      collectionDuration,
-		Unit:       "seconds",
-		Timestamp:  time.Now(),
-	})
-
-	// Send metrics with retry
-	payload := MetricsPayload{
-		Hostname: config.Hostname,
-		Metrics:  metrics,
-		APIKey:   config.APIKey,
+// deliverMetrics sends a payload, in as many requests as max_payload_bytes
+// and the server's size limit take, with retry, and on failure quarantines
+// or spools each of them for later, depending on why it failed. A request
+// the server refuses as too large is sent again, with the requests not yet
+// sent, in smaller ones.
+func deliverMetrics(cfg Config, payload MetricsPayload, collectionDuration float64) {
+	parts := payloadParts(payload)
+	for i := 0; i < len(parts); i++ {
+		base := serverURL()
+		err := deliverPayload(cfg, parts[i], collectionDuration)
+		limit, ok := resplit(base, parts[i], err)
+		if !ok {
+			continue
+		}
+		rest := parts[i]
+		rest.Metrics = nil
+		for _, part := range parts[i:] {
+			rest.Metrics = append(rest.Metrics, part.Metrics...)
+		}
+		parts = markParts(append(parts[:i], splitPayload(rest, limit)...), i)
+		i--
 	}
+}
 
-	if err := sendMetricsWithRetry(payload); err != nil {
-		log.Printf("❌ Failed to send metrics: %v", err)
+// deliverPayload sends one request of metrics. It returns the error of a
+// request refused as too large, to be split, without quarantining it.
+func deliverPayload(cfg Config, payload MetricsPayload, collectionDuration float64) error {
+	if err := sendMetricsWithRetry(cfg, payload); err != nil {
+		if _, ok := tooLarge(payload, err); ok {
+			return err
+		}
+		health.recordSendError(err)
+		switch {
+		case errors.Is(err, ErrAuth):
+			haltOnAuthError(err)
+		case errors.Is(err, ErrPayloadRejected):
+			if quota, ok := quotaExceeded(err); ok {
+				// The payload is fine; resending it cannot help until the
+				// quota is raised, so it is not quarantined
+				reportQuota(&quota, false)
+				break
+			}
+			logger.Error("metrics.rejected", "Server rejected metrics payload", Fields{"error": err, "count": len(payload.Metrics)})
+			quarantinePayload("/api/agent/metrics", payload, err)
+		default:
+			logger.Error("metrics.send_failed", "Failed to send metrics", Fields{"error": err})
+			spoolPayload(payload)
+		}
 	} else {
-		log.Printf("✅ Sent %d metrics in %.2fs", len(metrics), collectionDuration)
+		health.recordSend()
+		logger.Info("metrics.sent", "Sent metrics", Fields{"count": len(payload.Metrics), "collection_seconds": roundSeconds(collectionDuration)})
+		replaySpool(cfg)
 	}
+	return nil
 }
 
-func sendMetricsWithRetry(payload MetricsPayload) error {
+func sendMetricsWithRetry(cfg Config, payload MetricsPayload) error {
 	var lastErr error
-	for attempt := 1; attempt <= config.MaxRetries; attempt++ {
-		if err := sendMetrics(payload); err != nil {
+	for attempt := 1; attempt <= cfg.MaxRetries; attempt++ {
+		if err := sendMetrics(cfg, payload); err != nil {
 			lastErr = err
-			if config.EnableDebug {
-				log.Printf("⚠️  Metrics send attempt %d failed: %v", attempt, err)
+			logger.Debug("metrics.attempt_failed", "Metrics send attempt failed", Fields{"attempt": attempt, "error": err})
+			// With the circuit open, the payload is spooled at once
+			if !isRetryable(err) || errors.Is(err, errCircuitOpen) {
+				return err
 			}
-			if attempt < config.MaxRetries {
-				time.Sleep(config.RetryDelay)
+			if attempt < cfg.MaxRetries {
+				time.Sleep(retryWait(cfg, attempt, err))
 			}
 		} else {
 			return nil
@@ -471,100 +571,158 @@ func sendMetricsWithRetry(payload MetricsPayload) error {
 	return lastErr
 }
 
-func sendMetrics(payload MetricsPayload) error {
+func sendMetrics(cfg Config, payload MetricsPayload) (err error) {
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metrics: %w", err)
 	}
-
-	req, err := http.NewRequest("POST", config.ServerURL+"/api/agent/metrics", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	if dryRun("/api/agent/metrics", jsonData) {
+		return nil
+	}
+	if err := takeSendToken(); err != nil {
+		return err
+	}
+	if mqttEnabled() {
+		return mqttPublish("metrics", jsonData)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	base := serverURL()
+	defer func() { recordServerResult(base, err) }()
+
+	resp, err := postCompressed(base, "/api/agent/metrics", cfg.APIKey, payload.agentID, jsonData)
 	if err != nil {
-		return fmt.Errorf("metrics request failed: %w", err)
+		return unavailable("metrics submission", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("metrics submission failed with status %d: %s", resp.StatusCode, string(body))
+	if err := checkResponse("metrics submission", resp); err != nil {
+		return err
 	}
-
+	// A "clipped" response carries the quota the server enforced
+	var result struct {
+		Quota *QuotaStatus `json:"quota"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+	reportQuota(result.Quota, true)
 	return nil
 }
 
-func checkAndExecuteCommands() {
+func checkAndExecuteCommands(cfg Config) {
+	if health.authHalted() {
+		return
+	}
+	if cfg.DryRun {
+		logger.Debug("dry_run.commands", "Dry run: not polling for commands", nil)
+		return
+	}
+	if commandChannelOpen() || mqttEnabled() || serverless() {
+		return
+	}
+
 	// Get pending commands
-	req, err := http.NewRequest("GET", config.ServerURL+"/api/agent/commands", nil)
+	base := serverURL()
+	req, err := http.NewRequest("GET", base+"/api/agent/commands", nil)
 	if err != nil {
-		log.Printf("❌ Failed to create commands request: %v", err)
+		logger.Error("commands.request_failed", "Failed to create commands request", Fields{"error": err})
 		return
 	}
-	req.Header.Set("X-API-Key", config.APIKey)
-	req.URL.RawQuery = fmt.Sprintf("hostname=%s", config.Hostname)
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	req.URL.RawQuery = url.Values{"hostname": {cfg.Hostname}}.Encode()
+	signRequest(req, cfg.APIKey, nil)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := serverDo(req, 30*time.Second)
 	if err != nil {
-		log.Printf("❌ Failed to get commands: %v", err)
+		recordServerResult(base, unavailable("commands poll", err))
+		logger.Error("commands.poll_failed", "Failed to get commands", Fields{"error": err})
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("⚠️  Commands request failed with status %d", resp.StatusCode)
+	err = checkResponse("commands poll", resp)
+	recordServerResult(base, err)
+	if err != nil {
+		if errors.Is(err, ErrAuth) {
+			haltOnAuthError(err)
+			return
+		}
+		logger.Warn("commands.poll_status", "Commands request failed", Fields{"status": resp.StatusCode, "error": err})
 		return
 	}
 
-	var commands []PendingCommand
-	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
-		log.Printf("❌ Failed to decode commands: %v", err)
+	commands, err := decodeCommands(resp.Body)
+	if err != nil {
+		logger.Error("commands.decode_failed", "Failed to decode commands", Fields{"error": err})
 		return
 	}
 
 	if len(commands) > 0 {
-		log.Printf("📋 Found %d pending commands", len(commands))
+		logger.Info("commands.pending", "Found pending commands", Fields{"count": len(commands)})
 	}
+	runCommands(cfg, commands)
+}
 
-	// Execute commands concurrently
+// runCommands executes commands concurrently.
+func runCommands(cfg Config, commands []PendingCommand) {
 	for _, cmd := range commands {
 		wg.Add(1)
 		go func(command PendingCommand) {
 			defer wg.Done()
-			executeCommand(command)
+			defer crashGuard()
+			executeCommand(cfg, command)
 		}(cmd)
 	}
 }
 
-func executeCommand(cmd PendingCommand) {
-	startTime := time.Now()
-	log.Printf("⚙️  Executing command %d: %s", cmd.ID, cmd.Command)
+// maxCommandsResponse bounds the commands poll response, so a misbehaving
+// server or proxy cannot stall the agent with an endless body.
+const maxCommandsResponse = 1 << 20
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), config.MaxTimeout)
-	defer cancel()
+// decodeCommands reads the commands poll response.
+func decodeCommands(r io.Reader) ([]PendingCommand, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxCommandsResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCommandsResponse {
+		return nil, fmt.Errorf("response larger than %d bytes", maxCommandsResponse)
+	}
+	var commands []PendingCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
 
-	// Execute command
-	execCmd := exec.CommandContext(ctx, "bash", "-c", cmd.Command)
-	var stdout, stderr bytes.Buffer
-	execCmd.Stdout = &stdout
-	execCmd.Stderr = &stderr
+func executeCommand(cfg Config, cmd PendingCommand) {
+	startTime := time.Now()
+	logger.Info("command.exec", "Executing command", Fields{"command_id": cmd.ID, "command": cmd.Command})
 
-	err := execCmd.Run()
-	duration := time.Since(startTime).Seconds()
+	var stdout, stderr bytes.Buffer
 	exitCode := 0
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else {
+	if cmd.Control != nil {
+		// Control commands are handled by the agent, never by a shell
+		out, err := runControl(*cmd.Control)
+		stdout.WriteString(out)
+		if err != nil {
+			stderr.WriteString(err.Error())
 			exitCode = 1
 		}
+	} else if cmd.Script != nil {
+		// Library scripts run from the verified content, never inline text
+		path, temp, err := loadScript(*cmd.Script)
+		if err != nil {
+			stderr.WriteString(err.Error())
+			exitCode = 1
+		} else {
+			if temp {
+				defer os.Remove(path)
+			}
+			exitCode = runShell(cfg, append([]string{path}, cmd.Script.Args...), &stdout, &stderr)
+		}
+	} else {
+		exitCode = runShell(cfg, []string{"-c", cmd.Command}, &stdout, &stderr)
 	}
+	duration := time.Since(startTime).Seconds()
 
 	// Send result with retry
 	result := CommandResult{
@@ -576,23 +734,56 @@ func executeCommand(cmd PendingCommand) {
 		Timestamp: time.Now(),
 	}
 
-	if err := sendCommandResultWithRetry(result); err != nil {
-		log.Printf("❌ Failed to send command result: %v", err)
+	err := sendCommandResultWithRetry(cfg, result)
+	auditCommand(cmd, exitCode, duration, err == nil)
+	if err != nil {
+		if errors.Is(err, ErrAuth) {
+			haltOnAuthError(err)
+		}
+		if errors.Is(err, ErrPayloadRejected) {
+			quarantinePayload("/api/agent/command-result", result, err)
+		} else if !errors.Is(err, ErrAuth) && spoolCommandResult(result) {
+			return
+		}
+		logger.Error("command.result_failed", "Failed to send command result", Fields{"command_id": cmd.ID, "error": err})
 	} else {
-		log.Printf("✅ Command %d completed with exit code %d in %.2fs", cmd.ID, exitCode, duration)
+		logger.Info("command.done", "Command completed", Fields{"command_id": cmd.ID, "exit_code": exitCode, "duration_seconds": roundSeconds(duration)})
+	}
+}
+
+// runShell runs bash with args under max_timeout and returns its exit code.
+func runShell(cfg Config, args []string, stdout, stderr *bytes.Buffer) int {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MaxTimeout)
+	defer cancel()
+
+	execCmd := exec.CommandContext(ctx, "bash", args...)
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stderr
+
+	if err := execCmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		return 1
 	}
+	return 0
 }
 
-func sendCommandResultWithRetry(result CommandResult) error {
+func sendCommandResultWithRetry(cfg Config, result CommandResult) error {
+	if sendResultOnChannel(result) {
+		return nil
+	}
 	var lastErr error
-	for attempt := 1; attempt <= config.MaxRetries; attempt++ {
-		if err := sendCommandResult(result); err != nil {
+	for attempt := 1; attempt <= cfg.MaxRetries; attempt++ {
+		if err := sendCommandResult(cfg, result); err != nil {
 			lastErr = err
-			if config.EnableDebug {
-				log.Printf("⚠️  Result send attempt %d failed: %v", attempt, err)
+			logger.Debug("command.result_attempt_failed", "Result send attempt failed", Fields{"attempt": attempt, "error": err})
+			// With the circuit open, the result is spooled at once
+			if !isRetryable(err) || errors.Is(err, errCircuitOpen) {
+				return err
 			}
-			if attempt < config.MaxRetries {
-				time.Sleep(config.RetryDelay)
+			if attempt < cfg.MaxRetries {
+				time.Sleep(retryWait(cfg, attempt, err))
 			}
 		} else {
 			return nil
@@ -601,33 +792,37 @@ func sendCommandResultWithRetry(result CommandResult) error {
 	return lastErr
 }
 
-func sendCommandResult(result CommandResult) error {
+func sendCommandResult(cfg Config, result CommandResult) (err error) {
 	jsonData, err := json.Marshal(result)
 	if err != nil {
 		return fmt.Errorf("failed to marshal result: %w", err)
 	}
+	if dryRun("/api/agent/command-result", jsonData) {
+		return nil
+	}
+	if mqttEnabled() {
+		return mqttPublish("command-result", jsonData)
+	}
+
+	base := serverURL()
+	defer func() { recordServerResult(base, err) }()
 
-	req, err := http.NewRequest("POST", config.ServerURL+"/api/agent/command-result", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", base+"/api/agent/command-result", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create result request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", config.APIKey)
-	req.URL.RawQuery = fmt.Sprintf("hostname=%s", config.Hostname)
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	req.URL.RawQuery = url.Values{"hostname": {cfg.Hostname}}.Encode()
+	signRequest(req, cfg.APIKey, jsonData)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := serverDo(req, 30*time.Second)
 	if err != nil {
-		return fmt.Errorf("result request failed: %w", err)
+		return unavailable("result submission", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("result submission failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	return nil
+	return checkResponse("result submission", resp)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -667,11 +862,11 @@ func getOSInfo() map[string]interface{} {
 	}
 
 	return map[string]interface{}{
-		"os":              hostInfo.OS,
-		"platform":        hostInfo.Platform,
-		"platform_family": hostInfo.PlatformFamily,
+		"os":               hostInfo.OS,
+		"platform":         hostInfo.Platform,
+		"platform_family":  hostInfo.PlatformFamily,
 		"platform_version": hostInfo.PlatformVersion,
-		"kernel_version":  hostInfo.KernelVersion,
-		"kernel_arch":     hostInfo.KernelArch,
+		"kernel_version":   hostInfo.KernelVersion,
+		"kernel_arch":      hostInfo.KernelArch,
 	}
 }
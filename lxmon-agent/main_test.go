@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestSubcommandArgs(t *testing.T) {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	fs.Bool("once", false, "")
+	fs.Duration("refresh", 0, "")
+	own, rest := subcommandArgs(fs, []string{"--once", "--config", "/etc/lxmon.yaml", "--refresh", "5s", "-interval=10s", "--refresh=1s", "--", "--once"})
+	if want := "--once --refresh 5s --refresh=1s"; strings.Join(own, " ") != want {
+		t.Errorf("own = %q, want %q", own, want)
+	}
+	if want := "--config /etc/lxmon.yaml -interval=10s --once"; strings.Join(rest, " ") != want {
+		t.Errorf("rest = %q, want %q", rest, want)
+	}
+}
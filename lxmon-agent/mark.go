@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// runMark implements `lxmon-agent mark --type deploy --note "v1.2.3"`. The
+// marker is handed to the running agent through /local/events; if no agent
+// is listening it is sent straight to the server. A maintenance marker with
+// --duration puts the host in a maintenance window on the server, which
+// silences its alerts; a maintenance_end marker ends it early.
+func runMark(args []string) int {
+	fs := flag.NewFlagSet("mark", flag.ContinueOnError)
+	markType := fs.String("type", "deploy", "marker type (deploy, rollback, maintenance, maintenance_end, ...)")
+	duration := fs.Duration("duration", 0, "how long the marked work lasts; with --type maintenance, silences the host's alerts for that long")
+	note := fs.String("note", "", "free-text note, e.g. the released version")
+	source := fs.String("source", "mark", "who or what recorded the marker")
+	own, rest := subcommandArgs(fs, args)
+	if err := fs.Parse(own); err != nil {
+		return 2
+	}
+	if err := loadConfig(rest); err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 1
+	}
+	cfg := currentConfig()
+
+	event := Event{
+		Type:      *markType,
+		Source:    *source,
+		Message:   *note,
+		Fields:    map[string]interface{}{"marker": true},
+		Timestamp: time.Now(),
+	}
+	if *duration > 0 {
+		event.Fields["duration_seconds"] = duration.Seconds()
+	}
+
+	if cfg.ListenAddr != "" {
+		err := postLocalEvent(event)
+		if err == nil {
+			fmt.Printf("recorded %s marker via local agent\n", event.Type)
+			return 0
+		}
+		logger.Warn("mark.local_failed", "Local agent unreachable, sending marker to server", Fields{"error": err})
+	}
+
+	emitEvent(event)
+	payload := newMetricsPayload(cfg, drainEventMetrics())
+	if err := sendMetricsWithRetry(cfg, payload); err != nil {
+		logger.Error("mark.failed", "Failed to record marker", Fields{"error": err})
+		return 1
+	}
+	fmt.Printf("recorded %s marker on server\n", event.Type)
+	return 0
+}
+
+func postLocalEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client, base := localAPIClient()
+	resp, err := client.Post(base+"/local/events", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("local agent returned status %d", resp.StatusCode)
+	}
+	return nil
+}
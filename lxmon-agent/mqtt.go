@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With mqtt_broker set, the agent talks MQTT 3.1.1 to a broker instead of
+// HTTP to the server, for sites (edge devices behind NAT, flaky links) where
+// a broker is the only infrastructure it can reach. Registration, metrics,
+// metric descriptions and command results are published as the same JSON
+// documents the HTTP API takes, to <mqtt_topic_prefix>/<hostname>/<kind>,
+// and signed commands are taken from <mqtt_topic_prefix>/<hostname>/commands
+// (see verifyMQTTCommands). The API key is left out of what is published, as
+// every subscriber could read it. The
+// retained <mqtt_topic_prefix>/<hostname>/status is "online" while the agent
+// is connected and "offline" once it disconnects or the broker loses it.
+
+const (
+	mqttKeepAlive   = 60 * time.Second
+	mqttDialTimeout = 10 * time.Second
+	mqttAckTimeout  = 10 * time.Second
+	// mqttMaxPacket bounds a packet from the broker, as maxCommandsResponse
+	// bounds the commands poll.
+	mqttMaxPacket = maxCommandsResponse
+)
+
+// MQTT control packet types (the high nibble of the fixed header).
+const (
+	mqttTypeConnect    = 1
+	mqttTypeConnAck    = 2
+	mqttTypePublish    = 3
+	mqttTypePubAck     = 4
+	mqttTypeSubscribe  = 8
+	mqttTypeSubAck     = 9
+	mqttTypePingReq    = 12
+	mqttTypeDisconnect = 14
+)
+
+var errMQTTDisconnected = errors.New("not connected to the MQTT broker")
+
+// mqttSchemes are the mqtt_broker URL schemes, and whether they use TLS.
+var mqttSchemes = map[string]bool{"tcp": false, "mqtt": false, "ssl": true, "tls": true, "mqtts": true}
+
+// mqttClient is the connection to the broker, opened on first use and
+// reopened by runMQTT when it drops.
+var mqttClient = struct {
+	sync.Mutex
+	conn    *mqttConn
+	stopped bool
+}{}
+
+// mqttCommands is draining while the agent stops: commands are left with the
+// broker for the next run, and cycles still in flight publish their metrics
+// before closeMQTT disconnects.
+var mqttCommands = struct {
+	sync.Mutex
+	draining bool
+}{}
+
+func knownMQTTScheme(scheme string) bool {
+	_, ok := mqttSchemes[scheme]
+	return ok
+}
+
+func mqttEnabled() bool {
+	return currentConfig().MQTTBroker != ""
+}
+
+func mqttTopic(kind string) string {
+	cfg := currentConfig()
+	return cfg.MQTTTopicPrefix + "/" + cfg.Hostname + "/" + kind
+}
+
+// mqttPublish publishes data, a JSON document for the HTTP endpoint kind
+// stands for, to the host's topic for kind.
+func mqttPublish(kind string, data []byte) error {
+	cfg := currentConfig()
+	data, err := withoutAPIKey(data)
+	if err != nil {
+		return err
+	}
+	conn, err := mqttConnection()
+	if err != nil {
+		return unavailable("mqtt "+kind, err)
+	}
+	if err := conn.publish(mqttTopic(kind), data, byte(cfg.MQTTQoS), false); err != nil {
+		conn.close()
+		return unavailable("mqtt "+kind, err)
+	}
+	return nil
+}
+
+// withoutAPIKey drops the api_key of a JSON document. Every subscriber
+// reads what is published, and the bridge knows the key itself.
+func withoutAPIKey(data []byte) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	if _, ok := doc["api_key"]; !ok {
+		return data, nil
+	}
+	delete(doc, "api_key")
+	return json.Marshal(doc)
+}
+
+// mqttState is the broker connection state, for /health.
+func mqttState() string {
+	if !mqttEnabled() {
+		return ""
+	}
+	mqttClient.Lock()
+	defer mqttClient.Unlock()
+	if mqttClient.conn != nil && !mqttClient.conn.closed() {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// mqttConnection returns the open connection, connecting first if there is
+// none.
+func mqttConnection() (*mqttConn, error) {
+	cfg := currentConfig()
+	mqttClient.Lock()
+	defer mqttClient.Unlock()
+	if mqttClient.stopped {
+		return nil, errMQTTDisconnected
+	}
+	if mqttClient.conn != nil && !mqttClient.conn.closed() {
+		return mqttClient.conn, nil
+	}
+	conn, err := dialMQTT()
+	if err != nil {
+		return nil, err
+	}
+	mqttClient.conn = conn
+	logger.Info("mqtt.connected", "Connected to the MQTT broker", Fields{"broker": redactURL(cfg.MQTTBroker)})
+	return conn, nil
+}
+
+// runMQTT keeps the broker connection open, so commands arrive between
+// publishes, and closes it when ctx is done.
+func runMQTT(ctx context.Context) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	failing := false
+	for {
+		conn, err := mqttConnection()
+		switch {
+		case err != nil:
+			if !failing {
+				logger.Warn("mqtt.connect_failed", "Cannot reach the MQTT broker, retrying", Fields{"broker": redactURL(currentConfig().MQTTBroker), "error": err})
+			}
+			failing = true
+		case time.Since(time.Unix(0, conn.lastRead.Load())) > mqttKeepAlive*3/2:
+			logger.Warn("mqtt.timeout", "MQTT broker stopped answering, reconnecting", nil)
+			conn.close()
+		default:
+			failing = false
+			if err := conn.write(mqttTypePingReq<<4, nil); err != nil {
+				conn.close()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			mqttCommands.Lock()
+			mqttCommands.draining = true
+			mqttCommands.Unlock()
+			return
+		}
+	}
+}
+
+// closeMQTT marks the host offline and disconnects, once nothing is left to
+// publish.
+func closeMQTT() {
+	if !mqttEnabled() {
+		return
+	}
+	mqttClient.Lock()
+	mqttClient.stopped = true
+	conn := mqttClient.conn
+	mqttClient.Unlock()
+	if conn != nil && !conn.closed() {
+		conn.publish(mqttTopic("status"), []byte("offline"), 1, true)
+		conn.write(mqttTypeDisconnect<<4, nil)
+		conn.close()
+	}
+}
+
+// handleMQTTCommands runs the commands of a signed message on the commands
+// topic. Callers hold the mqttCommands lock.
+func handleMQTTCommands(payload []byte) {
+	commands, err := verifyMQTTCommands(payload, time.Now())
+	if err != nil {
+		logger.Warn("mqtt.command_rejected", "Rejected a message on the commands topic", Fields{"error": err})
+		return
+	}
+	if len(commands) == 0 {
+		return
+	}
+	logger.Info("commands.pending", "Received commands from the MQTT broker", Fields{"count": len(commands)})
+	runCommands(currentConfig(), commands)
+}
+
+// Anyone who can publish to the broker can publish to the commands topic,
+// so commands are only run from a message signed with the API key:
+//
+//	{"timestamp": <unix seconds>, "commands": <one command or a list>,
+//	 "signature": "v1=<hex HMAC-SHA256>"}
+//
+// The signature covers "<hostname>\n<timestamp>\n" and the commands exactly
+// as published, command IDs included, under a key derived from the API key.
+// A message older than mqttCommandMaxAge is refused, and a command ID runs
+// once: the IDs run are kept in the state dir until their messages expire.
+const (
+	mqttCommandMaxAge  = 15 * time.Minute
+	mqttCommandsFile   = "mqtt-commands.json"
+	mqttCommandsFormat = 1
+)
+
+var (
+	errMQTTUnsigned = errors.New("command message is not signed")
+	errMQTTNoKey    = errors.New("commands over MQTT need an api_key to verify them")
+)
+
+type mqttCommandMessage struct {
+	Timestamp int64           `json:"timestamp"`
+	Commands  json.RawMessage `json:"commands"`
+	Signature string          `json:"signature"`
+}
+
+// mqttCommandIDs are the command IDs run recently, with the timestamps of
+// their messages. Guarded by the mqttCommands lock.
+var mqttCommandIDs map[int]int64
+
+type mqttCommandsState struct {
+	Version int           `json:"version"`
+	Ran     map[int]int64 `json:"ran"`
+}
+
+// verifyMQTTCommands checks the signature and age of a command message and
+// returns its commands that have not run yet.
+func verifyMQTTCommands(payload []byte, now time.Time) ([]PendingCommand, error) {
+	cfg := currentConfig()
+	apiKey, hostname := cfg.APIKey, cfg.Hostname
+	if apiKey == "" {
+		return nil, errMQTTNoKey
+	}
+
+	var msg mqttCommandMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, fmt.Errorf("invalid command message: %w", err)
+	}
+	if msg.Signature == "" || len(msg.Commands) == 0 {
+		return nil, errMQTTUnsigned
+	}
+	want := "v1=" + mqttCommandSignature(apiKey, hostname, msg.Timestamp, msg.Commands)
+	if !hmac.Equal([]byte(msg.Signature), []byte(want)) {
+		return nil, errors.New("command message signature does not match")
+	}
+	age := now.Sub(time.Unix(msg.Timestamp, 0))
+	if age > mqttCommandMaxAge || age < -mqttCommandMaxAge {
+		return nil, fmt.Errorf("command message is %s old, more than %s apart from the agent's clock", age.Round(time.Second), mqttCommandMaxAge)
+	}
+
+	var commands []PendingCommand
+	raw := bytes.TrimSpace(msg.Commands)
+	var err error
+	if raw[0] == '[' {
+		commands, err = decodeCommands(bytes.NewReader(raw))
+	} else {
+		var cmd PendingCommand
+		err = json.Unmarshal(raw, &cmd)
+		commands = []PendingCommand{cmd}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid commands: %w", err)
+	}
+
+	loadMQTTCommandIDs(now)
+	fresh := commands[:0]
+	for _, cmd := range commands {
+		if _, ran := mqttCommandIDs[cmd.ID]; ran {
+			logger.Warn("mqtt.command_replayed", "Ignored a command that already ran", Fields{"command_id": cmd.ID})
+			continue
+		}
+		mqttCommandIDs[cmd.ID] = msg.Timestamp
+		fresh = append(fresh, cmd)
+	}
+	if len(fresh) > 0 {
+		saveMQTTCommandIDs()
+	}
+	return fresh, nil
+}
+
+// mqttCommandSignature is the hex signature of a command message.
+func mqttCommandSignature(apiKey, hostname string, timestamp int64, commands []byte) string {
+	key := hmac.New(sha256.New, []byte(apiKey))
+	key.Write([]byte("lxmon-mqtt-commands"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	fmt.Fprintf(mac, "%s\n%d\n", hostname, timestamp)
+	mac.Write(commands)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadMQTTCommandIDs reads the IDs run by earlier runs on first use, and
+// forgets the IDs whose messages have expired.
+func loadMQTTCommandIDs(now time.Time) {
+	cfg := currentConfig()
+	if mqttCommandIDs == nil {
+		mqttCommandIDs = map[int]int64{}
+		if cfg.StateDir != "" {
+			var state mqttCommandsState
+			data, err := os.ReadFile(filepath.Join(cfg.StateDir, mqttCommandsFile))
+			if err == nil {
+				if err := json.Unmarshal(data, &state); err != nil || state.Version != mqttCommandsFormat {
+					logger.Warn("mqtt.state_ignored", "Ignoring unreadable MQTT command state", Fields{"version": state.Version, "error": err})
+				} else {
+					for id, ts := range state.Ran {
+						mqttCommandIDs[id] = ts
+					}
+				}
+			}
+		}
+	}
+	expired := now.Add(-2 * mqttCommandMaxAge).Unix()
+	for id, ts := range mqttCommandIDs {
+		if ts < expired {
+			delete(mqttCommandIDs, id)
+		}
+	}
+}
+
+func saveMQTTCommandIDs() {
+	cfg := currentConfig()
+	if cfg.StateDir == "" {
+		return
+	}
+	data, _ := json.Marshal(mqttCommandsState{Version: mqttCommandsFormat, Ran: mqttCommandIDs})
+	if err := writeStateFile(filepath.Join(cfg.StateDir, mqttCommandsFile), data); err != nil {
+		logger.Warn("mqtt.state_save_failed", "Failed to record the commands run, a replay after a restart could run them again", Fields{"error": err})
+	}
+}
+
+// mqttConn is one connection to the broker.
+type mqttConn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	writeMu  sync.Mutex
+	lastRead atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+
+	mu     sync.Mutex
+	nextID uint16
+	acks   map[uint16]chan byte
+}
+
+// dialMQTT connects to mqtt_broker (tcp:// or mqtt://, or ssl://, tls://
+// or mqtts:// with the agent's TLS settings), subscribes to the commands
+// topic and marks the host online.
+func dialMQTT() (*mqttConn, error) {
+	cfg := currentConfig()
+	u, err := url.Parse(cfg.MQTTBroker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt_broker: %w", err)
+	}
+	secure, ok := mqttSchemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid mqtt_broker: unknown scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var raw net.Conn
+	if secure {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = u.Hostname()
+		raw, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		raw, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &mqttConn{conn: raw, br: bufio.NewReader(raw), done: make(chan struct{}), acks: map[uint16]chan byte{}}
+	c.lastRead.Store(time.Now().UnixNano())
+	raw.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if err := c.write(mqttTypeConnect<<4, connectPacket()); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	header, body, err := c.readPacket()
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	if header>>4 != mqttTypeConnAck || len(body) < 2 {
+		raw.Close()
+		return nil, fmt.Errorf("mqtt connect: unexpected packet type %d", header>>4)
+	}
+	if body[1] != 0 {
+		raw.Close()
+		return nil, fmt.Errorf("mqtt connect: broker refused the connection (return code %d)", body[1])
+	}
+	raw.SetDeadline(time.Time{})
+
+	go func() {
+		defer crashGuard()
+		c.readLoop()
+	}()
+
+	if err := c.subscribe(mqttTopic("commands"), byte(cfg.MQTTQoS)); err != nil {
+		c.close()
+		return nil, err
+	}
+	if err := c.publish(mqttTopic("status"), []byte("online"), 1, true); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connectPacket is the variable header and payload of CONNECT: a persistent
+// session, so the broker keeps commands for the agent while it is offline,
+// with "offline" on the status topic as the will.
+func connectPacket() []byte {
+	cfg := currentConfig()
+	flags := byte(0x04 | 0x08 | 0x20) // will at QoS 1, retained
+	if cfg.MQTTUsername != "" {
+		flags |= 0x80
+		if cfg.MQTTPassword != "" {
+			flags |= 0x40
+		}
+	}
+	// The session is keyed by client ID, so it must stay the same across
+	// runs.
+	clientID := "lxmon-" + cfg.Hostname
+
+	packet := mqttString(nil, "MQTT")
+	packet = append(packet, 4, flags)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(mqttKeepAlive/time.Second))
+	packet = mqttString(packet, clientID)
+	packet = mqttString(packet, mqttTopic("status"))
+	packet = mqttString(packet, "offline")
+	if cfg.MQTTUsername != "" {
+		packet = mqttString(packet, cfg.MQTTUsername)
+		if cfg.MQTTPassword != "" {
+			packet = mqttString(packet, cfg.MQTTPassword)
+		}
+	}
+	return packet
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// publish sends payload to topic. At QoS 1 it waits for the broker's PUBACK.
+func (c *mqttConn) publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(mqttTypePublish<<4) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+	body := mqttString(nil, topic)
+	if qos == 0 {
+		return c.write(header, append(body, payload...))
+	}
+	id, ack := c.expectAck()
+	defer c.forgetAck(id)
+	body = binary.BigEndian.AppendUint16(body, id)
+	if err := c.write(header, append(body, payload...)); err != nil {
+		return err
+	}
+	_, err := c.waitAck(ack)
+	return err
+}
+
+// subscribe subscribes to topic and waits for the broker's SUBACK.
+func (c *mqttConn) subscribe(topic string, qos byte) error {
+	id, ack := c.expectAck()
+	defer c.forgetAck(id)
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = mqttString(body, topic)
+	body = append(body, qos)
+	// SUBSCRIBE has the reserved flags 0010
+	if err := c.write(mqttTypeSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+	code, err := c.waitAck(ack)
+	if err != nil {
+		return err
+	}
+	if code == 0x80 {
+		return fmt.Errorf("mqtt: broker refused the subscription to %s", topic)
+	}
+	return nil
+}
+
+func (c *mqttConn) expectAck() (uint16, chan byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	ack := make(chan byte, 1)
+	c.acks[c.nextID] = ack
+	return c.nextID, ack
+}
+
+func (c *mqttConn) forgetAck(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.acks, id)
+}
+
+func (c *mqttConn) waitAck(ack chan byte) (byte, error) {
+	select {
+	case code := <-ack:
+		return code, nil
+	case <-c.done:
+		return 0, errMQTTDisconnected
+	case <-time.After(mqttAckTimeout):
+		return 0, errors.New("mqtt: broker did not acknowledge in time")
+	}
+}
+
+// readLoop handles the packets from the broker until the connection closes.
+func (c *mqttConn) readLoop() {
+	defer c.close()
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			if !c.closed() {
+				logger.Warn("mqtt.disconnected", "Lost the connection to the MQTT broker", Fields{"error": err})
+			}
+			return
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+
+		switch header >> 4 {
+		case mqttTypePublish:
+			qos := header >> 1 & 0x03
+			if len(body) < 2 {
+				continue
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			rest := body[2:]
+			if len(rest) < n {
+				continue
+			}
+			rest = rest[n:]
+			// Unacknowledged while draining, the broker delivers the
+			// commands again to the next run. Checking under the lock
+			// keeps new commands from starting once the agent waits for
+			// the running ones.
+			mqttCommands.Lock()
+			if !mqttCommands.draining {
+				if qos > 0 && len(rest) >= 2 {
+					c.write(mqttTypePubAck<<4, rest[:2])
+					rest = rest[2:]
+				}
+				handleMQTTCommands(rest)
+			}
+			mqttCommands.Unlock()
+		case mqttTypePubAck, mqttTypeSubAck:
+			if len(body) < 2 {
+				continue
+			}
+			var code byte
+			if len(body) > 2 {
+				code = body[2]
+			}
+			c.mu.Lock()
+			if ack, ok := c.acks[binary.BigEndian.Uint16(body)]; ok {
+				ack <- code
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// write sends a packet with the given fixed header byte and body.
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(mqttAckTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	header, err := c.br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		digit, err := c.br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("mqtt: packet larger than %d bytes", mqttMaxPacket)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func (c *mqttConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *mqttConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metric names are moving to a dotted canonical scheme, where the metric's
+// full name is "<metric_type>.<metric_name>" and reads from the general to
+// the specific: system.cpu.utilization instead of cpu.usage_percent. The
+// server already takes that form wherever a metric is named as one string.
+//
+// metric_names chooses what the agent sends: the legacy names (the default),
+// both, or the canonical names only. Sending both during a transition keeps
+// dashboards and alert rules on the old names working while they are moved.
+const (
+	metricNamesLegacy    = "legacy"
+	metricNamesBoth      = "both"
+	metricNamesCanonical = "canonical"
+)
+
+// canonicalNames maps legacy names to canonical ones. Metrics not listed
+// already follow the scheme and keep their name.
+var canonicalNames = map[string]string{
+	"cpu.usage_percent": "system.cpu.utilization",
+	"cpu.count":         "system.cpu.logical_count",
+
+	"memory.total":             "system.memory.total",
+	"memory.used":              "system.memory.usage",
+	"memory.used_percent":      "system.memory.utilization",
+	"memory.available":         "system.memory.available",
+	"memory.swap_total":        "system.paging.total",
+	"memory.swap_used":         "system.paging.usage",
+	"memory.swap_used_percent": "system.paging.utilization",
+
+	"disk.usage_percent": "system.filesystem.utilization",
+	"disk.total":         "system.filesystem.total",
+	"disk.free":          "system.filesystem.free",
+
+	"network.bytes_sent":   "system.network.io.transmit",
+	"network.bytes_recv":   "system.network.io.receive",
+	"network.packets_sent": "system.network.packets.transmit",
+	"network.packets_recv": "system.network.packets.receive",
+
+	"system.load_average_1m":  "system.cpu.load_average.1m",
+	"system.load_average_5m":  "system.cpu.load_average.5m",
+	"system.load_average_15m": "system.cpu.load_average.15m",
+	"system.process_count":    "system.processes.count",
+}
+
+// canonicalMetric returns m under its canonical name, or false if its name
+// is canonical already.
+func canonicalMetric(m Metric) (Metric, bool) {
+	canonical, ok := canonicalNames[m.MetricType+"."+m.MetricName]
+	if !ok {
+		return m, false
+	}
+	m.MetricType, m.MetricName, _ = strings.Cut(canonical, ".")
+	return m, true
+}
+
+// applyMetricNames renames metrics as metric_names asks.
+func applyMetricNames(cfg Config, metrics []Metric) []Metric {
+	switch cfg.MetricNames {
+	case metricNamesBoth:
+		for _, m := range metrics {
+			if canonical, ok := canonicalMetric(m); ok {
+				metrics = append(metrics, canonical)
+			}
+		}
+	case metricNamesCanonical:
+		for i, m := range metrics {
+			metrics[i], _ = canonicalMetric(m)
+		}
+	}
+	return metrics
+}
+
+// runMetricNames prints the legacy names and the canonical names they move
+// to, for updating dashboards and alert rules.
+func runMetricNames(args []string) int {
+	legacy := make([]string, 0, len(canonicalNames))
+	for name := range canonicalNames {
+		legacy = append(legacy, name)
+	}
+	sort.Strings(legacy)
+	for _, name := range legacy {
+		fmt.Printf("%-26s %s\n", name, canonicalNames[name])
+	}
+	return 0
+}
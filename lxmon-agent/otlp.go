@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The agent can also export its metrics to any OpenTelemetry backend, through
+// OTLP/HTTP with the JSON encoding (POST <otlp_endpoint>/v1/metrics). Each
+// cycle becomes one ExportMetricsServiceRequest: the host and the configured
+// tags are resource attributes, metadata are data point attributes, and
+// metrics are named "<metric_type>.<metric_name>" under their canonical
+// names. Counters in the registry are monotonic cumulative sums; everything
+// else is a gauge.
+
+const otlpMetricsPath = "/v1/metrics"
+
+// otlpTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpTemporalityCumulative = 2
+
+// otlpClient sends to the OTLP endpoint, which is not the lxmon server: it
+// gets neither the server's TLS settings nor its request signature.
+var otlpClient = &http.Client{Timeout: 30 * time.Second}
+
+// otlpUnits maps registry units to UCUM, as OpenTelemetry expects. Other
+// units are annotations, such as {level}.
+var otlpUnits = map[string]string{
+	"percent": "%",
+	"bytes":   "By",
+	"seconds": "s",
+	"days":    "d",
+	"bool":    "1",
+	"count":   "1",
+	"load":    "1",
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+// otlpDataPoint is a NumberDataPoint. The JSON encoding of OTLP carries
+// 64-bit integers as strings.
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue; exactly one field is set.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpEnabled() bool {
+	return currentConfig().OTLPEndpoint != ""
+}
+
+// otlpOnly reports whether metrics go to the OTLP endpoint instead of the
+// lxmon server, which the agent then does not talk to at all.
+func otlpOnly() bool {
+	return otlpEnabled() && currentConfig().OTLPOnly
+}
+
+// otlpURL is where the metrics are posted: the endpoint as given when it
+// has a path, otherwise its /v1/metrics.
+func otlpURL(cfg Config) string {
+	endpoint := strings.TrimSuffix(cfg.OTLPEndpoint, "/")
+	if u, err := url.Parse(endpoint); err == nil && u.Path == "" {
+		return endpoint + otlpMetricsPath
+	}
+	return endpoint
+}
+
+// encodeOTLP encodes a cycle's metrics, as collected, as an OTLP request.
+func encodeOTLP(cfg Config, metrics []Metric) sinkBatch {
+	request := newOTLPRequest(cfg, metrics)
+	data, err := json.Marshal(request)
+	if err != nil {
+		logger.Error("otlp.marshal_failed", "Failed to encode OTLP metrics", Fields{"error": err})
+		return sinkBatch{}
+	}
+	return sinkBatch{body: data, count: request.dataPoints()}
+}
+
+// sendOTLP makes one attempt at exporting a batch.
+func sendOTLP(cfg Config, batch sinkBatch) error {
+	if cfg.DryRun {
+		logDryRun(otlpURL(cfg), batch.body)
+		return nil
+	}
+	return postOTLP(cfg, batch.body)
+}
+
+// otlpDone counts, in OTLP-only mode, as the cycle's send for the health
+// endpoint.
+func otlpDone(batch sinkBatch, err error) {
+	if !otlpOnly() {
+		return
+	}
+	if err != nil {
+		health.recordSendError(err)
+		return
+	}
+	health.recordSend()
+	logger.Info("metrics.sent", "Exported metrics over OTLP", Fields{"count": batch.count})
+}
+
+func postOTLP(cfg Config, data []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), "POST", otlpURL(cfg), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range cfg.OTLPHeaders {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return unavailable("otlp export", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("otlp export", resp); err != nil {
+		return err
+	}
+
+	// A partial success names the data points the backend dropped, which
+	// resending would not help
+	var result struct {
+		PartialSuccess struct {
+			RejectedDataPoints string `json:"rejectedDataPoints"`
+			ErrorMessage       string `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+	partial := result.PartialSuccess
+	if (partial.RejectedDataPoints != "" && partial.RejectedDataPoints != "0") || partial.ErrorMessage != "" {
+		logger.Warn("otlp.partial_success", "OTLP backend rejected some data points", Fields{
+			"rejected": partial.RejectedDataPoints,
+			"error":    partial.ErrorMessage,
+		})
+	}
+	return nil
+}
+
+// newOTLPRequest converts a cycle's metrics, as collected and before
+// newMetricsPayload renames them, grouping the data points of each name.
+func newOTLPRequest(cfg Config, metrics []Metric) otlpRequest {
+	resource := []otlpAttribute{
+		otlpAttr("host.name", cfg.Hostname),
+		otlpAttr("service.name", "lxmon-agent"),
+		otlpAttr("service.version", version),
+	}
+	if agentID != "" {
+		resource = append(resource, otlpAttr("service.instance.id", agentID))
+	}
+	tags := make([]string, 0, len(cfg.Tags))
+	for key := range cfg.Tags {
+		tags = append(tags, key)
+	}
+	sort.Strings(tags)
+	for _, key := range tags {
+		resource = append(resource, otlpAttr(key, cfg.Tags[key]))
+	}
+
+	descriptors := registryByName()
+	start := strconv.FormatInt(health.startedAt.UnixNano(), 10)
+	byName := map[string]*otlpMetric{}
+	var names []string
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		// OpenTelemetry backends get the canonical names whatever
+		// metric_names sends to the server
+		m, _ = canonicalMetric(m)
+		name := m.MetricType + "." + m.MetricName
+
+		metric, ok := byName[name]
+		if !ok {
+			descriptor := descriptors[name]
+			unit := descriptor.Unit
+			if unit == "" {
+				unit = m.Unit
+			}
+			metric = &otlpMetric{Name: name, Description: descriptor.Description, Unit: otlpUnit(unit)}
+			if descriptor.Kind == kindCounter {
+				metric.Sum = &otlpSum{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+			} else {
+				metric.Gauge = &otlpGauge{}
+			}
+			byName[name] = metric
+			names = append(names, name)
+		}
+
+		point := otlpDataPoint{
+			Attributes:   otlpAttributes(m.Metadata),
+			TimeUnixNano: strconv.FormatInt(m.Timestamp.UnixNano(), 10),
+			AsDouble:     m.Value,
+		}
+		if metric.Sum != nil {
+			point.StartTimeUnixNano = start
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+		} else {
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point)
+		}
+	}
+
+	scope := otlpScopeMetrics{Scope: otlpScope{Name: "lxmon-agent", Version: version}}
+	for _, name := range names {
+		scope.Metrics = append(scope.Metrics, *byName[name])
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: resource},
+		ScopeMetrics: []otlpScopeMetrics{scope},
+	}}}
+}
+
+func (r otlpRequest) dataPoints() int {
+	count := 0
+	for _, resource := range r.ResourceMetrics {
+		for _, scope := range resource.ScopeMetrics {
+			for _, metric := range scope.Metrics {
+				if metric.Sum != nil {
+					count += len(metric.Sum.DataPoints)
+				} else {
+					count += len(metric.Gauge.DataPoints)
+				}
+			}
+		}
+	}
+	return count
+}
+
+func otlpUnit(unit string) string {
+	if unit == "" {
+		return ""
+	}
+	if ucum, ok := otlpUnits[unit]; ok {
+		return ucum
+	}
+	return "{" + unit + "}"
+}
+
+// otlpAttributes converts metadata, in key order. Other values than strings,
+// booleans, ints and finite floats are sent as strings.
+func otlpAttributes(metadata map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := metadata[key].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				s := strconv.FormatFloat(v, 'g', -1, 64)
+				value.StringValue = &s
+				break
+			}
+			value.DoubleValue = &v
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			s := string(encoded)
+			value.StringValue = &s
+		}
+		attributes = append(attributes, otlpAttribute{Key: key, Value: value})
+	}
+	return attributes
+}
+
+func otlpAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
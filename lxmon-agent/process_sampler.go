@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// processSample is one process's resource usage since the previous sample.
+type processSample struct {
+	PID  int32
+	User string
+	Name string
+	CPU  float64
+	RSS  uint64
+}
+
+// processSampler keeps process handles between calls so that CPU usage is
+// measured over the interval between samples rather than since process start.
+type processSampler struct {
+	mu        sync.Mutex
+	processes map[int32]*process.Process
+}
+
+func newProcessSampler() *processSampler {
+	return &processSampler{processes: map[int32]*process.Process{}}
+}
+
+// sample returns usage for every visible process. Processes seen for the
+// first time report 0% CPU until the next sample.
+func (s *processSampler) sample() []processSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pids, err := process.Pids()
+	if err != nil {
+		return nil
+	}
+	alive := make(map[int32]*process.Process, len(pids))
+	samples := make([]processSample, 0, len(pids))
+	for _, pid := range pids {
+		p, ok := s.processes[pid]
+		if !ok {
+			if p, err = process.NewProcess(pid); err != nil {
+				continue
+			}
+		}
+		alive[pid] = p
+		cpuPercent, err := p.Percent(0)
+		if err != nil {
+			continue
+		}
+		entry := processSample{PID: pid, CPU: cpuPercent}
+		entry.Name, _ = p.Name()
+		entry.User, _ = p.Username()
+		if memInfo, err := p.MemoryInfo(); err == nil {
+			entry.RSS = memInfo.RSS
+		}
+		samples = append(samples, entry)
+	}
+	s.processes = alive
+	return samples
+}
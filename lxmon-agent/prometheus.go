@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With prometheus_listen, the agent serves its latest values on /metrics for
+// Prometheus to scrape, in the OpenMetrics format when the scraper asks for
+// it and the classic text format otherwise. Series are named and labeled as
+// for remote write, without instance and job, which Prometheus adds itself.
+// A series keeps its last value until its collector runs again, so
+// collectors on their own interval stay visible in between; one not seen
+// for three of the longest intervals (its source went away) is dropped.
+//
+// With prometheus_only, being scraped replaces the lxmon server, as with
+// otlp_only.
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	promTextContentType    = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+type promSample struct {
+	family string
+	name   string
+	kind   string
+	labels string
+	value  float64
+	seen   time.Time
+}
+
+var promExposition = struct {
+	sync.Mutex
+	series map[string]promSample
+	help   map[string]string
+}{series: map[string]promSample{}, help: map[string]string{}}
+
+var (
+	promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	promHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func prometheusEnabled() bool {
+	return currentConfig().PrometheusListen != ""
+}
+
+// prometheusOnly reports whether Prometheus scrapes the agent instead of it
+// sending to the lxmon server.
+func prometheusOnly() bool {
+	return prometheusEnabled() && currentConfig().PrometheusOnly
+}
+
+// serverless reports whether the agent does not talk to the lxmon server at
+// all, as it exports over OTLP or is scraped by Prometheus instead.
+func serverless() bool {
+	return otlpOnly() || prometheusOnly()
+}
+
+// updatePrometheus records a cycle's metrics, as collected, for the next
+// scrapes. In Prometheus-only mode it counts as the cycle's send for the
+// health endpoint.
+func updatePrometheus(cfg Config, metrics []Metric) {
+	// Renamed on a copy: the metrics are sent on to the server as they are
+	metrics = applyMetricNames(cfg, append([]Metric(nil), metrics...))
+	descriptors := registryByName()
+
+	now := time.Now()
+	promExposition.Lock()
+	for _, m := range metrics {
+		// Events are one-off marks, not values to keep exposing
+		if m.MetricType == "event" || math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		descriptor := descriptors[m.MetricType+"."+m.MetricName]
+		name, labels := promSeries(cfg, m, descriptor.Kind)
+		family := name
+		if descriptor.Kind == kindCounter {
+			family = strings.TrimSuffix(name, "_total")
+		}
+		sample := promSample{family: family, name: name, kind: descriptor.Kind, labels: promLabelSet(labels), value: m.Value, seen: now}
+		promExposition.series[name+"{"+sample.labels+"}"] = sample
+		if descriptor.Description != "" {
+			promExposition.help[family] = descriptor.Description
+		}
+	}
+	staleAfter := 3 * degradedInterval(cfg.Interval)
+	for _, interval := range cfg.CollectorIntervals {
+		staleAfter = max(staleAfter, 3*interval)
+	}
+	for key, sample := range promExposition.series {
+		if now.Sub(sample.seen) > staleAfter {
+			delete(promExposition.series, key)
+		}
+	}
+	count := len(promExposition.series)
+	promExposition.Unlock()
+
+	if prometheusOnly() {
+		health.recordSend()
+		logger.Debug("prometheus.updated", "Updated the values exposed to Prometheus", Fields{"series": count})
+	}
+}
+
+// promLabelSet renders labels as name="value" pairs in name order, leaving
+// out empty values, which Prometheus treats as absent.
+func promLabelSet(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(promLabelEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// handlePrometheus serves /metrics.
+func handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	promExposition.Lock()
+	samples := make([]promSample, 0, len(promExposition.series))
+	for _, sample := range promExposition.series {
+		samples = append(samples, sample)
+	}
+	help := make(map[string]string, len(promExposition.help))
+	for family, text := range promExposition.help {
+		help[family] = text
+	}
+	promExposition.Unlock()
+	// A family's samples must be together
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].family != samples[j].family {
+			return samples[i].family < samples[j].family
+		}
+		return samples[i].labels < samples[j].labels
+	})
+
+	var b strings.Builder
+	family := ""
+	for _, sample := range samples {
+		if sample.family != family {
+			family = sample.family
+			kind := "gauge"
+			if sample.kind == kindCounter {
+				kind = "counter"
+			}
+			// OpenMetrics names a counter family without its _total
+			// suffix, the classic format with it
+			name := sample.name
+			if openMetrics {
+				name = sample.family
+			}
+			if text, ok := help[family]; ok {
+				b.WriteString("# HELP " + name + " " + promHelpEscaper.Replace(text) + "\n")
+			}
+			b.WriteString("# TYPE " + name + " " + kind + "\n")
+		}
+		b.WriteString(sample.name)
+		if sample.labels != "" {
+			b.WriteString("{" + sample.labels + "}")
+		}
+		b.WriteString(" " + strconv.FormatFloat(sample.value, 'g', -1, 64) + "\n")
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", promTextContentType)
+	}
+	w.Write([]byte(b.String()))
+}
+
+// startPrometheusListener starts the /metrics listener on prometheus_listen,
+// behind prometheus_allow. It returns nil when it is disabled or cannot
+// listen.
+func startPrometheusListener() *http.Server {
+	cfg := currentConfig()
+	if !prometheusEnabled() {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handlePrometheus)
+	addr, err := listenAddress(cfg.PrometheusListen)
+	var listener net.Listener
+	if err == nil {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		logger.Error("prometheus.failed", "Prometheus listener failed", Fields{"error": err})
+		return nil
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		defer crashGuard()
+		err := server.Serve(allowListener{Listener: listener, name: "prometheus", allow: func(c Config) []string { return c.PrometheusAllow }})
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("prometheus.failed", "Prometheus listener failed", Fields{"error": err})
+		}
+	}()
+	logger.Info("prometheus.listening", "Serving metrics for Prometheus", Fields{"addr": cfg.PrometheusListen})
+	return server
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The agent registers with the version of the protocol it speaks and the
+// optional features it can use, and the server answers with its own. The
+// agent then leaves out what the server does not list, so agents and servers
+// of different versions keep working together during an upgrade. A server
+// from before the handshake answers with neither and is assumed to support
+// everything, as before: the agent finds out by trying, from 404s and
+// refused upgrades.
+
+// agentSchemaVersion is the version of the registration and metrics
+// payloads the agent sends.
+const agentSchemaVersion = 1
+
+// Optional features the agent uses only when the server advertises them.
+const (
+	capabilityGzip           = "gzip"
+	capabilityCommandChannel = "command_channel"
+	capabilityMetricRegistry = "metric_registry"
+	capabilityServerConfig   = "server_config"
+)
+
+var agentCapabilities = []string{capabilityGzip, capabilityCommandChannel, capabilityMetricRegistry, capabilityServerConfig}
+
+// Commands the agent runs itself rather than through the shell. They are
+// registered with the capabilities, and the server only queues them to agents
+// that list them: an older agent would run their text as a shell command.
+const (
+	capabilityControl = "control"
+	capabilityScript  = "script"
+)
+
+var agentCommandCapabilities = []string{capabilityControl, capabilityScript}
+
+// registeredCapabilities is what the agent registers as its capabilities.
+func registeredCapabilities() []string {
+	return append(append([]string{}, agentCapabilities...), agentCommandCapabilities...)
+}
+
+// serverProtocol is what a server advertised in its registration answer.
+type serverProtocol struct {
+	SchemaVersion int      `json:"schema_version"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+// serverProtocols remembers, per server base URL, what the server
+// advertised, as servers behind failover_urls may run different versions.
+var serverProtocols = struct {
+	sync.Mutex
+	servers map[string]serverProtocol
+}{servers: map[string]serverProtocol{}}
+
+// noteServerProtocol records what a registration answer from base
+// advertises, if anything.
+func noteServerProtocol(base string, body []byte) {
+	var advertised serverProtocol
+	if json.Unmarshal(body, &advertised) != nil || advertised.SchemaVersion == 0 {
+		return
+	}
+	sort.Strings(advertised.Capabilities)
+
+	serverProtocols.Lock()
+	previous, known := serverProtocols.servers[base]
+	serverProtocols.servers[base] = advertised
+	serverProtocols.Unlock()
+	if known && previous.SchemaVersion == advertised.SchemaVersion && strings.Join(previous.Capabilities, ",") == strings.Join(advertised.Capabilities, ",") {
+		return
+	}
+
+	var unsupported []string
+	for _, capability := range agentCapabilities {
+		if !advertised.supports(capability) {
+			unsupported = append(unsupported, capability)
+		}
+	}
+	fields := Fields{"server_url": base, "schema_version": advertised.SchemaVersion, "capabilities": strings.Join(advertised.Capabilities, ","), "disabled": strings.Join(unsupported, ",")}
+	if advertised.SchemaVersion < agentSchemaVersion {
+		logger.Warn("server.protocol_older", "Server speaks an older protocol than the agent, upgrade it", fields)
+	} else {
+		logger.Info("server.protocol", "Negotiated the protocol with the server", fields)
+	}
+}
+
+func (p serverProtocol) supports(capability string) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// serverSupports reports whether the server at base advertised a
+// capability, or advertised none at all.
+func serverSupports(base, capability string) bool {
+	serverProtocols.Lock()
+	defer serverProtocols.Unlock()
+	advertised, known := serverProtocols.servers[base]
+	return !known || advertised.supports(capability)
+}
+
+// serverCapabilities returns what the active server advertised, for
+// /health, or nil before it did.
+func serverCapabilities() []string {
+	base := serverURL()
+	serverProtocols.Lock()
+	defer serverProtocols.Unlock()
+	return serverProtocols.servers[base].Capabilities
+}
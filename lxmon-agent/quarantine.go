@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxQuarantineEntries bounds the quarantine directory; the oldest entries
+// are removed first.
+const maxQuarantineEntries = 100
+
+// QuarantineEntry is a payload the server refused, stored together with the
+// server's answer so the rejection can be investigated later.
+type QuarantineEntry struct {
+	ID            string          `json:"id"`
+	QuarantinedAt time.Time       `json:"quarantined_at"`
+	Endpoint      string          `json:"endpoint"`
+	StatusCode    int             `json:"status_code,omitempty"`
+	Response      string          `json:"response,omitempty"`
+	Error         string          `json:"error"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+func quarantineDir() string {
+	return filepath.Join(currentConfig().StateDir, "quarantine")
+}
+
+// quarantinePayload persists a rejected payload. Failures to write are logged
+// but never affect the send path.
+func quarantinePayload(endpoint string, payload interface{}, sendErr error) {
+	cfg := currentConfig()
+	if cfg.StateDir == "" {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("quarantine.marshal_failed", "Failed to encode rejected payload", Fields{"error": err})
+		return
+	}
+
+	now := time.Now().UTC()
+	entry := QuarantineEntry{
+		ID:            fmt.Sprintf("%s-%s", now.Format("20060102T150405.000000000"), strings.Trim(strings.ReplaceAll(endpoint, "/", "-"), "-")),
+		QuarantinedAt: now,
+		Endpoint:      endpoint,
+		Error:         sendErr.Error(),
+		Payload:       redactSecrets(data),
+	}
+	var serverErr *ServerError
+	if errors.As(sendErr, &serverErr) {
+		entry.StatusCode = serverErr.StatusCode
+		entry.Response = serverErr.Body
+	}
+
+	dir := quarantineDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		logger.Warn("quarantine.write_failed", "Failed to create quarantine directory", Fields{"dir": dir, "error": err})
+		return
+	}
+	out, _ := json.MarshalIndent(entry, "", "  ")
+	path := filepath.Join(dir, entry.ID+".json")
+	if err := os.WriteFile(path, out, 0o600); err != nil {
+		logger.Warn("quarantine.write_failed", "Failed to write quarantine entry", Fields{"path": path, "error": err})
+		return
+	}
+	logger.Warn("quarantine.stored", "Rejected payload quarantined", Fields{"id": entry.ID, "status": entry.StatusCode})
+
+	pruneQuarantine(dir)
+}
+
+// secretFields are the top-level fields redactSecrets blanks.
+var secretFields = []string{"api_key", "enrollment_token", "mqtt_password", "otlp_headers", "remote_write_url", "remote_write_headers", "influx_url", "influx_token", "kafka_password", "kafka_schema_registry", "local_api_token"}
+
+// redactSecrets blanks the top-level credential fields so quarantined
+// payloads do not leak credentials.
+func redactSecrets(data []byte) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	redacted := false
+	for _, key := range secretFields {
+		if _, ok := fields[key]; ok {
+			fields[key] = json.RawMessage(`"REDACTED"`)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return data
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func listQuarantine(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func pruneQuarantine(dir string) {
+	files, err := listQuarantine(dir)
+	if err != nil || len(files) <= maxQuarantineEntries {
+		return
+	}
+	for _, file := range files[:len(files)-maxQuarantineEntries] {
+		os.Remove(file)
+	}
+}
+
+func readQuarantineEntry(path string) (QuarantineEntry, error) {
+	var entry QuarantineEntry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// runQuarantine implements `lxmon-agent quarantine [flags] list|show <id>|purge`
+// for inspecting payloads the server rejected.
+func runQuarantine(args []string) int {
+	rest, err := loadConfigArgs(args)
+	if err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 2
+	}
+	dir := quarantineDir()
+
+	action := "list"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+
+	switch action {
+	case "list":
+		files, err := listQuarantine(dir)
+		if err != nil {
+			logger.Error("quarantine.read_failed", "Failed to list quarantine", Fields{"error": err})
+			return 1
+		}
+		for _, file := range files {
+			entry, err := readQuarantineEntry(file)
+			if err != nil {
+				fmt.Printf("%s\t(unreadable: %v)\n", filepath.Base(file), err)
+				continue
+			}
+			fmt.Printf("%s\t%s\t%d\t%s\n", entry.ID, entry.Endpoint, entry.StatusCode, entry.QuarantinedAt.Format(time.RFC3339))
+		}
+		return 0
+	case "show":
+		if len(rest) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: lxmon-agent quarantine show <id>")
+			return 2
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.Base(rest[1])+".json"))
+		if err != nil {
+			logger.Error("quarantine.read_failed", "Failed to read quarantine entry", Fields{"error": err})
+			return 1
+		}
+		os.Stdout.Write(data)
+		fmt.Println()
+		return 0
+	case "purge":
+		files, err := listQuarantine(dir)
+		if err != nil {
+			logger.Error("quarantine.read_failed", "Failed to list quarantine", Fields{"error": err})
+			return 1
+		}
+		for _, file := range files {
+			os.Remove(file)
+		}
+		fmt.Printf("removed %d entries\n", len(files))
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown quarantine action %q (list, show, purge)\n", action)
+		return 2
+	}
+}
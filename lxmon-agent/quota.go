@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// QuotaStatus is how the server reports a host over one of its metric
+// quotas: in the "quota" field of a clipped metrics response, or as the
+// details of a QUOTA_EXCEEDED error.
+type QuotaStatus struct {
+	// metrics_per_payload or series_per_host
+	Quota    string `json:"quota"`
+	Limit    int    `json:"limit"`
+	Series   int    `json:"series,omitempty"`
+	Received int    `json:"received,omitempty"`
+	Dropped  int    `json:"dropped,omitempty"`
+}
+
+func (q QuotaStatus) String() string {
+	switch q.Quota {
+	case "metrics_per_payload":
+		return fmt.Sprintf("%d metrics in one payload, server limit is %d", q.Received, q.Limit)
+	case "series_per_host":
+		return fmt.Sprintf("host has %d of %d series, %d metrics of new series dropped", q.Series, q.Limit, q.Dropped)
+	}
+	return fmt.Sprintf("over the server's %s quota of %d", q.Quota, q.Limit)
+}
+
+// quotaExceeded returns the quota a QUOTA_EXCEEDED server error reports.
+func quotaExceeded(err error) (QuotaStatus, bool) {
+	var quota QuotaStatus
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "QUOTA_EXCEEDED" {
+		return quota, false
+	}
+	data, _ := json.Marshal(serverErr.Details)
+	json.Unmarshal(data, &quota)
+	return quota, true
+}
+
+// reportQuota surfaces the server clipping (delivered) or rejecting metrics
+// over a quota in the log and on /health. A nil quota clears the report.
+func reportQuota(quota *QuotaStatus, delivered bool) {
+	message := ""
+	if quota != nil {
+		message = quota.String()
+	}
+	if !health.recordQuota(message) || quota == nil {
+		return
+	}
+	fields := Fields{"quota": quota.Quota, "limit": quota.Limit, "detail": message}
+	if delivered {
+		logger.Warn("metrics.quota_clipped", "Server dropped metrics over the host's quota", fields)
+	} else {
+		logger.Error("metrics.quota_exceeded", "Server rejected metrics over the host's quota", fields)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With server_regions, the agent picks the closest of several regional
+// servers by round-trip time instead of by a GeoIP database or a per-site
+// setting. The RTT is measured once at startup, as the time to open a TCP
+// connection (the best of regionProbes), and the agent is tagged with the
+// closest region. Requests go to that region's server, and to the others,
+// in order of RTT, when it is unavailable.
+
+const (
+	regionProbes       = 3
+	regionProbeTimeout = 2 * time.Second
+	// regionTag is the tag the closest region is recorded in, unless the
+	// tags already set it.
+	regionTag = "region"
+)
+
+// serverRegion is a region with its measured round-trip time.
+type serverRegion struct {
+	Name string
+	URL  string
+	RTT  time.Duration
+	Err  error
+}
+
+// serverRegions caches the last measurement, so a reload does not measure
+// again unless server_regions or the way to dial them changed.
+var serverRegions = struct {
+	sync.Mutex
+	key     string
+	regions []serverRegion
+}{}
+
+// closestRegions returns the regions, the closest first and the unreachable
+// ones last, by name.
+func closestRegions(cfg Config) []serverRegion {
+	regions := cfg.ServerRegions
+	names := make([]string, 0, len(regions))
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The dial settings decide which addresses are measured
+	var key strings.Builder
+	key.WriteString(cfg.IPFamily + "|" + strings.Join(cfg.DNSServers, ",") + "|")
+	for _, name := range names {
+		key.WriteString(name + "=" + regions[name] + ",")
+	}
+
+	serverRegions.Lock()
+	defer serverRegions.Unlock()
+	if serverRegions.key == key.String() {
+		return serverRegions.regions
+	}
+
+	dial := serverDialer(cfg)
+	measured := make([]serverRegion, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			rtt, err := measureRTT(regions[name], dial)
+			measured[i] = serverRegion{Name: name, URL: regions[name], RTT: rtt, Err: err}
+		}(i, name)
+	}
+	wg.Wait()
+	sort.SliceStable(measured, func(i, j int) bool {
+		if (measured[i].Err == nil) != (measured[j].Err == nil) {
+			return measured[i].Err == nil
+		}
+		return measured[i].Err == nil && measured[i].RTT < measured[j].RTT
+	})
+
+	for _, region := range measured {
+		if region.Err != nil {
+			logger.Warn("region.unreachable", "Cannot reach a server region", Fields{"region": region.Name, "url": region.URL, "error": region.Err})
+		} else {
+			logger.Debug("region.measured", "Measured the round-trip time to a server region", Fields{"region": region.Name, "rtt": region.RTT})
+		}
+	}
+	if measured[0].Err == nil {
+		logger.Info("region.selected", "Selected the closest server region", Fields{"region": measured[0].Name, "url": measured[0].URL, "rtt": measured[0].RTT})
+	}
+	serverRegions.key, serverRegions.regions = key.String(), measured
+	return measured
+}
+
+// measureRTT returns the shortest time it took to connect to a server's
+// port in regionProbes attempts, dialing as requests to it will.
+func measureRTT(rawURL string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (time.Duration, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	var best time.Duration
+	var lastErr error
+	for i := 0; i < regionProbes; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), regionProbeTimeout)
+		start := time.Now()
+		conn, err := dial(ctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rtt := time.Since(start)
+		conn.Close()
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	if best == 0 {
+		return 0, lastErr
+	}
+	return best, nil
+}
+
+// applyServerRegions points cfg at the closest region and tags it, and
+// returns the servers to use in order. Without a reachable region it
+// returns nil and cfg keeps server_url.
+func applyServerRegions(cfg *Config) []string {
+	regions := closestRegions(*cfg)
+	if regions[0].Err != nil {
+		logger.Warn("region.none_reachable", "No server region is reachable, using server_url", nil)
+		return nil
+	}
+	urls := make([]string, 0, len(regions))
+	for _, region := range regions {
+		urls = append(urls, region.URL)
+	}
+	cfg.ServerURL = regions[0].URL
+	if _, ok := cfg.Tags[regionTag]; !ok {
+		tags := make(map[string]string, len(cfg.Tags)+1)
+		for key, value := range cfg.Tags {
+			tags[key] = value
+		}
+		tags[regionTag] = regions[0].Name
+		cfg.Tags = tags
+	}
+	return urls
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Metric kinds in the registry.
+const (
+	kindGauge   = "gauge"   // a value at collection time
+	kindCounter = "counter" // a running total that only grows (until a restart)
+	kindState   = "state"   // a flag or an enumerated state, see the description
+)
+
+// MetricDescriptor describes a metric, so the server and the dashboard can
+// document a series without knowing the collector behind it.
+type MetricDescriptor struct {
+	MetricType  string `json:"metric_type"`
+	MetricName  string `json:"metric_name"`
+	Description string `json:"description"`
+	Unit        string `json:"unit"`
+	Kind        string `json:"kind"`
+}
+
+// MetricRegistryPayload is the body of POST /api/agent/metric-registry.
+type MetricRegistryPayload struct {
+	Hostname     string             `json:"hostname"`
+	APIKey       string             `json:"api_key"`
+	AgentVersion string             `json:"agent_version"`
+	Metrics      []MetricDescriptor `json:"metrics"`
+}
+
+// metricRegistry describes every metric the collectors send. Event metrics
+// (type "event", named after the event) and application metrics (type "app",
+// named by the application) are not listed.
+var metricRegistry = []MetricDescriptor{
+	{"agent", "collection_duration", "Time the agent took to run all collectors in a cycle", "seconds", kindGauge},
+	{"agent", "collector_duration", "Time one collector took (metadata: collector)", "seconds", kindGauge},
+	{"agent", "collector_up", "1 if the collector's last run succeeded (metadata: collector)", "bool", kindState},
+	{"agent", "degraded", "1 while the agent collects less because the host is overloaded (metadata: reason)", "bool", kindState},
+	{"agent", "events_dropped", "Events dropped because the event buffer was full", "count", kindGauge},
+
+	{"cpu", "usage_percent", "CPU time spent not idle, across all cores", "percent", kindGauge},
+	{"cpu", "count", "Logical CPUs", "cores", kindGauge},
+
+	{"memory", "total", "Physical memory", "bytes", kindGauge},
+	{"memory", "used", "Memory in use, excluding buffers and page cache", "bytes", kindGauge},
+	{"memory", "used_percent", "Memory in use as a share of total", "percent", kindGauge},
+	{"memory", "available", "Memory available to new processes without swapping", "bytes", kindGauge},
+	{"memory", "swap_total", "Swap space", "bytes", kindGauge},
+	{"memory", "swap_used", "Swap space in use", "bytes", kindGauge},
+	{"memory", "swap_used_percent", "Swap space in use as a share of total", "percent", kindGauge},
+	{"memory", "hugepages_total", "Huge pages in the pool", "pages", kindGauge},
+	{"memory", "hugepages_used", "Huge pages allocated", "pages", kindGauge},
+	{"memory", "hugepages_reserved", "Huge pages reserved but not yet allocated", "pages", kindGauge},
+	{"memory", "hugepages_surplus", "Huge pages above the configured pool size", "pages", kindGauge},
+	{"memory", "hugepages_used_percent", "Huge pages allocated as a share of the pool", "percent", kindGauge},
+	{"memory", "hugepage_size", "Size of a huge page", "bytes", kindGauge},
+	{"memory", "anon_hugepages", "Memory backed by transparent huge pages", "bytes", kindGauge},
+	{"memory", "shm_total", "Size of /dev/shm", "bytes", kindGauge},
+	{"memory", "shm_used", "Shared memory in use in /dev/shm", "bytes", kindGauge},
+	{"memory", "shm_used_percent", "Shared memory in use as a share of /dev/shm", "percent", kindGauge},
+
+	{"disk", "usage_percent", "Space used on the filesystem (metadata: mountpoint)", "percent", kindGauge},
+	{"disk", "total", "Size of the filesystem (metadata: mountpoint)", "bytes", kindGauge},
+	{"disk", "free", "Space free on the filesystem (metadata: mountpoint)", "bytes", kindGauge},
+	{"disk", "ext4_errors", "Errors ext4 recorded on the filesystem", "count", kindCounter},
+	{"disk", "ext4_warnings", "Warnings ext4 recorded on the filesystem", "count", kindCounter},
+	{"disk", "xfs_log_writes", "XFS log writes", "count", kindCounter},
+	{"disk", "xfs_log_blocks", "XFS log blocks written", "count", kindCounter},
+	{"disk", "xfs_log_noiclogs", "Times XFS found no in-core log buffer free", "count", kindCounter},
+	{"disk", "xfs_log_forces", "XFS log forces", "count", kindCounter},
+	{"disk", "xfs_log_force_sleeps", "XFS log forces that had to wait", "count", kindCounter},
+
+	{"network", "bytes_sent", "Bytes sent since boot (metadata: interface)", "bytes", kindCounter},
+	{"network", "bytes_recv", "Bytes received since boot (metadata: interface)", "bytes", kindCounter},
+	{"network", "packets_sent", "Packets sent since boot (metadata: interface)", "packets", kindCounter},
+	{"network", "packets_recv", "Packets received since boot (metadata: interface)", "packets", kindCounter},
+	{"network", "dhcp_lease_remaining", "Time left on the interface's DHCP lease", "seconds", kindGauge},
+	{"network", "static_address_match", "1 if the interface holds its configured static address", "bool", kindState},
+	{"network", "flow_bytes", "Bytes a connection moved during the interval, for the top flows", "bytes", kindGauge},
+	{"network", "egress_connections_by_country", "Outbound connections per destination country", "count", kindGauge},
+	{"network", "egress_connections_by_asn", "Outbound connections per destination AS", "count", kindGauge},
+
+	{"system", "uptime", "Time since boot", "seconds", kindGauge},
+	{"system", "load_average_1m", "Load average over 1 minute", "load", kindGauge},
+	{"system", "load_average_5m", "Load average over 5 minutes", "load", kindGauge},
+	{"system", "load_average_15m", "Load average over 15 minutes", "load", kindGauge},
+	{"system", "process_count", "Processes running", "count", kindGauge},
+
+	{"user", "cpu_percent", "CPU used by the user's processes during the interval, for the top users", "percent", kindGauge},
+	{"user", "memory_rss", "Resident memory of the user's processes, for the top users", "bytes", kindGauge},
+	{"user", "process_count", "Processes the user runs, for the top users", "count", kindGauge},
+	{"process", "cpu_percent", "CPU used by the process during the interval, for the top processes", "percent", kindGauge},
+	{"process", "memory_rss", "Resident memory of the process, for the top processes", "bytes", kindGauge},
+	{"runtime", "installed", "1 for each runtime found (openssl, glibc, musl, node, python, java), with its version in the metadata", "bool", kindState},
+
+	{"container", "cpu_quota_cores", "CPU limit of the agent's container", "cores", kindGauge},
+	{"container", "cpu_throttled_periods", "Scheduling periods the container was throttled in", "count", kindCounter},
+	{"container", "cpu_throttled_seconds", "Time the container was throttled for", "seconds", kindCounter},
+	{"container", "memory_usage", "Memory the container uses", "bytes", kindGauge},
+	{"container", "memory_limit", "Memory limit of the container", "bytes", kindGauge},
+	{"container", "memory_usage_percent", "Memory the container uses as a share of its limit", "percent", kindGauge},
+
+	{"security", "secure_boot", "1 if the host booted with UEFI Secure Boot on", "bool", kindState},
+	{"security", "kernel_lockdown", "Kernel lockdown mode: 0 none, 1 integrity, 2 confidentiality", "level", kindState},
+	{"security", "unsigned_modules", "Loaded kernel modules without a valid signature", "count", kindGauge},
+	{"security", "kernel_modules", "Loaded kernel modules", "count", kindGauge},
+	{"security", "encrypted_volumes", "dm-crypt volumes on the host", "count", kindGauge},
+	{"security", "mount_encrypted", "1 if the filesystem sits on an encrypted volume (metadata: mountpoint)", "bool", kindState},
+
+	{"timesync", "synchronized", "1 if the clock is synchronized", "bool", kindState},
+	{"timesync", "stratum", "NTP stratum of the time source", "stratum", kindGauge},
+	{"timesync", "offset", "Offset of the clock from the time source", "seconds", kindGauge},
+	{"timesync", "last_sync_age", "Time since the clock was last synchronized", "seconds", kindGauge},
+
+	{"certificate", "days_to_expiry", "Days until the certificate expires", "days", kindGauge},
+	{"certificate", "last_renewal_age", "Time since the certificate was last renewed", "seconds", kindGauge},
+	{"certificate", "renewal_failing", "1 if the last renewal attempt failed", "bool", kindState},
+
+	{"backup", "check_ok", "1 if the backup repository passed its check", "bool", kindState},
+	{"backup", "last_backup_age", "Time since the last backup", "seconds", kindGauge},
+	{"backup", "size", "Size of the last backup", "bytes", kindGauge},
+
+	{"dependency", "reachable", "1 if a TCP connection to the dependency could be opened", "bool", kindState},
+	{"dependency", "connect_latency", "Time to open a TCP connection to the dependency", "seconds", kindGauge},
+	{"dependency", "established_connections", "Connections established to the dependency", "count", kindGauge},
+
+	{"haproxy", "backend_up", "1 if the backend has a server up", "bool", kindState},
+	{"haproxy", "servers_up", "Servers up in the backend", "count", kindGauge},
+	{"haproxy", "servers_down", "Servers down in the backend", "count", kindGauge},
+	{"haproxy", "servers_maint", "Servers in maintenance in the backend", "count", kindGauge},
+	{"vrrp", "vrrp_master", "1 if keepalived is master for the instance", "bool", kindState},
+	{"vrrp", "vip_held", "1 if the host holds the virtual IP", "bool", kindState},
+
+	{"phpfpm", "active_workers", "Workers serving a request", "count", kindGauge},
+	{"phpfpm", "idle_workers", "Workers waiting for a request", "count", kindGauge},
+	{"phpfpm", "total_workers", "Workers in the pool", "count", kindGauge},
+	{"phpfpm", "listen_queue", "Requests waiting for a free worker", "count", kindGauge},
+	{"phpfpm", "max_listen_queue", "Most requests that have waited for a free worker", "count", kindGauge},
+	{"phpfpm", "listen_queue_len", "Size of the socket's listen queue", "count", kindGauge},
+	{"phpfpm", "accepted_connections", "Requests the pool accepted", "count", kindCounter},
+	{"phpfpm", "max_children_reached", "Times the pool hit pm.max_children", "count", kindCounter},
+	{"phpfpm", "slow_requests", "Requests slower than request_slowlog_timeout", "count", kindCounter},
+	{"uwsgi", "active_workers", "Workers serving a request", "count", kindGauge},
+	{"uwsgi", "idle_workers", "Workers waiting for a request", "count", kindGauge},
+	{"uwsgi", "total_workers", "Workers in the instance", "count", kindGauge},
+	{"uwsgi", "listen_queue", "Requests waiting for a free worker", "count", kindGauge},
+	{"uwsgi", "listen_queue_errors", "Requests refused because the listen queue was full", "count", kindCounter},
+	{"uwsgi", "harakiri_count", "Workers killed for exceeding the harakiri timeout", "count", kindCounter},
+
+	{"jvm", "heap_used", "Heap in use", "bytes", kindGauge},
+	{"jvm", "heap_committed", "Heap committed by the JVM", "bytes", kindGauge},
+	{"jvm", "heap_max", "Largest heap the JVM may use", "bytes", kindGauge},
+	{"jvm", "heap_used_percent", "Heap in use as a share of its maximum", "percent", kindGauge},
+	{"jvm", "nonheap_used", "Non-heap memory in use", "bytes", kindGauge},
+	{"jvm", "gc_collections", "Collections the garbage collector ran (metadata: collector)", "count", kindCounter},
+	{"jvm", "gc_time", "Time spent in the garbage collector (metadata: collector)", "seconds", kindCounter},
+	{"jvm", "threads", "Live threads", "count", kindGauge},
+	{"jvm", "daemon_threads", "Live daemon threads", "count", kindGauge},
+	{"jvm", "peak_threads", "Most live threads since the JVM started", "count", kindGauge},
+
+	{"elasticsearch", "cluster_status", "Cluster health: 0 green, 1 yellow, 2 red", "status", kindState},
+	{"elasticsearch", "number_of_nodes", "Nodes in the cluster", "count", kindGauge},
+	{"elasticsearch", "active_shards", "Active shards", "count", kindGauge},
+	{"elasticsearch", "active_shards_percent", "Active shards as a share of all shards", "percent", kindGauge},
+	{"elasticsearch", "relocating_shards", "Shards being moved to another node", "count", kindGauge},
+	{"elasticsearch", "initializing_shards", "Shards being initialized", "count", kindGauge},
+	{"elasticsearch", "unassigned_shards", "Shards not assigned to a node", "count", kindGauge},
+	{"elasticsearch", "pending_tasks", "Cluster-level changes not yet applied", "count", kindGauge},
+	{"elasticsearch", "heap_used", "Heap in use on the node", "bytes", kindGauge},
+	{"elasticsearch", "heap_max", "Largest heap the node may use", "bytes", kindGauge},
+	{"elasticsearch", "heap_used_percent", "Heap in use on the node as a share of its maximum", "percent", kindGauge},
+
+	{"rabbitmq", "queue_messages", "Messages in the queue", "count", kindGauge},
+	{"rabbitmq", "queue_messages_ready", "Messages ready for delivery", "count", kindGauge},
+	{"rabbitmq", "queue_unacked", "Messages delivered but not acknowledged", "count", kindGauge},
+	{"rabbitmq", "queue_consumers", "Consumers of the queue", "count", kindGauge},
+	{"rabbitmq", "connections", "Client connections (metadata: vhost)", "count", kindGauge},
+}
+
+// registryDescriptors is the registry under the names metric_names sends.
+func registryDescriptors() []MetricDescriptor {
+	cfg := currentConfig()
+	descriptors := make([]MetricDescriptor, 0, len(metricRegistry))
+	for _, d := range metricRegistry {
+		m, renamed := canonicalMetric(Metric{MetricType: d.MetricType, MetricName: d.MetricName})
+		if cfg.MetricNames != metricNamesCanonical || !renamed {
+			descriptors = append(descriptors, d)
+		}
+		if cfg.MetricNames != metricNamesLegacy && renamed {
+			canonical := d
+			canonical.MetricType, canonical.MetricName = m.MetricType, m.MetricName
+			descriptors = append(descriptors, canonical)
+		}
+	}
+	return descriptors
+}
+
+// registryByName indexes the registry by full name, under the legacy and
+// the canonical names alike.
+func registryByName() map[string]MetricDescriptor {
+	descriptors := make(map[string]MetricDescriptor, 2*len(metricRegistry))
+	for _, d := range metricRegistry {
+		m, _ := canonicalMetric(Metric{MetricType: d.MetricType, MetricName: d.MetricName})
+		descriptors[d.MetricType+"."+d.MetricName] = d
+		descriptors[m.MetricType+"."+m.MetricName] = d
+	}
+	return descriptors
+}
+
+// sendMetricRegistry sends the registry once per run, after registration.
+// Servers without the endpoint answer 404, which is not an error here.
+// OTLP and the Prometheus exposition carry the descriptions with the metrics
+// themselves.
+func sendMetricRegistry(cfg Config) {
+	if serverless() || !serverSupports(serverURL(), capabilityMetricRegistry) {
+		return
+	}
+	payload := MetricRegistryPayload{
+		Hostname:     cfg.Hostname,
+		APIKey:       cfg.APIKey,
+		AgentVersion: version,
+		Metrics:      registryDescriptors(),
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("registry.marshal_failed", "Failed to encode metric registry", Fields{"error": err})
+		return
+	}
+	if dryRun("/api/agent/metric-registry", data) {
+		return
+	}
+
+	for attempt := 1; attempt <= cfg.MaxRetries; attempt++ {
+		err = postMetricRegistry(cfg, data)
+		if err == nil || !isRetryable(err) {
+			break
+		}
+		if attempt < cfg.MaxRetries {
+			time.Sleep(retryWait(cfg, attempt, err))
+		}
+	}
+	var serverErr *ServerError
+	switch {
+	case err == nil:
+		logger.Debug("registry.sent", "Sent metric registry", Fields{"count": len(payload.Metrics)})
+	case errors.As(err, &serverErr) && serverErr.StatusCode == http.StatusNotFound:
+		logger.Debug("registry.unsupported", "Server does not take a metric registry", nil)
+	default:
+		logger.Warn("registry.failed", "Failed to send metric registry", Fields{"error": err})
+	}
+}
+
+func postMetricRegistry(cfg Config, data []byte) (err error) {
+	if mqttEnabled() {
+		return mqttPublish("metric-registry", data)
+	}
+	base := serverURL()
+	defer func() { recordServerResult(base, err) }()
+
+	req, err := http.NewRequest("POST", base+"/api/agent/metric-registry", bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create metric registry request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, cfg.APIKey, data)
+
+	resp, err := serverDo(req, 30*time.Second)
+	if err != nil {
+		return unavailable("metric registry", err)
+	}
+	defer resp.Body.Close()
+	return checkResponse("metric registry", resp)
+}
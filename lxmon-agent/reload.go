@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// configLock guards config against reloads. Nothing holds it beyond a copy:
+// a collection cycle or a command takes one with currentConfig when it
+// starts and passes it down, so its requests and retries use the same
+// settings throughout, and a reload swaps in the new configuration without
+// waiting for in-flight work.
+var configLock sync.RWMutex
+
+// currentConfig returns a copy of the configuration in effect.
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+var reloading sync.Mutex
+
+// swapConfig installs loaded if ok, and returns the configurations in
+// effect before and after. The unlock is deferred so that a crash report
+// written on a panic here can still read the configuration.
+func swapConfig(loaded loadedConfig, ok bool) (previous, current Config) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	previous = config
+	if ok {
+		loaded.install()
+	}
+	return previous, config
+}
+
+// reloadConfig re-reads the configuration with the original command-line
+// arguments and re-registers when the server or credentials changed. On
+// error the previous configuration stays in effect. The new configuration is
+// built first, with the remote store, DNS and region probes it may need, and
+// only swapped in under the write lock, so readers wait for the swap alone.
+func reloadConfig(args []string, trigger string) {
+	logger.Info("config.reloading", "Reloading configuration", Fields{"trigger": trigger})
+
+	// One reload at a time, so an older one cannot swap in after a newer one
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	loaded, err := buildConfig(args)
+	if err == nil && len(loaded.rest) > 0 {
+		err = fmt.Errorf("unexpected arguments: %s", strings.Join(loaded.rest, " "))
+	}
+
+	previous, current := swapConfig(loaded, err == nil)
+
+	if err != nil {
+		logger.Error("config.reload_failed", "Configuration reload failed, keeping previous configuration", Fields{"error": err})
+		return
+	}
+
+	if current.ListenAddr != previous.ListenAddr {
+		logger.Warn("config.restart_required", "listen_addr changes take effect after a restart", Fields{"listen_addr": previous.ListenAddr})
+	}
+
+	if current.PrometheusListen != previous.PrometheusListen {
+		logger.Warn("config.restart_required", "prometheus_listen changes take effect after a restart", Fields{"prometheus_listen": previous.PrometheusListen})
+	}
+
+	if current.StatsDListen != previous.StatsDListen {
+		logger.Warn("config.restart_required", "statsd_listen changes take effect after a restart", Fields{"statsd_listen": previous.StatsDListen})
+	}
+
+	if current.RemoteConfig != previous.RemoteConfig {
+		logger.Warn("config.restart_required", "remote_config changes are watched after a restart", Fields{"remote_config": previous.RemoteConfig})
+	}
+
+	if current.ServerURL != previous.ServerURL || current.APIKey != previous.APIKey || current.Hostname != previous.Hostname {
+		health.clearAuthFailure()
+		if err := registerAgentWithRetry(current); err != nil {
+			logger.Error("register.failed", "Re-registration after reload failed", Fields{"error": err})
+		}
+	}
+
+	logger.Info("config.reloaded", "Configuration reloaded", Fields{
+		"server_url": current.ServerURL,
+		"interval":   current.Interval,
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadConfigKeepsPreviousOnError(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		setServerURLs(nil)
+	})
+	args := []string{"--api-key", "k", "--hostname", "h", "--server-url", "https://lxmon.example.com", "--interval", "15s"}
+	if err := loadConfig(args); err != nil {
+		t.Fatal(err)
+	}
+
+	reloadConfig(append(args, "--interval", "soon"), "test")
+	if cfg := currentConfig(); cfg.Interval != 15*time.Second {
+		t.Errorf("failed reload changed interval to %s", cfg.Interval)
+	}
+
+	// Same server, key and hostname: no re-registration
+	reloadConfig(append(args, "--interval", "5s"), "test")
+	if cfg := currentConfig(); cfg.Interval != 5*time.Second {
+		t.Errorf("reload did not apply interval, got %s", cfg.Interval)
+	}
+}
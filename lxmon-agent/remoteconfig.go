@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteSource is a config document stored in Consul KV or etcd, given as
+// consul://host:8500/lxmon/agent.yaml or etcd://host:2379/lxmon/agent.yaml
+// ("consul+https://", "etcd+https://" for TLS). The key's extension picks
+// the format like for --config; YAML otherwise.
+type remoteSource struct {
+	Kind    string // consul or etcd
+	BaseURL string
+	Key     string
+}
+
+func parseRemoteSource(raw string) (remoteSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return remoteSource{}, err
+	}
+	kind, scheme, _ := strings.Cut(u.Scheme, "+")
+	if scheme == "" {
+		scheme = "http"
+	}
+	if (kind != "consul" && kind != "etcd") || (scheme != "http" && scheme != "https") {
+		return remoteSource{}, fmt.Errorf("remote config %q: scheme must be consul, etcd, consul+https or etcd+https", raw)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return remoteSource{}, fmt.Errorf("remote config %q: expected %s://host:port/key", raw, u.Scheme)
+	}
+	return remoteSource{Kind: kind, BaseURL: scheme + "://" + u.Host, Key: key}, nil
+}
+
+// remoteConfigCache keeps the last document fetched, so the agent still
+// starts with the central settings while Consul/etcd is unreachable.
+func remoteConfigCache(stateDir string) string {
+	if stateDir == "" {
+		return ""
+	}
+	return filepath.Join(stateDir, "remote-config")
+}
+
+// applyRemoteConfig fetches the document and applies it to cfg, falling
+// back to the copy cached in stateDir if the store cannot be reached.
+func applyRemoteConfig(cfg *Config, raw, stateDir string) error {
+	source, err := parseRemoteSource(raw)
+	if err != nil {
+		return err
+	}
+	cache := remoteConfigCache(stateDir)
+	data, _, err := fetchRemoteConfig(context.Background(), source, 0)
+	if err != nil {
+		if cache == "" {
+			return fmt.Errorf("fetch remote config: %w", err)
+		}
+		cached, cacheErr := os.ReadFile(cache)
+		if cacheErr != nil {
+			return fmt.Errorf("fetch remote config: %w (no cached copy: %v)", err, cacheErr)
+		}
+		logger.Warn("config.remote_unavailable", "Remote config unavailable, using cached copy", Fields{"source": raw, "error": err})
+		data = cached
+	} else if cache != "" {
+		if err := os.MkdirAll(filepath.Dir(cache), 0700); err == nil {
+			if err := os.WriteFile(cache, data, 0600); err != nil {
+				logger.Warn("config.remote_cache_failed", "Failed to cache remote config", Fields{"error": err})
+			}
+		}
+	}
+
+	if err := applyConfigData(cfg, data, path.Ext(source.Key), "remote config "+raw); err != nil {
+		return err
+	}
+	cfg.RemoteConfig = raw
+	return nil
+}
+
+// fetchRemoteConfig reads the key. With a non-zero index it blocks until the
+// key changes past that index (Consul blocking query); etcd ignores it. The
+// returned index identifies the version read.
+func fetchRemoteConfig(ctx context.Context, source remoteSource, index uint64) ([]byte, uint64, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if source.Kind == "consul" {
+		query := url.Values{"raw": {""}}
+		if index > 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", "5m")
+			client.Timeout = 6 * time.Minute
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", source.BaseURL+"/v1/kv/"+source.Key+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("consul: status %d for key %s", resp.StatusCode, source.Key)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if err != nil {
+			return nil, 0, err
+		}
+		newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		return data, newIndex, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(source.Key))})
+	req, err := http.NewRequestWithContext(ctx, "POST", source.BaseURL+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd: status %d", resp.StatusCode)
+	}
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	if len(result.KVs) == 0 {
+		return nil, 0, fmt.Errorf("etcd: key %s not found", source.Key)
+	}
+	data, err := base64.StdEncoding.DecodeString(result.KVs[0].Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, _ := strconv.ParseUint(result.Header.Revision, 10, 64)
+	return data, revision, nil
+}
+
+// remoteConfigPoll is how often the document is read again when the store
+// cannot watch it: a Consul that returns no index, or a failed watch.
+const remoteConfigPoll = 30 * time.Second
+
+// watchRemoteConfig calls onChange whenever the remote document changes,
+// using Consul blocking queries or an etcd watch stream, until ctx ends.
+func watchRemoteConfig(ctx context.Context, raw string, onChange func()) {
+	source, err := parseRemoteSource(raw)
+	if err != nil {
+		return
+	}
+	logger.Info("config.remote_watch", "Watching remote config for changes", Fields{"source": raw})
+
+	var index uint64
+	var last []byte
+	for ctx.Err() == nil {
+		var err error
+		wait := false
+		if source.Kind == "consul" {
+			var data []byte
+			var newIndex uint64
+			data, newIndex, err = fetchRemoteConfig(ctx, source, index)
+			if err == nil {
+				if last != nil && !bytes.Equal(data, last) {
+					onChange()
+				}
+				last = data
+				// Consul may return a lower index after a leader change
+				if newIndex < index {
+					newIndex = 0
+				}
+				index = newIndex
+				// Without an index the query cannot block: poll instead
+				// of asking again at once
+				wait = index == 0
+			}
+		} else {
+			index, err = watchEtcdKey(ctx, source, index, onChange)
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("config.remote_watch_failed", "Remote config watch failed, retrying", Fields{"source": raw, "error": err})
+			wait = true
+		}
+		if wait {
+			select {
+			case <-time.After(remoteConfigPoll):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// watchEtcdKey streams an etcd v3 watch (through the gRPC gateway) from
+// revision next and calls onChange for every batch of events on the key. It
+// returns when the stream ends, with the revision to watch from next, so a
+// new stream misses nothing that changed in between. A zero next starts
+// from the key's current revision.
+func watchEtcdKey(ctx context.Context, source remoteSource, next uint64, onChange func()) (uint64, error) {
+	if next == 0 {
+		_, revision, err := fetchRemoteConfig(ctx, source, 0)
+		if err != nil {
+			return 0, err
+		}
+		next = revision + 1
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            base64.StdEncoding.EncodeToString([]byte(source.Key)),
+			"start_revision": strconv.FormatUint(next, 10),
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", source.BaseURL+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return next, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return next, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return next, fmt.Errorf("etcd watch: status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var message struct {
+			Result struct {
+				CompactRevision string `json:"compact_revision"`
+				Events          []struct {
+					KV struct {
+						ModRevision string `json:"mod_revision"`
+					} `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		if compacted, _ := strconv.ParseUint(message.Result.CompactRevision, 10, 64); compacted > 0 {
+			// The revisions since next are gone: read the key again and
+			// watch from its current revision
+			onChange()
+			return 0, fmt.Errorf("etcd watch: revision %d compacted", next)
+		}
+		// The header's revision is the store's, not how far the watch got:
+		// only the events move next on
+		for _, event := range message.Result.Events {
+			if revision, _ := strconv.ParseUint(event.KV.ModRevision, 10, 64); revision >= next {
+				next = revision + 1
+			}
+		}
+		if len(message.Result.Events) > 0 {
+			onChange()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return next, err
+	}
+	return next, errors.New("etcd watch stream closed")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The agent can also write its metrics to a Prometheus remote_write endpoint
+// (Prometheus, Thanos, Mimir, Cortex, VictoriaMetrics), following the
+// remote write 1.0 protocol: a protobuf WriteRequest in a snappy block, in a
+// POST. Each metric becomes a series named "<metric_type>_<metric_name>",
+// with "_total" for counters, labeled with the host, the tags and the
+// metadata. Names follow metric_names, like those sent to the server.
+
+const remoteWriteVersion = "0.1.0"
+
+// remoteWriteClient sends to the remote_write endpoint, which is not the
+// lxmon server: it gets neither the server's TLS settings nor its request
+// signature.
+var remoteWriteClient = &http.Client{Timeout: 30 * time.Second}
+
+type remoteWriteSeries struct {
+	labels []remoteWriteLabel
+	value  float64
+	millis int64
+}
+
+type remoteWriteLabel struct {
+	name, value string
+}
+
+func remoteWriteEnabled() bool {
+	return currentConfig().RemoteWriteURL != ""
+}
+
+// sendRemoteWrite makes one attempt at writing a batch. As with Prometheus
+// itself, a request the endpoint rejects is dropped, and one it cannot take
+// right now is retried.
+func sendRemoteWrite(cfg Config, batch sinkBatch) error {
+	if cfg.DryRun {
+		logDryRun(redactURL(cfg.RemoteWriteURL), []byte(fmt.Sprintf(`{"series":%d}`, batch.count)))
+		return nil
+	}
+	return postRemoteWrite(cfg, batch.body)
+}
+
+func postRemoteWrite(cfg Config, body []byte) error {
+	req, err := http.NewRequest("POST", cfg.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create remote write request: %w", err)
+	}
+	if req.URL.User != nil {
+		password, _ := req.URL.User.Password()
+		req.SetBasicAuth(req.URL.User.Username(), password)
+		req.URL.User = nil
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	req.Header.Set("User-Agent", "lxmon-agent/"+version)
+	for key, value := range cfg.RemoteWriteHeaders {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := remoteWriteClient.Do(req)
+	if err != nil {
+		return unavailable("remote write", err)
+	}
+	defer resp.Body.Close()
+	return checkResponse("remote write", resp)
+}
+
+// encodeRemoteWrite encodes a cycle's metrics, as collected, into a
+// compressed WriteRequest.
+func encodeRemoteWrite(cfg Config, metrics []Metric) sinkBatch {
+	// Renamed on a copy: the metrics are sent on to the server as they are
+	metrics = applyMetricNames(cfg, append([]Metric(nil), metrics...))
+
+	descriptors := registryByName()
+	series := make([]remoteWriteSeries, 0, len(metrics))
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		series = append(series, remoteWriteSeries{
+			labels: remoteWriteLabels(cfg, m, descriptors[m.MetricType+"."+m.MetricName].Kind),
+			value:  m.Value,
+			millis: m.Timestamp.UnixMilli(),
+		})
+	}
+
+	var request []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = protoString(l, 1, label.name)
+			l = protoString(l, 2, label.value)
+			ts = protoBytes(ts, 1, l)
+		}
+		var sample []byte
+		sample = protoTag(sample, 1, 1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.value))
+		sample = protoTag(sample, 2, 0)
+		sample = binary.AppendUvarint(sample, uint64(s.millis))
+		ts = protoBytes(ts, 2, sample)
+		request = protoBytes(request, 1, ts)
+	}
+	return sinkBatch{body: snappyLiteral(request), count: len(series)}
+}
+
+// remoteWriteLabels are a metric's labels, sorted by name as remote write
+// requires. instance and job are the agent's own.
+func remoteWriteLabels(cfg Config, m Metric, kind string) []remoteWriteLabel {
+	name, values := promSeries(cfg, m, kind)
+	values["__name__"] = name
+	values["instance"] = cfg.Hostname
+	values["job"] = "lxmon-agent"
+
+	labels := make([]remoteWriteLabel, 0, len(values))
+	for key, value := range values {
+		if value != "" {
+			labels = append(labels, remoteWriteLabel{key, value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// promSeries returns a metric's Prometheus name, with "_total" for counters,
+// and its labels: the tags and the metadata, which win over tags of the same
+// name, as in the payload to the server.
+func promSeries(cfg Config, m Metric, kind string) (string, map[string]string) {
+	name := promName(m.MetricType + "_" + m.MetricName)
+	if kind == kindCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	labels := map[string]string{}
+	for key, value := range cfg.Tags {
+		labels[promLabelName(key)] = value
+	}
+	for key, value := range m.Metadata {
+		labels[promLabelName(key)] = fmt.Sprint(value)
+	}
+	return name, labels
+}
+
+// promName makes name a valid Prometheus metric name, [a-zA-Z_:][a-zA-Z0-9_:]*,
+// replacing the dots of canonical names and anything else with underscores.
+func promName(name string) string {
+	return promSanitize(name, true)
+}
+
+// promLabelName makes name a valid label name, [a-zA-Z_][a-zA-Z0-9_]*. Names
+// starting with "__" are reserved, so metadata cannot set them.
+func promLabelName(name string) string {
+	name = promSanitize(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = "x" + name
+	}
+	return name
+}
+
+func promSanitize(name string, colon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', colon && r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func protoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func protoBytes(b []byte, field int, value []byte) []byte {
+	b = protoTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protoString(b []byte, field int, value string) []byte {
+	return protoBytes(b, field, []byte(value))
+}
+
+// snappyLiteral frames data as a snappy block made of literals only. Every
+// snappy decoder reads it; it is not compressed, which costs bandwidth but
+// needs no compressor. Literals are at most 64KiB here.
+func snappyLiteral(data []byte) []byte {
+	out := binary.AppendUvarint(make([]byte, 0, len(data)+len(data)/65536*3+16), uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			out = append(out, byte(n)<<2)
+		case n < 1<<8:
+			out = append(out, 60<<2, byte(n))
+		default:
+			out = append(out, 61<<2, byte(n), byte(n>>8))
+		}
+		out = append(out, chunk...)
+		data = data[len(chunk):]
+	}
+	return out
+}
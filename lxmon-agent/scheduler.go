@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// schedulerFile keeps the next runs of the collectors with their own
+// interval across restarts, so that a collector every 6h does not run at
+// each restart, nor wait 6h more after one.
+const (
+	schedulerFile    = "scheduler.json"
+	schedulerVersion = 1
+)
+
+type schedulerState struct {
+	Version int                  `json:"version"`
+	NextRun map[string]time.Time `json:"next_run"`
+}
+
+// maxScheduledMetrics bounds the buffer of metrics gathered by scheduled
+// collectors between two sends.
+const maxScheduledMetrics = 10000
+
+// collectorScheduler runs the collectors that have their own
+// collector_intervals entry, independently of the send cycle. Their results
+// are buffered and merged into the next metrics payload by collectMetrics.
+//
+// With spread_collection it runs the other collectors too, once per
+// collection interval, each at its own offset within the interval. Instead of
+// a burst of every collector at each tick, the load is spread evenly, which
+// small edge devices notice. Each payload then carries the results of the
+// interval before it.
+var collectorScheduler = struct {
+	sync.Mutex
+	running  bool
+	nextRun  map[string]time.Time
+	inFlight map[string]bool
+	metrics  []Metric
+}{nextRun: map[string]time.Time{}, inFlight: map[string]bool{}}
+
+// collectorInterval returns a collector's own interval, if it has one. With
+// spread_collection the others have the collection interval.
+func collectorInterval(name string) (time.Duration, bool) {
+	cfg := currentConfig()
+	if interval, ok := cfg.CollectorIntervals[name]; ok {
+		return interval, true
+	}
+	if cfg.SpreadCollection {
+		return degradedInterval(cfg.Interval), true
+	}
+	return 0, false
+}
+
+// spreadOffset is when a collector first runs with spread_collection: the
+// collectors without their own interval share the collection interval out
+// in equal slices, in order.
+func spreadOffset(name string) time.Duration {
+	cfg := currentConfig()
+	var spread []string
+	for _, collector := range collectors {
+		if _, own := cfg.CollectorIntervals[collector.Name]; !own && collectorEnabled(collector.Name) {
+			spread = append(spread, collector.Name)
+		}
+	}
+	for i, spreadName := range spread {
+		if spreadName == name {
+			return cfg.Interval * time.Duration(i) / time.Duration(len(spread))
+		}
+	}
+	return 0
+}
+
+// startCollectorScheduler checks once a second which scheduled collectors
+// are due. Intervals are read on every check, so a SIGHUP reload applies
+// them without a restart.
+func startCollectorScheduler(stop <-chan struct{}) {
+	collectorScheduler.Lock()
+	collectorScheduler.running = true
+	for name, next := range loadSchedulerState() {
+		collectorScheduler.nextRun[name] = next
+	}
+	collectorScheduler.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer crashGuard()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			runDueCollectors()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// runDueCollectors starts the due collectors, each in its own goroutine, so
+// a slow one delays neither the others nor the next check. A collector
+// still running is not started again.
+func runDueCollectors() {
+	cfg := currentConfig()
+	now := time.Now()
+	for _, collector := range collectors {
+		interval, ok := collectorInterval(collector.Name)
+		if !ok || !collectorEnabled(collector.Name) || skipWhileDegraded(collector) {
+			continue
+		}
+		collectorScheduler.Lock()
+		next, scheduled := collectorScheduler.nextRun[collector.Name]
+		if _, own := cfg.CollectorIntervals[collector.Name]; !scheduled && !own {
+			next = now.Add(spreadOffset(collector.Name))
+			collectorScheduler.nextRun[collector.Name] = next
+		}
+		due := !now.Before(next) && !collectorScheduler.inFlight[collector.Name]
+		if due {
+			collectorScheduler.inFlight[collector.Name] = true
+		}
+		collectorScheduler.Unlock()
+		if !due {
+			continue
+		}
+
+		wg.Add(1)
+		go runScheduledCollector(collector, now, interval)
+	}
+}
+
+// runScheduledCollector runs one due collector and buffers its results.
+func runScheduledCollector(collector Collector, started time.Time, interval time.Duration) {
+	defer wg.Done()
+	defer crashGuard()
+	cfg := currentConfig()
+
+	collected, err := runCollector(collector)
+	if err != nil {
+		logger.Debug("collector.failed", "Collector failed", Fields{"collector": collector.Name, "error": err})
+	}
+
+	collectorScheduler.Lock()
+	collectorScheduler.nextRun[collector.Name] = started.Add(interval)
+	delete(collectorScheduler.inFlight, collector.Name)
+	collectorScheduler.metrics = append(collectorScheduler.metrics, collected...)
+	if overflow := len(collectorScheduler.metrics) - maxScheduledMetrics; overflow > 0 {
+		collectorScheduler.metrics = collectorScheduler.metrics[overflow:]
+	}
+	collectorScheduler.Unlock()
+	if _, own := cfg.CollectorIntervals[collector.Name]; own {
+		saveSchedulerState()
+	}
+}
+
+// loadSchedulerState returns the saved next runs of the collectors that
+// still have their own interval. A run further away than the interval (the
+// interval was shortened, the clock went back) is brought forward to it.
+func loadSchedulerState() map[string]time.Time {
+	cfg := currentConfig()
+	if cfg.StateDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.StateDir, schedulerFile))
+	if err != nil {
+		return nil
+	}
+	var state schedulerState
+	if err := json.Unmarshal(data, &state); err != nil || state.Version != schedulerVersion {
+		// Collectors then run as on a first start
+		logger.Warn("scheduler.state_ignored", "Ignoring unreadable scheduler state", Fields{"version": state.Version, "error": err})
+		return nil
+	}
+
+	now := time.Now()
+	nextRun := map[string]time.Time{}
+	for name, next := range state.NextRun {
+		interval, own := cfg.CollectorIntervals[name]
+		if !own {
+			continue
+		}
+		if latest := now.Add(interval); next.After(latest) {
+			next = latest
+		}
+		nextRun[name] = next
+	}
+	return nextRun
+}
+
+// schedulerSaving keeps collectors finishing together from writing their
+// snapshots of the state out of order.
+var schedulerSaving sync.Mutex
+
+// saveSchedulerState records the next runs of the collectors with their own
+// interval. Spread collectors are not saved: their offsets are recomputed.
+func saveSchedulerState() {
+	cfg := currentConfig()
+	if cfg.StateDir == "" {
+		return
+	}
+	schedulerSaving.Lock()
+	defer schedulerSaving.Unlock()
+	state := schedulerState{Version: schedulerVersion, NextRun: map[string]time.Time{}}
+	collectorScheduler.Lock()
+	for name, next := range collectorScheduler.nextRun {
+		if _, own := cfg.CollectorIntervals[name]; own {
+			state.NextRun[name] = next
+		}
+	}
+	collectorScheduler.Unlock()
+	data, _ := json.Marshal(state)
+	if err := writeStateFile(filepath.Join(cfg.StateDir, schedulerFile), data); err != nil {
+		logger.Debug("scheduler.save_failed", "Failed to save the scheduler state", Fields{"error": err})
+	}
+}
+
+// isScheduled reports whether a collector runs on its own schedule rather
+// than in the send cycle.
+func isScheduled(name string) bool {
+	collectorScheduler.Lock()
+	running := collectorScheduler.running
+	collectorScheduler.Unlock()
+	_, ok := collectorInterval(name)
+	return running && ok
+}
+
+// drainScheduledMetrics returns and clears the buffered scheduled results.
+func drainScheduledMetrics() []Metric {
+	collectorScheduler.Lock()
+	defer collectorScheduler.Unlock()
+	metrics := collectorScheduler.metrics
+	collectorScheduler.metrics = nil
+	return metrics
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxScriptSize bounds a script fetched from the library.
+const maxScriptSize = 1024 * 1024
+
+// ScriptRef points at a version of a script in the server's library. The
+// agent runs exactly the content whose SHA-256 is SHA256, so a script edited
+// after the command was queued (or tampered with on the way) never runs.
+type ScriptRef struct {
+	ID      int      `json:"id"`
+	Version int      `json:"version"`
+	SHA256  string   `json:"sha256"`
+	Args    []string `json:"args"`
+}
+
+func scriptCacheDir() string {
+	return filepath.Join(currentConfig().StateDir, "scripts")
+}
+
+// loadScript returns the path of the script's content, from the cache in the
+// state dir or fetched from the server. The caller removes the path if temp.
+func loadScript(ref ScriptRef) (path string, temp bool, err error) {
+	cfg := currentConfig()
+	if cfg.StateDir != "" {
+		path = filepath.Join(scriptCacheDir(), ref.SHA256)
+		if data, err := os.ReadFile(path); err == nil && scriptHash(data) == ref.SHA256 {
+			return path, false, nil
+		}
+	}
+
+	content, err := fetchScript(ref)
+	if err != nil {
+		return "", false, err
+	}
+
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(scriptCacheDir(), 0700); err == nil {
+			if err := os.WriteFile(path, content, 0600); err == nil {
+				return path, false, nil
+			}
+		}
+		logger.Debug("script.cache_failed", "Failed to cache script, using a temporary file", Fields{"dir": scriptCacheDir()})
+	}
+
+	f, err := os.CreateTemp("", "lxmon-script-*")
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		os.Remove(f.Name())
+		return "", false, err
+	}
+	return f.Name(), true, nil
+}
+
+// fetchScript downloads a script version and checks it against its hash.
+func fetchScript(ref ScriptRef) ([]byte, error) {
+	cfg := currentConfig()
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/agent/scripts/%d/%s", serverURL(), ref.ID, url.PathEscape(ref.SHA256)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	req.URL.RawQuery = url.Values{"hostname": {cfg.Hostname}}.Encode()
+	signRequest(req, cfg.APIKey, nil)
+
+	resp, err := serverDo(req, 30*time.Second)
+	if err != nil {
+		return nil, unavailable("script fetch", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("script fetch", resp); err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxScriptSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("script fetch: %w", err)
+	}
+	if len(content) > maxScriptSize {
+		return nil, fmt.Errorf("script %d is larger than %d bytes", ref.ID, maxScriptSize)
+	}
+	if hash := scriptHash(content); hash != ref.SHA256 {
+		return nil, fmt.Errorf("script %d v%d: content hash %s does not match %s", ref.ID, ref.Version, hash, ref.SHA256)
+	}
+	logger.Debug("script.fetched", "Fetched script from the library", Fields{"script_id": ref.ID, "version": ref.Version, "sha256": ref.SHA256})
+	return content, nil
+}
+
+func scriptHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readSecretFile returns the trimmed contents of a file holding a secret.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// readVaultSecret reads a field from a HashiCorp Vault KV secret given as
+// "path#field" (field defaults to api_key), e.g. "secret/data/lxmon#api_key"
+// for KV v2 or "secret/lxmon" for KV v1. The server and token come from the
+// standard VAULT_ADDR and VAULT_TOKEN variables, falling back to the token
+// file `vault login` writes.
+func readVaultSecret(ref string) (string, error) {
+	secretPath, field, _ := strings.Cut(ref, "#")
+	if field == "" {
+		field = "api_key"
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			token, _ = readSecretFile(filepath.Join(home, ".vault-token"))
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no Vault token: set VAULT_TOKEN")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: status %d for %s", resp.StatusCode, secretPath)
+	}
+
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	values := result.Data
+	// KV v2 nests the secret under data.data
+	if nested, ok := values["data"].(map[string]interface{}); ok {
+		values = nested
+	}
+	secret, _ := values[field].(string)
+	if secret == "" {
+		return "", fmt.Errorf("vault: %s has no field %q", secretPath, field)
+	}
+	return secret, nil
+}
+
+// currentAPIKeySource re-reads the API key from api_key_file or
+// api_key_vault. ok is false when the key was given directly.
+func currentAPIKeySource(cfg Config) (key string, ok bool, err error) {
+	switch {
+	case cfg.APIKeyVault != "":
+		key, err = readVaultSecret(cfg.APIKeyVault)
+		return key, true, err
+	case cfg.APIKeyFile != "":
+		key, err = readSecretFile(cfg.APIKeyFile)
+		return key, true, err
+	}
+	return "", false, nil
+}
+
+// refreshSecrets re-reads the API key every secret_refresh so a rotated key
+// is used without a restart. A failed read keeps the current key.
+func refreshSecrets(ctx context.Context) {
+	for {
+		cfg := currentConfig()
+		every := cfg.SecretRefresh
+		if every <= 0 {
+			every = time.Minute // disabled; check again in case a reload enables it
+		}
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+		if cfg.SecretRefresh <= 0 {
+			continue
+		}
+
+		key, ok, err := currentAPIKeySource(cfg)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			logger.Warn("secrets.refresh_failed", "Failed to re-read API key, keeping the current one", Fields{"error": err})
+			continue
+		}
+
+		configLock.Lock()
+		// Skip if a reload switched the source while we were reading
+		changed := config.APIKeyFile == cfg.APIKeyFile && config.APIKeyVault == cfg.APIKeyVault && config.APIKey != key
+		if changed {
+			config.APIKey = key
+		}
+		configLock.Unlock()
+		if changed {
+			health.clearAuthFailure()
+			logger.Info("secrets.api_key_rotated", "Picked up rotated API key", nil)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agent caps what it sends to the server, so a collector gone wrong (a
+// StatsD client with request IDs in its tags, a runaway process list) can
+// flood neither the server nor a thin WAN link:
+//
+//   - max_payload_bytes caps the JSON of one metrics request. A larger
+//     payload is split into several requests, the highest-priority metrics
+//     first.
+//   - max_requests_per_minute caps the metrics requests, retries and spool
+//     replays included. A payload that needs more requests than are left
+//     sheds its lowest-priority metrics until it fits; a request over the
+//     limit fails as the server being unavailable would, so it is retried
+//     and spooled.
+//   - A request the server (or a proxy in front of it) refuses as too large,
+//     with a 413, is sent again in smaller ones instead of being
+//     quarantined. The agent remembers the smaller size for that server
+//     until it restarts.
+//
+// The requests of a payload sent in several carry continuation markers, a
+// batch ID and which part of how many each is, so the server knows when it
+// has all of them.
+
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+)
+
+// minPayloadBytes is the smallest max_payload_bytes that holds a payload of
+// one metric with its metadata.
+const minPayloadBytes = 1024
+
+// metricPriorities ranks metric types for shedding. The host's vital signs
+// and the agent's own metrics go first; what applications, processes and
+// users send, which can grow without bound, goes last. Other types are
+// normal.
+var metricPriorities = map[string]int{
+	"agent":   priorityHigh,
+	"cpu":     priorityHigh,
+	"memory":  priorityHigh,
+	"disk":    priorityHigh,
+	"network": priorityHigh,
+	"system":  priorityHigh,
+	"event":   priorityHigh,
+
+	"app":     priorityLow,
+	"process": priorityLow,
+	"user":    priorityLow,
+	"runtime": priorityLow,
+}
+
+var errRateLimited = errors.New("max_requests_per_minute reached")
+
+// sendLimit is a token bucket of max_requests_per_minute, full at start.
+var sendLimit = struct {
+	sync.Mutex
+	tokens  float64
+	updated time.Time
+}{}
+
+func metricPriority(m Metric) int {
+	if priority, ok := metricPriorities[m.MetricType]; ok {
+		return priority
+	}
+	return priorityNormal
+}
+
+// refillSendTokens adds the requests earned since the last call. Callers
+// hold sendLimit.
+func refillSendTokens() {
+	cfg := currentConfig()
+	perMinute := float64(cfg.MaxRequestsPerMinute)
+	now := time.Now()
+	if sendLimit.updated.IsZero() {
+		sendLimit.tokens = perMinute
+	} else {
+		sendLimit.tokens = math.Min(perMinute, sendLimit.tokens+now.Sub(sendLimit.updated).Minutes()*perMinute)
+	}
+	sendLimit.updated = now
+}
+
+// sendTokens returns how many metrics requests can be made now, or -1
+// without max_requests_per_minute.
+func sendTokens() int {
+	cfg := currentConfig()
+	if cfg.MaxRequestsPerMinute <= 0 {
+		return -1
+	}
+	sendLimit.Lock()
+	defer sendLimit.Unlock()
+	refillSendTokens()
+	return int(sendLimit.tokens)
+}
+
+// takeSendToken uses up one request of max_requests_per_minute. It returns
+// errRateLimited, as unavailable, when none is left.
+func takeSendToken() error {
+	cfg := currentConfig()
+	if cfg.MaxRequestsPerMinute <= 0 {
+		return nil
+	}
+	sendLimit.Lock()
+	defer sendLimit.Unlock()
+	refillSendTokens()
+	if sendLimit.tokens < 1 {
+		return unavailable("metrics submission", errRateLimited)
+	}
+	sendLimit.tokens--
+	return nil
+}
+
+// limitPayload splits a payload into requests of at most max_payload_bytes,
+// the highest-priority metrics first, in no more requests than
+// max_requests_per_minute has left (at least one, which may then wait for
+// its retry). Metrics that do not fit are shed, the lowest priority first,
+// as is a single metric larger than max_payload_bytes.
+func limitPayload(payload MetricsPayload) []MetricsPayload {
+	cfg := currentConfig()
+	if cfg.MaxPayloadBytes <= 0 || len(payload.Metrics) == 0 {
+		return []MetricsPayload{payload}
+	}
+	empty := payload
+	empty.Metrics = []Metric{}
+	// Room for the continuation markers
+	empty.BatchID, empty.Part, empty.Parts = strings.Repeat("0", 36), 9999, 9999
+	encoded, _ := json.Marshal(empty)
+	overhead := len(encoded)
+	sizes := make([]int, len(payload.Metrics))
+	total := overhead
+	for i, m := range payload.Metrics {
+		encoded, _ := json.Marshal(m)
+		sizes[i] = len(encoded) + 1 // and a comma
+		total += sizes[i]
+	}
+	if total <= cfg.MaxPayloadBytes {
+		return []MetricsPayload{payload}
+	}
+
+	budget := sendTokens()
+	if budget == 0 {
+		budget = 1
+	}
+	order := make([]int, len(payload.Metrics))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return metricPriority(payload.Metrics[order[a]]) < metricPriority(payload.Metrics[order[b]])
+	})
+
+	var chunks []MetricsPayload
+	var chunk []Metric
+	size := overhead
+	shed := map[string]int{}
+	full := false
+	for _, i := range order {
+		m := payload.Metrics[i]
+		if overhead+sizes[i] > cfg.MaxPayloadBytes || full {
+			shed[m.MetricType]++
+			continue
+		}
+		if size+sizes[i] > cfg.MaxPayloadBytes {
+			if budget > 0 && len(chunks)+1 == budget {
+				// The rest is of the same or a lower priority
+				full = true
+				shed[m.MetricType]++
+				continue
+			}
+			chunks = append(chunks, payload.withMetrics(chunk))
+			chunk, size = nil, overhead
+		}
+		chunk = append(chunk, m)
+		size += sizes[i]
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, payload.withMetrics(chunk))
+	}
+	if len(shed) > 0 {
+		reportShed(shed)
+	}
+	return chunks
+}
+
+// serverMetricLimits holds, per server base URL, the most metrics a request
+// to the server may hold, learned from its 413s.
+var serverMetricLimits = struct {
+	sync.Mutex
+	limits map[string]int
+}{limits: map[string]int{}}
+
+func serverMetricLimit(base string) int {
+	serverMetricLimits.Lock()
+	defer serverMetricLimits.Unlock()
+	return serverMetricLimits.limits[base]
+}
+
+// payloadParts splits a payload as limitPayload does and into requests of
+// no more metrics than the server takes, with continuation markers.
+func payloadParts(payload MetricsPayload) []MetricsPayload {
+	var parts []MetricsPayload
+	for _, chunk := range limitPayload(payload) {
+		parts = append(parts, splitPayload(chunk, serverMetricLimit(serverURL()))...)
+	}
+	return markParts(parts, 0)
+}
+
+// splitPayload splits a payload into requests of at most limit metrics, in
+// order. A limit of 0 leaves it whole.
+func splitPayload(payload MetricsPayload, limit int) []MetricsPayload {
+	if limit <= 0 || len(payload.Metrics) <= limit {
+		return []MetricsPayload{payload}
+	}
+	var parts []MetricsPayload
+	for start := 0; start < len(payload.Metrics); start += limit {
+		end := min(start+limit, len(payload.Metrics))
+		parts = append(parts, payload.withMetrics(payload.Metrics[start:end]))
+	}
+	return parts
+}
+
+// markParts numbers the requests of a payload sent in several, under the
+// batch ID of the first or a new one. The first sent of them went out
+// already and keep their numbers, so a split only ever raises the count the
+// later ones carry. A single request carries no markers.
+func markParts(parts []MetricsPayload, sent int) []MetricsPayload {
+	if len(parts) < 2 {
+		return parts
+	}
+	batchID := parts[0].BatchID
+	if batchID == "" {
+		batchID, _ = newUUID()
+	}
+	for i := sent; i < len(parts); i++ {
+		parts[i].BatchID, parts[i].Part, parts[i].Parts = batchID, i+1, len(parts)
+	}
+	return parts
+}
+
+// tooLarge returns how many metrics a request may hold after the server
+// refused payload as too large, and false for other errors. A
+// QUOTA_EXCEEDED error for metrics_per_payload gives the limit; otherwise
+// the payload is halved.
+func tooLarge(payload MetricsPayload, err error) (int, bool) {
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusRequestEntityTooLarge || len(payload.Metrics) < 2 {
+		return 0, false
+	}
+	limit := len(payload.Metrics) / 2
+	if quota, ok := quotaExceeded(err); ok {
+		if quota.Quota != "metrics_per_payload" || quota.Limit <= 0 {
+			// Over the series quota: smaller requests would not help
+			return 0, false
+		}
+		limit = min(quota.Limit, len(payload.Metrics)-1)
+	}
+	return limit, true
+}
+
+// resplit is tooLarge, remembering the limit for the server at base.
+func resplit(base string, payload MetricsPayload, err error) (int, bool) {
+	limit, ok := tooLarge(payload, err)
+	if !ok {
+		return 0, false
+	}
+	serverMetricLimits.Lock()
+	if known := serverMetricLimits.limits[base]; known == 0 || limit < known {
+		serverMetricLimits.limits[base] = limit
+	}
+	serverMetricLimits.Unlock()
+	logger.Warn("metrics.split", "Server refused the payload as too large, sending it in smaller requests", Fields{"count": len(payload.Metrics), "limit": limit, "error": err})
+	return limit, true
+}
+
+// withMetrics returns a copy of the payload holding the given metrics.
+func (p MetricsPayload) withMetrics(metrics []Metric) MetricsPayload {
+	p.Metrics = metrics
+	return p
+}
+
+// reportShed logs and counts metrics shed, by type.
+func reportShed(shed map[string]int) {
+	count := 0
+	types := make([]string, 0, len(shed))
+	for metricType, n := range shed {
+		count += n
+		types = append(types, metricType)
+	}
+	sort.Strings(types)
+	health.recordShed(count)
+	logger.Warn("metrics.shed", "Shed metrics over max_payload_bytes and max_requests_per_minute", Fields{"count": count, "types": strings.Join(types, ",")})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// serverConfigFile caches the server-managed settings in the state dir so
+// they apply from startup, before the first poll. Files from before
+// serverConfigVersion have no version and read as 0.
+const (
+	serverConfigFile    = "server-config.json"
+	serverConfigVersion = 1
+)
+
+// serverManagedKeys are the settings the server may override: what the
+// agent collects and how it labels and logs it. Everything else, from how
+// the agent reaches the server and who it is to how much it sends and the
+// endpoints collectors connect to, stays with the host, so a bad or hostile
+// value pushed from the server cannot cut the agent off or point it
+// elsewhere. Options added later are local until listed here.
+var serverManagedKeys = map[string]bool{
+	"log_level":           true,
+	"tags":                true,
+	"metric_names":        true,
+	"collectors":          true,
+	"collector_intervals": true,
+	"spread_collection":   true,
+	"top_users":           true,
+	"top_processes":       true,
+	"top_flows":           true,
+	"heartbeat_interval":  true,
+	"degrade_load":        true,
+	"degrade_psi":         true,
+	"degrade_slowdown":    true,
+}
+
+// serverSettings is the document served by /api/agent/config.
+type serverSettings struct {
+	ETag     string                 `json:"etag"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// serverConfigState is serverConfigFile: the settings with their format.
+type serverConfigState struct {
+	Version int `json:"version"`
+	serverSettings
+}
+
+var serverOverrides = struct {
+	sync.Mutex
+	current  serverSettings
+	loaded   bool
+	rejected string // ETag of settings that failed to apply, not retried
+}{}
+
+// applyServerOverrides applies the settings last received from the server on
+// top of every local layer. Settings the agent cannot apply are skipped with
+// a warning rather than failing the whole configuration.
+func applyServerOverrides(cfg *Config) {
+	serverOverrides.Lock()
+	if !serverOverrides.loaded {
+		serverOverrides.loaded = true
+		if cfg.StateDir != "" {
+			var state serverConfigState
+			if data, err := os.ReadFile(filepath.Join(cfg.StateDir, serverConfigFile)); err == nil && json.Unmarshal(data, &state) == nil {
+				if state.Version <= serverConfigVersion {
+					serverOverrides.current = state.serverSettings
+				} else {
+					// The first poll fetches them again
+					logger.Warn("config.server_cache_ignored", "Ignoring cached server-managed settings of a newer format", Fields{"version": state.Version})
+				}
+			}
+		}
+	}
+	settings := serverOverrides.current.Settings
+	serverOverrides.Unlock()
+
+	if len(settings) == 0 {
+		return
+	}
+	updated, err := withServerSettings(*cfg, settings)
+	if err != nil {
+		logger.Warn("config.server_invalid", "Ignoring server-managed settings", Fields{"error": err})
+		return
+	}
+	*cfg = updated
+}
+
+// withServerSettings returns cfg with settings applied, leaving cfg alone on
+// error.
+func withServerSettings(cfg Config, settings map[string]interface{}) (Config, error) {
+	allowed := map[string]interface{}{}
+	for key, value := range settings {
+		if !serverManagedKeys[key] {
+			logger.Warn("config.server_local_key", "Server may not override this setting", Fields{"key": key})
+			continue
+		}
+		allowed[key] = value
+	}
+	data, err := json.Marshal(allowed)
+	if err != nil {
+		return cfg, err
+	}
+	if err := applyConfigData(&cfg, data, ".json", "server config"); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// pollServerConfig fetches /api/agent/config every server_config_interval
+// with If-None-Match, and calls onChange after storing settings that differ
+// from the current ones.
+func pollServerConfig(ctx context.Context, onChange func()) {
+	for {
+		cfg := currentConfig()
+
+		if cfg.ServerConfigInterval > 0 && !cfg.DryRun && !health.authHalted() && serverSupports(serverURL(), capabilityServerConfig) {
+			changed, err := fetchServerConfig(ctx, cfg)
+			if err != nil && ctx.Err() == nil {
+				logger.Warn("config.server_poll_failed", "Failed to fetch server-managed settings", Fields{"error": err})
+			}
+			if changed {
+				onChange()
+			}
+		}
+
+		wait := cfg.ServerConfigInterval
+		if wait <= 0 {
+			wait = time.Minute // disabled; check again in case a reload enables it
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func fetchServerConfig(ctx context.Context, cfg Config) (bool, error) {
+	serverOverrides.Lock()
+	etag, rejected := serverOverrides.current.ETag, serverOverrides.rejected
+	serverOverrides.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", serverURL()+"/api/agent/config?"+url.Values{"hostname": {cfg.Hostname}}.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	signRequest(req, cfg.APIKey, nil)
+	resp, err := serverDo(req, 30*time.Second)
+	if err != nil {
+		return false, unavailable("server config", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusNotFound:
+		// Older servers have no config endpoint
+		logger.Debug("config.server_unsupported", "Server does not provide agent settings", nil)
+		return false, nil
+	}
+	if err := checkResponse("server config", resp); err != nil {
+		if errors.Is(err, ErrAuth) {
+			haltOnAuthError(err)
+		}
+		return false, err
+	}
+
+	var received serverSettings
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&received); err != nil {
+		return false, fmt.Errorf("decode server config: %w", err)
+	}
+	received.ETag = resp.Header.Get("ETag")
+	if received.ETag != "" && received.ETag == rejected {
+		return false, nil
+	}
+	serverOverrides.Lock()
+	current := serverOverrides.current.Settings
+	unchanged := reflect.DeepEqual(received.Settings, current) || (len(received.Settings) == 0 && len(current) == 0)
+	if unchanged {
+		serverOverrides.current.ETag = received.ETag
+	}
+	serverOverrides.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// Check the settings against the current configuration before adopting
+	// them, so a typo on the server cannot break the next reload.
+	if _, err := withServerSettings(cfg, received.Settings); err != nil {
+		serverOverrides.Lock()
+		serverOverrides.rejected = received.ETag
+		serverOverrides.Unlock()
+		return false, fmt.Errorf("rejected server-managed settings: %w", err)
+	}
+
+	serverOverrides.Lock()
+	serverOverrides.current = received
+	serverOverrides.rejected = ""
+	serverOverrides.Unlock()
+	if cfg.StateDir != "" {
+		if data, err := json.Marshal(serverConfigState{Version: serverConfigVersion, serverSettings: received}); err == nil {
+			writeStateFile(filepath.Join(cfg.StateDir, serverConfigFile), data)
+		}
+	}
+	logger.Info("config.server_updated", "Received new server-managed settings", Fields{"etag": received.ETag, "keys": len(received.Settings)})
+	return true, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithServerSettings(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ServerURL = "https://lxmon.example.com"
+	cfg.Interval = time.Minute
+
+	updated, err := withServerSettings(cfg, map[string]interface{}{
+		"log_level":         "debug",
+		"top_processes":     5,
+		"server_url":        "https://elsewhere.example.com",
+		"interval":          "1ms",
+		"max_payload_bytes": 1,
+		"jolokia":           "metadata=http://169.254.169.254/",
+		"some_later_option": "x",
+	})
+	if err != nil {
+		t.Fatalf("withServerSettings: %v", err)
+	}
+	if updated.LogLevel != "debug" || updated.TopProcesses != 5 {
+		t.Errorf("managed settings not applied: log_level %q, top_processes %d", updated.LogLevel, updated.TopProcesses)
+	}
+	if updated.ServerURL != cfg.ServerURL || updated.Interval != cfg.Interval || updated.MaxPayloadBytes != cfg.MaxPayloadBytes || len(updated.Jolokia) != 0 {
+		t.Errorf("server overrode local settings: %+v", updated)
+	}
+}
+
+func TestServerManagedKeysAreOptions(t *testing.T) {
+	known := map[string]bool{}
+	for _, opt := range configOptions {
+		known[opt.Key] = true
+	}
+	for key := range serverManagedKeys {
+		if !known[key] {
+			t.Errorf("serverManagedKeys lists %q, which is not an option", key)
+		}
+	}
+}
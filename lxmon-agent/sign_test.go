@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestSignature(t *testing.T) {
+	// Same vector as lxmon-server/tests/test_signature.py
+	body := []byte(`{"hostname":"web-1"}`)
+	want := "7f2c3810f36d8c071a1d668f8644c2296266a3307a1ef2f8b510847fb596adfd"
+	if got := requestSignature("agent-key-1", "1700000000", "POST", "/api/agent/metrics?hostname=web-1", body); got != want {
+		t.Errorf("requestSignature = %s, want %s", got, want)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	body := []byte(`{"hostname":"web-1"}`)
+	req, _ := http.NewRequest("POST", "https://proxy.example.com/lxmon/api/agent/metrics?hostname=web-1", nil)
+	signRequest(req, "agent-key-1", body)
+
+	timestamp := req.Header.Get("X-LXMON-Timestamp")
+	signature := req.Header.Get("X-LXMON-Signature")
+	if timestamp == "" {
+		t.Fatal("no X-LXMON-Timestamp")
+	}
+	// The proxy's prefix is not signed
+	if want := requestSignature("agent-key-1", timestamp, "POST", "/api/agent/metrics?hostname=web-1", body); signature != "v1="+want {
+		t.Errorf("X-LXMON-Signature = %q, want v1=%s", signature, want)
+	}
+
+	unsigned, _ := http.NewRequest("POST", "https://lxmon.example.com/api/agent/metrics", nil)
+	signRequest(unsigned, "", body)
+	if unsigned.Header.Get("X-LXMON-Signature") != "" {
+		t.Error("signed a request without an API key")
+	}
+}
+
+func TestClassifyStatusSignatureErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   error
+	}{
+		{http.StatusUnauthorized, "", ErrAuth},
+		{http.StatusUnauthorized, "INVALID_SIGNATURE", ErrAuth},
+		{http.StatusUnauthorized, "SIGNATURE_EXPIRED", ErrServerUnavailable},
+		{http.StatusUnauthorized, "REPLAYED_REQUEST", ErrServerUnavailable},
+		{http.StatusUnprocessableEntity, "", ErrPayloadRejected},
+	}
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status, tt.code); !errors.Is(got, tt.want) {
+			t.Errorf("classifyStatus(%d, %q) = %v, want %v", tt.status, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestLearnServerClock(t *testing.T) {
+	t.Cleanup(func() { serverClock.skew = 0 })
+
+	learnServerClock(time.Now().Add(10 * time.Minute).UTC().Format(http.TimeFormat))
+	if skew := signingTime().Sub(time.Now()); skew < 9*time.Minute || skew > 11*time.Minute {
+		t.Errorf("signing %s off the local clock, want about 10m", skew)
+	}
+
+	learnServerClock("not a date")
+	if skew := signingTime().Sub(time.Now()); skew < 9*time.Minute {
+		t.Errorf("an unreadable Date header reset the skew to %s", skew)
+	}
+}
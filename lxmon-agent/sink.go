@@ -0,0 +1,267 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// metricSink is an output the metrics go to besides the lxmon server: OTLP,
+// Prometheus remote_write, InfluxDB, Kafka or a local file. Every cycle is encoded
+// for each enabled sink and queued; each sink has a worker sending its queue
+// in order, with its own retries, so a slow or unreachable sink holds up
+// neither the others nor the server. While a sink is down, up to sink_buffer
+// cycles wait in its queue, and the oldest are dropped beyond that.
+//
+// The lxmon server is not one of them: its delivery has batching, the spool
+// and quarantine, and runs in the cycle as before.
+type metricSink struct {
+	Name    string
+	Enabled func() bool
+	// Encode converts a cycle's metrics, as collected. It runs in the
+	// cycle, as newMetricsPayload changes the metrics in place afterwards.
+	Encode func(Config, []Metric) sinkBatch
+	// Send makes one attempt at delivering a batch, with a copy of the
+	// configuration: it runs without configLock, so a sink that hangs does
+	// not hold up a reload.
+	Send func(Config, sinkBatch) error
+	// Retryable tells a failure worth retrying from a batch the sink
+	// rejects; isRetryable when not set.
+	Retryable func(error) bool
+	// Done, if set, is called once a batch is sent or given up on.
+	Done func(sinkBatch, error)
+}
+
+// sinkBatch is a cycle encoded for a sink.
+type sinkBatch struct {
+	body  []byte
+	count int
+}
+
+var sinks = []metricSink{
+	{Name: "otlp", Enabled: otlpEnabled, Encode: encodeOTLP, Send: sendOTLP, Done: otlpDone},
+	{Name: "remote_write", Enabled: remoteWriteEnabled, Encode: encodeRemoteWrite, Send: sendRemoteWrite},
+	{Name: "influx", Enabled: influxEnabled, Encode: encodeInflux, Send: sendInflux},
+	{Name: "kafka", Enabled: kafkaEnabled, Encode: encodeKafka, Send: sendKafka},
+	{Name: "file", Enabled: fileOutputEnabled, Encode: encodeFileOutput, Send: sendFileOutput, Retryable: func(error) bool { return true }},
+}
+
+// sinkQueue is a sink's buffer and delivery state.
+type sinkQueue struct {
+	sync.Mutex
+	batches  []sinkBatch
+	wake     chan struct{}
+	dropped  int
+	dropping bool
+	lastSend time.Time
+	lastErr  string
+}
+
+var sinkQueues = func() map[string]*sinkQueue {
+	queues := map[string]*sinkQueue{}
+	for _, sink := range sinks {
+		queues[sink.Name] = &sinkQueue{wake: make(chan struct{}, 1)}
+	}
+	return queues
+}()
+
+// SinkStatus is a sink's state on /health.
+type SinkStatus struct {
+	Queued    int       `json:"queued"`
+	Dropped   int       `json:"dropped,omitempty"`
+	LastSend  time.Time `json:"last_send"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var sinkWG sync.WaitGroup
+
+// fanOut queues a cycle's metrics for every enabled sink.
+func fanOut(cfg Config, metrics []Metric) {
+	for _, sink := range sinks {
+		if !sink.Enabled() {
+			continue
+		}
+		batch := sink.Encode(cfg, metrics)
+		if batch.count == 0 {
+			continue
+		}
+		queue := sinkQueues[sink.Name]
+		queue.Lock()
+		queue.batches = append(queue.batches, batch)
+		if overflow := len(queue.batches) - max(cfg.SinkBuffer, 1); overflow > 0 {
+			queue.batches = queue.batches[overflow:]
+			queue.dropped += overflow
+			if !queue.dropping {
+				// Once per outage, not once per cycle
+				queue.dropping = true
+				logger.Warn("sink.dropping", "Output buffer is full, dropping its oldest metrics", Fields{"sink": sink.Name, "buffer": cfg.SinkBuffer})
+			}
+		}
+		queue.Unlock()
+		select {
+		case queue.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startSinks starts a worker per sink. Sinks without a worker for their
+// settings just never get a batch, so a reload can enable one.
+func startSinks(stop <-chan struct{}) {
+	for _, sink := range sinks {
+		sinkWG.Add(1)
+		go func(sink metricSink) {
+			defer sinkWG.Done()
+			defer crashGuard()
+			runSink(sink, sinkQueues[sink.Name], stop)
+		}(sink)
+	}
+}
+
+// waitSinks waits for the workers to stop. Stopping, each sends what its
+// queue still holds, one attempt per batch, after the last cycle was queued.
+func waitSinks() {
+	sinkWG.Wait()
+}
+
+func runSink(sink metricSink, queue *sinkQueue, stop <-chan struct{}) {
+	retryable := sink.Retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	for {
+		queue.Lock()
+		var batch sinkBatch
+		pending := len(queue.batches) > 0
+		if pending {
+			batch = queue.batches[0]
+		}
+		queue.Unlock()
+
+		if !pending {
+			select {
+			case <-queue.wake:
+				continue
+			case <-stop:
+				drainSink(sink, queue)
+				return
+			}
+		}
+
+		err := sendWithRetry(sink, batch, retryable, stop)
+		if err != nil && retryable(err) {
+			// Kept at the front of the queue, and tried again after a pause
+			queue.Lock()
+			queue.lastErr = err.Error()
+			queued := len(queue.batches)
+			queue.Unlock()
+			logger.Error("sink.failed", "Failed to send metrics to an output, keeping them queued", Fields{"sink": sink.Name, "error": err, "queued": queued})
+			if sink.Done != nil {
+				sink.Done(batch, err)
+			}
+			pause := currentConfig().RetryMaxDelay
+			select {
+			case <-time.After(pause):
+			case <-stop:
+				drainSink(sink, queue)
+				return
+			}
+			continue
+		}
+
+		queue.Lock()
+		if len(queue.batches) > 0 {
+			queue.batches = queue.batches[1:]
+		}
+		if err != nil {
+			queue.lastErr = err.Error()
+		} else {
+			queue.lastSend, queue.lastErr, queue.dropping = time.Now(), "", false
+		}
+		queue.Unlock()
+		if err != nil {
+			logger.Error("sink.rejected", "Output rejected metrics, dropping them", Fields{"sink": sink.Name, "error": err, "count": batch.count})
+		} else {
+			logger.Debug("sink.sent", "Sent metrics to an output", Fields{"sink": sink.Name, "count": batch.count})
+		}
+		if sink.Done != nil {
+			sink.Done(batch, err)
+		}
+	}
+}
+
+// sendWithRetry sends a batch, retrying max_retries times while the sink
+// is unavailable, and stops retrying when the agent stops.
+func sendWithRetry(sink metricSink, batch sinkBatch, retryable func(error) bool, stop <-chan struct{}) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		cfg := currentConfig()
+		err = sink.Send(cfg, batch)
+		if err == nil || !retryable(err) || attempt >= cfg.MaxRetries {
+			return err
+		}
+		logger.Debug("sink.attempt_failed", "Output send attempt failed", Fields{"sink": sink.Name, "attempt": attempt, "error": err})
+		wait := retryWait(cfg, attempt, err)
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return err
+		}
+	}
+}
+
+// drainSink makes one attempt at each queued batch, and gives up on the
+// rest at the first failure.
+func drainSink(sink metricSink, queue *sinkQueue) {
+	for {
+		queue.Lock()
+		if len(queue.batches) == 0 {
+			queue.Unlock()
+			return
+		}
+		batch := queue.batches[0]
+		queue.Unlock()
+
+		cfg := currentConfig()
+		err := sink.Send(cfg, batch)
+		queue.Lock()
+		if err != nil {
+			unsent := 0
+			for _, b := range queue.batches {
+				unsent += b.count
+			}
+			queue.batches = nil
+			queue.Unlock()
+			logger.Warn("sink.unsent", "Output unreachable while stopping, its queued metrics are lost", Fields{"sink": sink.Name, "error": err, "count": unsent})
+			return
+		}
+		queue.batches = queue.batches[1:]
+		queue.lastSend = time.Now()
+		queue.Unlock()
+		if sink.Done != nil {
+			sink.Done(batch, nil)
+		}
+	}
+}
+
+// sinkStatuses returns the state of the enabled sinks.
+func sinkStatuses() map[string]SinkStatus {
+	statuses := map[string]SinkStatus{}
+	for _, sink := range sinks {
+		if !sink.Enabled() {
+			continue
+		}
+		queue := sinkQueues[sink.Name]
+		queue.Lock()
+		statuses[sink.Name] = SinkStatus{
+			Queued:    len(queue.batches),
+			Dropped:   queue.dropped,
+			LastSend:  queue.lastSend,
+			LastError: queue.lastErr,
+		}
+		queue.Unlock()
+	}
+	if len(statuses) == 0 {
+		return nil
+	}
+	return statuses
+}
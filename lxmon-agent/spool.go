@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolMagic starts every spool entry. The entry format is
+//
+//	"LXSPOOL1" | CRC-32 of the payload (4 bytes) | payload length (4 bytes) | payload
+//
+// so a file cut short by a crash or a full disk is recognized and dropped
+// instead of being sent half.
+var spoolMagic = []byte("LXSPOOL1")
+
+const (
+	spoolHeaderSize   = 16
+	spoolSuffix       = ".spool"
+	spoolResultSuffix = ".result"
+	// maxReplayPerCycle bounds how many spooled payloads one send cycle
+	// replays, so a long backlog drains over a few cycles.
+	maxReplayPerCycle = 20
+)
+
+// spool keeps metrics payloads and command results the server could not take
+// during an outage, and replays them oldest first once it is reachable again.
+// Metrics carry their collection time, so replayed ones fill the gap in
+// history.
+var spool = struct {
+	sync.Mutex
+	seq       int
+	replaying bool
+}{}
+
+func spoolDir() string {
+	return filepath.Join(currentConfig().StateDir, "spool")
+}
+
+func spoolEnabled() bool {
+	cfg := currentConfig()
+	return cfg.StateDir != "" && cfg.SpoolMaxMB > 0 && !cfg.DryRun
+}
+
+// spoolPayload stores payload for a later replay. The API key is not stored;
+// the current one is used when the payload is replayed.
+func spoolPayload(payload MetricsPayload) {
+	if !spoolEnabled() {
+		return
+	}
+	payload.APIKey = ""
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("spool.marshal_failed", "Failed to encode payload for the spool", Fields{"error": err})
+		return
+	}
+
+	if entries, ok := storeSpoolEntry(data, spoolSuffix); ok {
+		logger.Info("spool.stored", "Server unreachable, payload spooled for replay", Fields{"count": len(payload.Metrics), "spooled": entries})
+	}
+}
+
+// spoolCommandResult stores the result of a command that ran while the
+// server was unreachable, so it is not lost.
+func spoolCommandResult(result CommandResult) bool {
+	if !spoolEnabled() {
+		return false
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Warn("spool.marshal_failed", "Failed to encode command result for the spool", Fields{"error": err})
+		return false
+	}
+	entries, ok := storeSpoolEntry(data, spoolResultSuffix)
+	if ok {
+		logger.Info("spool.result_stored", "Server unreachable, command result spooled for replay", Fields{"command_id": result.CommandID, "spooled": entries})
+	}
+	return ok
+}
+
+// storeSpoolEntry adds an entry with the given suffix to the spool and
+// returns the number of entries after pruning.
+func storeSpoolEntry(data []byte, suffix string) (int, bool) {
+	spool.Lock()
+	defer spool.Unlock()
+	dir := spoolDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Warn("spool.write_failed", "Failed to create spool directory", Fields{"dir": dir, "error": err})
+		return 0, false
+	}
+	spool.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), spool.seq%1000000, suffix)
+	if err := writeSpoolEntry(filepath.Join(dir, name), data); err != nil {
+		logger.Warn("spool.write_failed", "Failed to spool payload", Fields{"error": err})
+		return 0, false
+	}
+	entries := pruneSpool(dir)
+	health.setSpooled(entries)
+	return entries, true
+}
+
+// writeSpoolEntry writes the entry to a temporary file first and renames it
+// into place, so readers never see a partial entry.
+func writeSpoolEntry(path string, data []byte) error {
+	header := make([]byte, spoolHeaderSize)
+	copy(header, spoolMagic)
+	binary.BigEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(data)))
+
+	return writeStateFile(path, append(header, data...))
+}
+
+// readSpoolEntry returns the payload of an entry, or an error if the entry
+// is damaged.
+func readSpoolEntry(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < spoolHeaderSize || !bytes.Equal(data[:8], spoolMagic) {
+		return nil, errors.New("not a spool entry")
+	}
+	payload := data[spoolHeaderSize:]
+	if length := binary.BigEndian.Uint32(data[12:16]); int(length) != len(payload) {
+		return nil, fmt.Errorf("truncated: %d of %d bytes", len(payload), length)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[8:12]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// spoolEntries lists the entries of dir, payloads and command results,
+// oldest first.
+func spoolEntries(dir string) []os.DirEntry {
+	all, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var entries []os.DirEntry
+	for _, entry := range all {
+		name := entry.Name()
+		if entry.Type().IsRegular() && (strings.HasSuffix(name, spoolSuffix) || strings.HasSuffix(name, spoolResultSuffix)) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// removeStaleTemp removes temporary files left by a crash while spooling.
+func removeStaleTemp(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > time.Hour {
+			os.Remove(path)
+		}
+	}
+}
+
+// pruneSpool drops entries older than spool_max_age, then the oldest ones
+// while the spool is larger than spool_max_mb. It returns the entries left.
+func pruneSpool(dir string) int {
+	cfg := currentConfig()
+	removeStaleTemp(dir)
+	entries := spoolEntries(dir)
+	maxBytes := int64(cfg.SpoolMaxMB) << 20
+	var total int64
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	dropped := 0
+	kept := entries[:0]
+	for i, entry := range entries {
+		expired := cfg.SpoolMaxAge > 0 && time.Since(spoolEntryTime(entry.Name())) > cfg.SpoolMaxAge
+		if expired || total > maxBytes {
+			if os.Remove(filepath.Join(dir, entry.Name())) == nil {
+				total -= sizes[i]
+				dropped++
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+	if dropped > 0 {
+		logger.Warn("spool.dropped", "Dropped spooled payloads over the spool's size or age limit", Fields{
+			"dropped":     dropped,
+			"max_mb":      cfg.SpoolMaxMB,
+			"max_age":     cfg.SpoolMaxAge,
+			"spool_bytes": total,
+		})
+	}
+	return len(kept)
+}
+
+// spoolEntryTime is when an entry was spooled, from its name.
+func spoolEntryTime(name string) time.Time {
+	prefix, _, _ := strings.Cut(name, "-")
+	nanos, _ := strconv.ParseInt(prefix, 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// replaySpool sends spooled payloads and command results, oldest first,
+// until the spool is empty, maxReplayPerCycle were sent or the server stops
+// taking them. Only one replay runs at a time.
+func replaySpool(cfg Config) {
+	if !spoolEnabled() || health.authHalted() {
+		return
+	}
+	spool.Lock()
+	if spool.replaying {
+		spool.Unlock()
+		return
+	}
+	spool.replaying = true
+	spool.Unlock()
+	defer func() {
+		spool.Lock()
+		spool.replaying = false
+		spool.Unlock()
+	}()
+
+	dir := spoolDir()
+	entries := spoolEntries(dir)
+	replayed := 0
+	for _, entry := range entries {
+		if replayed == maxReplayPerCycle {
+			break
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := readSpoolEntry(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn("spool.corrupt", "Dropped a damaged spool entry", Fields{"entry": entry.Name(), "error": err})
+				os.Remove(path)
+			}
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), spoolResultSuffix) {
+			if !replayCommandResult(cfg, path, entry.Name(), data) {
+				health.setSpooled(len(spoolEntries(dir)))
+				return
+			}
+			replayed++
+			continue
+		}
+		var payload MetricsPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			logger.Warn("spool.corrupt", "Dropped a damaged spool entry", Fields{"entry": entry.Name(), "error": err})
+			os.Remove(path)
+			continue
+		}
+		payload.APIKey = cfg.APIKey
+
+		if err := sendMetrics(cfg, payload); err != nil {
+			switch {
+			case errors.Is(err, ErrAuth):
+				haltOnAuthError(err)
+				return
+			case errors.Is(err, ErrPayloadRejected):
+				if quota, ok := quotaExceeded(err); ok {
+					reportQuota(&quota, false)
+				} else {
+					logger.Error("spool.rejected", "Server rejected a spooled payload", Fields{"entry": entry.Name(), "error": err})
+					quarantinePayload("/api/agent/metrics", payload, err)
+				}
+				os.Remove(path)
+				continue
+			default:
+				logger.Debug("spool.replay_stopped", "Server not taking spooled payloads, retrying next cycle", Fields{"error": err})
+				health.setSpooled(len(spoolEntries(dir)))
+				return
+			}
+		}
+		os.Remove(path)
+		replayed++
+	}
+
+	left := len(spoolEntries(dir))
+	health.setSpooled(left)
+	if replayed > 0 {
+		logger.Info("spool.replayed", "Replayed spooled payloads", Fields{"replayed": replayed, "spooled": left})
+	}
+}
+
+// replayCommandResult sends a spooled command result, and reports whether
+// the replay may go on with the next entry.
+func replayCommandResult(cfg Config, path, name string, data []byte) bool {
+	var result CommandResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		logger.Warn("spool.corrupt", "Dropped a damaged spool entry", Fields{"entry": name, "error": err})
+		os.Remove(path)
+		return true
+	}
+	if err := sendCommandResult(cfg, result); err != nil {
+		switch {
+		case errors.Is(err, ErrAuth):
+			haltOnAuthError(err)
+			return false
+		case errors.Is(err, ErrPayloadRejected):
+			logger.Error("spool.rejected", "Server rejected a spooled command result", Fields{"entry": name, "command_id": result.CommandID, "error": err})
+			quarantinePayload("/api/agent/command-result", result, err)
+		default:
+			logger.Debug("spool.replay_stopped", "Server not taking spooled payloads, retrying next cycle", Fields{"error": err})
+			return false
+		}
+	}
+	os.Remove(path)
+	return true
+}
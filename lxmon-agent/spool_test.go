@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useSpool points the spool at a fresh state dir for the test.
+func useSpool(t *testing.T) string {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	config.StateDir = t.TempDir()
+	config.APIKey = "spool-key"
+	config.Hostname = "spool-host"
+	config.MaxRetries = 1
+	return spoolDir()
+}
+
+func TestSpoolEntryCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry"+spoolSuffix)
+	if err := writeSpoolEntry(path, []byte(`{"hostname":"h"}`)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := readSpoolEntry(path)
+	if err != nil || string(data) != `{"hostname":"h"}` {
+		t.Fatalf("readSpoolEntry = %q, %v", data, err)
+	}
+	entry, _ := os.ReadFile(path)
+
+	damaged := map[string][]byte{
+		"checksum mismatch": append(append([]byte{}, entry[:len(entry)-1]...), 'X'),
+		"truncated":         entry[:len(entry)-3],
+		"not a spool entry": append([]byte("LXSPOOL0"), entry[8:]...),
+	}
+	for want, content := range damaged {
+		os.WriteFile(path, content, 0o600)
+		if _, err := readSpoolEntry(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v", want, err)
+		}
+	}
+}
+
+func TestPruneSpool(t *testing.T) {
+	dir := useSpool(t)
+	config.SpoolMaxMB = 1
+	config.SpoolMaxAge = time.Hour
+	os.MkdirAll(dir, 0o700)
+
+	write := func(at time.Time, size int) string {
+		name := fmt.Sprintf("%020d-%06d%s", at.UnixNano(), 0, spoolSuffix)
+		if err := writeSpoolEntry(filepath.Join(dir, name), bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	now := time.Now()
+	write(now.Add(-2*time.Hour), 10)
+	write(now.Add(-3*time.Minute), 400<<10)
+	write(now.Add(-2*time.Minute), 400<<10)
+	newest := write(now.Add(-time.Minute), 400<<10)
+
+	// The expired entry goes for its age, the oldest of the rest for size
+	if left := pruneSpool(dir); left != 2 {
+		t.Errorf("pruneSpool left %d entries, want 2", left)
+	}
+	entries := spoolEntries(dir)
+	if len(entries) != 2 || entries[1].Name() != newest {
+		t.Errorf("entries left: %v", entries)
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	var mu sync.Mutex
+	var received []MetricsPayload
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload MetricsPayload
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := useSpool(t)
+	config.ServerURL = srv.URL
+	config.CompressThreshold = 0
+	spoolPayload(MetricsPayload{Hostname: "spool-host", Metrics: []Metric{{MetricType: "cpu", MetricName: "usage", Value: 1}}})
+	spoolPayload(MetricsPayload{Hostname: "spool-host", Metrics: []Metric{{MetricType: "cpu", MetricName: "usage", Value: 2}}})
+	for _, entry := range spoolEntries(dir) {
+		if data, _ := os.ReadFile(filepath.Join(dir, entry.Name())); bytes.Contains(data, []byte("spool-key")) {
+			t.Errorf("API key written to spool entry %s", entry.Name())
+		}
+	}
+	os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d-%06d%s", 1, 0, spoolSuffix)), []byte("LXSPOOL1 damaged"), 0o600)
+
+	// A server still down keeps the entries, without the damaged one
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	replaySpool(config)
+	if n := len(spoolEntries(dir)); n != 2 {
+		t.Fatalf("%d entries left after a failed replay, want 2", n)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	replaySpool(config)
+	if n := len(spoolEntries(dir)); n != 0 {
+		t.Errorf("%d entries left after the replay", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Metrics[0].Value != 1 || received[1].Metrics[0].Value != 2 {
+		t.Fatalf("replayed %+v, want the two payloads oldest first", received)
+	}
+	// The key is not stored in the spool; the current one is sent
+	if received[0].APIKey != "spool-key" {
+		t.Errorf("replayed api_key = %q", received[0].APIKey)
+	}
+}
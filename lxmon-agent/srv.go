@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SRV answers are re-resolved when their TTL expires, within these
+	// bounds so a TTL of 0 does not hammer the resolver and a day-long one
+	// does not pin a dead site.
+	minSRVTTL = 30 * time.Second
+	maxSRVTTL = time.Hour
+	// defaultSRVTTL is used when the TTL is unknown (system resolver).
+	defaultSRVTTL = 5 * time.Minute
+)
+
+// serverSRV caches the last resolution of server_srv.
+var serverSRV = struct {
+	sync.Mutex
+	raw     string
+	urls    []string
+	expires time.Time
+}{}
+
+// parseServerSRV splits server_srv ([scheme://]_service._proto.domain) into
+// the scheme used for the targets (http by default) and the SRV name.
+func parseServerSRV(raw string) (string, string, error) {
+	scheme, name := "http", raw
+	if i := strings.Index(raw, "://"); i >= 0 {
+		scheme, name = raw[:i], raw[i+3:]
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", "", fmt.Errorf("scheme must be http or https, got %q", scheme)
+	}
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasPrefix(name, "_") || strings.Count(name, ".") < 2 {
+		return "", "", fmt.Errorf("%q is not an SRV name like _lxmon._tcp.example.com", name)
+	}
+	return scheme, name, nil
+}
+
+// serverSRVURLs returns the server URLs server_srv points at, in the order
+// to try them, resolving again once the previous answer expired.
+func serverSRVURLs(raw string, dnsServers []string) ([]string, error) {
+	serverSRV.Lock()
+	defer serverSRV.Unlock()
+	if serverSRV.raw == raw && time.Now().Before(serverSRV.expires) {
+		return serverSRV.urls, nil
+	}
+	urls, ttl, err := resolveServerSRV(raw, dnsServers)
+	if err != nil {
+		return nil, err
+	}
+	serverSRV.raw, serverSRV.urls, serverSRV.expires = raw, urls, time.Now().Add(ttl)
+	return urls, nil
+}
+
+// watchServerSRV re-resolves server_srv whenever its answer expires and
+// switches the agent to the new servers.
+func watchServerSRV(ctx context.Context) {
+	for {
+		serverSRV.Lock()
+		wait := time.Until(serverSRV.expires)
+		serverSRV.Unlock()
+		if wait < minSRVTTL {
+			wait = minSRVTTL
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		cfg := currentConfig()
+		raw, failover, dnsServers := cfg.ServerSRV, cfg.FailoverURLs, cfg.DNSServers
+		if raw == "" {
+			continue
+		}
+		urls, err := serverSRVURLs(raw, dnsServers)
+		if err != nil {
+			// Keep using the servers from the last answer
+			logger.Warn("server.srv_failed", "Failed to resolve server SRV record", Fields{"name": raw, "error": err})
+			serverSRV.Lock()
+			serverSRV.expires = time.Now().Add(minSRVTTL)
+			serverSRV.Unlock()
+			continue
+		}
+		logger.Debug("server.srv_resolved", "Resolved server SRV record", Fields{"name": raw, "servers": urls})
+		setServerURLs(append(append([]string{}, urls...), failover...))
+	}
+}
+
+// resolveServerSRV looks up server_srv on dnsServers, or those of
+// /etc/resolv.conf without any, and orders the targets by priority, and by
+// weight within a priority (RFC 2782).
+func resolveServerSRV(raw string, dnsServers []string) ([]string, time.Duration, error) {
+	scheme, name, err := parseServerSRV(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, ttl, err := querySRV(name, dnsServers)
+	if err != nil {
+		// Fall back to the Go or system resolver, which does not report TTLs
+		_, records, err = newResolver(dnsServers).LookupSRV(context.Background(), "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = defaultSRVTTL
+	} else {
+		orderSRV(records)
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records for %s", name)
+	}
+	if ttl < minSRVTTL {
+		ttl = minSRVTTL
+	}
+	if ttl > maxSRVTTL {
+		ttl = maxSRVTTL
+	}
+
+	urls := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		urls = append(urls, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return urls, ttl, nil
+}
+
+// orderSRV sorts records by priority and shuffles each priority by weight.
+func orderSRV(records []*net.SRV) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	for start := 0; start < len(records); {
+		end := start
+		total := 0
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			total += int(records[end].Weight)
+			end++
+		}
+		for i := start; i < end-1; i++ {
+			pick := i
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				sum := 0
+				for j := i; j < end; j++ {
+					sum += int(records[j].Weight)
+					if sum >= n {
+						pick = j
+						break
+					}
+				}
+			}
+			total -= int(records[pick].Weight)
+			records[i], records[pick] = records[pick], records[i]
+		}
+		start = end
+	}
+}
+
+// querySRV asks the nameservers (host:port), or those in /etc/resolv.conf,
+// for SRV records directly, since the system resolver hides the TTL. It
+// returns the lowest TTL of the answers.
+func querySRV(name string, servers []string) ([]*net.SRV, time.Duration, error) {
+	if len(servers) == 0 {
+		for _, server := range resolvConfNameservers() {
+			servers = append(servers, net.JoinHostPort(server, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, 0, errors.New("no nameservers in /etc/resolv.conf")
+	}
+	query, id, err := buildSRVQuery(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, server := range servers {
+		records, ttl, err := exchangeSRV(server, query, id)
+		if err == nil {
+			return records, ttl, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+func resolvConfNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+const dnsTypeSRV = 33
+
+func buildSRVQuery(name string) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypeSRV, 0, 1) // root, type SRV, class IN
+	return msg, id, nil
+}
+
+func exchangeSRV(server string, query []byte, id uint16) ([]*net.SRV, time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, 3*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseSRVResponse(buf[:n], id)
+}
+
+func parseSRVResponse(msg []byte, id uint16) ([]*net.SRV, time.Duration, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, 0, errors.New("malformed DNS response")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x0200 != 0 {
+		return nil, 0, errors.New("truncated DNS response")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS error (rcode %d)", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+
+	var records []*net.SRV
+	var ttl uint32
+	for i := 0; i < answers; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errors.New("malformed DNS answer")
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrTTL := binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, 0, errors.New("malformed DNS answer")
+		}
+		if rrType == dnsTypeSRV && length >= 7 {
+			target, _, err := readDNSName(msg, off+6)
+			if err != nil {
+				return nil, 0, err
+			}
+			records = append(records, &net.SRV{
+				Priority: binary.BigEndian.Uint16(msg[off:]),
+				Weight:   binary.BigEndian.Uint16(msg[off+2:]),
+				Port:     binary.BigEndian.Uint16(msg[off+4:]),
+				Target:   target,
+			})
+			if len(records) == 1 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		off += length
+	}
+	return records, time.Duration(ttl) * time.Second, nil
+}
+
+// readDNSName reads a possibly compressed name at off and returns it with
+// the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("malformed DNS name")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errors.New("malformed DNS name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("malformed DNS name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
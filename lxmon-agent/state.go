@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The state dir (/var/lib/lxmon by default) keeps what the agent needs across
+// restarts:
+//
+//	state.json          layout version, see below
+//	agent.pid           PID and instance lock
+//	agent-id.json       durable agent ID
+//	scheduler.json      next runs of collectors with their own interval
+//	audit.log           commands the agent ran, one JSON object per line
+//	server-config.json  last settings pushed by the server
+//	remote-config       last document fetched from Consul/etcd
+//	spool/              payloads waiting for the server ("LXSPOOL1" entries)
+//	quarantine/         payloads the server rejected
+//	crash/              crash reports waiting for upload
+//	scripts/            verified library scripts
+//
+// Every format of the agent's own carries its version: the spool entries
+// their magic, the JSON files a "version" field (read as 0 in files from
+// before it) and the audit log lines a "v" field. remote-config is the
+// document as fetched. A reader skips a version it does not know instead of
+// misreading it. When the layout changes (files move, a format changes in
+// a way old readers cannot skip), stateVersion goes up and a migration below
+// converts the dir at startup, under the instance lock, before anything
+// reads it.
+
+// stateVersion is the layout this agent writes.
+const stateVersion = 1
+
+const stateFile = "state.json"
+
+// stateLayout is state.json. ReadableBy is the oldest layout version whose
+// agents can still use the dir, so rolling back to an older agent after an
+// update keeps working until a migration breaks that.
+type stateLayout struct {
+	Version    int    `json:"version"`
+	ReadableBy int    `json:"readable_by"`
+	WrittenBy  string `json:"written_by"`
+}
+
+// stateMigration converts the dir from layout To-1 to To. Migrations must be
+// safe to run again: the version is only recorded once one has finished, so
+// a crash in the middle repeats it on the next start.
+type stateMigration struct {
+	To          int
+	Description string
+	// ReadableBy is the oldest layout that can still read the dir afterwards
+	ReadableBy int
+	Migrate    func(dir string) error
+}
+
+var stateMigrations = []stateMigration{
+	{
+		// Dirs from before the layout was versioned already have version 1's
+		// files; only the version is new.
+		To:          1,
+		Description: "record the layout version",
+		ReadableBy:  1,
+		Migrate:     func(dir string) error { return nil },
+	},
+}
+
+// errStateTooNew is returned for a state dir written by a newer agent that
+// this one cannot read.
+var errStateTooNew = errors.New("state dir written by a newer agent")
+
+// migrateStateDir brings the state dir to stateVersion. It runs once the
+// instance lock is held, so no other agent uses the dir meanwhile.
+func migrateStateDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	layout, err := readStateLayout(dir)
+	if err != nil {
+		return err
+	}
+	if layout.Version > stateVersion {
+		if layout.ReadableBy > stateVersion {
+			return fmt.Errorf("%w: layout %d, readable by agents of layout %d and later, this agent has layout %d", errStateTooNew, layout.Version, layout.ReadableBy, stateVersion)
+		}
+		// Left as it is: the newer agent finds its own layout again
+		logger.Warn("state.newer", "State dir was written by a newer agent", Fields{"layout": layout.Version, "agent_layout": stateVersion, "written_by": layout.WrittenBy})
+		return nil
+	}
+
+	for _, migration := range stateMigrations {
+		if migration.To <= layout.Version {
+			continue
+		}
+		if err := migration.Migrate(dir); err != nil {
+			return fmt.Errorf("migrate state dir to layout %d (%s): %w", migration.To, migration.Description, err)
+		}
+		layout = stateLayout{Version: migration.To, ReadableBy: migration.ReadableBy, WrittenBy: version}
+		if err := writeStateLayout(dir, layout); err != nil {
+			return err
+		}
+		logger.Info("state.migrated", "Migrated the state dir", Fields{"layout": migration.To, "change": migration.Description})
+	}
+	return nil
+}
+
+// readStateLayout reads state.json. A dir without one has layout 0.
+func readStateLayout(dir string) (stateLayout, error) {
+	var layout stateLayout
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return layout, nil
+	}
+	if err != nil {
+		return layout, fmt.Errorf("read state layout: %w", err)
+	}
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return layout, fmt.Errorf("read state layout: %w", err)
+	}
+	return layout, nil
+}
+
+func writeStateLayout(dir string, layout stateLayout) error {
+	data, _ := json.MarshalIndent(layout, "", "  ")
+	if err := writeStateFile(filepath.Join(dir, stateFile), data); err != nil {
+		return fmt.Errorf("write state layout: %w", err)
+	}
+	return nil
+}
+
+// writeStateFile replaces path with data in one step, so a crash leaves the
+// previous content or the new one, never half of it.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
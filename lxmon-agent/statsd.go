@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With statsd_listen, the agent takes StatsD and DogStatsD metrics from the
+// applications on the host over UDP and sends them, aggregated over the
+// interval, as metric_type "app". The statsd collector drains them each
+// cycle, so they follow collector_intervals and go to every output:
+//
+//   - Counters (c) are summed over the interval, scaled up by their sample
+//     rate, and sent when they were updated.
+//   - Gauges (g) keep their last value and are sent every cycle, as StatsD
+//     does; +n and -n change the value instead of setting it.
+//   - Timers, histograms and distributions (ms, h, d) are sent as
+//     <name>.count, .min, .max, .mean and .p95.
+//   - Sets (s) are sent as the number of distinct values in the interval.
+//
+// DogStatsD tags (|#env:prod,role:web) become metadata. Events and service
+// checks are ignored.
+
+const (
+	// statsdMaxSeries caps the series aggregated at once; new ones beyond it
+	// are dropped until the next cycle, so a tag with a request ID in it
+	// cannot exhaust the agent's memory or the host's series quota.
+	statsdMaxSeries = 1000
+	// statsdMaxSamples caps the values a timer keeps for its percentile. The
+	// count, min, max and mean still cover every value.
+	statsdMaxSamples = 1000
+	// statsdMaxName leaves room in the server's 100 characters for the
+	// timer suffixes.
+	statsdMaxName = 90
+)
+
+type statsdSeries struct {
+	name string
+	kind string
+	tags map[string]string
+
+	unit  string
+	value float64 // counter sum, gauge value
+	set   map[string]bool
+
+	count   float64
+	seen    int
+	sum     float64
+	min     float64
+	max     float64
+	samples []float64
+}
+
+var statsdState = struct {
+	sync.Mutex
+	series   map[string]*statsdSeries
+	dropping bool
+}{series: map[string]*statsdSeries{}}
+
+func statsdEnabled() bool {
+	return currentConfig().StatsDListen != ""
+}
+
+// startStatsD starts the StatsD listener on statsd_listen, dropping packets
+// from outside statsd_allow. It returns nil when it is disabled or cannot
+// listen.
+func startStatsD() net.PacketConn {
+	cfg := currentConfig()
+	if !statsdEnabled() {
+		return nil
+	}
+	addr, err := listenAddress(cfg.StatsDListen)
+	var conn net.PacketConn
+	if err == nil {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		logger.Error("statsd.failed", "Cannot listen for StatsD metrics", Fields{"addr": cfg.StatsDListen, "error": err})
+		return nil
+	}
+	go func() {
+		defer crashGuard()
+		buf := make([]byte, 65535)
+		allow := func(c Config) []string { return c.StatsDAllow }
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !strings.Contains(err.Error(), "use of closed network connection") {
+					logger.Error("statsd.failed", "StatsD listener failed", Fields{"error": err})
+				}
+				return
+			}
+			if !clientAllowed("statsd", allow, from) {
+				continue
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if err := parseStatsDLine(strings.TrimSpace(line)); err != nil {
+					logger.Debug("statsd.invalid", "Ignoring an invalid StatsD line", Fields{"line": line, "error": err})
+				}
+			}
+		}
+	}()
+	logger.Info("statsd.listening", "Listening for StatsD metrics", Fields{"addr": cfg.StatsDListen})
+	return conn
+}
+
+func stopStatsD(conn net.PacketConn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// parseStatsDLine aggregates one name:value|type[|@rate][|#tags] line.
+func parseStatsDLine(line string) error {
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil
+	}
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("no name")
+	}
+	if len(name) > statsdMaxName {
+		return errors.New("name too long")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return errors.New("no type")
+	}
+	raw, kind := fields[0], fields[1]
+	rate := 1.0
+	tags := map[string]string{}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return errors.New("invalid sample rate")
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			for _, tag := range strings.Split(field[1:], ",") {
+				if key, value, _ := strings.Cut(tag, ":"); key != "" {
+					tags[key] = value
+				}
+			}
+		}
+	}
+
+	var value float64
+	if kind != "s" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("invalid value")
+		}
+		value = v
+	}
+	switch kind {
+	case "c", "g", "ms", "h", "d", "s":
+	default:
+		return fmt.Errorf("unknown type %q", kind)
+	}
+
+	statsdState.Lock()
+	defer statsdState.Unlock()
+	series := statsdLookup(name, kind, tags)
+	if series == nil {
+		return nil
+	}
+	switch kind {
+	case "c":
+		series.value += value / rate
+	case "g":
+		if strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-") {
+			series.value += value
+		} else {
+			series.value = value
+		}
+	case "s":
+		if series.set == nil {
+			series.set = map[string]bool{}
+		}
+		series.set[raw] = true
+	default:
+		if series.seen == 0 || value < series.min {
+			series.min = value
+		}
+		if series.seen == 0 || value > series.max {
+			series.max = value
+		}
+		series.count += 1 / rate
+		series.sum += value
+		series.seen++
+		// Reservoir sampling keeps an even sample of the interval's values
+		if len(series.samples) < statsdMaxSamples {
+			series.samples = append(series.samples, value)
+		} else if i := rand.Intn(series.seen); i < statsdMaxSamples {
+			series.samples[i] = value
+		}
+	}
+	return nil
+}
+
+// statsdLookup returns the series of a metric, creating it while there is
+// room. Callers hold statsdState.
+func statsdLookup(name, kind string, tags map[string]string) *statsdSeries {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name + "|" + statsdFamily(kind))
+	for _, key := range keys {
+		b.WriteString("|" + key + "=" + tags[key])
+	}
+	id := b.String()
+
+	if series, ok := statsdState.series[id]; ok {
+		return series
+	}
+	if len(statsdState.series) >= statsdMaxSeries {
+		if !statsdState.dropping {
+			statsdState.dropping = true
+			logger.Warn("statsd.dropping", "Too many StatsD series, dropping new ones", Fields{"max": statsdMaxSeries})
+		}
+		return nil
+	}
+	series := &statsdSeries{name: name, kind: statsdFamily(kind), tags: tags}
+	if kind == "ms" {
+		series.unit = "milliseconds"
+	}
+	statsdState.series[id] = series
+	return series
+}
+
+// statsdFamily aggregates timers, histograms and distributions alike.
+func statsdFamily(kind string) string {
+	if kind == "h" || kind == "d" {
+		return "ms"
+	}
+	return kind
+}
+
+// collectStatsD returns what the applications sent since the last cycle and
+// starts the next interval.
+func collectStatsD() ([]Metric, error) {
+	if !statsdEnabled() {
+		return nil, nil
+	}
+	now := time.Now()
+	var metrics []Metric
+	statsdState.Lock()
+	defer statsdState.Unlock()
+	for id, series := range statsdState.series {
+		metadata := map[string]interface{}{}
+		for key, value := range series.tags {
+			metadata[key] = value
+		}
+		add := func(name string, value float64, unit string) {
+			metrics = append(metrics, Metric{MetricType: "app", MetricName: name, Value: value, Unit: unit, Metadata: metadata, Timestamp: now})
+		}
+		switch series.kind {
+		case "c":
+			add(series.name, series.value, "count")
+			delete(statsdState.series, id)
+		case "g":
+			// Kept for the next cycles and for relative updates
+			add(series.name, series.value, "")
+		case "s":
+			add(series.name, float64(len(series.set)), "count")
+			delete(statsdState.series, id)
+		default:
+			sort.Float64s(series.samples)
+			p95 := series.samples[int(math.Ceil(0.95*float64(len(series.samples))))-1]
+			add(series.name+".count", series.count, "count")
+			add(series.name+".min", series.min, series.unit)
+			add(series.name+".max", series.max, series.unit)
+			add(series.name+".mean", series.sum/float64(series.seen), series.unit)
+			add(series.name+".p95", p95, series.unit)
+			delete(statsdState.series, id)
+		}
+	}
+	// Warned about again once there was room, not every cycle while gauges
+	// fill it
+	statsdState.dropping = len(statsdState.series) >= statsdMaxSeries
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].MetricName < metrics[j].MetricName })
+	return metrics, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions are the accepted values of tls_min_version.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadCAFile reads a PEM bundle of CA certificates.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertificate is the agent's client certificate for servers that
+// authenticate agents with mTLS. It is read again whenever the certificate or
+// key file changes, so a rotated certificate is used from the next
+// connection on without a reload.
+type clientCertificate struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newClientCertificate(certFile, keyFile string) (*clientCertificate, error) {
+	c := &clientCertificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load returns the certificate, reading the files again if either changed.
+func (c *clientCertificate) load() (*tls.Certificate, error) {
+	var modified time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && modified.Equal(c.modified) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if c.cert != nil {
+		logger.Info("tls.client_cert_reloaded", "Client certificate changed, reloaded", Fields{"cert_file": c.certFile, "subject": leaf.Subject.CommonName, "not_after": leaf.NotAfter})
+	}
+	if time.Now().After(leaf.NotAfter) {
+		logger.Warn("tls.client_cert_expired", "Client certificate has expired", Fields{"cert_file": c.certFile, "not_after": leaf.NotAfter})
+	}
+	c.cert, c.modified = &cert, modified
+	return c.cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate. If a
+// rotated certificate cannot be read (say, half written), the previous one is
+// offered.
+func (c *clientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := c.load()
+	if err != nil {
+		logger.Warn("tls.client_cert_failed", "Failed to reload client certificate, using the previous one", Fields{"cert_file": c.certFile, "error": err})
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.cert, nil
+	}
+	return cert, nil
+}
+
+// cipherSuiteIDs maps cipher suite names (TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+// to their IDs. Only TLS 1.2 suites Go considers secure are accepted.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				known[suite.Name] = suite.ID
+			}
+		}
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			valid := make([]string, 0, len(known))
+			for name := range known {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q (supported: %s)", name, strings.Join(valid, ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newServerTransport builds the transport for the TLS and connection pool
+// settings of cfg.
+func newServerTransport(cfg Config) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = cfg.HTTPIdleConns
+	transport.IdleConnTimeout = cfg.HTTPIdleTimeout
+	transport.DisableKeepAlives = cfg.HTTPIdleConns == 0
+	transport.DialContext = serverDialer(cfg)
+	return transport, nil
+}
+
+// newTLSConfig builds the TLS settings of cfg for connections to the server
+// (or the MQTT broker).
+// A CA bundle replaces the system roots. Cipher suites only apply up to
+// TLS 1.2; TLS 1.3 suites are not configurable.
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tlsVersions[cfg.TLSMinVersion]}
+	if cfg.TLSCAFile != "" {
+		pool, err := loadCAFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cfg.TLSCipherSuites) > 0 {
+		ids, err := cipherSuiteIDs(cfg.TLSCipherSuites)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_cipher_suites: %w", err)
+		}
+		tlsConfig.CipherSuites = ids
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+		}
+		cert, err := newClientCertificate(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = cert.GetClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// warnCleartext warns about server URLs that send the API key and metrics
+// unencrypted to another host.
+func warnCleartext(urls []string) {
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "http" {
+			continue
+		}
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			continue
+		}
+		logger.Warn("server.cleartext", "Server URL is not HTTPS, the API key and metrics are sent in cleartext", Fields{"server_url": raw})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runTop implements `lxmon-agent top`: a live terminal view of what the
+// agent's collectors see on this host, for on-box triage.
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	refresh := fs.Duration("refresh", 2*time.Second, "screen refresh interval")
+	procs := fs.Int("procs", 10, "number of top processes to show")
+	own, rest := subcommandArgs(fs, args)
+	if err := fs.Parse(own); err != nil {
+		return 2
+	}
+	if *refresh <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --refresh must be greater than 0, got %s\n", *refresh)
+		return 2
+	}
+	if *procs < 0 {
+		fmt.Fprintf(os.Stderr, "error: --procs must not be negative, got %d\n", *procs)
+		return 2
+	}
+	if err := loadConfig(rest); err != nil {
+		logger.Error("config.invalid", "Failed to load configuration", Fields{"error": err})
+		return 1
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	view := &topView{sampler: newProcessSampler()}
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	for {
+		metrics, duration := collectMetrics()
+		fmt.Print("\033[H\033[2J")
+		fmt.Print(view.render(metrics, duration, *procs))
+		select {
+		case <-ticker.C:
+		case <-stop:
+			fmt.Println()
+			return 0
+		}
+	}
+}
+
+// topView keeps the state needed to compute rates between refreshes.
+type topView struct {
+	lastNet  map[string]float64
+	lastTime time.Time
+	sampler  *processSampler
+}
+
+func (v *topView) render(metrics []Metric, duration float64, procs int) string {
+	cfg := currentConfig()
+	var b strings.Builder
+	now := time.Now()
+	find := func(metricType, name string) (float64, bool) {
+		for _, m := range metrics {
+			if m.MetricType == metricType && m.MetricName == name {
+				return m.Value, true
+			}
+		}
+		return 0, false
+	}
+	value := func(metricType, name string) float64 {
+		val, _ := find(metricType, name)
+		return val
+	}
+
+	fmt.Fprintf(&b, "lxmon-agent top - %s - %s (collected in %.2fs, %d metrics)\n\n",
+		cfg.Hostname, now.Format("15:04:05"), duration, len(metrics))
+
+	fmt.Fprintf(&b, "CPU     %5.1f%%  %s  cores %.0f   load %.2f %.2f %.2f   uptime %s\n",
+		value("cpu", "usage_percent"), bar(value("cpu", "usage_percent"), 20), value("cpu", "count"),
+		value("system", "load_average_1m"), value("system", "load_average_5m"), value("system", "load_average_15m"),
+		(time.Duration(value("system", "uptime")) * time.Second).String())
+	fmt.Fprintf(&b, "Memory  %5.1f%%  %s  %s / %s\n",
+		value("memory", "used_percent"), bar(value("memory", "used_percent"), 20),
+		formatBytes(value("memory", "used")), formatBytes(value("memory", "total")))
+	fmt.Fprintf(&b, "Swap    %5.1f%%  %s  %s / %s\n",
+		value("memory", "swap_used_percent"), bar(value("memory", "swap_used_percent"), 20),
+		formatBytes(value("memory", "swap_used")), formatBytes(value("memory", "swap_total")))
+
+	sent, _ := find("network", "bytes_sent")
+	recv, _ := find("network", "bytes_recv")
+	if v.lastNet != nil {
+		elapsed := now.Sub(v.lastTime).Seconds()
+		fmt.Fprintf(&b, "Network tx %s/s  rx %s/s\n",
+			formatBytes((sent-v.lastNet["sent"])/elapsed), formatBytes((recv-v.lastNet["recv"])/elapsed))
+	} else {
+		fmt.Fprintf(&b, "Network tx -  rx -\n")
+	}
+	v.lastNet = map[string]float64{"sent": sent, "recv": recv}
+	v.lastTime = now
+
+	fmt.Fprintf(&b, "\n%-30s %-8s %6s  %-22s %10s\n", "MOUNTPOINT", "FS", "USED", "", "FREE")
+	free := map[string]float64{}
+	for _, m := range metrics {
+		if m.MetricType == "disk" && m.MetricName == "free" {
+			free[fmt.Sprint(m.Metadata["mountpoint"])] = m.Value
+		}
+	}
+	for _, m := range metrics {
+		if m.MetricType != "disk" || m.MetricName != "usage_percent" {
+			continue
+		}
+		mount := fmt.Sprint(m.Metadata["mountpoint"])
+		fmt.Fprintf(&b, "%-30s %-8s %5.1f%%  %s %10s\n",
+			truncate(mount, 30), truncate(fmt.Sprint(m.Metadata["filesystem"]), 8), m.Value, bar(m.Value, 20), formatBytes(free[mount]))
+	}
+
+	fmt.Fprintf(&b, "\n%7s %-12s %6s %10s  %s\n", "PID", "USER", "CPU%", "RSS", "COMMAND")
+	samples := v.sampler.sample()
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].CPU != samples[j].CPU {
+			return samples[i].CPU > samples[j].CPU
+		}
+		return samples[i].RSS > samples[j].RSS
+	})
+	if len(samples) > procs {
+		samples = samples[:procs]
+	}
+	for _, p := range samples {
+		fmt.Fprintf(&b, "%7d %-12s %6.1f %10s  %s\n", p.PID, truncate(p.User, 12), p.CPU, formatBytes(float64(p.RSS)), p.Name)
+	}
+	fmt.Fprintf(&b, "\nPress Ctrl-C to quit.\n")
+	return b.String()
+}
+
+func bar(percent float64, width int) string {
+	filled := int(percent / 100 * float64(width))
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func formatBytes(value float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
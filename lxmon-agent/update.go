@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LatestVersion is the document served by /api/agent/latest-version: the
+// newest published agent release and where to get it for this platform.
+type LatestVersion struct {
+	Version         string `json:"version"`
+	UpdateAvailable bool   `json:"update_available"`
+	URL             string `json:"url"`
+	ChecksumsURL    string `json:"checksums_url"`
+}
+
+// checkForUpdates asks the server for the latest agent release every
+// update_check and reports a newer one, once per release, in the log and as
+// an agent_update_available event. Development builds are not checked.
+func checkForUpdates(ctx context.Context) {
+	if _, ok := parseVersion(version); !ok {
+		return
+	}
+	announced := ""
+	for {
+		cfg := currentConfig()
+
+		if cfg.UpdateCheck > 0 && !cfg.DryRun && !health.authHalted() {
+			latest, err := fetchLatestVersion(ctx, cfg)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					logger.Debug("update.check_failed", "Failed to check for a newer agent release", Fields{"error": err})
+				}
+			case latest != nil && newerVersion(latest.Version, version) && latest.Version != announced:
+				announced = latest.Version
+				logger.Info("update.available", "A newer agent release is available", Fields{"current": version, "latest": latest.Version, "url": latest.URL})
+				emitEvent(Event{
+					Type:     "agent_update_available",
+					Source:   "agent",
+					Severity: "info",
+					Message:  fmt.Sprintf("lxmon-agent %s is available (running %s)", latest.Version, version),
+					Fields:   map[string]interface{}{"current": version, "latest": latest.Version, "url": latest.URL, "checksums_url": latest.ChecksumsURL},
+				})
+			}
+		}
+
+		wait := cfg.UpdateCheck
+		if wait <= 0 {
+			wait = time.Hour // disabled; check again in case a reload enables it
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchLatestVersion returns nil when the server publishes no release.
+func fetchLatestVersion(ctx context.Context, cfg Config) (*LatestVersion, error) {
+	query := url.Values{"os": {runtime.GOOS}, "arch": {runtime.GOARCH}, "current": {version}}
+	req, err := http.NewRequestWithContext(ctx, "GET", serverURL()+"/api/agent/latest-version?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	signRequest(req, cfg.APIKey, nil)
+	resp, err := serverDo(req, 30*time.Second)
+	if err != nil {
+		return nil, unavailable("latest version", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkResponse("latest version", resp); err != nil {
+		if errors.Is(err, ErrAuth) {
+			haltOnAuthError(err)
+		}
+		return nil, err
+	}
+	var latest LatestVersion
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&latest); err != nil {
+		return nil, fmt.Errorf("decode latest version: %w", err)
+	}
+	return &latest, nil
+}
+
+// parseVersion parses a release version (1.2.3, v1.2.3, 1.2.3-rc1) into its
+// major, minor and patch numbers.
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// newerVersion reports whether release version a is newer than b.
+func newerVersion(a, b string) bool {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return pa[i] > pb[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runValidateConfig loads the configuration the same way the agent does
+// (file, env, flags), checks it and prints the effective settings as JSON.
+// It exits non-zero when the configuration cannot be used, so it can gate a
+// config rollout in CI.
+func runValidateConfig(args []string) int {
+	if err := loadConfig(args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	cfg := currentConfig()
+
+	out, err := effectiveConfigJSON(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(out))
+
+	problems := validateConfig(cfg)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateConfig returns every problem found in cfg, including a DNS lookup
+// of the server host.
+func validateConfig(cfg Config) []string {
+	var problems []string
+
+	if problem := validateServerURL(cfg.ServerURL, cfg.DNSServers); problem != "" {
+		problems = append(problems, "server_url: "+problem)
+	}
+	for _, failoverURL := range cfg.FailoverURLs {
+		if problem := validateServerURL(failoverURL, cfg.DNSServers); problem != "" {
+			problems = append(problems, fmt.Sprintf("failover_urls: %s: %s", failoverURL, problem))
+		}
+	}
+	if len(cfg.ServerRegions) > 0 && cfg.ServerSRV != "" {
+		problems = append(problems, "server_regions: cannot be combined with server_srv")
+	}
+	regions := make([]string, 0, len(cfg.ServerRegions))
+	for name := range cfg.ServerRegions {
+		regions = append(regions, name)
+	}
+	sort.Strings(regions)
+	for _, name := range regions {
+		if problem := validateServerURL(cfg.ServerRegions[name], cfg.DNSServers); problem != "" {
+			problems = append(problems, fmt.Sprintf("server_regions: %s: %s", name, problem))
+		}
+	}
+	if cfg.MQTTBroker != "" {
+		broker, err := url.Parse(cfg.MQTTBroker)
+		if err != nil || !knownMQTTScheme(broker.Scheme) || broker.Hostname() == "" {
+			problems = append(problems, fmt.Sprintf("mqtt_broker: %q is not a tcp://, mqtt://, ssl://, tls:// or mqtts:// URL", cfg.MQTTBroker))
+		}
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		endpoint, err := url.Parse(cfg.OTLPEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problems = append(problems, fmt.Sprintf("otlp_endpoint: %q is not an http:// or https:// URL", cfg.OTLPEndpoint))
+		}
+	}
+	if cfg.RemoteWriteURL != "" {
+		endpoint, err := url.Parse(cfg.RemoteWriteURL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problems = append(problems, fmt.Sprintf("remote_write_url: %q is not an http:// or https:// URL", redactURL(cfg.RemoteWriteURL)))
+		}
+	}
+	if cfg.InfluxURL != "" {
+		endpoint, err := url.Parse(cfg.InfluxURL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problems = append(problems, fmt.Sprintf("influx_url: %q is not an http:// or https:// URL", redactURL(cfg.InfluxURL)))
+		}
+	}
+	if len(cfg.KafkaBrokers) > 0 {
+		if cfg.KafkaTopic == "" {
+			problems = append(problems, "kafka_topic: must be set with kafka_brokers")
+		}
+		for _, broker := range cfg.KafkaBrokers {
+			if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+				problems = append(problems, fmt.Sprintf("kafka_brokers: %q is not host:port", broker))
+			}
+		}
+		if cfg.KafkaFormat == kafkaFormatAvro && cfg.KafkaSchemaRegistry == "" {
+			problems = append(problems, "kafka_format: avro needs kafka_schema_registry")
+		}
+		if cfg.KafkaSchemaRegistry != "" {
+			registry, err := url.Parse(cfg.KafkaSchemaRegistry)
+			if err != nil || (registry.Scheme != "http" && registry.Scheme != "https") || registry.Host == "" {
+				problems = append(problems, fmt.Sprintf("kafka_schema_registry: %q is not an http:// or https:// URL", redactURL(cfg.KafkaSchemaRegistry)))
+			}
+		}
+	}
+	if cfg.SinkBuffer < 1 {
+		problems = append(problems, "sink_buffer: must be at least 1")
+	}
+	if cfg.OTLPOnly {
+		switch {
+		case cfg.OTLPEndpoint == "":
+			problems = append(problems, "otlp_only: set without otlp_endpoint")
+		case cfg.MQTTBroker != "":
+			problems = append(problems, "otlp_only: cannot be combined with mqtt_broker")
+		}
+	}
+
+	if cfg.PrometheusOnly {
+		switch {
+		case cfg.PrometheusListen == "":
+			problems = append(problems, "prometheus_only: set without prometheus_listen")
+		case cfg.MQTTBroker != "":
+			problems = append(problems, "prometheus_only: cannot be combined with mqtt_broker")
+		}
+	}
+	if len(cfg.ClusterIdentities) > 0 {
+		if len(cfg.ClusterMetrics) == 0 {
+			problems = append(problems, "cluster_identities: set without cluster_metrics")
+		}
+		if cfg.MQTTBroker != "" {
+			problems = append(problems, "cluster_identities: cannot be combined with mqtt_broker")
+		}
+	}
+	serverless := (cfg.OTLPOnly && cfg.OTLPEndpoint != "") || (cfg.PrometheusOnly && cfg.PrometheusListen != "")
+	if cfg.APIKey == "" && cfg.TLSCertFile == "" && !serverless {
+		problems = append(problems, "api_key: empty (and no tls_cert_file)")
+	}
+	if cfg.Interval < time.Second {
+		problems = append(problems, fmt.Sprintf("interval: %s is shorter than 1s", cfg.Interval))
+	}
+	if cfg.MaxTimeout <= 0 {
+		problems = append(problems, "max_timeout: must be positive")
+	}
+	if cfg.MaxRetries < 1 {
+		problems = append(problems, "max_retries: must be at least 1")
+	}
+	if cfg.RetryDelay < 0 {
+		problems = append(problems, "retry_delay: must not be negative")
+	}
+	if cfg.RetryMaxDelay < cfg.RetryDelay {
+		problems = append(problems, fmt.Sprintf("retry_max_delay: %s is shorter than retry_delay %s", cfg.RetryMaxDelay, cfg.RetryDelay))
+	}
+	if cfg.SpoolMaxMB < 0 {
+		problems = append(problems, "spool_max_mb: must not be negative")
+	}
+	if cfg.SpoolMaxAge < 0 {
+		problems = append(problems, "spool_max_age: must not be negative")
+	}
+	if cfg.CircuitBreakerFailures < 0 {
+		problems = append(problems, "circuit_breaker_failures: must not be negative")
+	}
+	if cfg.CircuitBreakerFailures > 0 && cfg.CircuitBreakerCooldown <= 0 {
+		problems = append(problems, "circuit_breaker_cooldown: must be positive")
+	}
+	if cfg.MaxPayloadBytes < 0 {
+		problems = append(problems, "max_payload_bytes: must not be negative")
+	} else if cfg.MaxPayloadBytes > 0 && cfg.MaxPayloadBytes < minPayloadBytes {
+		problems = append(problems, fmt.Sprintf("max_payload_bytes: %d cannot hold a metric, use at least %d", cfg.MaxPayloadBytes, minPayloadBytes))
+	}
+	if cfg.MaxRequestsPerMinute < 0 {
+		problems = append(problems, "max_requests_per_minute: must not be negative")
+	}
+	if cfg.DegradeLoad < 0 {
+		problems = append(problems, "degrade_load: must not be negative")
+	}
+	if cfg.DegradePSI < 0 || cfg.DegradePSI > 100 {
+		problems = append(problems, fmt.Sprintf("degrade_psi: %d is not a percentage", cfg.DegradePSI))
+	}
+	if cfg.DegradeSlowdown < 1 {
+		problems = append(problems, "degrade_slowdown: must be at least 1")
+	}
+	if cfg.ChaosLatency < 0 {
+		problems = append(problems, "chaos_latency: must not be negative")
+	}
+	if cfg.ChaosLoss < 0 || cfg.ChaosLoss > 100 {
+		problems = append(problems, fmt.Sprintf("chaos_loss: %d is not a percentage", cfg.ChaosLoss))
+	}
+	if cfg.Chaos5xx < 0 || cfg.Chaos5xx > 100 {
+		problems = append(problems, fmt.Sprintf("chaos_5xx: %d is not a percentage", cfg.Chaos5xx))
+	}
+	if cfg.ChaosClockJump < 0 {
+		problems = append(problems, "chaos_clock_jump: must not be negative")
+	}
+	var backoff time.Duration
+	for attempt := 1; attempt < cfg.MaxRetries && backoff < cfg.Interval; attempt++ {
+		backoff += retryBackoff(cfg, attempt)
+	}
+	if backoff >= cfg.Interval {
+		problems = append(problems, fmt.Sprintf("retry_delay: %d retries backing off from %s (up to %s in total) do not fit in the %s interval", cfg.MaxRetries-1, cfg.RetryDelay, backoff, cfg.Interval))
+	}
+	knownLevel := false
+	for _, name := range levelNames {
+		knownLevel = knownLevel || strings.EqualFold(cfg.LogLevel, name)
+	}
+	if !knownLevel {
+		problems = append(problems, fmt.Sprintf("log_level: unknown level %q", cfg.LogLevel))
+	}
+	socket, unixSocket := strings.CutPrefix(cfg.ListenAddr, localUnixPrefix)
+	if unixSocket && !filepath.IsAbs(socket) {
+		problems = append(problems, fmt.Sprintf("listen_addr: unix socket %q is not an absolute path", socket))
+	} else if cfg.ListenAddr != "" && !unixSocket {
+		if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("listen_addr: %v", err))
+		}
+	}
+	listeners := []struct{ key, addr string }{
+		{"listen_addr", cfg.ListenAddr},
+		{"prometheus_listen", cfg.PrometheusListen},
+		{"statsd_listen", cfg.StatsDListen},
+	}
+	for _, l := range listeners {
+		if _, err := listenAddress(l.addr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", l.key, err))
+		}
+	}
+	if cfg.LocalAPIAuth == localAuthPeerCred && !unixSocket {
+		problems = append(problems, "local_api_auth: peercred needs listen_addr to be a unix socket (unix:/path)")
+	}
+	for _, name := range cfg.LocalAPIUsers {
+		if _, err := lookupUID(name); err != nil {
+			problems = append(problems, fmt.Sprintf("local_api_users: unknown user %q", name))
+		}
+	}
+	for _, dep := range cfg.Dependencies {
+		if _, _, err := net.SplitHostPort(dep); err != nil {
+			problems = append(problems, fmt.Sprintf("dependencies: %q: %v", dep, err))
+		}
+	}
+	for _, path := range cfg.GeoIPDatabases {
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("geoip_db: %v", err))
+		}
+	}
+	if cfg.HTTPIdleConns < 0 {
+		problems = append(problems, "http_idle_conns: must not be negative")
+	}
+	if cfg.HTTPIdleTimeout < 0 {
+		problems = append(problems, "http_idle_timeout: must not be negative")
+	}
+	if cfg.HeartbeatInterval < 0 {
+		problems = append(problems, "heartbeat_interval: must not be negative")
+	} else if cfg.HeartbeatInterval > 0 && cfg.HeartbeatInterval < time.Second {
+		problems = append(problems, fmt.Sprintf("heartbeat_interval: %s is below the 1s minimum", cfg.HeartbeatInterval))
+	}
+	if cfg.DialFallbackDelay <= 0 || cfg.DialFallbackDelay >= serverDialTimeout {
+		problems = append(problems, fmt.Sprintf("dial_fallback_delay: must be between 0 and %s", serverDialTimeout))
+	}
+	if cfg.CompressThreshold < 0 {
+		problems = append(problems, "compress_threshold: must not be negative")
+	}
+	if cfg.TopUsers < 0 {
+		problems = append(problems, "top_users: must not be negative")
+	}
+	if cfg.TopProcesses < 0 {
+		problems = append(problems, "top_processes: must not be negative")
+	}
+	if cfg.TopFlows < 0 {
+		problems = append(problems, "top_flows: must not be negative")
+	}
+	return problems
+}
+
+// validateServerURL describes what is wrong with a server endpoint, including
+// whether its host resolves on dnsServers, or returns "".
+func validateServerURL(raw string, dnsServers []string) string {
+	serverURL, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return err.Error()
+	case serverURL.Scheme != "http" && serverURL.Scheme != "https":
+		return fmt.Sprintf("scheme must be http or https, got %q", serverURL.Scheme)
+	case serverURL.Hostname() == "":
+		return "missing host"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := newResolver(dnsServers).LookupHost(ctx, serverURL.Hostname()); err != nil {
+		return fmt.Sprintf("cannot resolve %s: %v", serverURL.Hostname(), err)
+	}
+	return ""
+}
+
+// effectiveConfigJSON renders cfg with credentials and URL passwords redacted
+// and durations in their readable form ("1m0s") instead of nanoseconds. It is
+// what validate-config prints and what crash reports carry.
+func effectiveConfigJSON(cfg Config) ([]byte, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(redactSecrets(data), &fields); err != nil {
+		return nil, err
+	}
+
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch v := value.Field(i).Interface().(type) {
+		case time.Duration:
+			fields[name] = v.String()
+		case map[string]time.Duration:
+			durations := map[string]string{}
+			for key, d := range v {
+				durations[key] = d.String()
+			}
+			fields[name] = durations
+		}
+	}
+	redactURLs := func(urls []string) []string {
+		redacted := make([]string, 0, len(urls))
+		for _, u := range urls {
+			redacted = append(redacted, redactURL(u))
+		}
+		return redacted
+	}
+	for name, u := range map[string]string{
+		"server_url":    cfg.ServerURL,
+		"rabbitmq":      cfg.RabbitMQ,
+		"mqtt_broker":   cfg.MQTTBroker,
+		"otlp_endpoint": cfg.OTLPEndpoint,
+		"remote_config": cfg.RemoteConfig,
+	} {
+		if u != "" {
+			fields[name] = redactURL(u)
+		}
+	}
+	if len(cfg.FailoverURLs) > 0 {
+		fields["failover_urls"] = redactURLs(cfg.FailoverURLs)
+	}
+	if len(cfg.Elasticsearch) > 0 {
+		fields["elasticsearch"] = redactURLs(cfg.Elasticsearch)
+	}
+	if len(cfg.ServerRegions) > 0 {
+		regions := map[string]string{}
+		for region, u := range cfg.ServerRegions {
+			regions[region] = redactURL(u)
+		}
+		fields["server_regions"] = regions
+	}
+	if len(cfg.Jolokia) > 0 {
+		jolokia := map[string]string{}
+		for name, u := range cfg.Jolokia {
+			jolokia[name] = redactURL(u)
+		}
+		fields["jolokia"] = jolokia
+	}
+	return json.MarshalIndent(fields, "", "  ")
+}
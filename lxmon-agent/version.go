@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func runVersion(args []string) int {
+	fmt.Printf("lxmon-agent %s (commit %s, built %s, %s %s/%s)\n",
+		version, commit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With command_channel set to websocket (the default), the agent keeps a
+// WebSocket open to /api/agent/ws. The server pushes commands on it as soon
+// as they are queued and takes their results back on it, where polling finds
+// a command only on the next cycle. Polling stays the fallback: it pauses
+// while the channel is open and takes over whenever the channel is down or
+// the server has none.
+const (
+	commandChannelWebSocket = "websocket"
+	commandChannelPoll      = "poll"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// wsPingInterval is how often the agent pings the server. A channel
+	// that has not heard from the server for two intervals is dead.
+	wsPingInterval = 30 * time.Second
+	// wsHandshakeTimeout bounds connecting and the upgrade.
+	wsHandshakeTimeout = 30 * time.Second
+	// wsMaxMessage bounds a message from the server, as maxCommandsResponse
+	// bounds the commands poll.
+	wsMaxMessage = maxCommandsResponse
+	// wsAckTimeout is how long a result sent on the channel waits for the
+	// server to acknowledge it before it is sent by HTTP instead.
+	wsAckTimeout = 10 * time.Second
+	// wsRefusedRetry is how long the agent polls before trying the channel
+	// again after the server refused it (an older server without one).
+	wsRefusedRetry = 5 * time.Minute
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// errChannelRefused is a handshake the server answered without switching to
+// the WebSocket protocol.
+var errChannelRefused = errors.New("server refused the command channel")
+
+// channelMessage is a message on the command channel. The server sends
+// "command" messages and an "ack" for every result it stored; the agent
+// sends "command_result" messages.
+type channelMessage struct {
+	Type      string          `json:"type"`
+	Command   *PendingCommand `json:"command,omitempty"`
+	Result    *CommandResult  `json:"result,omitempty"`
+	CommandID int             `json:"command_id,omitempty"`
+}
+
+// commandChannel is the open channel, if any, and the results sent on it
+// waiting for their ack.
+var commandChannel = struct {
+	sync.Mutex
+	conn *wsConn
+	acks map[int]chan struct{}
+}{acks: map[int]chan struct{}{}}
+
+func commandChannelEnabled() bool {
+	cfg := currentConfig()
+	return cfg.CommandChannel == commandChannelWebSocket && !cfg.DryRun && !health.authHalted()
+}
+
+// commandChannelOpen reports whether commands arrive on the channel, so
+// polling can pause.
+func commandChannelOpen() bool {
+	commandChannel.Lock()
+	defer commandChannel.Unlock()
+	return commandChannel.conn != nil
+}
+
+// commandChannelState is how commands reach the agent right now, for /health.
+func commandChannelState() string {
+	if commandChannelOpen() {
+		return commandChannelWebSocket
+	}
+	return commandChannelPoll
+}
+
+// runCommandChannel keeps the command channel open until ctx is done,
+// reconnecting with backoff when it drops.
+func runCommandChannel(ctx context.Context) {
+	attempt := 0
+	refused := false
+	for {
+		wait := time.Minute
+		if commandChannelEnabled() && serverSupports(serverURL(), capabilityCommandChannel) {
+			connected := time.Now()
+			err := serveCommandChannel(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(connected) > wsPingInterval {
+				attempt = 0
+			}
+			attempt++
+			wait = retryWait(currentConfig(), attempt, err)
+			switch {
+			case errors.Is(err, errChannelRefused):
+				// Logged once, as older servers refuse it every time
+				if !refused {
+					logger.Info("channel.refused", "Server has no command channel, polling for commands", Fields{"error": err})
+					refused = true
+				}
+				wait = wsRefusedRetry
+			default:
+				logger.Warn("channel.closed", "Command channel closed, polling for commands until it reconnects", Fields{"error": err, "retry_in": wait})
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveCommandChannel connects the channel and runs the commands pushed on
+// it until it closes.
+func serveCommandChannel(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Only the handshake is timed out; ctx keeps the open channel alive
+	base := serverURL()
+	timer := time.AfterFunc(wsHandshakeTimeout, cancel)
+	conn, err := dialCommandChannel(ctx, base)
+	timer.Stop()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	commandChannel.Lock()
+	commandChannel.conn = conn
+	commandChannel.Unlock()
+	defer func() {
+		commandChannel.Lock()
+		commandChannel.conn = nil
+		commandChannel.Unlock()
+	}()
+	logger.Info("channel.connected", "Command channel connected, commands are pushed by the server", Fields{"server_url": base})
+
+	go conn.keepalive(ctx, base)
+
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			return err
+		}
+		var msg channelMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Warn("channel.decode_failed", "Failed to decode command channel message", Fields{"error": err})
+			continue
+		}
+		switch msg.Type {
+		case "command":
+			if msg.Command != nil {
+				runCommands(currentConfig(), []PendingCommand{*msg.Command})
+			}
+		case "ack":
+			commandChannel.Lock()
+			if ack, ok := commandChannel.acks[msg.CommandID]; ok {
+				close(ack)
+				delete(commandChannel.acks, msg.CommandID)
+			}
+			commandChannel.Unlock()
+		default:
+			logger.Debug("channel.unknown_message", "Ignored command channel message", Fields{"type": msg.Type})
+		}
+	}
+}
+
+// dialCommandChannel opens the channel on the server at base. The handshake
+// goes through serverClient, so it uses the same TLS settings, client
+// certificate and agent ID as every other request, and is signed like them.
+func dialCommandChannel(ctx context.Context, base string) (*wsConn, error) {
+	cfg := currentConfig()
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/api/agent/ws", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create command channel request: %w", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("X-API-Key", cfg.APIKey)
+	req.URL.RawQuery = url.Values{"hostname": {cfg.Hostname}}.Encode()
+	signRequest(req, cfg.APIKey, nil)
+
+	resp, err := serverClient.Do(req)
+	if err != nil {
+		return nil, unavailable("command channel", err)
+	}
+	// Servers without the channel answer 403 or 404 (and a real
+	// authentication failure shows on the other requests), so any status
+	// but 101 falls back to polling
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w (status %d)", errChannelRefused, resp.StatusCode)
+	}
+	rw, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: connection cannot be upgraded", errChannelRefused)
+	}
+	accept := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		rw.Close()
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Accept", errChannelRefused)
+	}
+
+	conn := &wsConn{rw: rw, br: bufio.NewReader(rw)}
+	conn.lastRead.Store(time.Now().UnixNano())
+	return conn, nil
+}
+
+// sendResultOnChannel sends result on the command channel and waits for the
+// server to acknowledge it. It reports false if the channel is not open or
+// the ack does not come, for the result to be sent by HTTP instead.
+func sendResultOnChannel(result CommandResult) bool {
+	commandChannel.Lock()
+	conn := commandChannel.conn
+	if conn == nil {
+		commandChannel.Unlock()
+		return false
+	}
+	ack := make(chan struct{})
+	commandChannel.acks[result.CommandID] = ack
+	commandChannel.Unlock()
+	defer func() {
+		commandChannel.Lock()
+		delete(commandChannel.acks, result.CommandID)
+		commandChannel.Unlock()
+	}()
+
+	data, err := json.Marshal(channelMessage{Type: "command_result", Result: &result})
+	if err != nil {
+		return false
+	}
+	if err := conn.writeFrame(wsText, data); err != nil {
+		logger.Debug("channel.result_failed", "Failed to send result on the command channel", Fields{"command_id": result.CommandID, "error": err})
+		return false
+	}
+	select {
+	case <-ack:
+		return true
+	case <-time.After(wsAckTimeout):
+		logger.Debug("channel.result_unacknowledged", "Server did not acknowledge the result on the command channel", Fields{"command_id": result.CommandID})
+		return false
+	}
+}
+
+// wsConn is the client end of a WebSocket (RFC 6455), as much of it as the
+// command channel needs.
+type wsConn struct {
+	rw        io.ReadWriteCloser
+	br        *bufio.Reader
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	lastRead  atomic.Int64
+}
+
+// keepalive pings the server, and closes the channel once ctx is done, the
+// server stopped answering, the agent failed over to another server or
+// command_channel changed.
+func (c *wsConn) keepalive(ctx context.Context, base string) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.Close()
+			return
+		}
+		if time.Since(time.Unix(0, c.lastRead.Load())) > 2*wsPingInterval {
+			logger.Warn("channel.timeout", "Command channel timed out", nil)
+			c.Close()
+			return
+		}
+		if serverURL() != base || !commandChannelEnabled() {
+			c.Close()
+			return
+		}
+		if err := c.writeFrame(wsPing, nil); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, 1000))
+		err = c.rw.Close()
+	})
+	return err
+}
+
+// writeFrame writes payload as a single masked frame, as clients must.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.rw.Write(frame)
+	return err
+}
+
+// readMessage returns the next text or binary message, answering pings and
+// reassembling fragmented messages on the way. A close from the server ends
+// the channel with io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if len(message)+len(payload) > wsMaxMessage {
+				return nil, fmt.Errorf("websocket: message larger than %d bytes", wsMaxMessage)
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	if head[1]&0x80 != 0 {
+		return false, 0, nil, errors.New("websocket: masked frame from server")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, fmt.Errorf("websocket: frame larger than %d bytes", wsMaxMessage)
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.br, payload)
+	return
+}
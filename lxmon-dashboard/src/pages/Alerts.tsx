@@ -1,9 +1,16 @@
-import React from 'react';
-import { useQuery } from '@tanstack/react-query';
-import { alertsAPI, type Alert, type AlertRule } from '../services/api';
-import { AlertTriangle, CheckCircle, Clock, Settings } from 'lucide-react';
+import React, { useState } from 'react';
+import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
+import { alertsAPI, maintenanceAPI, serversAPI, type Alert, type AlertRule, type MaintenanceWindow, type Server } from '../services/api';
+import { AlertTriangle, CheckCircle, Clock, Settings, Wrench } from 'lucide-react';
 
 const Alerts: React.FC = () => {
+  const [windowName, setWindowName] = useState('');
+  const [windowServer, setWindowServer] = useState('');
+  const [windowTag, setWindowTag] = useState('');
+  const [windowMinutes, setWindowMinutes] = useState(60);
+
+  const queryClient = useQueryClient();
+
   const { data: alerts, isLoading: alertsLoading } = useQuery({
     queryKey: ['alerts'],
     queryFn: () => alertsAPI.getAlerts(),
@@ -15,6 +22,51 @@ const Alerts: React.FC = () => {
     queryFn: () => alertsAPI.getAlertRules(),
   });
 
+  const { data: maintenanceWindows } = useQuery({
+    queryKey: ['maintenance-windows'],
+    queryFn: () => maintenanceAPI.getWindows(),
+    refetchInterval: 30000,
+  });
+
+  const { data: servers } = useQuery({
+    queryKey: ['servers'],
+    queryFn: () => serversAPI.getServers(),
+  });
+
+  const createWindowMutation = useMutation({
+    mutationFn: (data: any) => maintenanceAPI.createWindow(data),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: ['maintenance-windows'] });
+      setWindowName('');
+      setWindowTag('');
+    },
+  });
+
+  const endWindowMutation = useMutation({
+    mutationFn: (id: number) => maintenanceAPI.endWindow(id),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: ['maintenance-windows'] });
+    },
+  });
+
+  const handleCreateWindow = () => {
+    if (windowName.trim()) {
+      createWindowMutation.mutate({
+        name: windowName.trim(),
+        server_id: windowServer ? Number(windowServer) : undefined,
+        tag: !windowServer && windowTag.trim() ? windowTag.trim() : undefined,
+        duration_minutes: windowMinutes,
+      });
+    }
+  };
+
+  const windowScope = (maintenance: MaintenanceWindow) => {
+    if (maintenance.server_id) {
+      return servers?.data.find((server: Server) => server.id === maintenance.server_id)?.hostname || `server ${maintenance.server_id}`;
+    }
+    return maintenance.tag || 'all hosts';
+  };
+
   if (alertsLoading || rulesLoading) {
     return (
       <div className="flex items-center justify-center h-64">
@@ -25,6 +77,9 @@ const Alerts: React.FC = () => {
 
   const activeAlerts = alerts?.data.filter((alert: Alert) => alert.status === 'active') || [];
   const resolvedAlerts = alerts?.data.filter((alert: Alert) => alert.status === 'resolved') || [];
+  const currentWindows = maintenanceWindows?.data.filter(
+    (maintenance: MaintenanceWindow) => maintenance.active || new Date(maintenance.starts_at + 'Z') > new Date()
+  ) || [];
 
   return (
     <div className="space-y-6">
@@ -150,6 +205,96 @@ const Alerts: React.FC = () => {
         </div>
       </div>
 
+      {/* Maintenance Windows */}
+      <div className="bg-white rounded-lg shadow">
+        <div className="px-6 py-4 border-b border-gray-200">
+          <h2 className="text-lg font-medium text-gray-900">Maintenance Windows</h2>
+          <p className="text-sm text-gray-500">Alerts are silenced for hosts under maintenance</p>
+        </div>
+        <div className="px-6 py-4 border-b border-gray-200">
+          <div className="flex flex-wrap gap-2">
+            <input
+              type="text"
+              value={windowName}
+              onChange={(e) => setWindowName(e.target.value)}
+              placeholder="Reason (e.g., kernel upgrade)"
+              className="flex-1 px-3 py-2 border border-gray-300 rounded-md focus:ring-blue-500 focus:border-blue-500"
+            />
+            <select
+              value={windowServer}
+              onChange={(e) => setWindowServer(e.target.value)}
+              className="px-3 py-2 border border-gray-300 rounded-md focus:ring-blue-500 focus:border-blue-500"
+            >
+              <option value="">All hosts / by tag</option>
+              {servers?.data.map((server: Server) => (
+                <option key={server.id} value={server.id}>{server.hostname}</option>
+              ))}
+            </select>
+            {!windowServer && (
+              <input
+                type="text"
+                value={windowTag}
+                onChange={(e) => setWindowTag(e.target.value)}
+                placeholder="Tag (env=prod)"
+                className="w-36 px-3 py-2 border border-gray-300 rounded-md focus:ring-blue-500 focus:border-blue-500"
+              />
+            )}
+            <input
+              type="number"
+              min={1}
+              value={windowMinutes}
+              onChange={(e) => setWindowMinutes(Number(e.target.value))}
+              className="w-24 px-3 py-2 border border-gray-300 rounded-md focus:ring-blue-500 focus:border-blue-500"
+              title="Duration in minutes"
+            />
+            <button
+              onClick={handleCreateWindow}
+              disabled={!windowName.trim() || windowMinutes < 1 || createWindowMutation.isPending}
+              className="bg-blue-600 text-white px-4 py-2 rounded-md hover:bg-blue-700 disabled:opacity-50 flex items-center"
+            >
+              <Wrench className="h-4 w-4 mr-1" />
+              {createWindowMutation.isPending ? 'Scheduling...' : 'Start'}
+            </button>
+          </div>
+        </div>
+        <div className="divide-y divide-gray-200">
+          {currentWindows.map((maintenance: MaintenanceWindow) => (
+            <div key={maintenance.id} className="px-6 py-4">
+              <div className="flex items-center justify-between">
+                <div>
+                  <h3 className="text-sm font-medium text-gray-900">{maintenance.name}</h3>
+                  <p className="text-sm text-gray-500">
+                    {windowScope(maintenance)} &middot; {new Date(maintenance.starts_at + 'Z').toLocaleString()} - {new Date(maintenance.ends_at + 'Z').toLocaleString()}
+                  </p>
+                  <p className="text-xs text-gray-400 mt-1">by {maintenance.created_by || maintenance.source}</p>
+                </div>
+                <div className="flex items-center space-x-2">
+                  <span className={`inline-flex items-center px-2.5 py-0.5 rounded-full text-xs font-medium ${
+                    maintenance.active ? 'bg-yellow-100 text-yellow-800' : 'bg-blue-100 text-blue-800'
+                  }`}>
+                    {maintenance.active ? 'active' : 'scheduled'}
+                  </span>
+                  {maintenance.active && (
+                    <button
+                      onClick={() => endWindowMutation.mutate(maintenance.id)}
+                      disabled={endWindowMutation.isPending}
+                      className="text-sm text-blue-600 hover:text-blue-800 disabled:opacity-50"
+                    >
+                      End now
+                    </button>
+                  )}
+                </div>
+              </div>
+            </div>
+          ))}
+          {currentWindows.length === 0 && (
+            <div className="px-6 py-8 text-center text-gray-500">
+              No active or scheduled maintenance
+            </div>
+          )}
+        </div>
+      </div>
+
       {/* Recent Resolved Alerts */}
       {resolvedAlerts.length > 0 && (
         <div className="bg-white rounded-lg shadow">
@@ -68,6 +68,12 @@ export interface Command {
   server_id: number;
   command: string;
   status: string;
+  requested_by?: string;
+  approval_rule?: string;
+  reviewed_by?: string;
+  reviewed_at?: string;
+  review_note?: string;
+  script?: { id: number; version: number; sha256: string; args: string[] };
   exit_code?: number;
   stdout?: string;
   stderr?: string;
@@ -180,6 +186,18 @@ export interface AlertRule {
   created_at: string;
 }
 
+export interface MaintenanceWindow {
+  id: number;
+  name: string;
+  server_id?: number;
+  tag?: string;
+  starts_at: string;
+  ends_at: string;
+  source: string;
+  created_by?: string;
+  active: boolean;
+}
+
 // Auth API
 export const authAPI = {
   login: (data: LoginRequest) => {
@@ -203,10 +221,30 @@ export const serversAPI = {
   createServer: (data: any) => api.post<Server>('/api/servers', data),
   updateServer: (id: number, data: any) => api.put<Server>(`/api/servers/${id}`, data),
   deleteServer: (id: number) => api.delete(`/api/servers/${id}`),
+  getDuplicates: () => api.get('/api/servers/duplicates'),
+  renameServer: (id: number, data: { hostname: string; name?: string }) =>
+    api.post<Server>(`/api/servers/${id}/rename`, data),
+  mergeServers: (id: number, sourceIds: number[]) =>
+    api.post<Server>(`/api/servers/${id}/merge`, { source_ids: sourceIds }),
   getServerMetrics: (id: number, params?: any) => api.get(`/api/servers/${id}/metrics`, { params }),
   sendCommand: (id: number, command: string) => api.post<Command>(`/api/servers/${id}/command`, { command }),
   getServerCommands: (id: number, params?: any) => api.get<Command[]>(`/api/servers/${id}/commands`, { params }),
   getCommandStatus: (id: number) => api.get<Command>(`/api/commands/${id}/status`),
+  getCommandsAwaitingApproval: () => api.get<Command[]>('/api/servers/commands/awaiting-approval'),
+  approveCommand: (id: number, note?: string) => api.post<Command>(`/api/servers/commands/${id}/approve`, { note }),
+  rejectCommand: (id: number, note?: string) => api.post<Command>(`/api/servers/commands/${id}/reject`, { note }),
+  runScript: (id: number, data: { script_id: number; version?: number; args?: string[] }) =>
+    api.post<Command>(`/api/servers/${id}/run-script`, data),
+};
+
+// Scripts API
+export const scriptsAPI = {
+  getScripts: () => api.get('/api/scripts'),
+  getScript: (id: number) => api.get(`/api/scripts/${id}`),
+  createScript: (data: any) => api.post('/api/scripts', data),
+  addVersion: (id: number, data: any) => api.post(`/api/scripts/${id}/versions`, data),
+  getVersion: (id: number, version: number) => api.get(`/api/scripts/${id}/versions/${version}`),
+  deleteScript: (id: number) => api.delete(`/api/scripts/${id}`),
 };
 
 // Alerts API
@@ -220,6 +258,42 @@ export const alertsAPI = {
   deleteAlertRule: (id: number) => api.delete(`/api/alerts/rules/${id}`),
 };
 
+// Maintenance API
+export const maintenanceAPI = {
+  getWindows: (params?: any) => api.get<MaintenanceWindow[]>('/api/maintenance', { params }),
+  createWindow: (data: any) => api.post<MaintenanceWindow>('/api/maintenance', data),
+  updateWindow: (id: number, data: any) => api.put<MaintenanceWindow>(`/api/maintenance/${id}`, data),
+  endWindow: (id: number) => api.post<MaintenanceWindow>(`/api/maintenance/${id}/end`),
+  deleteWindow: (id: number) => api.delete(`/api/maintenance/${id}`),
+};
+
+// Archive API
+export const archiveAPI = {
+  getExports: (params?: any) => api.get('/api/archive', { params }),
+  getDay: (day: string, params?: any) => api.get(`/api/archive/${day}`, { params }),
+};
+
+// Enrollment API
+export const enrollmentAPI = {
+  getTokens: () => api.get('/api/enrollment/tokens'),
+  createToken: (data: any) => api.post('/api/enrollment/tokens', data),
+  deleteToken: (id: number) => api.delete(`/api/enrollment/tokens/${id}`),
+  getPending: (params?: any) => api.get('/api/enrollment/pending', { params }),
+  approve: (serverId: number) => api.post(`/api/enrollment/${serverId}/approve`),
+  reject: (serverId: number) => api.post(`/api/enrollment/${serverId}/reject`),
+};
+
+// Fleet API
+export const fleetAPI = {
+  getOverview: (params?: any) => api.get('/api/fleet/overview', { params }),
+  getHeatmap: (params?: any) => api.get('/api/fleet/heatmap', { params }),
+};
+
+// Metrics API
+export const metricsAPI = {
+  getDescriptors: (params?: any) => api.get('/api/metrics/descriptors', { params }),
+};
+
 // System API
 export const systemAPI = {
   getHealth: () => api.get<HealthStatus>('/health'),
@@ -3,14 +3,16 @@ Authentication module for JWT tokens and API key validation.
 """
 
 from datetime import datetime, timedelta
-from typing import Optional
-from fastapi import Depends, HTTPException, status
-from fastapi.security import HTTPBearer, HTTPAuthorizationCredentials
+from typing import List, Optional
+from fastapi import Depends, HTTPException, Request, status
+from fastapi.security import HTTPBearer, HTTPAuthorizationCredentials, HTTPBasic, HTTPBasicCredentials
 from jose import JWTError, jwt
 from passlib.context import CryptContext
 from sqlalchemy import select
 from sqlalchemy.ext.asyncio import AsyncSession
+import ipaddress
 import logging
+import re
 
 from core.config import settings
 from core.database import get_db
@@ -23,6 +25,8 @@ pwd_context = CryptContext(schemes=["bcrypt"], deprecated="auto")
 
 # JWT security
 security = HTTPBearer()
+optional_bearer = HTTPBearer(auto_error=False)
+optional_basic = HTTPBasic(auto_error=False)
 
 def verify_password(plain_password: str, hashed_password: str) -> bool:
     """Verify a password against its hash."""
@@ -49,10 +53,64 @@ def create_access_token(data: dict, expires_delta: Optional[timedelta] = None):
     encoded_jwt = jwt.encode(to_encode, SECRET_KEY, algorithm=ALGORITHM)
     return encoded_jwt
 
-def verify_api_key(api_key: str) -> bool:
+def verify_api_key(api_key: Optional[str]) -> bool:
     """Verify agent API key."""
     return api_key in settings.AGENT_API_KEYS
 
+def trusted_proxy(host: Optional[str], proxies: List[str], setting: str) -> bool:
+    """Whether host is one of proxies, or on loopback when there are none."""
+    try:
+        address = ipaddress.ip_address(host or "")
+    except ValueError:
+        return False
+    if not proxies:
+        return address.is_loopback
+    for proxy in proxies:
+        try:
+            if address in ipaddress.ip_network(proxy, strict=False):
+                return True
+        except ValueError:
+            logger.warning(f"Invalid {setting} entry: {proxy}")
+    return False
+
+def trusted_mtls_proxy(host: Optional[str]) -> bool:
+    """Whether the peer may report client certificates: one listed in
+    AGENT_MTLS_PROXIES, or a proxy on the same host when it is empty."""
+    return trusted_proxy(host, settings.AGENT_MTLS_PROXIES, "AGENT_MTLS_PROXIES")
+
+def client_address(request: Request) -> Optional[str]:
+    """The address the client connects from. Behind TRUSTED_PROXIES it is
+    the last X-Forwarded-For entry that is not one of them; entries before
+    it are whatever the client claimed."""
+    host = request.client.host if request.client else None
+    if not trusted_proxy(host, settings.TRUSTED_PROXIES, "TRUSTED_PROXIES"):
+        return host
+    forwarded = [entry.strip() for entry in ",".join(request.headers.getlist("x-forwarded-for")).split(",") if entry.strip()]
+    for entry in reversed(forwarded):
+        host = entry
+        if not trusted_proxy(host, settings.TRUSTED_PROXIES, "TRUSTED_PROXIES"):
+            break
+    return host
+
+def agent_certificate_cn(request: Request) -> Optional[str]:
+    """Common name of the agent's client certificate, if the proxy verified one."""
+    if settings.AGENT_MTLS == "off":
+        return None
+    if not trusted_mtls_proxy(request.client.host if request.client else None):
+        return None
+    if request.headers.get(settings.AGENT_MTLS_VERIFY_HEADER) != "SUCCESS":
+        return None
+    # RFC 2253 ("CN=web-1,O=Example") or legacy ("/O=Example/CN=web-1") subject
+    match = re.search(r"(?:^|[,/])\s*CN=([^,/]+)", request.headers.get(settings.AGENT_MTLS_SUBJECT_HEADER, ""))
+    return match.group(1).strip() if match else None
+
+def verify_agent(api_key: Optional[str], cert_cn: Optional[str]) -> bool:
+    """Verify an agent by client certificate or, unless AGENT_MTLS is
+    "required", by API key."""
+    if cert_cn:
+        return True
+    return settings.AGENT_MTLS != "required" and verify_api_key(api_key)
+
 async def authenticate_user(db: AsyncSession, username: str, password: str) -> Optional[User]:
     """Authenticate a user by username and password."""
     # Get user from database
@@ -113,7 +171,42 @@ def get_current_tenant_id(user: User = Depends(get_current_user)) -> str:
     """Get current tenant ID from authenticated user."""
     return user.tenant_id
 
+def get_current_admin(user: User = Depends(get_current_user)) -> User:
+    """Get current user, who must be an admin of their tenant."""
+    if user.role != "admin":
+        raise HTTPException(
+            status_code=status.HTTP_403_FORBIDDEN,
+            detail="Admin role required"
+        )
+    return user
+
 def get_agent_tenant_id(api_key: str) -> str:
     """Get tenant ID for agent based on API key."""
     # For now, use default tenant. In production, you might have a mapping
     return settings.DEFAULT_TENANT_ID
+
+async def get_integration_tenant_id(
+    bearer: Optional[HTTPAuthorizationCredentials] = Depends(optional_bearer),
+    basic: Optional[HTTPBasicCredentials] = Depends(optional_basic),
+    db: AsyncSession = Depends(get_db)
+) -> str:
+    """Get tenant ID for integrations such as Grafana, which authenticate as a
+    dashboard user with HTTP Basic credentials or a JWT token."""
+    user = None
+    if basic:
+        user = await authenticate_user(db, basic.username, basic.password)
+    elif bearer:
+        payload = verify_token(bearer.credentials)
+        if payload and payload.get("sub"):
+            result = await db.execute(
+                select(User).where(User.username == payload["sub"], User.is_active == True)
+            )
+            user = result.scalar_one_or_none()
+
+    if user is None:
+        raise HTTPException(
+            status_code=status.HTTP_401_UNAUTHORIZED,
+            detail="Could not validate credentials",
+            headers={"WWW-Authenticate": "Basic"},
+        )
+    return user.tenant_id
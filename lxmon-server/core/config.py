@@ -40,6 +40,132 @@ class Settings(BaseSettings):
         """Parse AGENT_API_KEYS from comma-separated string."""
         return [key.strip() for key in self.AGENT_API_KEYS_STR.split(",") if key.strip()]
 
+    # Agent client certificates (mTLS), verified by a TLS-terminating proxy
+    # (nginx "ssl_verify_client") that passes the result in headers. "off"
+    # ignores the headers, "optional" accepts a certificate whose CN is the
+    # agent's hostname in place of the API key, "required" accepts nothing
+    # else. The headers are only trusted from the proxies in
+    # AGENT_MTLS_PROXIES (IPs or CIDRs), or from loopback when it is empty.
+    AGENT_MTLS: str = os.getenv("AGENT_MTLS", "off")
+    AGENT_MTLS_VERIFY_HEADER: str = os.getenv("AGENT_MTLS_VERIFY_HEADER", "X-SSL-Client-Verify")
+    AGENT_MTLS_SUBJECT_HEADER: str = os.getenv("AGENT_MTLS_SUBJECT_HEADER", "X-SSL-Client-S-DN")
+    AGENT_MTLS_PROXIES_STR: str = os.getenv("AGENT_MTLS_PROXIES", "")
+
+    @property
+    def AGENT_MTLS_PROXIES(self) -> List[str]:
+        """Parse AGENT_MTLS_PROXIES from comma-separated string."""
+        return [proxy.strip() for proxy in self.AGENT_MTLS_PROXIES_STR.split(",") if proxy.strip()]
+
+    # The address an agent connects from, for enrollment subnets, is taken
+    # from X-Forwarded-For when the peer is one of TRUSTED_PROXIES (IPs or
+    # CIDRs), or loopback when it is empty.
+    TRUSTED_PROXIES_STR: str = os.getenv("TRUSTED_PROXIES", "")
+
+    @property
+    def TRUSTED_PROXIES(self) -> List[str]:
+        """Parse TRUSTED_PROXIES from comma-separated string."""
+        return [proxy.strip() for proxy in self.TRUSTED_PROXIES_STR.split(",") if proxy.strip()]
+
+    # Agent releases, as published by the agent's .goreleaser.yaml. Leave
+    # AGENT_LATEST_VERSION empty to not advertise any release.
+    AGENT_LATEST_VERSION: str = os.getenv("AGENT_LATEST_VERSION", "")
+    AGENT_RELEASE_URL: str = os.getenv("AGENT_RELEASE_URL", "https://github.com/eminbuyuk/lxmon/releases/download/v{version}")
+
+    # Metric quotas per host. A series is a metric type, name and metadata
+    # combination; hosts may send MAX_SERIES_PER_HOST distinct series per
+    # SERIES_WINDOW_HOURS (Server.series_limit overrides it per host). New
+    # series over the limit are dropped ("clip") or fail the whole payload
+    # ("reject").
+    MAX_METRICS_PER_PAYLOAD: int = int(os.getenv("MAX_METRICS_PER_PAYLOAD", "5000"))
+    MAX_SERIES_PER_HOST: int = int(os.getenv("MAX_SERIES_PER_HOST", "10000"))
+    SERIES_WINDOW_HOURS: int = int(os.getenv("SERIES_WINDOW_HOURS", "24"))
+    SERIES_QUOTA_MODE: str = os.getenv("SERIES_QUOTA_MODE", "clip")
+
+    # Agents gzip large request bodies once the server advertises support
+    # (Accept-Encoding on responses under /api/agent). Decompressed bodies are
+    # capped at AGENT_MAX_BODY_BYTES.
+    AGENT_GZIP: bool = os.getenv("AGENT_GZIP", "true").lower() == "true"
+    AGENT_MAX_BODY_BYTES: int = int(os.getenv("AGENT_MAX_BODY_BYTES", str(32 * 1024 * 1024)))
+
+    # Signed agent requests (X-LXMON-Signature) are verified and may be
+    # AGENT_SIGNATURE_MAX_AGE seconds old; "required" also rejects unsigned
+    # requests from agents without a client certificate, "optional" only
+    # those from hosts that signed before ("off" skips checks).
+    AGENT_SIGNATURES: str = os.getenv("AGENT_SIGNATURES", "optional")
+    AGENT_SIGNATURE_MAX_AGE: int = int(os.getenv("AGENT_SIGNATURE_MAX_AGE", "300"))
+
+    # Raw metrics are kept METRICS_RETENTION_DAYS. With ARCHIVE_S3_BUCKET
+    # set, each older day is first downsampled to ARCHIVE_RESOLUTION_MINUTES
+    # (avg/min/max per series) and exported to S3-compatible storage, where
+    # the Grafana API still finds it.
+    METRICS_RETENTION_DAYS: int = int(os.getenv("METRICS_RETENTION_DAYS", "30"))
+    ARCHIVE_S3_ENDPOINT: str = os.getenv("ARCHIVE_S3_ENDPOINT", "https://s3.amazonaws.com")
+    ARCHIVE_S3_BUCKET: str = os.getenv("ARCHIVE_S3_BUCKET", "")
+    ARCHIVE_S3_REGION: str = os.getenv("ARCHIVE_S3_REGION", "us-east-1")
+    ARCHIVE_S3_ACCESS_KEY: str = os.getenv("ARCHIVE_S3_ACCESS_KEY", "")
+    ARCHIVE_S3_SECRET_KEY: str = os.getenv("ARCHIVE_S3_SECRET_KEY", "")
+    ARCHIVE_S3_PREFIX: str = os.getenv("ARCHIVE_S3_PREFIX", "lxmon/")
+    ARCHIVE_RESOLUTION_MINUTES: int = int(os.getenv("ARCHIVE_RESOLUTION_MINUTES", "60"))
+
+    # New hosts registering with an enrollment token wait in a queue for an
+    # admin to approve them, unless the token auto-approves them. "open" also
+    # lets new hosts register with the API key alone, as before; "required"
+    # turns those away. Pending agents ask again every
+    # AGENT_ENROLLMENT_RETRY_SECONDS.
+    AGENT_ENROLLMENT: str = os.getenv("AGENT_ENROLLMENT", "open")
+    AGENT_ENROLLMENT_RETRY_SECONDS: int = int(os.getenv("AGENT_ENROLLMENT_RETRY_SECONDS", "60"))
+
+    # Agents send a heartbeat every heartbeat_interval (their own setting).
+    # A host is marked offline after missing AGENT_HEARTBEAT_MISSES of them,
+    # or after AGENT_OFFLINE_SECONDS without any for agents that send none.
+    # Statuses are checked every SERVER_STATUS_CHECK_SECONDS.
+    AGENT_HEARTBEAT_MISSES: int = int(os.getenv("AGENT_HEARTBEAT_MISSES", "3"))
+    AGENT_OFFLINE_SECONDS: int = int(os.getenv("AGENT_OFFLINE_SECONDS", "300"))
+    SERVER_STATUS_CHECK_SECONDS: int = int(os.getenv("SERVER_STATUS_CHECK_SECONDS", "10"))
+
+    # Longest maintenance window a host may open for itself with a
+    # maintenance marker; longer ones are cut to it.
+    AGENT_MAINTENANCE_MAX_SECONDS: int = int(os.getenv("AGENT_MAINTENANCE_MAX_SECONDS", str(24 * 3600)))
+
+    # Shell commands matching any of these regular expressions (comma-separated)
+    # wait for a second user with one of COMMAND_APPROVER_ROLES to approve
+    # them before they are queued for the agent.
+    COMMAND_APPROVAL_PATTERNS_STR: str = os.getenv(
+        "COMMAND_APPROVAL_PATTERNS",
+        r"\brm\s,\breboot\b,\bmkfs,\bshutdown\b,\bpoweroff\b,\bhalt\b,\bdd\s"
+    )
+    COMMAND_APPROVER_ROLES_STR: str = os.getenv("COMMAND_APPROVER_ROLES", "admin")
+
+    @property
+    def COMMAND_APPROVAL_PATTERNS(self) -> List[str]:
+        """Parse COMMAND_APPROVAL_PATTERNS from comma-separated string."""
+        return [pattern.strip() for pattern in self.COMMAND_APPROVAL_PATTERNS_STR.split(",") if pattern.strip()]
+
+    @property
+    def COMMAND_APPROVER_ROLES(self) -> List[str]:
+        """Parse COMMAND_APPROVER_ROLES from comma-separated string."""
+        return [role.strip() for role in self.COMMAND_APPROVER_ROLES_STR.split(",") if role.strip()]
+
+    # Users (comma-separated usernames) made admins of their tenant on start,
+    # with an audit entry. Registration never grants admin.
+    BOOTSTRAP_ADMINS_STR: str = os.getenv("BOOTSTRAP_ADMINS", "")
+
+    @property
+    def BOOTSTRAP_ADMINS(self) -> List[str]:
+        """Parse BOOTSTRAP_ADMINS from comma-separated string."""
+        return [username.strip() for username in self.BOOTSTRAP_ADMINS_STR.split(",") if username.strip()]
+
+    # Webhooks may only call public addresses, so tenants cannot reach the
+    # server's own network (metadata services, internal APIs). Networks in
+    # WEBHOOK_ALLOWED_NETWORKS (CIDRs) are allowed anyway, for receivers
+    # inside it.
+    WEBHOOK_ALLOWED_NETWORKS_STR: str = os.getenv("WEBHOOK_ALLOWED_NETWORKS", "")
+
+    @property
+    def WEBHOOK_ALLOWED_NETWORKS(self) -> List[str]:
+        """Parse WEBHOOK_ALLOWED_NETWORKS from comma-separated string."""
+        return [network.strip() for network in self.WEBHOOK_ALLOWED_NETWORKS_STR.split(",") if network.strip()]
+
     # Multi-tenant settings
     DEFAULT_TENANT_ID: str = "default"
 
@@ -2,6 +2,7 @@
 Database connection and session management using SQLAlchemy.
 """
 
+from sqlalchemy import text
 from sqlalchemy.ext.asyncio import AsyncSession, create_async_engine
 from sqlalchemy.orm import sessionmaker
 from sqlalchemy.pool import StaticPool
@@ -36,14 +37,74 @@ async def get_background_db_session() -> AsyncSession:
     """Get a database session for background tasks (returns session directly)."""
     return async_session()
 
+# Columns added to tables that existed in the first release. create_all only
+# creates missing tables, so databases created by an older server get these
+# with ADD COLUMN IF NOT EXISTS, which makes the upgrade safe on every start.
+ADDED_COLUMNS = {
+    "servers": [
+        ("agent_id", "VARCHAR(36)"),
+        ("hostname_pinned", "BOOLEAN DEFAULT FALSE"),
+        ("heartbeat_interval", "INTEGER"),
+        ("last_collection", "TIMESTAMP WITHOUT TIME ZONE"),
+        ("agent_version", "VARCHAR(50)"),
+        ("agent_commit", "VARCHAR(64)"),
+        ("agent_build_date", "VARCHAR(32)"),
+        ("agent_schema_version", "INTEGER"),
+        ("agent_capabilities", "JSON"),
+        ("agent_config", "JSON"),
+        ("series_limit", "INTEGER"),
+        ("tags", "JSON"),
+        ("enrollment", "VARCHAR(20) DEFAULT 'approved'"),
+        ("enrollment_token_id", "INTEGER REFERENCES enrollment_tokens (id) ON DELETE SET NULL"),
+    ],
+    "commands": [
+        ("control", "JSON"),
+        ("script", "JSON"),
+        ("requested_by", "VARCHAR(50)"),
+        ("approval_rule", "VARCHAR(200)"),
+        ("reviewed_by", "VARCHAR(50)"),
+        ("reviewed_at", "TIMESTAMP WITHOUT TIME ZONE"),
+        ("review_note", "TEXT"),
+    ],
+    "users": [
+        ("role", "VARCHAR(20) DEFAULT 'operator'"),
+    ],
+}
+
+# Indexes and constraints of those columns, named as create_all names them
+ADDED_INDEXES = [
+    "CREATE INDEX IF NOT EXISTS ix_servers_agent_id ON servers (agent_id)",
+    # Hostnames were unique across tenants; now they are within one
+    "CREATE UNIQUE INDEX IF NOT EXISTS servers_tenant_id_hostname_key ON servers (tenant_id, hostname)",
+    "CREATE INDEX IF NOT EXISTS ix_servers_hostname ON servers (hostname)",
+    "ALTER TABLE servers DROP CONSTRAINT IF EXISTS servers_hostname_key",
+]
+ADDED_UNIQUE_INDEXES = [
+    "CREATE UNIQUE INDEX IF NOT EXISTS servers_tenant_id_agent_id_key ON servers (tenant_id, agent_id)",
+]
+
 async def create_tables():
-    """Create all database tables."""
+    """Create all database tables, and upgrade those of an older server."""
     from models.models import Base
 
     try:
         async with engine.begin() as conn:
             await conn.run_sync(Base.metadata.create_all)
+            for table, columns in ADDED_COLUMNS.items():
+                for name, definition in columns:
+                    await conn.execute(text(f"ALTER TABLE {table} ADD COLUMN IF NOT EXISTS {name} {definition}"))
+            for statement in ADDED_INDEXES:
+                await conn.execute(text(statement))
         logger.info("Database tables created successfully")
     except Exception as e:
         logger.error(f"Error creating database tables: {e}")
         raise
+
+    # A database may hold hosts that share an agent ID from before it was
+    # unique. The server then starts without the index until they are merged.
+    for statement in ADDED_UNIQUE_INDEXES:
+        try:
+            async with engine.begin() as conn:
+                await conn.execute(text(statement))
+        except Exception as e:
+            logger.error(f"Cannot add a unique index, merge the duplicate hosts and restart: {statement}: {e}")
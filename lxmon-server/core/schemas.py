@@ -4,7 +4,7 @@ Pydantic schemas for API request/response models.
 
 from datetime import datetime
 from typing import Optional, List, Dict, Any
-from pydantic import BaseModel, Field
+from pydantic import AliasChoices, BaseModel, Field
 
 # Authentication schemas
 class UserCreate(BaseModel):
@@ -18,12 +18,16 @@ class UserResponse(BaseModel):
     username: str
     email: str
     is_active: bool
+    role: str = "operator"
     tenant_id: str
     created_at: datetime
 
     class Config:
         from_attributes = True
 
+class UserRoleUpdate(BaseModel):
+    role: str = Field(..., pattern="^(admin|operator)$")
+
 class Token(BaseModel):
     access_token: str
     token_type: str
@@ -45,6 +49,17 @@ class ServerUpdate(BaseModel):
     hostname: Optional[str] = None
     ip_address: Optional[str] = None
     status: Optional[str] = None
+    # Distinct series the host may send; null uses MAX_SERIES_PER_HOST
+    series_limit: Optional[int] = Field(None, ge=0)
+
+class ServerRename(BaseModel):
+    hostname: str = Field(..., min_length=1, max_length=255)
+    # Defaults to the new hostname if the name was the old one
+    name: Optional[str] = Field(None, min_length=1, max_length=100)
+
+class ServerMerge(BaseModel):
+    # Servers whose history moves into this one; they are deleted
+    source_ids: List[int] = Field(..., min_length=1)
 
 class ServerResponse(ServerBase):
     id: int
@@ -52,6 +67,17 @@ class ServerResponse(ServerBase):
     tenant_id: str
     status: str
     last_heartbeat: Optional[datetime]
+    heartbeat_interval: Optional[int] = None
+    last_collection: Optional[datetime] = None
+    agent_version: Optional[str] = None
+    agent_commit: Optional[str] = None
+    agent_build_date: Optional[str] = None
+    agent_schema_version: Optional[int] = None
+    agent_capabilities: Optional[List[str]] = None
+    series_limit: Optional[int] = None
+    tags: Optional[Dict[str, str]] = None
+    agent_id: Optional[str] = None
+    hostname_pinned: Optional[bool] = None
     created_at: datetime
     updated_at: datetime
 
@@ -62,33 +88,228 @@ class ServerResponse(ServerBase):
 class AgentRegister(BaseModel):
     hostname: str
     ip_address: Optional[str] = None
-    api_key: str
+    # Optional for agents authenticating with a client certificate
+    api_key: Optional[str] = None
+    # Durable ID of the agent installation; survives hostname changes
+    agent_id: Optional[str] = Field(None, max_length=36)
+    agent_version: Optional[str] = None
+    agent_commit: Optional[str] = None
+    agent_build_date: Optional[str] = None
+    # Needed by new hosts when AGENT_ENROLLMENT is "required"
+    enrollment_token: Optional[str] = None
+    tags: Optional[Dict[str, str]] = None
+    # Protocol version and optional features of the agent; older agents
+    # send neither
+    schema_version: Optional[int] = None
+    capabilities: Optional[List[str]] = None
 
 class AgentHeartbeat(BaseModel):
     hostname: str
+    # "online", or "collection_stalled" while the agent runs but collects nothing
     status: str = "online"
+    agent_version: Optional[str] = None
+    uptime_seconds: Optional[float] = None
+    interval_seconds: Optional[float] = Field(None, gt=0, le=3600)
+    last_collection: Optional[datetime] = None
+
+class CrashReportData(BaseModel):
+    hostname: str
+    crashed_at: datetime
+    panic: str = Field(..., max_length=4096)
+    stack: Optional[str] = Field(None, max_length=256 * 1024)
+    go_version: Optional[str] = Field(None, max_length=32)
+    config: Optional[Dict[str, Any]] = None
+    last_cycle: Optional[Dict[str, Any]] = None
+    goroutines: Optional[int] = None
+
+class CrashReportResponse(BaseModel):
+    id: int
+    server_id: int
+    crashed_at: datetime
+    panic: str
+    stack: Optional[str]
+    go_version: Optional[str]
+    agent_version: Optional[str]
+    agent_config: Optional[Dict[str, Any]]
+    last_cycle: Optional[Dict[str, Any]]
+    goroutines: Optional[int]
+    received_at: datetime
+
+    class Config:
+        from_attributes = True
 
 class MetricData(BaseModel):
     metric_type: str  # cpu, memory, disk, network
     metric_name: str
     value: float
     unit: Optional[str] = None
-    metric_metadata: Optional[Dict[str, Any]] = None
+    # The agent sends this as "metadata"
+    metric_metadata: Optional[Dict[str, Any]] = Field(
+        None, validation_alias=AliasChoices("metric_metadata", "metadata")
+    )
+    # When the agent collected it; metrics replayed after an outage are
+    # stored at this time
+    timestamp: Optional[datetime] = None
 
 class MetricsPayload(BaseModel):
     hostname: str
     metrics: List[MetricData]
-    api_key: str
+    api_key: Optional[str] = None
+    tags: Optional[Dict[str, str]] = None
+    # Continuation markers of a payload the agent sent in several requests
+    batch_id: Optional[str] = Field(None, max_length=36)
+    part: Optional[int] = Field(None, ge=1)
+    parts: Optional[int] = Field(None, ge=1)
+
+class MetricDescriptorData(BaseModel):
+    metric_type: str
+    metric_name: str
+    description: Optional[str] = None
+    unit: Optional[str] = None
+    kind: Optional[str] = None  # gauge, counter, state
+
+class MetricRegistryPayload(BaseModel):
+    hostname: str
+    api_key: Optional[str] = None
+    agent_version: Optional[str] = None
+    metrics: List[MetricDescriptorData]
+
+class MetricDescriptorResponse(MetricDescriptorData):
+    id: int
+    agent_version: Optional[str]
+    updated_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class AgentConfig(BaseModel):
+    # Agent setting keys (as in the agent's config file) to values, e.g.
+    # {"interval": "30s", "collectors": {"flows": true}}
+    settings: Dict[str, Any] = {}
+
+class AgentLatestVersion(BaseModel):
+    version: str
+    update_available: bool
+    # Archive for the requesting agent's platform and the release's sha256
+    # checksums file
+    url: str
+    checksums_url: str
 
 # Command schemas
 class CommandCreate(BaseModel):
     command: str = Field(..., min_length=1)
 
+class ScriptCreate(BaseModel):
+    name: str = Field(..., min_length=1, max_length=100)
+    description: Optional[str] = None
+    content: str = Field(..., min_length=1)
+    changelog: Optional[str] = None
+
+class ScriptVersionCreate(BaseModel):
+    content: str = Field(..., min_length=1)
+    changelog: Optional[str] = None
+
+class ScriptVersionResponse(BaseModel):
+    version: int
+    sha256: str
+    changelog: Optional[str]
+    created_by: Optional[str]
+    created_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class ScriptVersionContent(ScriptVersionResponse):
+    content: str
+
+class ScriptResponse(BaseModel):
+    id: int
+    name: str
+    description: Optional[str]
+    latest_version: int
+    sha256: str
+    created_at: datetime
+    updated_at: datetime
+    versions: List[ScriptVersionResponse] = []
+
+class ScriptRun(BaseModel):
+    script_id: int
+    # Latest version when omitted
+    version: Optional[int] = None
+    args: List[str] = []
+
+class CommandReview(BaseModel):
+    note: Optional[str] = None
+
+class EnrollmentTokenCreate(BaseModel):
+    name: str = Field(..., min_length=1, max_length=100)
+    # Hosts connecting from these CIDRs, and reporting all these tags if any,
+    # are approved without waiting for an admin
+    auto_approve_subnets: List[str] = []
+    auto_approve_tags: Dict[str, str] = {}
+    max_uses: Optional[int] = Field(None, ge=1)
+    expires_in_hours: Optional[int] = Field(None, ge=1)
+
+class EnrollmentTokenResponse(BaseModel):
+    id: int
+    name: str
+    auto_approve_subnets: Optional[List[str]]
+    auto_approve_tags: Optional[Dict[str, str]]
+    max_uses: Optional[int]
+    uses: int
+    expires_at: Optional[datetime]
+    created_by: Optional[str]
+    created_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class EnrollmentTokenCreated(EnrollmentTokenResponse):
+    # Only returned when the token is created
+    token: str
+
+class PendingEnrollment(BaseModel):
+    id: int
+    hostname: str
+    ip_address: Optional[str]
+    tags: Optional[Dict[str, str]]
+    agent_version: Optional[str]
+    enrollment: str
+    enrollment_token_id: Optional[int]
+    created_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class AuditLogResponse(BaseModel):
+    id: int
+    actor: str
+    action: str
+    target_type: str
+    target_id: Optional[int]
+    details: Optional[Dict[str, Any]]
+    created_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class LogLevelControl(BaseModel):
+    # debug, info, warn or error; the agent reverts after duration_minutes
+    level: str = Field(..., pattern="^(debug|info|warn|error)$")
+    duration_minutes: int = Field(15, ge=1, le=1440)
+
 class CommandResponse(BaseModel):
     id: int
     server_id: int
     command: str
+    control: Optional[Dict[str, Any]] = None
+    script: Optional[Dict[str, Any]] = None
     status: str
+    requested_by: Optional[str] = None
+    approval_rule: Optional[str] = None
+    reviewed_by: Optional[str] = None
+    reviewed_at: Optional[datetime] = None
+    review_note: Optional[str] = None
     exit_code: Optional[int]
     stdout: Optional[str]
     stderr: Optional[str]
@@ -146,3 +367,72 @@ class AlertResponse(BaseModel):
 
     class Config:
         from_attributes = True
+
+class MaintenanceWindowCreate(BaseModel):
+    name: str = Field(..., min_length=1, max_length=200)
+    # One host, or the hosts tagged key=value; neither means every host
+    server_id: Optional[int] = None
+    tag: Optional[str] = Field(None, pattern=r"^[^=]+=.*$")
+    # Defaults to now
+    starts_at: Optional[datetime] = None
+    # ends_at, or starts_at plus duration_minutes
+    ends_at: Optional[datetime] = None
+    duration_minutes: Optional[int] = Field(None, ge=1)
+
+class MaintenanceWindowUpdate(BaseModel):
+    name: Optional[str] = None
+    starts_at: Optional[datetime] = None
+    ends_at: Optional[datetime] = None
+
+class MaintenanceWindowResponse(BaseModel):
+    id: int
+    name: str
+    server_id: Optional[int]
+    tag: Optional[str]
+    starts_at: datetime
+    ends_at: datetime
+    source: str
+    created_by: Optional[str]
+    tenant_id: str
+    created_at: datetime
+    active: bool = False
+
+    class Config:
+        from_attributes = True
+
+class WebhookBase(BaseModel):
+    name: str = Field(..., min_length=1, max_length=100)
+    url: str = Field(..., pattern=r"^https?://", max_length=500)
+    events: List[str] = Field(default_factory=lambda: ["alert.triggered", "alert.resolved"], min_length=1)
+    body_template: Optional[str] = None
+    headers: Dict[str, str] = Field(default_factory=dict)
+
+class WebhookCreate(WebhookBase):
+    secret: Optional[str] = None
+
+class WebhookUpdate(BaseModel):
+    name: Optional[str] = None
+    url: Optional[str] = Field(None, pattern=r"^https?://", max_length=500)
+    events: Optional[List[str]] = None
+    body_template: Optional[str] = None
+    headers: Optional[Dict[str, str]] = None
+    secret: Optional[str] = None
+    enabled: Optional[bool] = None
+
+class WebhookResponse(WebhookBase):
+    id: int
+    enabled: bool
+    tenant_id: str
+    last_status: Optional[int]
+    last_error: Optional[str]
+    last_delivery_at: Optional[datetime]
+    created_at: datetime
+
+    class Config:
+        from_attributes = True
+
+class WebhookTestResult(BaseModel):
+    ok: bool
+    status: Optional[int]
+    error: Optional[str]
+    attempts: int
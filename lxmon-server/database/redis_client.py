@@ -106,6 +106,47 @@ class RedisClient:
             logger.error(f"Error popping command: {e}")
             return None
 
+    async def wait_command(self, server_id: int, timeout: int, holding: str) -> Optional[dict]:
+        """Move a command from server's command queue to the holding list,
+        waiting up to timeout seconds for one to be queued. It stays there
+        until forget_commands or release_commands, so a caller stopped
+        half-way loses nothing."""
+        if not self.client:
+            await self.connect()
+
+        queue_key = f"commands:{server_id}"
+        try:
+            result = await self.client.blmove(queue_key, holding, timeout, src="RIGHT", dest="LEFT")
+            if result:
+                return json.loads(result)
+            return None
+        except Exception as e:
+            logger.error(f"Error waiting for command: {e}")
+            return None
+
+    async def forget_commands(self, holding: str):
+        """Drop the commands of a holding list once they were handed out."""
+        if not self.client:
+            await self.connect()
+
+        try:
+            await self.client.delete(holding)
+        except Exception as e:
+            logger.error(f"Error forgetting held commands: {e}")
+
+    async def release_commands(self, server_id: int, holding: str):
+        """Put the commands of a holding list back at the front of server's
+        command queue, oldest first."""
+        if not self.client:
+            await self.connect()
+
+        queue_key = f"commands:{server_id}"
+        try:
+            while await self.client.lmove(holding, queue_key, src="LEFT", dest="RIGHT") is not None:
+                pass
+        except Exception as e:
+            logger.error(f"Error releasing held commands: {e}")
+
     async def get_command_count(self, server_id: int) -> int:
         """Get number of pending commands for server."""
         if not self.client:
@@ -118,6 +159,68 @@ class RedisClient:
             logger.error(f"Error getting command count: {e}")
             return 0
 
+    async def track_series(self, server_id: int, series: list, limit: int, ttl: int) -> tuple:
+        """Record the series a host sent. Series already known are always
+        accepted; new ones only while the host stays within limit. Returns
+        the accepted series and the host's series count."""
+        if not self.client:
+            await self.connect()
+
+        key = f"series:{server_id}"
+        try:
+            known = await self.client.smismember(key, series) if series else []
+            count = await self.client.scard(key)
+            accepted = set()
+            new = []
+            for member, is_known in zip(series, known):
+                if is_known:
+                    accepted.add(member)
+                elif member not in accepted and count + len(new) < limit:
+                    new.append(member)
+                    accepted.add(member)
+            if new:
+                await self.client.sadd(key, *new)
+                await self.client.expire(key, ttl)
+            return accepted, count + len(new)
+        except Exception as e:
+            # Without Redis, do not hold back metrics
+            logger.error(f"Error tracking series: {e}")
+            return set(series), 0
+
+    async def remember_signature(self, signature: str, ttl: int) -> bool:
+        """Record a request signature. Returns False if it was seen before."""
+        if not self.client:
+            await self.connect()
+
+        try:
+            return bool(await self.client.set(f"signature:{signature}", 1, nx=True, ex=ttl))
+        except Exception as e:
+            # Without Redis, replays cannot be detected; do not hold back agents
+            logger.error(f"Error recording signature: {e}")
+            return True
+
+    async def remember_signing_host(self, host: str, ttl: int):
+        """Record that a host signs its requests."""
+        if not self.client:
+            await self.connect()
+
+        try:
+            await self.client.set(f"signing_host:{host}", 1, ex=ttl)
+        except Exception as e:
+            logger.error(f"Error recording signing host: {e}")
+
+    async def signing_host(self, host: str) -> bool:
+        """Whether a host signed a request within the TTL it was recorded with."""
+        if not self.client:
+            await self.connect()
+
+        try:
+            return bool(await self.client.exists(f"signing_host:{host}"))
+        except Exception as e:
+            # Without Redis, fall back to AGENT_SIGNATURES alone
+            logger.error(f"Error checking signing host: {e}")
+            return False
+
     async def get_info(self) -> dict:
         """Get Redis server information."""
         if not self.client:
@@ -14,8 +14,11 @@ from datetime import datetime, timedelta
 
 from core.config import settings
 from core.database import create_tables, get_db
+from utils.bootstrap import bootstrap_admins
 from middleware.rate_limit import RateLimitMiddleware
-from routers import agents, servers, auth, alerts
+from middleware.compression import GzipRequestMiddleware
+from middleware.signature import SignatureMiddleware
+from routers import agents, servers, auth, alerts, grafana, webhooks, maintenance, audit, scripts, fleet, archive, enrollment, metric_descriptors
 from database.redis_client import redis_client
 from utils.exceptions import LxmonException, create_error_response
 from utils.background_tasks import background_tasks
@@ -35,6 +38,7 @@ async def lifespan(app: FastAPI):
 
     # Create database tables
     await create_tables()
+    await bootstrap_admins()
 
     # Test Redis connection
     try:
@@ -117,6 +121,9 @@ app = FastAPI(
 
 # Add custom middleware
 app.add_middleware(RateLimitMiddleware)
+# Signatures cover the decompressed body, so GzipRequestMiddleware runs first
+app.add_middleware(SignatureMiddleware)
+app.add_middleware(GzipRequestMiddleware)
 
 # CORS middleware
 app.add_middleware(
@@ -459,6 +466,15 @@ app.include_router(auth.router, prefix="/api/auth", tags=["Authentication"])
 app.include_router(agents.router, prefix="/api/agent", tags=["Agent"])
 app.include_router(servers.router, prefix="/api/servers", tags=["Servers"])
 app.include_router(alerts.router, prefix="/api/alerts", tags=["Alerts"])
+app.include_router(grafana.router, prefix="/api/grafana", tags=["Grafana"])
+app.include_router(webhooks.router, prefix="/api/webhooks", tags=["Webhooks"])
+app.include_router(maintenance.router, prefix="/api/maintenance", tags=["Maintenance"])
+app.include_router(audit.router, prefix="/api/audit", tags=["Audit"])
+app.include_router(scripts.router, prefix="/api/scripts", tags=["Scripts"])
+app.include_router(fleet.router, prefix="/api/fleet", tags=["Fleet"])
+app.include_router(archive.router, prefix="/api/archive", tags=["Archive"])
+app.include_router(enrollment.router, prefix="/api/enrollment", tags=["Enrollment"])
+app.include_router(metric_descriptors.router, prefix="/api/metrics", tags=["Metrics"])
 
 if __name__ == "__main__":
     uvicorn.run(
@@ -0,0 +1,35 @@
+"""
+Administration commands run next to the server, with its settings:
+
+    python manage.py make-admin <username>
+"""
+
+import argparse
+import asyncio
+import sys
+
+from utils.bootstrap import make_admin
+from core.database import async_session
+
+async def run_make_admin(username: str) -> int:
+    async with async_session() as db:
+        user = await make_admin(db, username, "cli:make-admin")
+        await db.commit()
+    if not user:
+        print(f"No active user {username}", file=sys.stderr)
+        return 1
+    print(f"{user.username} is an admin of tenant {user.tenant_id}")
+    return 0
+
+def main() -> int:
+    parser = argparse.ArgumentParser(prog="manage.py")
+    commands = parser.add_subparsers(dest="command", required=True)
+    make = commands.add_parser("make-admin", help="make a user an admin of its tenant")
+    make.add_argument("username")
+    args = parser.parse_args()
+    if args.command == "make-admin":
+        return asyncio.run(run_make_admin(args.username))
+    return 2
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,112 @@
+"""
+Decompression of gzip request bodies from agents.
+
+Responses under /api/agent carry Accept-Encoding (RFC 7694) to tell agents
+which request codings the server takes. Agents only compress once they have
+seen it, so old agents and old servers keep talking uncompressed.
+"""
+
+import zlib
+from datetime import datetime
+
+from starlette.datastructures import Headers, MutableHeaders
+from starlette.responses import JSONResponse
+
+from core.config import settings
+
+AGENT_PREFIX = "/api/agent/"
+
+
+def error_response(status_code: int, error_code: str, message: str) -> JSONResponse:
+    return JSONResponse(
+        status_code=status_code,
+        content={
+            "error_code": error_code,
+            "message": message,
+            "timestamp": datetime.utcnow().isoformat()
+        },
+        headers={"Accept-Encoding": accepted_encodings()}
+    )
+
+
+def accepted_encodings() -> str:
+    return "gzip" if settings.AGENT_GZIP else "identity"
+
+
+def gunzip(body: bytes, limit: int) -> bytes:
+    """Decompress a gzip body; raises ValueError if it is invalid or
+    decompresses to more than limit bytes."""
+    decompressor = zlib.decompressobj(16 + zlib.MAX_WBITS)
+    try:
+        data = decompressor.decompress(body, limit + 1)
+    except zlib.error as e:
+        raise ValueError(f"invalid gzip body: {e}")
+    if len(data) > limit or decompressor.unconsumed_tail:
+        raise OverflowError(f"decompressed body exceeds {limit} bytes")
+    if not decompressor.eof:
+        raise ValueError("truncated gzip body")
+    return data
+
+
+class GzipRequestMiddleware:
+    """Decompress Content-Encoding: gzip request bodies sent to agent endpoints."""
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not scope["path"].startswith(AGENT_PREFIX):
+            await self.app(scope, receive, send)
+            return
+
+        async def send_with_accept_encoding(message):
+            if message["type"] == "http.response.start":
+                headers = MutableHeaders(scope=message)
+                if "accept-encoding" not in headers:
+                    headers.append("Accept-Encoding", accepted_encodings())
+            await send(message)
+
+        encoding = Headers(scope=scope).get("content-encoding", "").strip().lower()
+        if encoding in ("", "identity"):
+            await self.app(scope, receive, send_with_accept_encoding)
+            return
+        if encoding != "gzip" or not settings.AGENT_GZIP:
+            response = error_response(415, "UNSUPPORTED_ENCODING", f"Content-Encoding {encoding} is not accepted")
+            await response(scope, receive, send)
+            return
+
+        chunks = []
+        more_body = True
+        while more_body:
+            message = await receive()
+            if message["type"] == "http.disconnect":
+                return
+            chunks.append(message.get("body", b""))
+            more_body = message.get("more_body", False)
+
+        try:
+            body = gunzip(b"".join(chunks), settings.AGENT_MAX_BODY_BYTES)
+        except OverflowError as e:
+            await error_response(413, "PAYLOAD_TOO_LARGE", str(e))(scope, receive, send)
+            return
+        except ValueError as e:
+            await error_response(400, "INVALID_ENCODING", str(e))(scope, receive, send)
+            return
+
+        headers = [
+            (name, value) for name, value in scope["headers"]
+            if name not in (b"content-encoding", b"content-length")
+        ]
+        headers.append((b"content-length", str(len(body)).encode()))
+        scope = dict(scope, headers=headers)
+
+        delivered = False
+
+        async def receive_decompressed():
+            nonlocal delivered
+            if not delivered:
+                delivered = True
+                return {"type": "http.request", "body": body, "more_body": False}
+            return await receive()
+
+        await self.app(scope, receive_decompressed, send_with_accept_encoding)
@@ -0,0 +1,179 @@
+"""
+Verification of signed agent requests.
+
+Agents sign each request with X-LXMON-Timestamp and X-LXMON-Signature
+("v1=" and the hex HMAC-SHA256 of "<timestamp>\\n<method>\\n<path?query>\\n<body>"
+under HMAC-SHA256(api_key, "lxmon-request-signing")). The path is taken from
+/api/ on, and the body is the one after gzip decoding. A signature is
+accepted once, and only within AGENT_SIGNATURE_MAX_AGE seconds of its
+timestamp, so a captured request cannot be replayed. The handshake of the
+command channel WebSocket is signed like any GET.
+
+A signature is checked against the API key the request claims (X-API-Key,
+or api_key in the body), and a host, by that key and its hostname, that has
+signed a request must keep signing even where AGENT_SIGNATURES is
+"optional", so a stripped signature does not pass as an older agent.
+"""
+
+import hashlib
+import hmac
+import json
+import logging
+import time
+from datetime import datetime
+from typing import Optional
+from urllib.parse import parse_qs
+
+from starlette.datastructures import Headers
+from starlette.requests import HTTPConnection
+from starlette.responses import JSONResponse
+from starlette.websockets import WebSocketClose
+
+from core.auth import agent_certificate_cn
+from core.config import settings
+from database.redis_client import redis_client
+
+logger = logging.getLogger(__name__)
+
+AGENT_PREFIX = "/api/agent/"
+
+# How long a host that signed a request must keep signing
+SIGNING_HOST_TTL = 30 * 24 * 3600
+
+
+def reject(scope, error_code: str, message: str):
+    if scope["type"] == "websocket":
+        # Closing before the handshake is accepted answers it with a 403
+        return WebSocketClose(code=1008, reason=message)
+    return JSONResponse(
+        status_code=401,
+        content={
+            "error_code": error_code,
+            "message": message,
+            "timestamp": datetime.utcnow().isoformat()
+        }
+    )
+
+
+def signed_path(scope) -> str:
+    path = (scope.get("raw_path") or scope["path"].encode()).decode("latin-1")
+    index = path.find("/api/")
+    if index > 0:
+        path = path[index:]
+    query = scope.get("query_string", b"").decode("latin-1")
+    return f"{path}?{query}" if query else path
+
+
+def request_signature(api_key: str, timestamp: str, method: str, path: str, body: bytes) -> str:
+    signing_key = hmac.new(api_key.encode(), b"lxmon-request-signing", hashlib.sha256).digest()
+    message = f"{timestamp}\n{method}\n{path}\n".encode() + body
+    return hmac.new(signing_key, message, hashlib.sha256).hexdigest()
+
+
+def claimed_identity(scope, headers: Headers, body: bytes) -> tuple:
+    """The API key and hostname a request claims, from its headers and query
+    or, for the agent's POSTs, its JSON body. Either may be None."""
+    query = parse_qs(scope.get("query_string", b"").decode("latin-1"))
+    api_key = headers.get("x-api-key")
+    hostname = (query.get("hostname") or [None])[0]
+    if body and (api_key is None or hostname is None):
+        try:
+            document = json.loads(body)
+        except ValueError:
+            document = None
+        if isinstance(document, dict):
+            if api_key is None and isinstance(document.get("api_key"), str):
+                api_key = document["api_key"]
+            if hostname is None and isinstance(document.get("hostname"), str):
+                hostname = document["hostname"]
+    return api_key, hostname
+
+
+def signing_host(api_key: str, hostname: str) -> str:
+    """The Redis name of a host, which keeps the API key out of Redis."""
+    return hashlib.sha256(f"{api_key}\n{hostname}".encode()).hexdigest()
+
+
+def signature_valid(signature: str, api_key: Optional[str], timestamp: str, method: str, path: str, body: bytes) -> bool:
+    """Whether signature was made with api_key, one of the agent API keys."""
+    if not signature.startswith("v1=") or api_key not in settings.AGENT_API_KEYS:
+        return False
+    return hmac.compare_digest(signature[len("v1="):], request_signature(api_key, timestamp, method, path, body))
+
+
+class SignatureMiddleware:
+    """Verify signatures on requests to agent endpoints (AGENT_SIGNATURES:
+    "off", "optional" to let unsigned requests through from hosts that have
+    never signed, or "required")."""
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] not in ("http", "websocket") or not scope["path"].startswith(AGENT_PREFIX) or settings.AGENT_SIGNATURES == "off":
+            await self.app(scope, receive, send)
+            return
+
+        chunks = []
+        more_body = scope["type"] == "http"
+        while more_body:
+            message = await receive()
+            if message["type"] == "http.disconnect":
+                return
+            chunks.append(message.get("body", b""))
+            more_body = message.get("more_body", False)
+        body = b"".join(chunks)
+
+        headers = Headers(scope=scope)
+        signature = headers.get("x-lxmon-signature")
+        timestamp = headers.get("x-lxmon-timestamp", "")
+        api_key, hostname = claimed_identity(scope, headers, body)
+        if not signature:
+            # Agents authenticated by client certificate have no key to sign with
+            if not agent_certificate_cn(HTTPConnection(scope)):
+                if settings.AGENT_SIGNATURES == "required":
+                    await reject(scope, "SIGNATURE_REQUIRED", "Request must be signed")(scope, receive, send)
+                    return
+                if api_key and hostname and await redis_client.signing_host(signing_host(api_key, hostname)):
+                    logger.warning(f"Rejected unsigned request to {scope['path']} from {hostname}, which signed before")
+                    await reject(scope, "SIGNATURE_REQUIRED", "Request must be signed: this host signed its requests before")(scope, receive, send)
+                    return
+        else:
+            try:
+                age = abs(time.time() - int(timestamp))
+            except ValueError:
+                await reject(scope, "INVALID_SIGNATURE", "Invalid X-LXMON-Timestamp")(scope, receive, send)
+                return
+            if age > settings.AGENT_SIGNATURE_MAX_AGE:
+                await reject(
+                    scope,
+                    "SIGNATURE_EXPIRED",
+                    f"Request timestamp is {int(age)}s off the server clock (at most {settings.AGENT_SIGNATURE_MAX_AGE}s allowed)"
+                )(scope, receive, send)
+                return
+
+            if not signature_valid(signature, api_key, timestamp, scope.get("method", "GET"), signed_path(scope), body):
+                logger.warning(f"Rejected request to {scope['path']} with an invalid signature")
+                await reject(scope, "INVALID_SIGNATURE", "Request signature does not match")(scope, receive, send)
+                return
+            if not await redis_client.remember_signature(signature, settings.AGENT_SIGNATURE_MAX_AGE * 2):
+                logger.warning(f"Rejected replayed request to {scope['path']}")
+                await reject(scope, "REPLAYED_REQUEST", "Request was already received")(scope, receive, send)
+                return
+            if hostname:
+                await redis_client.remember_signing_host(signing_host(api_key, hostname), SIGNING_HOST_TTL)
+
+        if scope["type"] == "websocket":
+            await self.app(scope, receive, send)
+            return
+
+        delivered = False
+
+        async def receive_body():
+            nonlocal delivered
+            if not delivered:
+                delivered = True
+                return {"type": "http.request", "body": body, "more_body": False}
+            return await receive()
+
+        await self.app(scope, receive_body, send)
@@ -3,7 +3,7 @@ Database models for lxmon-server using SQLAlchemy.
 """
 
 from datetime import datetime
-from sqlalchemy import Column, Integer, String, DateTime, Text, Float, Boolean, ForeignKey, JSON
+from sqlalchemy import Column, Integer, String, DateTime, Date, Text, Float, Boolean, ForeignKey, JSON, UniqueConstraint
 from sqlalchemy.ext.declarative import declarative_base
 from sqlalchemy.orm import relationship
 
@@ -12,21 +12,37 @@ Base = declarative_base()
 class Server(Base):
     """Server model representing monitored servers."""
     __tablename__ = "servers"
+    __table_args__ = (UniqueConstraint("tenant_id", "agent_id"), UniqueConstraint("tenant_id", "hostname"))
 
     id = Column(Integer, primary_key=True, index=True)
     name = Column(String(100), nullable=False)
-    hostname = Column(String(255), nullable=False, unique=True)
+    hostname = Column(String(255), nullable=False, index=True)
     ip_address = Column(String(45))
     agent_api_key = Column(String(255), nullable=False)
+    agent_id = Column(String(36), nullable=True, index=True)  # The agent's durable ID
+    hostname_pinned = Column(Boolean, default=False)  # Renamed by an admin; agents keep their own name
     tenant_id = Column(String(50), default="default", index=True)
     status = Column(String(20), default="offline")  # online, offline, unknown
     last_heartbeat = Column(DateTime, nullable=True)
+    heartbeat_interval = Column(Integer, nullable=True)  # Seconds between the agent's heartbeats
+    last_collection = Column(DateTime, nullable=True)  # Last collection cycle the agent completed
+    agent_version = Column(String(50), nullable=True)
+    agent_commit = Column(String(64), nullable=True)
+    agent_build_date = Column(String(32), nullable=True)
+    agent_schema_version = Column(Integer, nullable=True)  # Protocol version the agent speaks
+    agent_capabilities = Column(JSON, nullable=True)  # Optional features the agent can use
+    agent_config = Column(JSON, nullable=True)  # Settings pushed to the agent
+    series_limit = Column(Integer, nullable=True)  # Overrides MAX_SERIES_PER_HOST
+    tags = Column(JSON, nullable=True)  # Tags the agent last reported
+    enrollment = Column(String(20), default="approved")  # approved, pending, rejected
+    enrollment_token_id = Column(Integer, ForeignKey("enrollment_tokens.id", ondelete="SET NULL"), nullable=True)
     created_at = Column(DateTime, default=datetime.utcnow)
     updated_at = Column(DateTime, default=datetime.utcnow, onupdate=datetime.utcnow)
 
     # Relationships
     metrics = relationship("Metric", back_populates="server", cascade="all, delete-orphan")
     commands = relationship("Command", back_populates="server", cascade="all, delete-orphan")
+    crash_reports = relationship("CrashReport", back_populates="server", cascade="all, delete-orphan")
 
 class Metric(Base):
     """Metrics collected from servers."""
@@ -51,7 +67,14 @@ class Command(Base):
     id = Column(Integer, primary_key=True, index=True)
     server_id = Column(Integer, ForeignKey("servers.id"), nullable=False)
     command = Column(Text, nullable=False)
-    status = Column(String(20), default="pending")  # pending, running, completed, failed, timeout
+    control = Column(JSON, nullable=True)  # structured agent control, run instead of a shell command
+    script = Column(JSON, nullable=True)  # script library reference (id, version, sha256, args) run instead of command
+    status = Column(String(20), default="pending")  # awaiting_approval, rejected, pending, running, completed, failed, timeout
+    requested_by = Column(String(50), nullable=True)
+    approval_rule = Column(String(200), nullable=True)  # dangerous pattern that required approval
+    reviewed_by = Column(String(50), nullable=True)
+    reviewed_at = Column(DateTime, nullable=True)
+    review_note = Column(Text, nullable=True)
     exit_code = Column(Integer, nullable=True)
     stdout = Column(Text)
     stderr = Column(Text)
@@ -62,6 +85,36 @@ class Command(Base):
     # Relationships
     server = relationship("Server", back_populates="commands")
 
+class Script(Base):
+    """Reusable script in the fleet-wide library."""
+    __tablename__ = "scripts"
+
+    id = Column(Integer, primary_key=True, index=True)
+    name = Column(String(100), nullable=False)
+    description = Column(Text, nullable=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    created_at = Column(DateTime, default=datetime.utcnow)
+    updated_at = Column(DateTime, default=datetime.utcnow, onupdate=datetime.utcnow)
+
+    # Relationships
+    versions = relationship("ScriptVersion", back_populates="script", cascade="all, delete-orphan", order_by="ScriptVersion.version")
+
+class ScriptVersion(Base):
+    """Immutable version of a script; agents fetch it by script ID and hash."""
+    __tablename__ = "script_versions"
+
+    id = Column(Integer, primary_key=True, index=True)
+    script_id = Column(Integer, ForeignKey("scripts.id"), nullable=False, index=True)
+    version = Column(Integer, nullable=False)
+    content = Column(Text, nullable=False)
+    sha256 = Column(String(64), nullable=False, index=True)
+    changelog = Column(Text, nullable=True)
+    created_by = Column(String(50), nullable=True)
+    created_at = Column(DateTime, default=datetime.utcnow)
+
+    # Relationships
+    script = relationship("Script", back_populates="versions")
+
 class AlertRule(Base):
     """Alert rules for monitoring."""
     __tablename__ = "alert_rules"
@@ -78,6 +131,25 @@ class AlertRule(Base):
     tenant_id = Column(String(50), default="default", index=True)
     created_at = Column(DateTime, default=datetime.utcnow)
 
+class CrashReport(Base):
+    """A panic of an agent, uploaded when it started again."""
+    __tablename__ = "crash_reports"
+
+    id = Column(Integer, primary_key=True, index=True)
+    server_id = Column(Integer, ForeignKey("servers.id"), nullable=False, index=True)
+    crashed_at = Column(DateTime, nullable=False)
+    panic = Column(Text, nullable=False)
+    stack = Column(Text)
+    go_version = Column(String(32))
+    agent_version = Column(String(50), nullable=True)  # The version that started again, usually the one that crashed
+    agent_config = Column(JSON, nullable=True)  # Effective configuration, credentials redacted by the agent
+    last_cycle = Column(JSON, nullable=True)  # The agent's health status at the time
+    goroutines = Column(Integer, nullable=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    received_at = Column(DateTime, default=datetime.utcnow)
+
+    server = relationship("Server", back_populates="crash_reports")
+
 class Alert(Base):
     """Triggered alerts."""
     __tablename__ = "alerts"
@@ -91,6 +163,40 @@ class Alert(Base):
     triggered_at = Column(DateTime, default=datetime.utcnow)
     resolved_at = Column(DateTime, nullable=True)
 
+class MaintenanceWindow(Base):
+    """Scheduled maintenance that suppresses alerts for one host, the hosts
+    with a tag, or every host of the tenant."""
+    __tablename__ = "maintenance_windows"
+
+    id = Column(Integer, primary_key=True, index=True)
+    name = Column(String(200), nullable=False)
+    server_id = Column(Integer, ForeignKey("servers.id", ondelete="CASCADE"), nullable=True)
+    tag = Column(String(200), nullable=True)  # key=value among the host's tags
+    starts_at = Column(DateTime, nullable=False)
+    ends_at = Column(DateTime, nullable=False)
+    source = Column(String(20), default="api")  # api, agent
+    created_by = Column(String(100), nullable=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    created_at = Column(DateTime, default=datetime.utcnow)
+
+class Webhook(Base):
+    """Outgoing webhooks fired on alert state changes and agent events."""
+    __tablename__ = "webhooks"
+
+    id = Column(Integer, primary_key=True, index=True)
+    name = Column(String(100), nullable=False)
+    url = Column(String(500), nullable=False)
+    events = Column(JSON, default=list)  # alert.triggered, alert.resolved, event.<type>; wildcards allowed
+    body_template = Column(Text, nullable=True)  # JSON with {{ path }} placeholders; None sends the payload
+    headers = Column(JSON, default=dict)
+    secret = Column(String(255), nullable=True)  # HMAC-SHA256 signing key
+    enabled = Column(Boolean, default=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    last_status = Column(Integer, nullable=True)
+    last_error = Column(Text, nullable=True)
+    last_delivery_at = Column(DateTime, nullable=True)
+    created_at = Column(DateTime, default=datetime.utcnow)
+
 class User(Base):
     """Dashboard users."""
     __tablename__ = "users"
@@ -100,5 +206,65 @@ class User(Base):
     email = Column(String(100), unique=True, nullable=False)
     hashed_password = Column(String(255), nullable=False)
     is_active = Column(Boolean, default=True)
+    role = Column(String(20), default="operator")  # admin, operator
+    tenant_id = Column(String(50), default="default", index=True)
+    created_at = Column(DateTime, default=datetime.utcnow)
+
+class AuditLog(Base):
+    """Who did what: commands requested, approved, rejected and completed,
+    role changes."""
+    __tablename__ = "audit_log"
+
+    id = Column(Integer, primary_key=True, index=True)
+    actor = Column(String(100), nullable=False)  # username, or agent:<hostname>
+    action = Column(String(50), nullable=False, index=True)  # command.requested, command.approved, ...
+    target_type = Column(String(50), nullable=False)
+    target_id = Column(Integer, nullable=True, index=True)
+    details = Column(JSON, nullable=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    created_at = Column(DateTime, default=datetime.utcnow, index=True)
+
+class ArchiveExport(Base):
+    """A day of a tenant's metrics, downsampled and moved to object storage."""
+    __tablename__ = "archive_exports"
+
+    id = Column(Integer, primary_key=True, index=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    day = Column(Date, nullable=False, index=True)
+    object_key = Column(String(500), nullable=False)
+    rows = Column(Integer, nullable=False)  # downsampled rows
+    samples = Column(Integer, nullable=False)  # raw metrics they replace
+    size_bytes = Column(Integer, nullable=False)
+    exported_at = Column(DateTime, default=datetime.utcnow)
+
+class EnrollmentToken(Base):
+    """Token new agents register with. Hosts enrolled with it wait for an
+    admin's approval unless they match one of its auto-approve rules."""
+    __tablename__ = "enrollment_tokens"
+
+    id = Column(Integer, primary_key=True, index=True)
+    name = Column(String(100), nullable=False)
+    token_hash = Column(String(64), nullable=False, unique=True)  # SHA-256 of the token
     tenant_id = Column(String(50), default="default", index=True)
+    auto_approve_subnets = Column(JSON, nullable=True)  # CIDRs of the connecting address
+    auto_approve_tags = Column(JSON, nullable=True)  # key=value pairs the host must report, all of them
+    max_uses = Column(Integer, nullable=True)
+    uses = Column(Integer, default=0)
+    expires_at = Column(DateTime, nullable=True)
+    created_by = Column(String(100), nullable=True)
     created_at = Column(DateTime, default=datetime.utcnow)
+
+class MetricDescriptor(Base):
+    """What a metric means, as described by the agents that send it."""
+    __tablename__ = "metric_descriptors"
+    __table_args__ = (UniqueConstraint("tenant_id", "metric_type", "metric_name"),)
+
+    id = Column(Integer, primary_key=True, index=True)
+    tenant_id = Column(String(50), default="default", index=True)
+    metric_type = Column(String(50), nullable=False)
+    metric_name = Column(String(100), nullable=False)
+    description = Column(Text, nullable=True)
+    unit = Column(String(20), nullable=True)
+    kind = Column(String(20), nullable=True)  # gauge, counter, state
+    agent_version = Column(String(50), nullable=True)  # of the agent that last described it
+    updated_at = Column(DateTime, default=datetime.utcnow)
@@ -2,48 +2,175 @@
 Agent router for handling agent registration, metrics, and commands.
 """
 
-from datetime import datetime
-from fastapi import APIRouter, Depends, HTTPException, status, Header
+from datetime import datetime, timedelta, timezone
+from fastapi import APIRouter, Depends, HTTPException, status, Header, Request, Response, WebSocket, WebSocketDisconnect
+from pydantic import ValidationError
 from sqlalchemy.ext.asyncio import AsyncSession
 from sqlalchemy import select, update
 from typing import List, Optional
+import asyncio
+import hashlib
+import json
 import logging
+import math
+import uuid
 
-from core.database import get_db
-from core.auth import verify_api_key, get_agent_tenant_id
+from core.database import get_db, async_session
+from core.auth import verify_agent, agent_certificate_cn, client_address, get_agent_tenant_id
 from database.redis_client import redis_client
-from models.models import Server, Metric, Command
+from models.models import Server, Metric, MetricDescriptor, Command, CrashReport, MaintenanceWindow, Script, ScriptVersion
 from core.schemas import (
-    AgentRegister, AgentHeartbeat, MetricsPayload,
-    CommandResponse, CommandResult
+    AgentRegister, AgentHeartbeat, MetricsPayload, MetricRegistryPayload,
+    CommandResponse, CommandResult, AgentConfig, AgentLatestVersion, CrashReportData
 )
+from core.config import settings
+from utils.exceptions import QuotaExceededError
+from utils.webhooks import dispatch_webhooks, server_payload
+from utils.audit import record_audit
+from utils.enrollment import find_enrollment_token, auto_approve_reason
 
 logger = logging.getLogger(__name__)
 
 router = APIRouter()
 
+# Statuses an agent reports in its heartbeat; anything else counts as online.
+HEARTBEAT_STATUSES = ("online", "collection_stalled")
+
+# Version of the agent protocol (registration and metrics payloads) this
+# server speaks. Agents newer than it fall back to it.
+AGENT_SCHEMA_VERSION = 1
+
+def server_protocol() -> dict:
+    """The protocol version and optional features advertised to agents in
+    the registration answer. Agents leave out what is not listed; older
+    agents ignore both."""
+    capabilities = ["command_channel", "metric_registry", "server_config"]
+    if settings.AGENT_GZIP:
+        capabilities.append("gzip")
+    return {"schema_version": AGENT_SCHEMA_VERSION, "capabilities": sorted(capabilities)}
+
+def agent_protocol(agent_data: AgentRegister) -> dict:
+    """Columns recording what a registering agent speaks."""
+    if agent_data.schema_version and agent_data.schema_version > AGENT_SCHEMA_VERSION:
+        logger.warning(
+            f"Agent of {agent_data.hostname} speaks protocol version {agent_data.schema_version}, "
+            f"newer than this server's {AGENT_SCHEMA_VERSION}; upgrade the server"
+        )
+    return {
+        "agent_schema_version": agent_data.schema_version,
+        "agent_capabilities": agent_data.capabilities,
+    }
+
 async def get_server_by_hostname_and_key(
-    db: AsyncSession, hostname: str, api_key: str
+    db: AsyncSession, hostname: str, api_key: Optional[str], cert_cn: Optional[str] = None,
+    approved_only: bool = True, agent_id: Optional[str] = None
 ) -> Optional[Server]:
-    """Get server by hostname and API key."""
-    if not verify_api_key(api_key):
+    """Get server by hostname and API key, or by hostname alone for an agent
+    whose client certificate is issued to that hostname. The agent's durable
+    ID, if it sent one, finds the server first, so a renamed server is still
+    found: within the tenant of the agent's API key, and for a certificate
+    only the server of the certificate's hostname. Hostnames are unique
+    within a tenant only, so an agent with a certificate alone is looked up
+    in the default tenant, which is where it registers. Servers waiting for
+    enrollment approval, or rejected, are not found unless approved_only is
+    False."""
+    if cert_cn:
+        if cert_cn != hostname:
+            return None
+    elif not verify_agent(api_key, cert_cn):
         return None
 
+    server = None
+    if agent_id:
+        query = select(Server).where(
+            Server.agent_id == agent_id,
+            Server.tenant_id == get_agent_tenant_id(api_key)
+        )
+        if cert_cn:
+            query = query.where(Server.hostname == cert_cn)
+        else:
+            query = query.where(Server.agent_api_key == api_key)
+        result = await db.execute(query)
+        server = result.scalar_one_or_none()
+    if server is None:
+        query = select(Server).where(Server.hostname == hostname)
+        if cert_cn:
+            query = query.where(Server.tenant_id == get_agent_tenant_id(api_key))
+        else:
+            query = query.where(Server.agent_api_key == api_key)
+        result = await db.execute(query)
+        server = result.scalar_one_or_none()
+
+    if server and approved_only and server.enrollment not in (None, "approved"):
+        return None
+    return server
+
+async def agent_id_taken(db: AsyncSession, tenant_id: str, agent_id: str, server_id: Optional[int] = None) -> bool:
+    """Whether another server of the tenant has the agent ID. Agent IDs are
+    unique within a tenant; a second host claiming one keeps its own record
+    without it."""
+    query = select(Server.id).where(Server.tenant_id == tenant_id, Server.agent_id == agent_id)
+    if server_id is not None:
+        query = query.where(Server.id != server_id)
+    result = await db.execute(query)
+    if result.first() is None:
+        return False
+    logger.warning(f"Agent ID {agent_id} is already used by another server of tenant {tenant_id}; not recorded")
+    return True
+
+async def follow_host_rename(db: AsyncSession, server: Server, hostname: str) -> dict:
+    """Values that rename server, found by its agent ID, to the hostname its
+    agent now reports. Names set by an admin (see POST
+    /api/servers/{id}/rename) are kept, and so are names another server
+    already has: those are duplicates to merge."""
+    if server.hostname_pinned:
+        return {}
     result = await db.execute(
-        select(Server).where(
-            Server.hostname == hostname,
-            Server.agent_api_key == api_key
+        select(Server.id).where(Server.hostname == hostname, Server.tenant_id == server.tenant_id)
+    )
+    if result.scalar_one_or_none() is not None:
+        logger.warning(
+            f"Agent of {server.hostname} now reports hostname {hostname}, which another server has; "
+            f"merge the duplicates to keep one"
         )
+        return {}
+
+    record_audit(
+        db, server.tenant_id, f"agent:{hostname}", "server.renamed", "server", server.id,
+        {"from": server.hostname, "to": hostname, "by": "agent"}
     )
-    return result.scalar_one_or_none()
+    logger.info(f"Server {server.hostname} renamed to {hostname} by its agent")
+    values = {"hostname": hostname}
+    if server.name == server.hostname:
+        values["name"] = hostname
+    return values
+
+def pending_response(response: Response) -> dict:
+    response.status_code = status.HTTP_202_ACCEPTED
+    return {
+        "status": "pending_approval",
+        "message": "Agent is waiting for an admin to approve its enrollment",
+        "retry_after": settings.AGENT_ENROLLMENT_RETRY_SECONDS,
+        **server_protocol()
+    }
 
 @router.post("/register")
 async def register_agent(
     agent_data: AgentRegister,
+    request: Request,
+    response: Response,
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
     db: AsyncSession = Depends(get_db)
 ):
-    """Register or update agent information."""
-    if not verify_api_key(agent_data.api_key):
+    """Register or update agent information. New hosts with an enrollment
+    token wait for approval (202 and "pending_approval") unless the token
+    auto-approves them."""
+    if cert_cn and cert_cn != agent_data.hostname:
+        raise HTTPException(
+            status_code=status.HTTP_401_UNAUTHORIZED,
+            detail="Client certificate is not issued to this hostname"
+        )
+    if not verify_agent(agent_data.api_key, cert_cn):
         raise HTTPException(
             status_code=status.HTTP_401_UNAUTHORIZED,
             detail="Invalid API key"
@@ -51,17 +178,48 @@ async def register_agent(
 
     # Check if server already exists
     server = await get_server_by_hostname_and_key(
-        db, agent_data.hostname, agent_data.api_key
+        db, agent_data.hostname, agent_data.api_key, cert_cn,
+        approved_only=False, agent_id=agent_data.agent_id
     )
 
+    if server and server.enrollment == "rejected":
+        raise HTTPException(
+            status_code=status.HTTP_403_FORBIDDEN,
+            detail="Enrollment rejected"
+        )
+    if server and server.enrollment == "pending":
+        await db.execute(
+            update(Server).where(Server.id == server.id).values(
+                ip_address=agent_data.ip_address,
+                agent_version=agent_data.agent_version,
+                tags=agent_data.tags,
+                updated_at=datetime.utcnow(),
+                **agent_protocol(agent_data)
+            )
+        )
+        await db.commit()
+        return pending_response(response)
+
     if server:
         # Update existing server
+        identity = {}
+        if (agent_data.agent_id and server.agent_id != agent_data.agent_id
+                and not await agent_id_taken(db, server.tenant_id, agent_data.agent_id, server.id)):
+            # First registration with an ID, or the agent was reinstalled
+            identity["agent_id"] = agent_data.agent_id
+        if server.hostname != agent_data.hostname:
+            identity.update(await follow_host_rename(db, server, agent_data.hostname))
         await db.execute(
             update(Server).where(Server.id == server.id).values(
                 ip_address=agent_data.ip_address,
+                agent_version=agent_data.agent_version,
+                agent_commit=agent_data.agent_commit,
+                agent_build_date=agent_data.agent_build_date,
                 status="online",
                 last_heartbeat=datetime.utcnow(),
-                updated_at=datetime.utcnow()
+                updated_at=datetime.utcnow(),
+                **agent_protocol(agent_data),
+                **identity
             )
         )
         await db.commit()
@@ -69,31 +227,83 @@ async def register_agent(
     else:
         # Create new server
         tenant_id = get_agent_tenant_id(agent_data.api_key)
+        enrollment = "approved"
+        enrollment_token = None
+        if agent_data.enrollment_token:
+            enrollment_token = await find_enrollment_token(db, agent_data.enrollment_token)
+            if not enrollment_token:
+                raise HTTPException(
+                    status_code=status.HTTP_401_UNAUTHORIZED,
+                    detail="Invalid enrollment token"
+                )
+            if cert_cn and enrollment_token.tenant_id != tenant_id:
+                # Found again by the certificate's hostname in its tenant only
+                raise HTTPException(
+                    status_code=status.HTTP_400_BAD_REQUEST,
+                    detail="Agents with a client certificate join the default tenant; use one of its enrollment tokens"
+                )
+        elif settings.AGENT_ENROLLMENT == "required":
+            raise HTTPException(
+                status_code=status.HTTP_401_UNAUTHORIZED,
+                detail="Enrollment token required"
+            )
+
+        if enrollment_token:
+            tenant_id = enrollment_token.tenant_id
+            enrollment_token.uses += 1
+            client_ip = client_address(request)
+            reason = auto_approve_reason(enrollment_token, client_ip, agent_data.tags)
+            if reason is None:
+                enrollment = "pending"
+            record_audit(
+                db, tenant_id, f"agent:{agent_data.hostname}",
+                "enrollment.approved" if reason else "enrollment.requested", "enrollment_token",
+                enrollment_token.id,
+                {"hostname": agent_data.hostname, "client_ip": client_ip, "auto_approved": reason}
+            )
+
+        new_agent_id = agent_data.agent_id
+        if new_agent_id and await agent_id_taken(db, tenant_id, new_agent_id):
+            new_agent_id = None
+
         new_server = Server(
             name=agent_data.hostname,
             hostname=agent_data.hostname,
             ip_address=agent_data.ip_address,
-            agent_api_key=agent_data.api_key,
+            agent_api_key=agent_data.api_key or "",
+            agent_id=new_agent_id,
+            agent_version=agent_data.agent_version,
+            agent_commit=agent_data.agent_commit,
+            agent_build_date=agent_data.agent_build_date,
             tenant_id=tenant_id,
-            status="online",
-            last_heartbeat=datetime.utcnow()
+            tags=agent_data.tags,
+            enrollment=enrollment,
+            enrollment_token_id=enrollment_token.id if enrollment_token else None,
+            status="pending" if enrollment == "pending" else "online",
+            last_heartbeat=datetime.utcnow(),
+            **agent_protocol(agent_data)
         )
         db.add(new_server)
         await db.commit()
         await db.refresh(new_server)
+        if enrollment == "pending":
+            logger.info(f"New server waiting for enrollment approval: {agent_data.hostname}")
+            return pending_response(response)
         logger.info(f"Registered new server: {agent_data.hostname}")
 
-    return {"status": "registered", "message": "Agent registered successfully"}
+    return {"status": "registered", "message": "Agent registered successfully", **server_protocol()}
 
 @router.post("/heartbeat")
 async def agent_heartbeat(
     heartbeat_data: AgentHeartbeat,
-    x_api_key: str = Header(..., alias="X-API-Key"),
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
     db: AsyncSession = Depends(get_db)
 ):
     """Receive heartbeat from agent."""
     server = await get_server_by_hostname_and_key(
-        db, heartbeat_data.hostname, x_api_key
+        db, heartbeat_data.hostname, x_api_key, cert_cn, agent_id=agent_id
     )
 
     if not server:
@@ -102,26 +312,101 @@ async def agent_heartbeat(
             detail="Server not found or invalid API key"
         )
 
+    heartbeat_status = heartbeat_data.status
+    if heartbeat_status not in HEARTBEAT_STATUSES:
+        heartbeat_status = "online"
+    if heartbeat_status != server.status:
+        if heartbeat_status == "collection_stalled":
+            logger.warning(f"Agent of {server.hostname} runs but has collected nothing since {heartbeat_data.last_collection}")
+        elif server.status == "offline":
+            logger.info(f"Server {server.hostname} back online")
+
+    values = {
+        "status": heartbeat_status,
+        "last_heartbeat": datetime.utcnow(),
+        "updated_at": datetime.utcnow()
+    }
+    if heartbeat_data.interval_seconds:
+        values["heartbeat_interval"] = max(1, round(heartbeat_data.interval_seconds))
+    if heartbeat_data.last_collection:
+        values["last_collection"] = heartbeat_data.last_collection.astimezone(timezone.utc).replace(tzinfo=None)
+    if heartbeat_data.agent_version:
+        values["agent_version"] = heartbeat_data.agent_version
+
     # Update server status and heartbeat
-    await db.execute(
-        update(Server).where(Server.id == server.id).values(
-            status=heartbeat_data.status,
-            last_heartbeat=datetime.utcnow(),
-            updated_at=datetime.utcnow()
-        )
-    )
+    await db.execute(update(Server).where(Server.id == server.id).values(**values))
     await db.commit()
 
     return {"status": "ok", "timestamp": datetime.utcnow()}
 
+async def apply_maintenance_marker(db: AsyncSession, server: Server, metric_data):
+    """Open or end the host's agent-scheduled maintenance window."""
+    metadata = metric_data.metric_metadata or {}
+    now = datetime.utcnow()
+    if metric_data.metric_name == "maintenance" and metadata.get("duration_seconds"):
+        try:
+            duration = float(metadata["duration_seconds"])
+        except (TypeError, ValueError):
+            duration = None
+        if duration is None or not math.isfinite(duration) or duration <= 0:
+            logger.warning(f"Agent {server.hostname} sent a maintenance marker with an invalid duration; ignored")
+            return
+        if duration > settings.AGENT_MAINTENANCE_MAX_SECONDS:
+            logger.warning(
+                f"Agent {server.hostname} asked for {duration:.0f}s of maintenance, "
+                f"cut to AGENT_MAINTENANCE_MAX_SECONDS ({settings.AGENT_MAINTENANCE_MAX_SECONDS}s)"
+            )
+            duration = settings.AGENT_MAINTENANCE_MAX_SECONDS
+        db.add(MaintenanceWindow(
+            name=str(metadata.get("message") or f"Maintenance on {server.hostname}")[:200],
+            server_id=server.id,
+            starts_at=now,
+            ends_at=now + timedelta(seconds=duration),
+            source="agent",
+            created_by=str(metadata.get("source") or server.hostname)[:100],
+            tenant_id=server.tenant_id
+        ))
+        logger.info(f"Agent {server.hostname} started maintenance for {duration:.0f}s")
+    elif metric_data.metric_name == "maintenance_end":
+        result = await db.execute(
+            select(MaintenanceWindow).where(
+                MaintenanceWindow.server_id == server.id,
+                MaintenanceWindow.source == "agent",
+                MaintenanceWindow.starts_at <= now,
+                MaintenanceWindow.ends_at > now
+            )
+        )
+        for window in result.scalars().all():
+            window.ends_at = now
+        logger.info(f"Agent {server.hostname} ended maintenance")
+
+def collection_time(timestamp: Optional[datetime], now: datetime) -> datetime:
+    """When the agent collected a metric, as naive UTC. Times from a clock
+    running ahead, or older than the retention, are replaced by now."""
+    if timestamp is None:
+        return now
+    if timestamp.tzinfo is not None:
+        timestamp = timestamp.astimezone(timezone.utc).replace(tzinfo=None)
+    if timestamp > now + timedelta(minutes=5) or timestamp < now - timedelta(days=settings.METRICS_RETENTION_DAYS):
+        return now
+    return timestamp
+
+def series_key(metric_data) -> str:
+    """Identity of a series: type, name and metadata."""
+    metadata = json.dumps(metric_data.metric_metadata or {}, sort_keys=True, default=str)
+    identity = f"{metric_data.metric_type}/{metric_data.metric_name}/{metadata}"
+    return hashlib.sha1(identity.encode()).hexdigest()[:20]
+
 @router.post("/metrics")
 async def submit_metrics(
     metrics_data: MetricsPayload,
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
     db: AsyncSession = Depends(get_db)
 ):
     """Receive metrics from agent."""
     server = await get_server_by_hostname_and_key(
-        db, metrics_data.hostname, metrics_data.api_key
+        db, metrics_data.hostname, metrics_data.api_key, cert_cn, agent_id=agent_id
     )
 
     if not server:
@@ -130,8 +415,55 @@ async def submit_metrics(
             detail="Server not found or invalid API key"
         )
 
+    if len(metrics_data.metrics) > settings.MAX_METRICS_PER_PAYLOAD:
+        raise QuotaExceededError(
+            f"{len(metrics_data.metrics)} metrics in one payload, limit is {settings.MAX_METRICS_PER_PAYLOAD}",
+            {
+                "quota": "metrics_per_payload",
+                "limit": settings.MAX_METRICS_PER_PAYLOAD,
+                "received": len(metrics_data.metrics)
+            }
+        )
+
+    # The last request of a batch has part equal to parts, so a part past
+    # the count would leave the batch looking incomplete
+    if (metrics_data.part is None) != (metrics_data.parts is None) or (
+        metrics_data.parts and (not metrics_data.batch_id or metrics_data.part > metrics_data.parts)
+    ):
+        raise HTTPException(
+            status_code=status.HTTP_422_UNPROCESSABLE_ENTITY,
+            detail="part must be between 1 and parts, with a batch_id"
+        )
+
+    # Enforce the host's series quota. Series seen within the window always
+    # pass; new ones only while the host is under its limit.
+    limit = server.series_limit if server.series_limit is not None else settings.MAX_SERIES_PER_HOST
+    keys = [series_key(metric_data) for metric_data in metrics_data.metrics]
+    accepted, series_count = await redis_client.track_series(
+        server.id, list(dict.fromkeys(keys)), limit, settings.SERIES_WINDOW_HOURS * 3600
+    )
+    dropped = sum(1 for key in keys if key not in accepted)
+    quota = None
+    if dropped:
+        quota = {
+            "quota": "series_per_host",
+            "limit": limit,
+            "series": series_count,
+            "dropped": dropped
+        }
+        logger.warning(f"Host {metrics_data.hostname} is over its series quota ({limit}), {dropped} metrics dropped")
+        if settings.SERIES_QUOTA_MODE == "reject":
+            raise QuotaExceededError(
+                f"payload adds series beyond the host's limit of {limit}",
+                quota
+            )
+
     # Insert metrics
-    for metric_data in metrics_data.metrics:
+    received = 0
+    now = datetime.utcnow()
+    for metric_data, key in zip(metrics_data.metrics, keys):
+        if key not in accepted:
+            continue
         metric = Metric(
             server_id=server.id,
             metric_type=metric_data.metric_type,
@@ -139,29 +471,133 @@ async def submit_metrics(
             value=metric_data.value,
             unit=metric_data.unit,
             metric_metadata=metric_data.metric_metadata,
-            collected_at=datetime.utcnow()
+            collected_at=collection_time(metric_data.timestamp, now)
         )
         db.add(metric)
+        received += 1
+
+    # Quota usage as metrics of the host, so alert rules can watch them
+    # (agent/series_dropped > 0)
+    for name, value in (("series_count", series_count), ("series_dropped", dropped)):
+        db.add(Metric(
+            server_id=server.id,
+            metric_type="agent",
+            metric_name=name,
+            value=value,
+            unit="count",
+            metric_metadata={"limit": limit},
+            collected_at=datetime.utcnow()
+        ))
+
+    # Tags select the host for tag-scoped maintenance windows
+    if metrics_data.tags is not None and metrics_data.tags != server.tags:
+        server.tags = metrics_data.tags
+
+    # `lxmon-agent mark --type maintenance --duration 1h` opens a maintenance
+    # window for the host, `--type maintenance_end` ends it early
+    for metric_data, key in zip(metrics_data.metrics, keys):
+        if metric_data.metric_type == "event" and key in accepted:
+            await apply_maintenance_marker(db, server, metric_data)
 
     await db.commit()
-    logger.info(f"Received {len(metrics_data.metrics)} metrics from {metrics_data.hostname}")
+    if metrics_data.parts:
+        logger.info(
+            f"Received {received} metrics from {metrics_data.hostname} "
+            f"(part {metrics_data.part} of {metrics_data.parts} of batch {metrics_data.batch_id})"
+        )
+    else:
+        logger.info(f"Received {received} metrics from {metrics_data.hostname}")
 
-    return {"status": "ok", "metrics_received": len(metrics_data.metrics)}
+    # Agent events (deploys, failovers, ...) fire "event.<type>" webhooks
+    for metric_data, key in zip(metrics_data.metrics, keys):
+        if metric_data.metric_type == "event" and key in accepted:
+            metadata = metric_data.metric_metadata or {}
+            dispatch_webhooks(server.tenant_id, f"event.{metric_data.metric_name}", {
+                "server": server_payload(server),
+                "agent_event": {
+                    "type": metric_data.metric_name,
+                    "severity": metadata.get("severity", "info"),
+                    "message": metadata.get("message", ""),
+                    "metadata": metadata
+                }
+            })
+
+    if quota:
+        return {"status": "clipped", "metrics_received": received, "quota": quota}
+    return {"status": "ok", "metrics_received": received}
+
+@router.post("/metric-registry")
+async def submit_metric_registry(
+    registry: MetricRegistryPayload,
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
+    db: AsyncSession = Depends(get_db)
+):
+    """Receive the agent's descriptions of its metrics, sent once per run.
+    Descriptions are kept per tenant; the latest agent to describe a metric
+    wins."""
+    server = await get_server_by_hostname_and_key(
+        db, registry.hostname, registry.api_key, cert_cn, agent_id=agent_id
+    )
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found or invalid API key"
+        )
+
+    result = await db.execute(
+        select(MetricDescriptor).where(MetricDescriptor.tenant_id == server.tenant_id)
+    )
+    existing = {(d.metric_type, d.metric_name): d for d in result.scalars().all()}
+
+    now = datetime.utcnow()
+    changed = 0
+    for data in registry.metrics[:settings.MAX_METRICS_PER_PAYLOAD]:
+        descriptor = existing.get((data.metric_type, data.metric_name))
+        if descriptor is None:
+            descriptor = MetricDescriptor(
+                tenant_id=server.tenant_id,
+                metric_type=data.metric_type,
+                metric_name=data.metric_name
+            )
+            db.add(descriptor)
+            existing[(data.metric_type, data.metric_name)] = descriptor
+        elif (descriptor.description, descriptor.unit, descriptor.kind) == (data.description, data.unit, data.kind):
+            continue
+        descriptor.description = data.description
+        descriptor.unit = data.unit
+        descriptor.kind = data.kind
+        descriptor.agent_version = registry.agent_version
+        descriptor.updated_at = now
+        changed += 1
+
+    await db.commit()
+    if changed:
+        logger.info(f"Agent {server.hostname} updated {changed} metric descriptions")
+
+    return {"status": "ok", "updated": changed}
 
 @router.get("/commands", response_model=List[CommandResponse])
 async def get_pending_commands(
     hostname: str,
-    x_api_key: str = Header(..., alias="X-API-Key"),
+    peek: bool = False,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
     db: AsyncSession = Depends(get_db)
 ):
-    """Get pending commands for agent."""
-    server = await get_server_by_hostname_and_key(db, hostname, x_api_key)
+    """Get pending commands for agent. With peek, as sent by `lxmon-agent
+    check`, only the authentication is checked and the queue is left alone."""
+    server = await get_server_by_hostname_and_key(db, hostname, x_api_key, cert_cn, agent_id=agent_id)
 
     if not server:
         raise HTTPException(
             status_code=status.HTTP_404_NOT_FOUND,
             detail="Server not found or invalid API key"
         )
+    if peek:
+        return []
 
     # Get pending commands from Redis queue
     commands = []
@@ -170,29 +606,187 @@ async def get_pending_commands(
     for _ in range(command_count):
         command_data = await redis_client.pop_command(server.id)
         if command_data:
-            # Create command record in database
-            command = Command(
-                server_id=server.id,
-                command=command_data["command"],
-                status="running",
-                executed_at=datetime.utcnow()
-            )
-            db.add(command)
-            await db.commit()
-            await db.refresh(command)
-            commands.append(command)
+            commands.append(await claim_command(db, server, command_data))
 
     return commands
 
+async def claim_command(db: AsyncSession, server: Server, command_data: dict) -> Command:
+    """Mark a command taken from the server's queue as running, on the record
+    created when it was queued (or a new one for commands queued without)."""
+    command = None
+    if command_data.get("command_id") is not None:
+        result = await db.execute(
+            select(Command).where(
+                Command.id == command_data["command_id"],
+                Command.server_id == server.id
+            )
+        )
+        command = result.scalar_one_or_none()
+    if command:
+        command.status = "running"
+        command.executed_at = datetime.utcnow()
+    else:
+        command = Command(
+            server_id=server.id,
+            command=command_data["command"],
+            control=command_data.get("control"),
+            script=command_data.get("script"),
+            status="running",
+            executed_at=datetime.utcnow()
+        )
+        db.add(command)
+    await db.commit()
+    await db.refresh(command)
+    return command
+
+@router.get("/scripts/{script_id}/{sha256}", response_class=Response)
+async def get_script_content(
+    script_id: int,
+    sha256: str,
+    hostname: str,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get a script version by script ID and content hash, as plain text."""
+    server = await get_server_by_hostname_and_key(db, hostname, x_api_key, cert_cn, agent_id=agent_id)
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found or invalid API key"
+        )
+
+    result = await db.execute(
+        select(ScriptVersion).join(Script).where(
+            Script.id == script_id,
+            Script.tenant_id == server.tenant_id,
+            ScriptVersion.sha256 == sha256
+        )
+    )
+    version = result.scalars().first()
+
+    if not version:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Script version not found"
+        )
+
+    return Response(content=version.content, media_type="text/plain; charset=utf-8")
+
+def agent_config_etag(settings: dict) -> str:
+    """ETag of an agent's settings, stable across key order."""
+    canonical = json.dumps(settings, sort_keys=True, separators=(",", ":"))
+    return '"' + hashlib.sha256(canonical.encode()).hexdigest()[:32] + '"'
+
+@router.get("/config", response_model=AgentConfig)
+async def get_agent_config(
+    hostname: str,
+    response: Response,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
+    if_none_match: Optional[str] = Header(None, alias="If-None-Match"),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get the settings managed for this agent on the server."""
+    server = await get_server_by_hostname_and_key(db, hostname, x_api_key, cert_cn, agent_id=agent_id)
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found or invalid API key"
+        )
+
+    settings = server.agent_config or {}
+    etag = agent_config_etag(settings)
+    if if_none_match == etag:
+        return Response(status_code=status.HTTP_304_NOT_MODIFIED, headers={"ETag": etag})
+
+    response.headers["ETag"] = etag
+    return {"settings": settings}
+
+def parse_version(version: str) -> tuple:
+    """Numeric (major, minor, patch) of a release version, (0, 0, 0) if unparseable."""
+    parts = version.lstrip("v").split("-", 1)[0].split(".")
+    try:
+        return tuple(int(part) for part in (parts + ["0", "0"])[:3])
+    except ValueError:
+        return (0, 0, 0)
+
+@router.get("/latest-version", response_model=AgentLatestVersion)
+async def get_latest_version(
+    os: str = "linux",
+    arch: str = "amd64",
+    current: Optional[str] = None,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn)
+):
+    """Get the latest agent release and the archive for the agent's platform."""
+    if not verify_agent(x_api_key, cert_cn):
+        raise HTTPException(
+            status_code=status.HTTP_401_UNAUTHORIZED,
+            detail="Invalid API key"
+        )
+
+    latest = settings.AGENT_LATEST_VERSION.lstrip("v")
+    if not latest:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="No agent release published"
+        )
+
+    # Only armv7 is built for 32-bit ARM
+    if arch == "arm":
+        arch = "armv7"
+    base_url = settings.AGENT_RELEASE_URL.format(version=latest).rstrip("/")
+    return {
+        "version": latest,
+        "update_available": current is not None and parse_version(latest) > parse_version(current),
+        "url": f"{base_url}/lxmon-agent_{latest}_{os}_{arch}.tar.gz",
+        "checksums_url": f"{base_url}/checksums.txt"
+    }
+
 @router.post("/command-result")
 async def submit_command_result(
     result_data: CommandResult,
     hostname: str,
-    x_api_key: str = Header(..., alias="X-API-Key"),
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
     db: AsyncSession = Depends(get_db)
 ):
     """Receive command execution result from agent."""
-    server = await get_server_by_hostname_and_key(db, hostname, x_api_key)
+    server = await get_server_by_hostname_and_key(db, hostname, x_api_key, cert_cn, agent_id=agent_id)
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found or invalid API key"
+        )
+
+    command = await store_command_result(db, server, result_data)
+
+    if not command:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Command not found"
+        )
+
+    return {"status": "ok", "command_id": command.id}
+
+@router.post("/crash-report")
+async def submit_crash_report(
+    report: CrashReportData,
+    hostname: str,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID"),
+    cert_cn: Optional[str] = Depends(agent_certificate_cn),
+    db: AsyncSession = Depends(get_db)
+):
+    """Receive the report of an agent's panic, uploaded by the next run."""
+    server = await get_server_by_hostname_and_key(db, hostname, x_api_key, cert_cn, agent_id=agent_id)
 
     if not server:
         raise HTTPException(
@@ -200,7 +794,28 @@ async def submit_command_result(
             detail="Server not found or invalid API key"
         )
 
-    # Update command with result
+    crashed_at = report.crashed_at
+    if crashed_at.tzinfo:
+        crashed_at = crashed_at.astimezone(timezone.utc).replace(tzinfo=None)
+    db.add(CrashReport(
+        server_id=server.id,
+        crashed_at=crashed_at,
+        panic=report.panic,
+        stack=report.stack,
+        go_version=report.go_version,
+        agent_version=server.agent_version,
+        agent_config=report.config,
+        last_cycle=report.last_cycle,
+        goroutines=report.goroutines,
+        tenant_id=server.tenant_id
+    ))
+    await db.commit()
+
+    logger.warning(f"Agent of {server.hostname} crashed at {crashed_at.isoformat()}: {report.panic[:200]}")
+    return {"status": "ok"}
+
+async def store_command_result(db: AsyncSession, server: Server, result_data: CommandResult) -> Optional[Command]:
+    """Store a command's result. Returns None if the server has no such command."""
     result = await db.execute(
         select(Command).where(
             Command.id == result_data.command_id,
@@ -210,10 +825,7 @@ async def submit_command_result(
     command = result.scalar_one_or_none()
 
     if not command:
-        raise HTTPException(
-            status_code=status.HTTP_404_NOT_FOUND,
-            detail="Command not found"
-        )
+        return None
 
     # Update command status
     await db.execute(
@@ -225,8 +837,104 @@ async def submit_command_result(
             completed_at=datetime.utcnow()
         )
     )
+    record_audit(
+        db, server.tenant_id, f"agent:{server.hostname}", "command.completed", "command", command.id,
+        {"exit_code": result_data.exit_code}
+    )
     await db.commit()
 
     logger.info(f"Command {command.id} completed with exit code {result_data.exit_code}")
+    return command
 
-    return {"status": "ok", "command_id": command.id}
+# How long the command channel waits on the queue before waiting again
+COMMAND_CHANNEL_WAIT = 30
+
+@router.websocket("/ws")
+async def command_channel(
+    websocket: WebSocket,
+    hostname: str,
+    x_api_key: Optional[str] = Header(None, alias="X-API-Key"),
+    agent_id: Optional[str] = Header(None, alias="X-LXMON-Agent-ID")
+):
+    """Command channel: commands are pushed to the agent as soon as they are
+    queued, and their results come back on the same connection, each
+    answered with an ack. Agents without the channel poll /commands."""
+    async with async_session() as db:
+        server = await get_server_by_hostname_and_key(
+            db, hostname, x_api_key, agent_certificate_cn(websocket), agent_id=agent_id
+        )
+    if not server:
+        # Refused before the handshake completes, the agent sees a 403
+        await websocket.close(code=status.WS_1008_POLICY_VIOLATION)
+        return
+
+    await websocket.accept()
+    logger.info(f"Command channel opened for {server.hostname}")
+    send_lock = asyncio.Lock()
+
+    async def send(message: dict):
+        async with send_lock:
+            await websocket.send_json(message)
+
+    # Where a command waits between the queue and the agent, so one taken when
+    # the channel closes goes back to the queue instead of being lost
+    holding = f"commands:{server.id}:sending:{uuid.uuid4().hex}"
+
+    async def push_commands():
+        try:
+            while True:
+                command_data = await redis_client.wait_command(server.id, COMMAND_CHANNEL_WAIT, holding)
+                if not command_data:
+                    # Also keeps a Redis outage from spinning
+                    await asyncio.sleep(1)
+                    continue
+                command = None
+                try:
+                    async with async_session() as db:
+                        command = await claim_command(db, server, command_data)
+                    await send({
+                        "type": "command",
+                        "command": CommandResponse.model_validate(command).model_dump(mode="json")
+                    })
+                    await redis_client.forget_commands(holding)
+                except Exception:
+                    # Back on the queue, for the agent's next poll or channel
+                    if command:
+                        command_data = {**command_data, "command_id": command.id}
+                    await redis_client.forget_commands(holding)
+                    await redis_client.push_command(server.id, command_data)
+                    raise
+        except Exception as e:
+            # An open channel pauses the agent's polling, so it must not
+            # stay open without pushing
+            logger.error(f"Command channel for {server.hostname} stopped pushing commands: {e}")
+            try:
+                await websocket.close(code=status.WS_1011_INTERNAL_ERROR)
+            except Exception:
+                pass
+        finally:
+            # Canceled while waiting or sending
+            await redis_client.release_commands(server.id, holding)
+
+    pusher = asyncio.create_task(push_commands())
+    try:
+        while True:
+            try:
+                message = json.loads(await websocket.receive_text())
+                if message.get("type") != "command_result":
+                    continue
+                result_data = CommandResult(**message.get("result", {}))
+            except (ValueError, TypeError, AttributeError, ValidationError) as e:
+                logger.warning(f"Invalid command channel message from {server.hostname}: {e}")
+                continue
+            async with async_session() as db:
+                command = await store_command_result(db, server, result_data)
+            if command:
+                await send({"type": "ack", "command_id": command.id})
+            else:
+                logger.warning(f"Command channel result for unknown command {result_data.command_id} from {server.hostname}")
+    except WebSocketDisconnect:
+        pass
+    finally:
+        pusher.cancel()
+        logger.info(f"Command channel closed for {server.hostname}")
@@ -11,6 +11,7 @@ import logging
 from core.database import get_db
 from core.auth import get_current_tenant_id
 from models.models import AlertRule, Alert, Server
+from utils.webhooks import dispatch_webhooks, alert_payload
 from core.schemas import (
     AlertRuleCreate, AlertRuleUpdate, AlertRuleResponse,
     AlertResponse
@@ -236,6 +237,11 @@ async def resolve_alert(
         )
     )
     await db.commit()
+    await db.refresh(alert)
 
     logger.info(f"Resolved alert {alert_id}")
+
+    rule = await db.get(AlertRule, alert.alert_rule_id)
+    server = await db.get(Server, alert.server_id)
+    dispatch_webhooks(tenant_id, "alert.resolved", alert_payload(alert, rule, server))
     return {"status": "ok", "message": "Alert resolved successfully"}
@@ -0,0 +1,71 @@
+"""
+Archive router for the metrics exported to object storage.
+"""
+
+from datetime import date, datetime, time, timedelta
+from fastapi import APIRouter, Depends, HTTPException, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select, desc
+from typing import Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_current_tenant_id
+from models.models import ArchiveExport
+from utils.archive import archive_enabled, archived_rows
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+@router.get("/")
+async def get_archive_exports(
+    since: Optional[date] = None,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Days of metrics moved to object storage, newest first."""
+    query = select(ArchiveExport).where(ArchiveExport.tenant_id == tenant_id)
+    if since:
+        query = query.where(ArchiveExport.day >= since)
+    result = await db.execute(query.order_by(desc(ArchiveExport.day)))
+    return {
+        "enabled": archive_enabled(),
+        "exports": [
+            {
+                "day": export.day.isoformat(),
+                "object_key": export.object_key,
+                "rows": export.rows,
+                "samples": export.samples,
+                "size_bytes": export.size_bytes,
+                "exported_at": export.exported_at,
+            }
+            for export in result.scalars().all()
+        ],
+    }
+
+@router.get("/{day}")
+async def get_archived_day(
+    day: date,
+    metric_type: Optional[str] = None,
+    metric_name: Optional[str] = None,
+    hostname: Optional[str] = None,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """The downsampled rows of an archived day, optionally filtered."""
+    result = await db.execute(
+        select(ArchiveExport).where(ArchiveExport.tenant_id == tenant_id, ArchiveExport.day == day)
+    )
+    if not result.scalar_one_or_none():
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Day not archived"
+        )
+
+    start = datetime.combine(day, time())
+    rows = await archived_rows(
+        db, tenant_id, start, start + timedelta(days=1) - timedelta(microseconds=1),
+        metric_type, metric_name, hostname
+    )
+    return {"day": day.isoformat(), "rows": rows, "count": len(rows)}
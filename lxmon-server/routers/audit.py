@@ -0,0 +1,49 @@
+"""
+Audit router for reviewing the audit log.
+"""
+
+from datetime import datetime
+from fastapi import APIRouter, Depends, Query
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select, desc
+from typing import List, Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_current_admin
+from models.models import AuditLog, User
+from core.schemas import AuditLogResponse
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+@router.get("/", response_model=List[AuditLogResponse])
+async def get_audit_log(
+    action: Optional[str] = None,
+    target_type: Optional[str] = None,
+    target_id: Optional[int] = None,
+    since: Optional[datetime] = None,
+    skip: int = Query(0, ge=0),
+    limit: int = Query(100, ge=1, le=1000),
+    current_user: User = Depends(get_current_admin),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get audit entries, newest first. target_type=command&target_id=N shows
+    one command's approval chain."""
+    query = select(AuditLog).where(AuditLog.tenant_id == current_user.tenant_id)
+
+    if action:
+        query = query.where(AuditLog.action == action)
+    if target_type:
+        query = query.where(AuditLog.target_type == target_type)
+    if target_id is not None:
+        query = query.where(AuditLog.target_id == target_id)
+    if since:
+        query = query.where(AuditLog.created_at >= since)
+
+    result = await db.execute(
+        query.order_by(desc(AuditLog.created_at), desc(AuditLog.id))
+        .offset(skip).limit(limit)
+    )
+    return result.scalars().all()
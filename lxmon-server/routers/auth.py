@@ -7,15 +7,17 @@ from fastapi import APIRouter, Depends, HTTPException, status
 from fastapi.security import OAuth2PasswordRequestForm
 from sqlalchemy.ext.asyncio import AsyncSession
 from sqlalchemy import select
+from typing import List
 import logging
 
 from core.database import get_db
 from core.auth import (
     verify_password, create_access_token, get_password_hash,
-    get_current_user, authenticate_user, ACCESS_TOKEN_EXPIRE_MINUTES
+    get_current_user, get_current_admin, authenticate_user, ACCESS_TOKEN_EXPIRE_MINUTES
 )
 from models.models import User
-from core.schemas import UserCreate, UserResponse, Token
+from core.schemas import UserCreate, UserResponse, UserRoleUpdate, Token
+from utils.audit import record_audit
 
 logger = logging.getLogger(__name__)
 
@@ -86,13 +88,18 @@ async def register_user(
             detail="Username or email already registered"
         )
 
+    # Registration is open, so it never grants admin: see utils/bootstrap.py
+    tenant_id = user_data.tenant_id or "default"
+    role = "operator"
+
     # Create new user
     hashed_password = get_password_hash(user_data.password)
     new_user = User(
         username=user_data.username,
         email=user_data.email,
         hashed_password=hashed_password,
-        tenant_id=user_data.tenant_id or "default"
+        role=role,
+        tenant_id=tenant_id
     )
 
     db.add(new_user)
@@ -168,3 +175,59 @@ async def change_password(
 
     logger.info(f"Password changed for user: {current_user.username}")
     return {"message": "Password changed successfully"}
+
+@router.get("/users", response_model=List[UserResponse], tags=["Authentication"])
+async def list_users(
+    current_user: User = Depends(get_current_admin),
+    db: AsyncSession = Depends(get_db)
+):
+    """
+    List the users of the admin's tenant.
+    """
+    result = await db.execute(
+        select(User).where(User.tenant_id == current_user.tenant_id).order_by(User.username)
+    )
+    return [UserResponse.from_orm(user) for user in result.scalars().all()]
+
+@router.put("/users/{user_id}/role", response_model=UserResponse, tags=["Authentication"])
+async def set_user_role(
+    user_id: int,
+    role_data: UserRoleUpdate,
+    current_user: User = Depends(get_current_admin),
+    db: AsyncSession = Depends(get_db)
+):
+    """
+    Change a user's role.
+
+    **Roles:**
+    - **admin**: manages users and approves dangerous commands
+    - **operator**: everything else
+    """
+    result = await db.execute(
+        select(User).where(User.id == user_id, User.tenant_id == current_user.tenant_id)
+    )
+    user = result.scalar_one_or_none()
+
+    if not user:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="User not found"
+        )
+
+    if user.id == current_user.id and role_data.role != "admin":
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="Admins cannot demote themselves"
+        )
+
+    previous = user.role
+    user.role = role_data.role
+    record_audit(
+        db, current_user.tenant_id, current_user.username, "user.role_changed", "user", user.id,
+        {"username": user.username, "from": previous, "to": role_data.role}
+    )
+    await db.commit()
+    await db.refresh(user)
+
+    logger.info(f"User {user.username} role changed from {previous} to {user.role} by {current_user.username}")
+    return UserResponse.from_orm(user)
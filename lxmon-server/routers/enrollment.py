@@ -0,0 +1,204 @@
+"""
+Enrollment router: tokens new agents register with, and the queue of hosts
+waiting for an admin to approve them.
+"""
+
+from datetime import datetime, timedelta
+from fastapi import APIRouter, Depends, HTTPException, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select
+from typing import List
+import ipaddress
+import logging
+import secrets
+
+from core.database import get_db
+from core.auth import get_current_admin, get_current_tenant_id
+from models.models import EnrollmentToken, Server, User
+from core.schemas import (
+    EnrollmentTokenCreate, EnrollmentTokenResponse, EnrollmentTokenCreated, PendingEnrollment
+)
+from utils.audit import record_audit
+from utils.enrollment import token_hash
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+async def get_enrolling_server(server_id: int, tenant_id: str, db: AsyncSession) -> Server:
+    """Server waiting for approval, or rejected."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id,
+            Server.enrollment.in_(["pending", "rejected"])
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Pending server not found"
+        )
+
+    return server
+
+@router.get("/tokens", response_model=List[EnrollmentTokenResponse])
+async def get_enrollment_tokens(
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get enrollment tokens, newest first."""
+    result = await db.execute(
+        select(EnrollmentToken)
+        .where(EnrollmentToken.tenant_id == tenant_id)
+        .order_by(EnrollmentToken.created_at.desc())
+    )
+    return result.scalars().all()
+
+@router.post("/tokens", response_model=EnrollmentTokenCreated)
+async def create_enrollment_token(
+    token_data: EnrollmentTokenCreate,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Create an enrollment token. The token itself is only returned here."""
+    if token_data.auto_approve_tags and not token_data.auto_approve_subnets:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="auto_approve_tags only narrow down auto_approve_subnets"
+        )
+    for subnet in token_data.auto_approve_subnets:
+        try:
+            ipaddress.ip_network(subnet, strict=False)
+        except ValueError:
+            raise HTTPException(
+                status_code=status.HTTP_400_BAD_REQUEST,
+                detail=f"Invalid subnet: {subnet}"
+            )
+
+    token = secrets.token_urlsafe(32)
+    enrollment_token = EnrollmentToken(
+        name=token_data.name,
+        token_hash=token_hash(token),
+        tenant_id=tenant_id,
+        auto_approve_subnets=token_data.auto_approve_subnets,
+        auto_approve_tags=token_data.auto_approve_tags,
+        max_uses=token_data.max_uses,
+        uses=0,
+        expires_at=(
+            datetime.utcnow() + timedelta(hours=token_data.expires_in_hours)
+            if token_data.expires_in_hours else None
+        ),
+        created_by=current_user.username
+    )
+    db.add(enrollment_token)
+    await db.flush()
+    record_audit(
+        db, tenant_id, current_user.username, "enrollment_token.created", "enrollment_token",
+        enrollment_token.id,
+        {
+            "name": enrollment_token.name,
+            "auto_approve_subnets": enrollment_token.auto_approve_subnets,
+            "auto_approve_tags": enrollment_token.auto_approve_tags,
+        }
+    )
+    await db.commit()
+    await db.refresh(enrollment_token)
+
+    logger.info(f"Created enrollment token: {enrollment_token.name}")
+    response = EnrollmentTokenResponse.from_orm(enrollment_token)
+    return EnrollmentTokenCreated(**response.dict(), token=token)
+
+@router.delete("/tokens/{token_id}")
+async def delete_enrollment_token(
+    token_id: int,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Revoke an enrollment token. Hosts already enrolled with it stay."""
+    result = await db.execute(
+        select(EnrollmentToken).where(
+            EnrollmentToken.id == token_id,
+            EnrollmentToken.tenant_id == tenant_id
+        )
+    )
+    enrollment_token = result.scalar_one_or_none()
+
+    if not enrollment_token:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Enrollment token not found"
+        )
+
+    await db.delete(enrollment_token)
+    record_audit(
+        db, tenant_id, current_user.username, "enrollment_token.deleted", "enrollment_token",
+        token_id, {"name": enrollment_token.name}
+    )
+    await db.commit()
+
+    logger.info(f"Deleted enrollment token: {enrollment_token.name}")
+    return {"message": "Enrollment token deleted successfully"}
+
+@router.get("/pending", response_model=List[PendingEnrollment])
+async def get_pending_enrollments(
+    include_rejected: bool = False,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get hosts waiting for approval, oldest first."""
+    states = ["pending", "rejected"] if include_rejected else ["pending"]
+    result = await db.execute(
+        select(Server)
+        .where(Server.tenant_id == tenant_id, Server.enrollment.in_(states))
+        .order_by(Server.created_at)
+    )
+    return result.scalars().all()
+
+@router.post("/{server_id}/approve", response_model=PendingEnrollment)
+async def approve_enrollment(
+    server_id: int,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Let a host into the fleet. It is online once its agent asks again."""
+    server = await get_enrolling_server(server_id, tenant_id, db)
+    server.enrollment = "approved"
+    server.status = "offline"
+    record_audit(
+        db, tenant_id, current_user.username, "enrollment.approved", "server", server.id,
+        {"hostname": server.hostname, "ip_address": server.ip_address}
+    )
+    await db.commit()
+    await db.refresh(server)
+
+    logger.info(f"Approved enrollment of {server.hostname}")
+    return server
+
+@router.post("/{server_id}/reject", response_model=PendingEnrollment)
+async def reject_enrollment(
+    server_id: int,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Turn a host away. Its agent is refused until the server is deleted."""
+    server = await get_enrolling_server(server_id, tenant_id, db)
+    server.enrollment = "rejected"
+    server.status = "rejected"
+    record_audit(
+        db, tenant_id, current_user.username, "enrollment.rejected", "server", server.id,
+        {"hostname": server.hostname, "ip_address": server.ip_address}
+    )
+    await db.commit()
+    await db.refresh(server)
+
+    logger.info(f"Rejected enrollment of {server.hostname}")
+    return server
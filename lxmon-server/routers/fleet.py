@@ -0,0 +1,324 @@
+"""
+Fleet-wide aggregates for overview pages: per tag group percentiles, counts of
+hosts over a threshold, host status and active alerts, and heatmaps of a
+metric across hosts and time. The runtime inventory lists the versions of
+openssl, glibc and the like the agents found on each host.
+
+Metrics are named "<metric_type>.<metric_name>" as in the Grafana API, e.g.
+"cpu.usage_percent". A host's value is the percentile of all its samples in
+the window (all series, so the fullest disk counts for disk metrics).
+"""
+
+from collections import defaultdict
+from datetime import datetime, timedelta
+from fastapi import APIRouter, Depends, HTTPException, Query, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import func, literal_column, select
+from typing import Dict, List, Optional
+import logging
+import re
+
+from core.database import get_db
+from core.auth import get_current_tenant_id
+from models.models import Server, Metric, Alert
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+UNTAGGED = "(untagged)"
+
+def percentile(column, pct: float):
+    """Postgres's percentile_cont: linear interpolation between the closest
+    ranks, like numpy's default."""
+    return func.percentile_cont(pct / 100).within_group(column)
+
+def rounded(value: Optional[float]) -> Optional[float]:
+    return round(value, 2) if value is not None else None
+
+def parse_metric(metric: str):
+    metric_type, _, metric_name = metric.partition(".")
+    if not metric_type or not metric_name:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail='metric must be "<metric_type>.<metric_name>", e.g. "cpu.usage_percent"'
+        )
+    return metric_type, metric_name
+
+def host_group(server: Server, group_by: Optional[str]) -> str:
+    if not group_by:
+        return "all"
+    return str((server.tags or {}).get(group_by) or UNTAGGED)
+
+async def tenant_servers(db: AsyncSession, tenant_id: str, tag: Optional[str]) -> List[Server]:
+    """The tenant's servers, narrowed to those with tag ("key=value") if set."""
+    result = await db.execute(
+        select(Server).where(Server.tenant_id == tenant_id).order_by(Server.hostname)
+    )
+    servers = result.scalars().all()
+    if tag:
+        key, _, value = tag.partition("=")
+        servers = [server for server in servers if str((server.tags or {}).get(key)) == value]
+    return servers
+
+def group_column(group_by: Optional[str]):
+    """SQL for host_group: the host's group_by tag, on servers."""
+    if not group_by:
+        return literal_column("'all'")
+    return func.coalesce(func.nullif(Server.tags[group_by].as_string(), ""), UNTAGGED)
+
+def metric_conditions(server_ids: List[int], metric: str, since: datetime):
+    """Conditions selecting the samples of metric since since."""
+    metric_type, metric_name = parse_metric(metric)
+    return [
+        Metric.server_id.in_(server_ids),
+        Metric.metric_type == metric_type,
+        Metric.metric_name == metric_name,
+        Metric.collected_at >= since,
+    ]
+
+@router.get("/overview")
+async def fleet_overview(
+    metric: str = "cpu.usage_percent",
+    group_by: Optional[str] = Query(None, description="Tag key to group hosts by, e.g. role"),
+    tag: Optional[str] = Query(None, description="Only hosts with this tag, e.g. env=prod"),
+    minutes: int = Query(60, ge=1, le=10080),
+    pct: float = Query(95, ge=0, le=100),
+    threshold: Optional[float] = None,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Per-group aggregates of metric over the last minutes, and one value per
+    host for an at-a-glance grid. With threshold set, hosts whose percentile
+    exceeds it are counted per group."""
+    servers = await tenant_servers(db, tenant_id, tag)
+    since = datetime.utcnow() - timedelta(minutes=minutes)
+    conditions = metric_conditions([server.id for server in servers], metric, since)
+
+    # Percentiles are computed by Postgres, so the samples stay there
+    values, latest, group_stats = {}, {}, {}
+    if servers:
+        result = await db.execute(
+            select(Metric.server_id, percentile(Metric.value, pct))
+            .where(*conditions)
+            .group_by(Metric.server_id)
+        )
+        values = dict(result.all())
+        result = await db.execute(
+            select(Metric.server_id, Metric.value)
+            .where(*conditions)
+            .distinct(Metric.server_id)
+            .order_by(Metric.server_id, Metric.collected_at.desc())
+        )
+        latest = dict(result.all())
+        samples = (
+            select(group_column(group_by).label("grp"), Metric.value)
+            .join(Server, Server.id == Metric.server_id)
+            .where(*conditions)
+            .subquery()
+        )
+        result = await db.execute(
+            select(
+                samples.c.grp,
+                percentile(samples.c.value, pct),
+                percentile(samples.c.value, 50),
+                func.max(samples.c.value),
+            ).group_by(samples.c.grp)
+        )
+        group_stats = {group: stats for group, *stats in result.all()}
+
+    result = await db.execute(
+        select(Alert.server_id, func.count(Alert.id))
+        .where(Alert.server_id.in_([server.id for server in servers]), Alert.status == "active")
+        .group_by(Alert.server_id)
+    )
+    active_alerts = dict(result.all())
+
+    hosts = []
+    groups: Dict[str, dict] = {}
+    for server in servers:
+        group = host_group(server, group_by)
+        value = values.get(server.id)
+        over = threshold is not None and value is not None and value > threshold
+        hosts.append({
+            "id": server.id,
+            "hostname": server.hostname,
+            "group": group,
+            "status": server.status,
+            "value": rounded(value),
+            "latest": rounded(latest.get(server.id)),
+            "over_threshold": over,
+            "active_alerts": active_alerts.get(server.id, 0),
+        })
+
+        summary = groups.setdefault(group, {
+            "group": group, "hosts": 0, "online": 0, "reporting": 0,
+            "over_threshold": 0, "active_alerts": 0
+        })
+        summary["hosts"] += 1
+        summary["online"] += server.status == "online"
+        summary["reporting"] += value is not None
+        summary["over_threshold"] += over
+        summary["active_alerts"] += active_alerts.get(server.id, 0)
+
+    for summary in groups.values():
+        group_pct, group_median, group_max = group_stats.get(summary["group"], (None, None, None))
+        summary.update({
+            "percentile": rounded(group_pct),
+            "median": rounded(group_median),
+            "max": rounded(group_max),
+        })
+
+    return {
+        "metric": metric,
+        "percentile": pct,
+        "minutes": minutes,
+        "threshold": threshold,
+        "group_by": group_by,
+        "groups": sorted(groups.values(), key=lambda summary: summary["group"]),
+        "hosts": hosts,
+    }
+
+@router.get("/heatmap")
+async def fleet_heatmap(
+    metric: str = "cpu.usage_percent",
+    rows: str = Query("host", pattern="^(host|group)$"),
+    group_by: Optional[str] = None,
+    tag: Optional[str] = None,
+    hours: int = Query(24, ge=1, le=168),
+    buckets: int = Query(48, ge=1, le=500),
+    pct: float = Query(95, ge=0, le=100),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """A grid of metric with one row per host (or tag group) and one column
+    per time bucket, each cell the percentile of the samples in it (null
+    without samples)."""
+    servers = await tenant_servers(db, tenant_id, tag)
+    until = datetime.utcnow()
+    since = until - timedelta(hours=hours)
+    bucket_seconds = hours * 3600 / buckets
+    conditions = metric_conditions([server.id for server in servers], metric, since)
+
+    if rows == "group":
+        row_of = {server.id: host_group(server, group_by) for server in servers}
+        row_key = group_column(group_by)
+    else:
+        row_of = {server.id: server.hostname for server in servers}
+        row_key = Metric.server_id
+
+    cells = defaultdict(dict)
+    if servers:
+        bucket = func.least(
+            func.floor(func.extract("epoch", Metric.collected_at - since) / bucket_seconds),
+            buckets - 1
+        )
+        samples = (
+            select(row_key.label("row_key"), bucket.label("bucket"), Metric.value)
+            .join(Server, Server.id == Metric.server_id)
+            .where(*conditions)
+            .subquery()
+        )
+        result = await db.execute(
+            select(samples.c.row_key, samples.c.bucket, percentile(samples.c.value, pct))
+            .group_by(samples.c.row_key, samples.c.bucket)
+        )
+        for row, index, value in result.all():
+            if rows == "host":
+                row = row_of[row]
+            cells[row][int(index)] = value
+
+    return {
+        "metric": metric,
+        "percentile": pct,
+        "buckets": [(since + timedelta(seconds=bucket_seconds * i)).isoformat() for i in range(buckets)],
+        "rows": [
+            {
+                "key": key,
+                "values": [rounded(cells[key].get(i)) for i in range(buckets)],
+            }
+            for key in sorted(set(row_of.values()))
+        ],
+    }
+
+def version_key(version: str):
+    """Sort key for versions such as 3.0.2, 1.1.1w or 17.0.9+9: numbers compare
+    as numbers, and a letter suffix after its number (1.1.1 < 1.1.1w)."""
+    return [
+        (int(part), "") if part.isdigit() else (-1, part)
+        for part in re.findall(r"\d+|[a-z]+", version.lower())
+    ]
+
+@router.get("/runtimes")
+async def fleet_runtimes(
+    runtime: Optional[str] = Query(None, description="Only this runtime, e.g. openssl"),
+    below: Optional[str] = Query(None, description="Only versions older than this one, e.g. 3.0.7"),
+    tag: Optional[str] = Query(None, description="Only hosts with this tag, e.g. env=prod"),
+    hours: int = Query(24, ge=1, le=168),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """The runtimes (openssl, glibc, node, ...) each host reported in the last
+    hours, at their latest version, and how many hosts run each version. With
+    below set, only the hosts on an older version are listed."""
+    servers = await tenant_servers(db, tenant_id, tag)
+    since = datetime.utcnow() - timedelta(hours=hours)
+    latest = {}
+    if servers:
+        # The latest sample of each runtime on each host, picked by Postgres
+        name = Metric.metric_metadata["runtime"].as_string()
+        query = (
+            select(Metric.server_id, Metric.metric_metadata, Metric.collected_at)
+            .where(
+                Metric.server_id.in_([server.id for server in servers]),
+                Metric.metric_type == "runtime",
+                Metric.metric_name == "installed",
+                Metric.collected_at >= since,
+                name.isnot(None)
+            )
+            .distinct(Metric.server_id, name)
+            .order_by(Metric.server_id, name, Metric.collected_at.desc())
+        )
+        if runtime:
+            query = query.where(name == runtime)
+        result = await db.execute(query)
+        for server_id, metadata, collected_at in result.all():
+            metadata = metadata or {}
+            version = metadata.get("version")
+            if not version:
+                continue
+            latest[(server_id, metadata["runtime"])] = {
+                "runtime": metadata["runtime"],
+                "version": str(version),
+                "path": metadata.get("path"),
+                "seen_at": collected_at.isoformat(),
+            }
+
+    hosts = []
+    versions = defaultdict(lambda: defaultdict(int))
+    for server in servers:
+        found = sorted(
+            (entry for (server_id, _), entry in latest.items() if server_id == server.id),
+            key=lambda entry: entry["runtime"]
+        )
+        if below:
+            found = [entry for entry in found if version_key(entry["version"]) < version_key(below)]
+        if not found:
+            continue
+        for entry in found:
+            versions[entry["runtime"]][entry["version"]] += 1
+        hosts.append({"id": server.id, "hostname": server.hostname, "runtimes": found})
+
+    return {
+        "runtime": runtime,
+        "below": below,
+        "hours": hours,
+        "versions": {
+            name: [
+                {"version": version, "hosts": count}
+                for version, count in sorted(counts.items(), key=lambda item: version_key(item[0]))
+            ]
+            for name, counts in sorted(versions.items())
+        },
+        "hosts": hosts,
+    }
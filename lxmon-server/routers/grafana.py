@@ -0,0 +1,240 @@
+"""
+Grafana data source API (SimpleJSON / JSON API plugin protocol), so Grafana
+can chart lxmon metrics and show agent events as annotations.
+
+Targets are "<metric_type>.<metric_name>" (one series per host and metadata
+combination), optionally narrowed to one host with "@<hostname>", e.g.
+"cpu.usage_percent@web-1". The search target "hosts" lists hostnames for
+template variables.
+"""
+
+from collections import defaultdict
+from datetime import datetime, timedelta, timezone
+from fastapi import APIRouter, Depends
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select
+from pydantic import BaseModel
+from typing import Any, Dict, List, Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_integration_tenant_id
+from models.models import Server, Metric, MaintenanceWindow
+from utils.maintenance import covers
+from utils.archive import VOLATILE_METADATA, archived_rows
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+class GrafanaSearch(BaseModel):
+    target: str = ""
+
+class GrafanaTarget(BaseModel):
+    target: str = ""
+    type: str = "timeserie"
+
+class GrafanaQuery(BaseModel):
+    # {"from": ..., "to": ...}
+    range: Dict[str, datetime]
+    intervalMs: int = 60000
+    maxDataPoints: int = 1000
+    targets: List[GrafanaTarget] = []
+
+class GrafanaAnnotation(BaseModel):
+    name: Optional[str] = None
+    query: Optional[str] = None
+
+class GrafanaAnnotationQuery(BaseModel):
+    range: Dict[str, datetime]
+    annotation: GrafanaAnnotation
+
+def to_utc_naive(value: datetime) -> datetime:
+    """Metrics are stored as naive UTC."""
+    if value.tzinfo is not None:
+        value = value.astimezone(timezone.utc).replace(tzinfo=None)
+    return value
+
+def epoch_ms(value: datetime) -> int:
+    return int((value - datetime(1970, 1, 1)).total_seconds() * 1000)
+
+def parse_target(target: str):
+    """Split "type.name@host" into its parts; host may be None."""
+    host = None
+    if "@" in target:
+        target, host = target.rsplit("@", 1)
+    metric_type, _, metric_name = target.partition(".")
+    return metric_type, metric_name, host or None
+
+def series_labels(metadata: Optional[Dict[str, Any]]) -> str:
+    if not metadata:
+        return ""
+    labels = [
+        f"{key}={value}" for key, value in sorted(metadata.items())
+        if key not in VOLATILE_METADATA and not isinstance(value, (dict, list))
+    ]
+    return " {" + ", ".join(labels) + "}" if labels else ""
+
+@router.get("/")
+async def grafana_test(tenant_id: str = Depends(get_integration_tenant_id)):
+    """Connection test used by Grafana's "Save & test"."""
+    return {"status": "ok"}
+
+@router.post("/search")
+async def grafana_search(
+    search: GrafanaSearch,
+    tenant_id: str = Depends(get_integration_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """List queryable targets, or hostnames for the target "hosts"."""
+    if search.target == "hosts":
+        result = await db.execute(
+            select(Server.hostname).where(Server.tenant_id == tenant_id).order_by(Server.hostname)
+        )
+        return [row[0] for row in result.all()]
+
+    since = datetime.utcnow() - timedelta(hours=24)
+    result = await db.execute(
+        select(Metric.metric_type, Metric.metric_name).distinct()
+        .join(Server, Server.id == Metric.server_id)
+        .where(
+            Server.tenant_id == tenant_id,
+            Metric.collected_at >= since,
+            Metric.metric_type != "event"
+        )
+    )
+    targets = sorted(f"{metric_type}.{metric_name}" for metric_type, metric_name in result.all())
+    if search.target:
+        targets = [target for target in targets if search.target.lower() in target.lower()]
+    return targets
+
+@router.post("/query")
+async def grafana_query(
+    query: GrafanaQuery,
+    tenant_id: str = Depends(get_integration_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Time series for each target, averaged into intervalMs buckets."""
+    since = to_utc_naive(query.range["from"])
+    until = to_utc_naive(query.range["to"])
+    # intervalMs buckets, widened if needed to stay within maxDataPoints
+    bucket_ms = max(query.intervalMs, int((until - since).total_seconds() * 1000 / max(query.maxDataPoints, 1)), 1)
+
+    response = []
+    for target in query.targets:
+        if target.type != "timeserie" or not target.target:
+            continue
+        metric_type, metric_name, host = parse_target(target.target)
+        statement = (
+            select(Server.hostname, Metric.value, Metric.metric_metadata, Metric.collected_at)
+            .join(Server, Server.id == Metric.server_id)
+            .where(
+                Server.tenant_id == tenant_id,
+                Metric.metric_type == metric_type,
+                Metric.metric_name == metric_name,
+                Metric.collected_at >= since,
+                Metric.collected_at <= until
+            )
+            .order_by(Metric.collected_at)
+        )
+        if host:
+            statement = statement.where(Server.hostname == host)
+        result = await db.execute(statement)
+
+        # series -> bucket start -> [sum, count]
+        series = defaultdict(dict)
+        for hostname, value, metadata, collected_at in result.all():
+            name = f"{hostname}{series_labels(metadata)}"
+            bucket = epoch_ms(collected_at) // bucket_ms * bucket_ms
+            total = series[name].setdefault(bucket, [0.0, 0])
+            total[0] += value
+            total[1] += 1
+
+        # Days past the retention come from the archive, already downsampled
+        for row in await archived_rows(db, tenant_id, since, until, metric_type, metric_name, host):
+            name = f"{row['hostname']}{series_labels(row['metadata'])}"
+            bucket = epoch_ms(row["t"]) // bucket_ms * bucket_ms
+            total = series[name].setdefault(bucket, [0.0, 0])
+            total[0] += row["avg"] * row["count"]
+            total[1] += row["count"]
+
+        for name in sorted(series):
+            response.append({
+                "target": f"{target.target} {name}" if len(query.targets) > 1 else name,
+                "datapoints": [
+                    [total / count, bucket] for bucket, (total, count) in sorted(series[name].items())
+                ]
+            })
+    return response
+
+@router.post("/annotations")
+async def grafana_annotations(
+    query: GrafanaAnnotationQuery,
+    tenant_id: str = Depends(get_integration_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Agent events (deploy markers, failovers, ...) as annotations, and
+    maintenance windows as regions. The annotation query is an event type
+    ("maintenance" for the windows), optionally "@hostname"; empty matches
+    all events."""
+    event_type, _, host = (query.annotation.query or "").partition("@")
+    since = to_utc_naive(query.range["from"])
+    until = to_utc_naive(query.range["to"])
+    statement = (
+        select(Server.hostname, Metric.metric_name, Metric.metric_metadata, Metric.collected_at)
+        .join(Server, Server.id == Metric.server_id)
+        .where(
+            Server.tenant_id == tenant_id,
+            Metric.metric_type == "event",
+            Metric.collected_at >= since,
+            Metric.collected_at <= until
+        )
+        .order_by(Metric.collected_at)
+        .limit(1000)
+    )
+    if event_type:
+        statement = statement.where(Metric.metric_name == event_type)
+    if host:
+        statement = statement.where(Server.hostname == host)
+    result = await db.execute(statement)
+
+    annotations = [
+        {
+            "annotation": query.annotation.dict(),
+            "time": epoch_ms(collected_at),
+            "title": f"{hostname}: {name}",
+            "text": (metadata or {}).get("message", ""),
+            "tags": [name, hostname, (metadata or {}).get("severity", "info")]
+        }
+        for hostname, name, metadata, collected_at in result.all()
+    ]
+
+    if event_type in ("", "maintenance"):
+        result = await db.execute(
+            select(MaintenanceWindow).where(
+                MaintenanceWindow.tenant_id == tenant_id,
+                MaintenanceWindow.starts_at <= until,
+                MaintenanceWindow.ends_at >= since
+            )
+        )
+        windows = result.scalars().all()
+        result = await db.execute(select(Server).where(Server.tenant_id == tenant_id))
+        servers = {server.id: server for server in result.scalars().all()}
+        if host:
+            server = next((server for server in servers.values() if server.hostname == host), None)
+            windows = [window for window in windows if server and covers(window, server)]
+        for window in windows:
+            if window.server_id is not None:
+                scope = servers[window.server_id].hostname if window.server_id in servers else "deleted host"
+            else:
+                scope = window.tag or "all hosts"
+            annotations.append({
+                "annotation": query.annotation.dict(),
+                "time": epoch_ms(window.starts_at),
+                "timeEnd": epoch_ms(window.ends_at),
+                "isRegion": True,
+                "title": f"Maintenance: {window.name}",
+                "text": f"{window.name} ({scope}, by {window.created_by or window.source})",
+                "tags": ["maintenance"]
+            })
+    return annotations
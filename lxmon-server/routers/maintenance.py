@@ -0,0 +1,188 @@
+"""
+Maintenance router for scheduling maintenance windows that silence alerts.
+"""
+
+from datetime import datetime, timedelta, timezone
+from fastapi import APIRouter, Depends, HTTPException, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select, desc
+from typing import List, Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_current_user, get_current_tenant_id
+from models.models import MaintenanceWindow, Server, User
+from core.schemas import MaintenanceWindowCreate, MaintenanceWindowUpdate, MaintenanceWindowResponse
+from utils.maintenance import is_active
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+def window_response(window: MaintenanceWindow) -> MaintenanceWindowResponse:
+    response = MaintenanceWindowResponse.from_orm(window)
+    response.active = is_active(window)
+    return response
+
+async def get_tenant_window(window_id: int, tenant_id: str, db: AsyncSession) -> MaintenanceWindow:
+    result = await db.execute(
+        select(MaintenanceWindow).where(
+            MaintenanceWindow.id == window_id,
+            MaintenanceWindow.tenant_id == tenant_id
+        )
+    )
+    window = result.scalar_one_or_none()
+
+    if not window:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Maintenance window not found"
+        )
+
+    return window
+
+def to_utc_naive(value: Optional[datetime]) -> Optional[datetime]:
+    """Windows are stored as naive UTC, like metrics."""
+    if value is not None and value.tzinfo is not None:
+        value = value.astimezone(timezone.utc).replace(tzinfo=None)
+    return value
+
+def check_times(starts_at: datetime, ends_at: datetime):
+    if ends_at <= starts_at:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="Maintenance window must end after it starts"
+        )
+
+@router.get("/", response_model=List[MaintenanceWindowResponse])
+async def get_maintenance_windows(
+    active: Optional[bool] = None,
+    server_id: Optional[int] = None,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get maintenance windows; active=false lists upcoming and past ones."""
+    query = select(MaintenanceWindow).where(MaintenanceWindow.tenant_id == tenant_id)
+    if server_id is not None:
+        query = query.where(MaintenanceWindow.server_id == server_id)
+
+    result = await db.execute(query.order_by(desc(MaintenanceWindow.starts_at)).limit(500))
+    windows = [window_response(window) for window in result.scalars().all()]
+    if active is not None:
+        windows = [window for window in windows if window.active == active]
+    return windows
+
+@router.post("/", response_model=MaintenanceWindowResponse)
+async def create_maintenance_window(
+    window_data: MaintenanceWindowCreate,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Schedule a maintenance window."""
+    if window_data.server_id is not None and window_data.tag:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="Give server_id or tag, not both"
+        )
+    if window_data.server_id is not None:
+        result = await db.execute(
+            select(Server).where(
+                Server.id == window_data.server_id,
+                Server.tenant_id == tenant_id
+            )
+        )
+        if not result.scalar_one_or_none():
+            raise HTTPException(
+                status_code=status.HTTP_404_NOT_FOUND,
+                detail="Server not found"
+            )
+
+    starts_at = to_utc_naive(window_data.starts_at) or datetime.utcnow()
+    ends_at = to_utc_naive(window_data.ends_at)
+    if ends_at is None:
+        if window_data.duration_minutes is None:
+            raise HTTPException(
+                status_code=status.HTTP_400_BAD_REQUEST,
+                detail="Give ends_at or duration_minutes"
+            )
+        ends_at = starts_at + timedelta(minutes=window_data.duration_minutes)
+    check_times(starts_at, ends_at)
+
+    window = MaintenanceWindow(
+        name=window_data.name,
+        server_id=window_data.server_id,
+        tag=window_data.tag,
+        starts_at=starts_at,
+        ends_at=ends_at,
+        source="api",
+        created_by=current_user.username,
+        tenant_id=tenant_id
+    )
+    db.add(window)
+    await db.commit()
+    await db.refresh(window)
+
+    logger.info(f"Scheduled maintenance window {window.name} ({starts_at} - {ends_at})")
+    return window_response(window)
+
+@router.put("/{window_id}", response_model=MaintenanceWindowResponse)
+async def update_maintenance_window(
+    window_id: int,
+    window_data: MaintenanceWindowUpdate,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Rename or reschedule a maintenance window."""
+    window = await get_tenant_window(window_id, tenant_id, db)
+
+    update_data = {
+        field: to_utc_naive(value) if isinstance(value, datetime) else value
+        for field, value in window_data.dict(exclude_unset=True).items()
+    }
+    check_times(update_data.get("starts_at", window.starts_at), update_data.get("ends_at", window.ends_at))
+    if update_data:
+        for field, value in update_data.items():
+            setattr(window, field, value)
+
+        await db.commit()
+        await db.refresh(window)
+
+    return window_response(window)
+
+@router.post("/{window_id}/end", response_model=MaintenanceWindowResponse)
+async def end_maintenance_window(
+    window_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """End an active maintenance window now."""
+    window = await get_tenant_window(window_id, tenant_id, db)
+
+    if not is_active(window):
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="Maintenance window is not active"
+        )
+
+    window.ends_at = datetime.utcnow()
+    await db.commit()
+    await db.refresh(window)
+
+    logger.info(f"Ended maintenance window {window.name}")
+    return window_response(window)
+
+@router.delete("/{window_id}")
+async def delete_maintenance_window(
+    window_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Delete a maintenance window."""
+    window = await get_tenant_window(window_id, tenant_id, db)
+
+    await db.delete(window)
+    await db.commit()
+
+    logger.info(f"Deleted maintenance window {window.name}")
+    return {"status": "ok", "message": "Maintenance window deleted successfully"}
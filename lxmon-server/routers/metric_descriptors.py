@@ -0,0 +1,34 @@
+"""
+Metric descriptors router: what agents say the metrics they collect mean, so
+the dashboard can document a series without knowing the agent's collectors.
+"""
+
+from fastapi import APIRouter, Depends
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select
+from typing import List, Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_current_tenant_id
+from models.models import MetricDescriptor
+from core.schemas import MetricDescriptorResponse
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+@router.get("/descriptors", response_model=List[MetricDescriptorResponse])
+async def get_metric_descriptors(
+    metric_type: Optional[str] = None,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get metric descriptions, by type and name."""
+    query = select(MetricDescriptor).where(MetricDescriptor.tenant_id == tenant_id)
+    if metric_type:
+        query = query.where(MetricDescriptor.metric_type == metric_type)
+    result = await db.execute(
+        query.order_by(MetricDescriptor.metric_type, MetricDescriptor.metric_name)
+    )
+    return result.scalars().all()
@@ -0,0 +1,194 @@
+"""
+Scripts router for the fleet-wide script library. Versions are immutable and
+identified by their SHA-256, which is what agents fetch and verify.
+"""
+
+from datetime import datetime
+from fastapi import APIRouter, Depends, HTTPException, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select
+from sqlalchemy.orm import selectinload
+from typing import List
+import hashlib
+import logging
+
+from core.database import get_db
+from core.auth import get_current_user, get_current_tenant_id
+from models.models import Script, ScriptVersion, User
+from core.schemas import (
+    ScriptCreate, ScriptVersionCreate, ScriptResponse,
+    ScriptVersionResponse, ScriptVersionContent
+)
+from utils.audit import record_audit
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+def script_sha256(content: str) -> str:
+    return hashlib.sha256(content.encode()).hexdigest()
+
+def script_response(script: Script, with_versions: bool = False) -> ScriptResponse:
+    latest = script.versions[-1]
+    return ScriptResponse(
+        id=script.id,
+        name=script.name,
+        description=script.description,
+        latest_version=latest.version,
+        sha256=latest.sha256,
+        created_at=script.created_at,
+        updated_at=script.updated_at,
+        versions=[ScriptVersionResponse.from_orm(version) for version in script.versions] if with_versions else []
+    )
+
+async def get_tenant_script(script_id: int, tenant_id: str, db: AsyncSession) -> Script:
+    """Script with its versions, oldest first."""
+    result = await db.execute(
+        select(Script).options(selectinload(Script.versions)).where(
+            Script.id == script_id,
+            Script.tenant_id == tenant_id
+        )
+    )
+    script = result.scalar_one_or_none()
+
+    if not script:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Script not found"
+        )
+
+    return script
+
+@router.get("/", response_model=List[ScriptResponse])
+async def get_scripts(
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get the script library with each script's latest version."""
+    result = await db.execute(
+        select(Script).options(selectinload(Script.versions))
+        .where(Script.tenant_id == tenant_id)
+        .order_by(Script.name)
+    )
+    return [script_response(script) for script in result.scalars().all()]
+
+@router.get("/{script_id}", response_model=ScriptResponse)
+async def get_script(
+    script_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get a script and its version history."""
+    script = await get_tenant_script(script_id, tenant_id, db)
+    return script_response(script, with_versions=True)
+
+@router.post("/", response_model=ScriptResponse)
+async def create_script(
+    script_data: ScriptCreate,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Add a script to the library as version 1."""
+    script = Script(
+        name=script_data.name,
+        description=script_data.description,
+        tenant_id=tenant_id
+    )
+    db.add(script)
+    await db.flush()
+
+    version = ScriptVersion(
+        script_id=script.id,
+        version=1,
+        content=script_data.content,
+        sha256=script_sha256(script_data.content),
+        changelog=script_data.changelog,
+        created_by=current_user.username
+    )
+    db.add(version)
+    record_audit(
+        db, tenant_id, current_user.username, "script.created", "script", script.id,
+        {"name": script.name, "version": 1, "sha256": version.sha256}
+    )
+    await db.commit()
+
+    logger.info(f"Created script: {script.name}")
+    return script_response(await get_tenant_script(script.id, tenant_id, db), with_versions=True)
+
+@router.post("/{script_id}/versions", response_model=ScriptResponse)
+async def create_script_version(
+    script_id: int,
+    version_data: ScriptVersionCreate,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Publish a new version of a script."""
+    script = await get_tenant_script(script_id, tenant_id, db)
+
+    sha256 = script_sha256(version_data.content)
+    latest = script.versions[-1]
+    if sha256 == latest.sha256:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail=f"Content is unchanged from version {latest.version}"
+        )
+
+    version = ScriptVersion(
+        script_id=script.id,
+        version=latest.version + 1,
+        content=version_data.content,
+        sha256=sha256,
+        changelog=version_data.changelog,
+        created_by=current_user.username
+    )
+    db.add(version)
+    script.updated_at = datetime.utcnow()
+    record_audit(
+        db, tenant_id, current_user.username, "script.versioned", "script", script.id,
+        {"name": script.name, "version": version.version, "sha256": sha256}
+    )
+    await db.commit()
+
+    logger.info(f"Script {script.name} is now at version {version.version}")
+    return script_response(await get_tenant_script(script.id, tenant_id, db), with_versions=True)
+
+@router.get("/{script_id}/versions/{version}", response_model=ScriptVersionContent)
+async def get_script_version(
+    script_id: int,
+    version: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get one version of a script, with its content."""
+    script = await get_tenant_script(script_id, tenant_id, db)
+
+    for script_version in script.versions:
+        if script_version.version == version:
+            return script_version
+
+    raise HTTPException(
+        status_code=status.HTTP_404_NOT_FOUND,
+        detail="Script version not found"
+    )
+
+@router.delete("/{script_id}")
+async def delete_script(
+    script_id: int,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Delete a script and all its versions."""
+    script = await get_tenant_script(script_id, tenant_id, db)
+
+    await db.delete(script)
+    record_audit(
+        db, tenant_id, current_user.username, "script.deleted", "script", script.id,
+        {"name": script.name}
+    )
+    await db.commit()
+
+    logger.info(f"Deleted script: {script.name}")
+    return {"status": "ok", "message": "Script deleted successfully"}
@@ -5,23 +5,47 @@ Servers router for dashboard API endpoints.
 from datetime import datetime, timedelta
 from fastapi import APIRouter, Depends, HTTPException, status, Query
 from sqlalchemy.ext.asyncio import AsyncSession
-from sqlalchemy import select, func, desc
+from sqlalchemy import select, update, func, desc
 from typing import List, Optional
 import logging
+import re
 
 from core.database import get_db
-from core.auth import get_current_user, get_current_tenant_id
+from core.auth import get_current_admin, get_current_user, get_current_tenant_id
 from database.redis_client import redis_client
-from models.models import Server, Metric, Command, User
+from models.models import Server, Metric, Command, CrashReport, Alert, MaintenanceWindow, User, Script, ScriptVersion
+from core.config import settings
 from core.schemas import (
-    ServerCreate, ServerUpdate, ServerResponse,
-    CommandCreate, CommandResponse, MetricData
+    ServerCreate, ServerUpdate, ServerResponse, ServerRename, ServerMerge,
+    CommandCreate, CommandResponse, CommandReview, MetricData, AgentConfig,
+    LogLevelControl, ScriptRun, CrashReportResponse
 )
+from utils.audit import record_audit
 
 logger = logging.getLogger(__name__)
 
 router = APIRouter()
 
+def require_capability(server: Server, capability: str):
+    """Refuse a command the server's agent cannot run itself. Agents run
+    commands they do not know as shell text, so these are never queued to
+    them."""
+    if capability not in (server.agent_capabilities or []):
+        raise HTTPException(
+            status_code=status.HTTP_409_CONFLICT,
+            detail=f"The agent of {server.hostname} does not support {capability} commands; upgrade it"
+        )
+
+def approval_rule(command: str) -> Optional[str]:
+    """The dangerous pattern command matches, if any."""
+    for pattern in settings.COMMAND_APPROVAL_PATTERNS:
+        try:
+            if re.search(pattern, command):
+                return pattern
+        except re.error:
+            logger.warning(f"Invalid COMMAND_APPROVAL_PATTERNS entry: {pattern}")
+    return None
+
 @router.get("/", response_model=List[ServerResponse])
 async def get_servers(
     skip: int = Query(0, ge=0),
@@ -37,6 +61,37 @@ async def get_servers(
     servers = result.scalars().all()
     return servers
 
+@router.get("/duplicates")
+async def get_duplicate_servers(
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Servers that are likely the same host: they share an agent ID (a
+    renamed host whose new name was already taken) or an IP address (a
+    hostname change by an agent too old to report an ID). Merge them with
+    POST /api/servers/{id}/merge."""
+    result = await db.execute(
+        select(Server).where(Server.tenant_id == tenant_id).order_by(Server.created_at)
+    )
+    servers = result.scalars().all()
+
+    duplicates = []
+    for reason in ("agent_id", "ip_address"):
+        groups = {}
+        for server in servers:
+            value = getattr(server, reason)
+            if value and value not in ("127.0.0.1", "::1"):
+                groups.setdefault(value, []).append(server)
+        duplicates.extend(
+            {
+                "reason": reason,
+                "value": value,
+                "servers": [ServerResponse.from_orm(server) for server in group],
+            }
+            for value, group in groups.items() if len(group) > 1
+        )
+    return duplicates
+
 @router.get("/{server_id}", response_model=ServerResponse)
 async def get_server(
     server_id: int,
@@ -69,7 +124,7 @@ async def create_server(
     """Create a new server."""
     # Check if hostname already exists
     result = await db.execute(
-        select(Server).where(Server.hostname == server_data.hostname)
+        select(Server).where(Server.hostname == server_data.hostname, Server.tenant_id == tenant_id)
     )
     existing_server = result.scalar_one_or_none()
 
@@ -128,6 +183,133 @@ async def update_server(
 
     return server
 
+@router.post("/{server_id}/rename", response_model=ServerResponse)
+async def rename_server(
+    server_id: int,
+    rename_data: ServerRename,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Rename a server, keeping its history. Its agent is recognized by its
+    ID, so it keeps reporting under the new name while its own hostname is
+    unchanged."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+    if server.agent_version and not server.agent_id:
+        # The agent would register as a new server under its old name
+        raise HTTPException(
+            status_code=status.HTTP_409_CONFLICT,
+            detail="The agent of this server does not report an agent ID; upgrade it or change its hostname setting instead"
+        )
+    if rename_data.hostname != server.hostname:
+        result = await db.execute(
+            select(Server.id).where(Server.hostname == rename_data.hostname, Server.tenant_id == tenant_id)
+        )
+        if result.scalar_one_or_none() is not None:
+            raise HTTPException(
+                status_code=status.HTTP_409_CONFLICT,
+                detail="Another server has this hostname; merge them instead"
+            )
+
+    previous = server.hostname
+    if rename_data.name:
+        server.name = rename_data.name
+    elif server.name == previous:
+        server.name = rename_data.hostname
+    server.hostname = rename_data.hostname
+    server.hostname_pinned = True
+    record_audit(
+        db, tenant_id, current_user.username, "server.renamed", "server", server.id,
+        {"from": previous, "to": server.hostname, "name": server.name}
+    )
+    await db.commit()
+    await db.refresh(server)
+
+    logger.info(f"Renamed server {previous} to {server.hostname}")
+    return server
+
+@router.post("/{server_id}/merge", response_model=ServerResponse)
+async def merge_servers(
+    server_id: int,
+    merge_data: ServerMerge,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Move the metrics, commands, alerts and maintenance windows of the
+    source servers into this one, then delete the sources. The server keeps
+    its settings and takes the agent ID of whichever server was seen last, so
+    that agent finds it (and renames it to the hostname it reports, unless an
+    admin renamed it)."""
+    source_ids = list(dict.fromkeys(merge_data.source_ids))
+    if server_id in source_ids:
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail="Cannot merge a server into itself"
+        )
+    result = await db.execute(
+        select(Server).where(
+            Server.id.in_([server_id] + source_ids),
+            Server.tenant_id == tenant_id
+        )
+    )
+    servers = {server.id: server for server in result.scalars().all()}
+    missing = [missing_id for missing_id in [server_id] + source_ids if missing_id not in servers]
+    if missing:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail=f"Server not found: {', '.join(map(str, missing))}"
+        )
+
+    server = servers[server_id]
+    sources = [servers[source_id] for source_id in source_ids]
+    moved = {}
+    for model in (Metric, Command, CrashReport, Alert, MaintenanceWindow):
+        result = await db.execute(
+            update(model).where(model.server_id.in_(source_ids)).values(server_id=server_id)
+        )
+        moved[model.__tablename__] = result.rowcount
+
+    latest = max([server] + sources, key=lambda candidate: candidate.last_heartbeat or candidate.created_at)
+    latest_agent_id = latest.agent_id
+    server.last_heartbeat = latest.last_heartbeat
+
+    for source in sources:
+        # Commands still queued for the source's agent
+        while (command := await redis_client.pop_command(source.id)) is not None:
+            await redis_client.push_command(server_id, command)
+        await db.delete(source)
+    # Agent IDs are unique within a tenant: the sources go first
+    await db.flush()
+    if latest_agent_id:
+        server.agent_id = latest_agent_id
+
+    record_audit(
+        db, tenant_id, current_user.username, "server.merged", "server", server.id,
+        {
+            "hostname": server.hostname,
+            "sources": [{"id": source.id, "hostname": source.hostname} for source in sources],
+            "moved": moved,
+        }
+    )
+    await db.commit()
+    await db.refresh(server)
+
+    logger.info(f"Merged {', '.join(source.hostname for source in sources)} into {server.hostname}")
+    return server
+
 @router.delete("/{server_id}")
 async def delete_server(
     server_id: int,
@@ -155,6 +337,65 @@ async def delete_server(
     logger.info(f"Deleted server: {server.hostname}")
     return {"status": "ok", "message": "Server deleted successfully"}
 
+@router.get("/{server_id}/agent-config", response_model=AgentConfig)
+async def get_server_agent_config(
+    server_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get the settings pushed to a server's agent."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+
+    return {"settings": server.agent_config or {}}
+
+@router.put("/{server_id}/agent-config", response_model=AgentConfig)
+async def update_server_agent_config(
+    server_id: int,
+    config_data: AgentConfig,
+    current_user: User = Depends(get_current_admin),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Replace the settings pushed to a server's agent (admins). The agent
+    picks them up on its next poll; settings it cannot apply, or may not
+    take from the server, are rejected there."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+
+    previous = server.agent_config or {}
+    server.agent_config = config_data.settings
+    record_audit(
+        db, tenant_id, current_user.username, "server.agent_config_changed", "server", server.id,
+        {"hostname": server.hostname, "from": previous, "to": config_data.settings}
+    )
+    await db.commit()
+
+    logger.info(f"Updated agent settings for {server.hostname} by {current_user.username}")
+    return {"settings": server.agent_config}
+
 @router.get("/{server_id}/metrics")
 async def get_server_metrics(
     server_id: int,
@@ -203,14 +444,69 @@ async def get_server_metrics(
         "count": len(metrics)
     }
 
+@router.get("/{server_id}/collectors")
+async def get_server_collectors(
+    server_id: int,
+    hours: int = Query(1, ge=1, le=24),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get per-collector health from the agent's collector_up and
+    collector_duration metrics. Collectors with nothing to collect on the
+    host report neither and are not listed."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+
+    since = datetime.utcnow() - timedelta(hours=hours)
+    result = await db.execute(
+        select(Metric).where(
+            Metric.server_id == server_id,
+            Metric.metric_type == "agent",
+            Metric.metric_name.in_(["collector_up", "collector_duration"]),
+            Metric.collected_at >= since
+        ).order_by(desc(Metric.collected_at))
+    )
+
+    # Newest first, so the first value seen per collector is the latest
+    collectors = {}
+    for metric in result.scalars().all():
+        name = (metric.metric_metadata or {}).get("collector")
+        if not name:
+            continue
+        entry = collectors.setdefault(name, {"name": name, "last_seen": metric.collected_at})
+        if metric.metric_name == "collector_up" and "up" not in entry:
+            entry["up"] = metric.value == 1
+            entry["error"] = (metric.metric_metadata or {}).get("error")
+        elif metric.metric_name == "collector_duration" and "duration_seconds" not in entry:
+            entry["duration_seconds"] = metric.value
+
+    return {
+        "server_id": server_id,
+        "server_name": server.name,
+        "collectors": sorted(collectors.values(), key=lambda entry: entry["name"])
+    }
+
 @router.post("/{server_id}/command", response_model=CommandResponse)
 async def send_command(
     server_id: int,
     command_data: CommandCreate,
+    current_user: User = Depends(get_current_user),
     tenant_id: str = Depends(get_current_tenant_id),
     db: AsyncSession = Depends(get_db)
 ):
-    """Send command to server."""
+    """Send command to server. Dangerous commands (COMMAND_APPROVAL_PATTERNS)
+    wait for a second user to approve them."""
     # Verify server exists and belongs to tenant
     result = await db.execute(
         select(Server).where(
@@ -227,16 +523,29 @@ async def send_command(
         )
 
     # Create command record
+    rule = approval_rule(command_data.command)
     command = Command(
         server_id=server_id,
         command=command_data.command,
-        status="pending"
+        status="awaiting_approval" if rule else "pending",
+        requested_by=current_user.username,
+        approval_rule=rule
     )
 
     db.add(command)
+    await db.flush()
+    record_audit(
+        db, tenant_id, current_user.username,
+        "command.requested" if rule else "command.queued", "command", command.id,
+        {"server": server.hostname, "command": command.command, "approval_rule": rule}
+    )
     await db.commit()
     await db.refresh(command)
 
+    if rule:
+        logger.info(f"Command for server {server.hostname} awaits approval ({rule}): {command_data.command}")
+        return command
+
     # Add to Redis queue
     await redis_client.push_command(server_id, {
         "command_id": command.id,
@@ -246,6 +555,161 @@ async def send_command(
     logger.info(f"Command queued for server {server.hostname}: {command_data.command}")
     return command
 
+@router.post("/{server_id}/run-script", response_model=CommandResponse)
+async def run_script(
+    server_id: int,
+    run: ScriptRun,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Run a script from the library on a server. The agent fetches the
+    version by its hash; dangerous content needs approval like commands."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+
+    require_capability(server, "script")
+
+    query = select(ScriptVersion, Script.name).join(Script).where(
+        Script.id == run.script_id,
+        Script.tenant_id == tenant_id
+    )
+    if run.version is not None:
+        query = query.where(ScriptVersion.version == run.version)
+    result = await db.execute(query.order_by(desc(ScriptVersion.version)).limit(1))
+    row = result.first()
+
+    if not row:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Script version not found"
+        )
+    version, name = row
+
+    script_ref = {
+        "id": run.script_id,
+        "version": version.version,
+        "sha256": version.sha256,
+        "args": run.args
+    }
+    rule = approval_rule(version.content)
+    # No command text: the agent runs the script, never a shell line
+    command = Command(
+        server_id=server_id,
+        command="",
+        script=script_ref,
+        status="awaiting_approval" if rule else "pending",
+        requested_by=current_user.username,
+        approval_rule=rule
+    )
+
+    db.add(command)
+    await db.flush()
+    record_audit(
+        db, tenant_id, current_user.username,
+        "command.requested" if rule else "command.queued", "command", command.id,
+        {"server": server.hostname, "script": {**script_ref, "name": name}, "approval_rule": rule}
+    )
+    await db.commit()
+    await db.refresh(command)
+
+    if rule:
+        logger.info(f"Script {name} v{version.version} for server {server.hostname} awaits approval ({rule})")
+        return command
+
+    await redis_client.push_command(server_id, {
+        "command_id": command.id,
+        "command": command.command,
+        "script": script_ref
+    })
+
+    logger.info(f"Script {name} v{version.version} queued for server {server.hostname}")
+    return command
+
+@router.post("/{server_id}/log-level", response_model=CommandResponse)
+async def set_log_level(
+    server_id: int,
+    control: LogLevelControl,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Switch an agent's log level for a while; the agent reverts on its own."""
+    result = await db.execute(
+        select(Server).where(
+            Server.id == server_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    server = result.scalar_one_or_none()
+
+    if not server:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Server not found"
+        )
+
+    require_capability(server, "control")
+
+    # Sent as a control command: the agent handles it itself, no shell
+    control_data = {
+        "action": "log_level",
+        "level": control.level,
+        "duration_seconds": control.duration_minutes * 60
+    }
+    command = Command(
+        server_id=server_id,
+        command="",
+        control=control_data,
+        status="pending",
+        requested_by=current_user.username
+    )
+
+    db.add(command)
+    await db.flush()
+    record_audit(
+        db, tenant_id, current_user.username, "command.queued", "command", command.id,
+        {"server": server.hostname, "control": control_data}
+    )
+    await db.commit()
+    await db.refresh(command)
+
+    await redis_client.push_command(server_id, {
+        "command_id": command.id,
+        "command": command.command,
+        "control": control_data
+    })
+
+    logger.info(f"Log level {control.level} queued for server {server.hostname} ({control.duration_minutes}m)")
+    return command
+
+@router.get("/{server_id}/crash-reports", response_model=List[CrashReportResponse])
+async def get_server_crash_reports(
+    server_id: int,
+    limit: int = Query(20, ge=1, le=100),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get the crash reports the server's agent uploaded, newest first."""
+    result = await db.execute(
+        select(CrashReport).where(
+            CrashReport.server_id == server_id,
+            CrashReport.tenant_id == tenant_id
+        ).order_by(desc(CrashReport.crashed_at)).limit(limit)
+    )
+    return result.scalars().all()
+
 @router.get("/{server_id}/commands", response_model=List[CommandResponse])
 async def get_server_commands(
     server_id: int,
@@ -302,3 +766,113 @@ async def get_command_status(
         )
 
     return command
+
+async def get_command_for_review(command_id: int, tenant_id: str, db: AsyncSession) -> Command:
+    result = await db.execute(
+        select(Command).join(Server).where(
+            Command.id == command_id,
+            Server.tenant_id == tenant_id
+        )
+    )
+    command = result.scalar_one_or_none()
+
+    if not command:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Command not found"
+        )
+
+    if command.status != "awaiting_approval":
+        raise HTTPException(
+            status_code=status.HTTP_400_BAD_REQUEST,
+            detail=f"Command is {command.status}, not awaiting approval"
+        )
+
+    return command
+
+def check_reviewer(command: Command, user: User):
+    """Approvers need an approver role and must not review their own request."""
+    if user.role not in settings.COMMAND_APPROVER_ROLES:
+        raise HTTPException(
+            status_code=status.HTTP_403_FORBIDDEN,
+            detail=f"Approving commands requires one of the roles: {', '.join(settings.COMMAND_APPROVER_ROLES)}"
+        )
+    if command.requested_by == user.username:
+        raise HTTPException(
+            status_code=status.HTTP_403_FORBIDDEN,
+            detail="Commands must be approved by someone other than the requester"
+        )
+
+@router.get("/commands/awaiting-approval", response_model=List[CommandResponse])
+async def get_commands_awaiting_approval(
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get commands waiting for a second approver."""
+    result = await db.execute(
+        select(Command).join(Server).where(
+            Server.tenant_id == tenant_id,
+            Command.status == "awaiting_approval"
+        ).order_by(Command.created_at)
+    )
+    return result.scalars().all()
+
+@router.post("/commands/{command_id}/approve", response_model=CommandResponse)
+async def approve_command(
+    command_id: int,
+    review: CommandReview,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Approve a dangerous command and queue it for the agent."""
+    command = await get_command_for_review(command_id, tenant_id, db)
+    check_reviewer(command, current_user)
+
+    command.status = "pending"
+    command.reviewed_by = current_user.username
+    command.reviewed_at = datetime.utcnow()
+    command.review_note = review.note
+    record_audit(
+        db, tenant_id, current_user.username, "command.approved", "command", command.id,
+        {"command": command.command, "requested_by": command.requested_by, "note": review.note}
+    )
+    await db.commit()
+    await db.refresh(command)
+
+    await redis_client.push_command(command.server_id, {
+        "command_id": command.id,
+        "command": command.command,
+        "script": command.script
+    })
+
+    logger.info(f"Command {command.id} approved by {current_user.username} and queued")
+    return command
+
+@router.post("/commands/{command_id}/reject", response_model=CommandResponse)
+async def reject_command(
+    command_id: int,
+    review: CommandReview,
+    current_user: User = Depends(get_current_user),
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Reject a dangerous command; it is never sent to the agent."""
+    command = await get_command_for_review(command_id, tenant_id, db)
+    # The requester may withdraw their own command
+    if command.requested_by != current_user.username:
+        check_reviewer(command, current_user)
+
+    command.status = "rejected"
+    command.reviewed_by = current_user.username
+    command.reviewed_at = datetime.utcnow()
+    command.review_note = review.note
+    record_audit(
+        db, tenant_id, current_user.username, "command.rejected", "command", command.id,
+        {"command": command.command, "requested_by": command.requested_by, "note": review.note}
+    )
+    await db.commit()
+    await db.refresh(command)
+
+    logger.info(f"Command {command.id} rejected by {current_user.username}")
+    return command
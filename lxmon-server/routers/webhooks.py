@@ -0,0 +1,161 @@
+"""
+Webhooks router for managing outgoing webhooks.
+"""
+
+from fastapi import APIRouter, Depends, HTTPException, status
+from sqlalchemy.ext.asyncio import AsyncSession
+from sqlalchemy import select, desc
+from datetime import datetime
+from typing import List, Optional
+import logging
+
+from core.database import get_db
+from core.auth import get_current_tenant_id
+from models.models import Webhook
+from core.schemas import WebhookCreate, WebhookUpdate, WebhookResponse, WebhookTestResult
+from utils.webhooks import SAMPLE_PAYLOAD, check_destination, deliver, validate_template
+
+logger = logging.getLogger(__name__)
+
+router = APIRouter()
+
+def check_template(template: Optional[str]):
+    try:
+        validate_template(template)
+    except ValueError as e:
+        raise HTTPException(
+            status_code=status.HTTP_422_UNPROCESSABLE_ENTITY,
+            detail=str(e)
+        )
+
+async def check_url(url: str):
+    refused = await check_destination(url)
+    if refused:
+        raise HTTPException(
+            status_code=status.HTTP_422_UNPROCESSABLE_ENTITY,
+            detail=f"Webhook URL not allowed: {refused}"
+        )
+
+async def get_tenant_webhook(webhook_id: int, tenant_id: str, db: AsyncSession) -> Webhook:
+    result = await db.execute(
+        select(Webhook).where(
+            Webhook.id == webhook_id,
+            Webhook.tenant_id == tenant_id
+        )
+    )
+    webhook = result.scalar_one_or_none()
+
+    if not webhook:
+        raise HTTPException(
+            status_code=status.HTTP_404_NOT_FOUND,
+            detail="Webhook not found"
+        )
+
+    return webhook
+
+@router.get("/", response_model=List[WebhookResponse])
+async def get_webhooks(
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get list of webhooks."""
+    result = await db.execute(
+        select(Webhook).where(Webhook.tenant_id == tenant_id)
+        .order_by(desc(Webhook.created_at))
+    )
+    return result.scalars().all()
+
+@router.get("/{webhook_id}", response_model=WebhookResponse)
+async def get_webhook(
+    webhook_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Get webhook by ID."""
+    return await get_tenant_webhook(webhook_id, tenant_id, db)
+
+@router.post("/", response_model=WebhookResponse)
+async def create_webhook(
+    webhook_data: WebhookCreate,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Create a new webhook."""
+    check_template(webhook_data.body_template)
+    await check_url(webhook_data.url)
+
+    new_webhook = Webhook(
+        name=webhook_data.name,
+        url=webhook_data.url,
+        events=webhook_data.events,
+        body_template=webhook_data.body_template,
+        headers=webhook_data.headers,
+        secret=webhook_data.secret,
+        enabled=True,
+        tenant_id=tenant_id
+    )
+
+    db.add(new_webhook)
+    await db.commit()
+    await db.refresh(new_webhook)
+
+    logger.info(f"Created webhook: {new_webhook.name}")
+    return new_webhook
+
+@router.put("/{webhook_id}", response_model=WebhookResponse)
+async def update_webhook(
+    webhook_id: int,
+    webhook_data: WebhookUpdate,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Update webhook."""
+    webhook = await get_tenant_webhook(webhook_id, tenant_id, db)
+
+    update_data = webhook_data.dict(exclude_unset=True)
+    if "body_template" in update_data:
+        check_template(update_data["body_template"])
+    if update_data.get("url"):
+        await check_url(update_data["url"])
+    if update_data:
+        for field, value in update_data.items():
+            setattr(webhook, field, value)
+
+        await db.commit()
+        await db.refresh(webhook)
+
+    return webhook
+
+@router.delete("/{webhook_id}")
+async def delete_webhook(
+    webhook_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Delete webhook."""
+    webhook = await get_tenant_webhook(webhook_id, tenant_id, db)
+
+    await db.delete(webhook)
+    await db.commit()
+
+    logger.info(f"Deleted webhook: {webhook.name}")
+    return {"status": "ok", "message": "Webhook deleted successfully"}
+
+@router.post("/{webhook_id}/test", response_model=WebhookTestResult)
+async def test_webhook(
+    webhook_id: int,
+    tenant_id: str = Depends(get_current_tenant_id),
+    db: AsyncSession = Depends(get_db)
+):
+    """Send a sample alert.triggered payload to the webhook and report the outcome."""
+    webhook = await get_tenant_webhook(webhook_id, tenant_id, db)
+
+    payload = {**SAMPLE_PAYLOAD, "timestamp": datetime.utcnow().isoformat(), "test": True}
+    outcome = await deliver(webhook, "alert.triggered", payload)
+
+    webhook.last_status = outcome["status"]
+    webhook.last_error = outcome["error"]
+    webhook.last_delivery_at = datetime.utcnow()
+    await db.commit()
+
+    return outcome
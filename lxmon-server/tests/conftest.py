@@ -0,0 +1,81 @@
+"""
+Shared fixtures: an in-memory SQLite database with the server's models, and
+an in-memory stand-in for Redis.
+"""
+
+import os
+import sys
+
+import pytest
+from sqlalchemy.ext.asyncio import AsyncSession, create_async_engine
+from sqlalchemy.orm import sessionmaker
+from sqlalchemy.pool import StaticPool
+
+sys.path.insert(0, os.path.dirname(os.path.dirname(os.path.abspath(__file__))))
+
+from core.config import settings
+from database.redis_client import redis_client
+from models.models import Base, Server, User
+
+class FakeRedis:
+    """The subset of redis.asyncio.Redis the server uses for queues and sets."""
+
+    def __init__(self):
+        self.lists = {}
+        self.sets = {}
+
+    async def lpush(self, key, value):
+        self.lists.setdefault(key, []).insert(0, value)
+        return len(self.lists[key])
+
+    async def rpop(self, key):
+        values = self.lists.get(key)
+        return values.pop() if values else None
+
+    async def smismember(self, key, members):
+        return [int(member in self.sets.get(key, set())) for member in members]
+
+    async def scard(self, key):
+        return len(self.sets.get(key, set()))
+
+    async def sadd(self, key, *members):
+        self.sets.setdefault(key, set()).update(members)
+        return len(members)
+
+    async def expire(self, key, ttl):
+        return True
+
+@pytest.fixture(autouse=True)
+def defaults(monkeypatch):
+    """Settings the tests assume, whatever the environment sets."""
+    monkeypatch.setattr(settings, "AGENT_API_KEYS_STR", "agent-key-1")
+    monkeypatch.setattr(settings, "AGENT_MTLS", "off")
+    monkeypatch.setattr(settings, "AGENT_ENROLLMENT", "open")
+    monkeypatch.setattr(settings, "ARCHIVE_S3_BUCKET", "")
+
+@pytest.fixture
+def fake_redis(monkeypatch):
+    fake = FakeRedis()
+    monkeypatch.setattr(redis_client, "client", fake)
+    return fake
+
+@pytest.fixture
+async def db():
+    engine = create_async_engine("sqlite+aiosqlite://", poolclass=StaticPool)
+    async with engine.begin() as connection:
+        await connection.run_sync(Base.metadata.create_all)
+    session = sessionmaker(bind=engine, class_=AsyncSession, expire_on_commit=False)()
+    try:
+        yield session
+    finally:
+        await session.close()
+        await engine.dispose()
+
+async def add_server(db, hostname, tenant_id="t1", agent_api_key="agent-key-1", **fields):
+    server = Server(name=hostname, hostname=hostname, agent_api_key=agent_api_key, tenant_id=tenant_id, **fields)
+    db.add(server)
+    await db.commit()
+    return server
+
+def make_user(username, role="operator", tenant_id="t1"):
+    return User(username=username, email=f"{username}@example.com", hashed_password="x", role=role, tenant_id=tenant_id)
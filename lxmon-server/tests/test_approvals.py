@@ -0,0 +1,75 @@
+import pytest
+from fastapi import HTTPException
+from sqlalchemy import select
+
+from core.schemas import CommandCreate, CommandReview
+from models.models import AuditLog
+from routers import servers
+from conftest import add_server, make_user
+
+@pytest.fixture(autouse=True)
+def patterns(monkeypatch):
+    monkeypatch.setattr(servers.settings, "COMMAND_APPROVAL_PATTERNS_STR", r"\brm\s+-rf\b,\breboot\b")
+    monkeypatch.setattr(servers.settings, "COMMAND_APPROVER_ROLES_STR", "admin")
+
+def test_approval_rule():
+    assert servers.approval_rule("rm -rf /var/tmp/x") == r"\brm\s+-rf\b"
+    assert servers.approval_rule("sudo reboot") == r"\breboot\b"
+    assert servers.approval_rule("uptime") is None
+
+def test_invalid_pattern_is_skipped(monkeypatch):
+    monkeypatch.setattr(servers.settings, "COMMAND_APPROVAL_PATTERNS_STR", "([,uptime")
+    assert servers.approval_rule("uptime") == "uptime"
+
+async def request_command(db, server, command, user):
+    return await servers.send_command(server.id, CommandCreate(command=command), current_user=user, tenant_id="t1", db=db)
+
+async def test_dangerous_command_waits_for_a_second_user(db, fake_redis):
+    server = await add_server(db, "web-1")
+    alice, bob = make_user("alice", role="admin"), make_user("bob", role="admin")
+    command = await request_command(db, server, "rm -rf /srv/cache", alice)
+
+    assert command.status == "awaiting_approval"
+    assert fake_redis.lists.get(f"commands:{server.id}") is None
+
+    # Not by the requester, nor by someone without an approver role
+    with pytest.raises(HTTPException) as e:
+        await servers.approve_command(command.id, CommandReview(), current_user=alice, tenant_id="t1", db=db)
+    assert e.value.status_code == 403
+    with pytest.raises(HTTPException) as e:
+        await servers.approve_command(command.id, CommandReview(), current_user=make_user("carol"), tenant_id="t1", db=db)
+    assert e.value.status_code == 403
+
+    approved = await servers.approve_command(command.id, CommandReview(note="ok"), current_user=bob, tenant_id="t1", db=db)
+    assert approved.status == "pending" and approved.reviewed_by == "bob"
+    assert len(fake_redis.lists[f"commands:{server.id}"]) == 1
+
+    # Reviewed once only
+    with pytest.raises(HTTPException) as e:
+        await servers.approve_command(command.id, CommandReview(), current_user=bob, tenant_id="t1", db=db)
+    assert e.value.status_code == 400
+
+    actions = (await db.execute(select(AuditLog.action).order_by(AuditLog.id))).scalars().all()
+    assert actions == ["command.requested", "command.approved"]
+
+async def test_requester_may_withdraw(db, fake_redis):
+    server = await add_server(db, "web-1")
+    alice = make_user("alice")
+    command = await request_command(db, server, "reboot", alice)
+
+    rejected = await servers.reject_command(command.id, CommandReview(), current_user=alice, tenant_id="t1", db=db)
+    assert rejected.status == "rejected"
+    assert fake_redis.lists.get(f"commands:{server.id}") is None
+
+async def test_safe_command_is_queued(db, fake_redis):
+    server = await add_server(db, "web-1")
+    command = await request_command(db, server, "uptime", make_user("alice"))
+    assert command.status == "pending" and command.approval_rule is None
+    assert len(fake_redis.lists[f"commands:{server.id}"]) == 1
+
+async def test_review_is_scoped_to_the_tenant(db, fake_redis):
+    server = await add_server(db, "web-1")
+    command = await request_command(db, server, "reboot", make_user("alice"))
+    with pytest.raises(HTTPException) as e:
+        await servers.approve_command(command.id, CommandReview(), current_user=make_user("eve", role="admin", tenant_id="t2"), tenant_id="t2", db=db)
+    assert e.value.status_code == 404
@@ -0,0 +1,115 @@
+import gzip
+import json
+from datetime import date, datetime, timedelta
+
+import pytest
+from sqlalchemy import select
+
+from models.models import ArchiveExport, Metric
+from utils import archive
+from conftest import add_server
+
+class FakeStorage:
+    def __init__(self, fail=False):
+        self.objects = {}
+        self.fail = fail
+
+    async def put(self, key, body, content_type):
+        if self.fail:
+            raise RuntimeError("bucket unavailable")
+        self.objects[key] = body
+
+    async def get(self, key):
+        return self.objects[key]
+
+@pytest.fixture
+def storage(monkeypatch):
+    storage = FakeStorage()
+    monkeypatch.setattr(archive.settings, "ARCHIVE_S3_BUCKET", "metrics")
+    monkeypatch.setattr(archive.settings, "ARCHIVE_RESOLUTION_MINUTES", 60)
+    monkeypatch.setattr(archive, "object_storage", lambda: storage)
+    monkeypatch.setattr(archive, "_cache", archive.OrderedDict())
+    return storage
+
+DAY = date(2024, 3, 1)
+
+def at(hour, minute=0):
+    return datetime(2024, 3, 1, hour, minute)
+
+async def add_metrics(db, server, *samples):
+    db.add_all(
+        Metric(server_id=server.id, metric_type="cpu", metric_name="usage", value=value,
+               metric_metadata=metadata, collected_at=collected_at)
+        for value, metadata, collected_at in samples
+    )
+    await db.commit()
+
+def test_series_metadata_drops_volatile_keys():
+    assert archive.series_metadata({"core": "0", "error": "x", "nested": {"a": 1}}) == {"core": "0"}
+    assert archive.series_metadata(None) == {}
+
+async def test_export_day_downsamples_per_tenant(db, storage):
+    web = await add_server(db, "web-1")
+    db2 = await add_server(db, "db-1", tenant_id="t2")
+    await add_metrics(
+        db, web,
+        (10, {"core": "0", "error": "timeout"}, at(9, 5)),
+        (30, {"core": "0"}, at(9, 55)),
+        (50, {"core": "0"}, at(10, 0)),
+        (99, None, at(23, 59)),
+    )
+    await add_metrics(db, db2, (5, None, at(0)), (7, None, datetime(2024, 3, 2)))
+
+    assert await archive.export_day(db, DAY)
+
+    key = archive.object_key("t1", DAY)
+    assert key == "lxmon/t1/metrics/2024/03/01.jsonl.gz"
+    rows = [json.loads(line) for line in gzip.decompress(storage.objects[key]).decode().splitlines()]
+    first = next(row for row in rows if row["t"] == at(9).isoformat())
+    assert first["metadata"] == {"core": "0"}
+    assert (first["avg"], first["min"], first["max"], first["count"]) == (20, 10, 30, 2)
+    assert len(rows) == 3
+
+    exports = (await db.execute(select(ArchiveExport).order_by(ArchiveExport.tenant_id))).scalars().all()
+    assert [(export.tenant_id, export.rows, export.samples) for export in exports] == [("t1", 3, 4), ("t2", 1, 1)]
+
+    # Archived days are not exported twice
+    storage.objects.clear()
+    assert await archive.export_day(db, DAY)
+    assert storage.objects == {}
+
+async def test_failed_upload_keeps_raw_metrics(db, storage):
+    server = await add_server(db, "web-1")
+    await add_metrics(db, server, (1, None, at(1)), (2, None, datetime(2024, 3, 2, 1)))
+    storage.fail = True
+
+    # Not deleted past the day that failed
+    assert await archive.archive_old_metrics(db, datetime(2024, 3, 3, 12)) == datetime(2024, 3, 1)
+    assert (await db.execute(select(ArchiveExport))).scalars().all() == []
+
+    storage.fail = False
+    assert await archive.archive_old_metrics(db, datetime(2024, 3, 3, 12)) == datetime(2024, 3, 3)
+
+async def test_archived_rows_filters_by_range_and_series(db, storage):
+    web = await add_server(db, "web-1")
+    app = await add_server(db, "app-1")
+    await add_metrics(db, web, (1, None, at(1)), (2, None, at(5)))
+    await add_metrics(db, app, (3, None, at(1)))
+    await archive.export_day(db, DAY)
+
+    rows = await archive.archived_rows(db, "t1", at(0), at(3), "cpu", "usage", "web-1")
+    assert [(row["hostname"], row["avg"]) for row in rows] == [("web-1", 1)]
+    assert await archive.archived_rows(db, "t2", at(0), at(23)) == []
+    assert await archive.archived_rows(db, "t1", at(0), at(23), metric_name="other") == []
+
+async def test_unreadable_archive_is_skipped(db, storage):
+    server = await add_server(db, "web-1")
+    await add_metrics(db, server, (1, None, at(1)))
+    await archive.export_day(db, DAY)
+    storage.objects.clear()
+
+    assert await archive.archived_rows(db, "t1", at(0), at(23)) == []
+
+async def test_archive_disabled(db, storage, monkeypatch):
+    monkeypatch.setattr(archive.settings, "ARCHIVE_S3_BUCKET", "")
+    assert await archive.archived_rows(db, "t1", at(0), at(23) + timedelta(hours=1)) == []
@@ -0,0 +1,94 @@
+from datetime import datetime, timedelta
+from types import SimpleNamespace
+
+import pytest
+from fastapi import HTTPException, Response
+from sqlalchemy import select
+
+from core.schemas import AgentRegister, EnrollmentTokenCreate
+from models.models import EnrollmentToken, Server
+from routers import agents, enrollment
+from utils.enrollment import auto_approve_reason, find_enrollment_token, in_subnets
+from conftest import make_user
+
+def test_in_subnets():
+    assert in_subnets("10.1.2.3", ["192.168.0.0/16", "10.0.0.0/8"])
+    assert not in_subnets("10.1.2.3", ["192.168.0.0/16"])
+    assert not in_subnets("10.1.2.3", ["bogus"])
+    assert not in_subnets(None, ["0.0.0.0/0"])
+    assert not in_subnets("not-an-ip", ["0.0.0.0/0"])
+
+def test_auto_approve_reason():
+    token = EnrollmentToken(auto_approve_subnets=["10.0.0.0/8"], auto_approve_tags={"env": "prod"})
+    assert auto_approve_reason(token, "10.1.2.3", {"env": "prod", "role": "web"}) == "subnet:10.1.2.3"
+    assert auto_approve_reason(token, "10.1.2.3", {"env": "dev"}) is None
+    assert auto_approve_reason(token, "192.168.1.1", {"env": "prod"}) is None
+    # Tags never approve a host alone
+    assert auto_approve_reason(EnrollmentToken(auto_approve_tags={"env": "prod"}), "10.1.2.3", {"env": "prod"}) is None
+
+async def test_create_token_validates_rules(db):
+    admin = make_user("admin", role="admin")
+    for data in (
+        EnrollmentTokenCreate(name="t", auto_approve_tags={"env": "prod"}),
+        EnrollmentTokenCreate(name="t", auto_approve_subnets=["10.0.0.0/33"]),
+    ):
+        with pytest.raises(HTTPException) as e:
+            await enrollment.create_enrollment_token(data, current_user=admin, tenant_id="t1", db=db)
+        assert e.value.status_code == 400
+
+async def test_token_uses_and_expiry(db):
+    created = await enrollment.create_enrollment_token(
+        EnrollmentTokenCreate(name="t", max_uses=1), current_user=make_user("admin", role="admin"), tenant_id="t1", db=db
+    )
+    token = await find_enrollment_token(db, created.token)
+    assert token is not None and token.token_hash != created.token
+
+    token.uses = 1
+    assert await find_enrollment_token(db, created.token) is None
+    token.uses, token.expires_at = 0, datetime.utcnow() - timedelta(minutes=1)
+    assert await find_enrollment_token(db, created.token) is None
+    assert await find_enrollment_token(db, "wrong") is None
+
+async def register(db, token, hostname, client_ip, tags=None):
+    request = SimpleNamespace(client=SimpleNamespace(host=client_ip), headers=None)
+    data = AgentRegister(hostname=hostname, api_key="agent-key-1", enrollment_token=token, tags=tags)
+    response = Response()
+    body = await agents.register_agent(data, request, response, cert_cn=None, db=db)
+    return response.status_code, body
+
+async def test_hosts_wait_for_approval_unless_auto_approved(db):
+    created = await enrollment.create_enrollment_token(
+        EnrollmentTokenCreate(name="t", auto_approve_subnets=["10.0.0.0/8"]),
+        current_user=make_user("admin", role="admin"), tenant_id="t1", db=db
+    )
+
+    _, body = await register(db, created.token, "inside", "10.1.2.3")
+    assert body["status"] == "registered"
+
+    status_code, body = await register(db, created.token, "outside", "203.0.113.9")
+    assert status_code == 202 and body["status"] == "pending_approval"
+    server = (await db.execute(select(Server).where(Server.hostname == "outside"))).scalar_one()
+    assert server.tenant_id == "t1" and server.enrollment == "pending"
+
+    # Pending hosts are not found by the agent endpoints until approved
+    assert await agents.get_server_by_hostname_and_key(db, "outside", "agent-key-1") is None
+    await enrollment.approve_enrollment(server.id, current_user=make_user("admin", role="admin"), tenant_id="t1", db=db)
+    _, body = await register(db, created.token, "outside", "203.0.113.9")
+    assert body["status"] == "registered"
+
+async def test_rejected_hosts_are_refused(db):
+    created = await enrollment.create_enrollment_token(
+        EnrollmentTokenCreate(name="t"), current_user=make_user("admin", role="admin"), tenant_id="t1", db=db
+    )
+    await register(db, created.token, "web-1", "203.0.113.9")
+    server = (await db.execute(select(Server).where(Server.hostname == "web-1"))).scalar_one()
+    await enrollment.reject_enrollment(server.id, current_user=make_user("admin", role="admin"), tenant_id="t1", db=db)
+
+    with pytest.raises(HTTPException) as e:
+        await register(db, created.token, "web-1", "203.0.113.9")
+    assert e.value.status_code == 403
+
+async def test_invalid_token_is_refused(db):
+    with pytest.raises(HTTPException) as e:
+        await register(db, "wrong", "web-1", "203.0.113.9")
+    assert e.value.status_code == 401
@@ -0,0 +1,72 @@
+from datetime import datetime, timezone
+
+from models.models import Metric, MaintenanceWindow
+from routers import grafana
+from conftest import add_server
+
+def test_parse_target():
+    assert grafana.parse_target("cpu.usage_percent@web-1") == ("cpu", "usage_percent", "web-1")
+    assert grafana.parse_target("disk.used.bytes") == ("disk", "used.bytes", None)
+    assert grafana.parse_target("cpu.usage@") == ("cpu", "usage", None)
+
+def test_series_labels():
+    assert grafana.series_labels({"mount": "/", "fs": "ext4", "error": "x", "nested": {}}) == " {fs=ext4, mount=/}"
+    assert grafana.series_labels({"error": "x"}) == ""
+    assert grafana.series_labels(None) == ""
+
+def test_to_utc_naive():
+    aware = datetime(2024, 3, 1, 12, tzinfo=timezone.utc).astimezone()
+    assert grafana.to_utc_naive(aware) == datetime(2024, 3, 1, 12)
+    assert grafana.epoch_ms(datetime(1970, 1, 1, 0, 0, 1)) == 1000
+
+def query(targets, interval_ms=60000, max_points=1000):
+    return grafana.GrafanaQuery(
+        range={"from": "2024-03-01T00:00:00Z", "to": "2024-03-01T01:00:00Z"},
+        intervalMs=interval_ms,
+        maxDataPoints=max_points,
+        targets=[grafana.GrafanaTarget(target=target) for target in targets],
+    )
+
+async def test_query_averages_buckets_per_series(db):
+    web = await add_server(db, "web-1")
+    other = await add_server(db, "web-1", tenant_id="t2")
+    db.add_all([
+        Metric(server_id=web.id, metric_type="cpu", metric_name="usage", value=10, collected_at=datetime(2024, 3, 1, 0, 0, 10)),
+        Metric(server_id=web.id, metric_type="cpu", metric_name="usage", value=20, collected_at=datetime(2024, 3, 1, 0, 0, 50)),
+        Metric(server_id=web.id, metric_type="cpu", metric_name="usage", value=40, collected_at=datetime(2024, 3, 1, 0, 5)),
+        Metric(server_id=web.id, metric_type="cpu", metric_name="usage", value=1, collected_at=datetime(2024, 3, 1, 2)),
+        Metric(server_id=other.id, metric_type="cpu", metric_name="usage", value=99, collected_at=datetime(2024, 3, 1, 0, 1)),
+    ])
+    await db.commit()
+
+    start = grafana.epoch_ms(datetime(2024, 3, 1))
+    response = await grafana.grafana_query(query(["cpu.usage@web-1"]), tenant_id="t1", db=db)
+    assert response == [{"target": "web-1", "datapoints": [[15, start], [40, start + 300000]]}]
+
+    # Buckets widen to stay within maxDataPoints
+    response = await grafana.grafana_query(query(["cpu.usage"], max_points=1), tenant_id="t1", db=db)
+    assert response[0]["datapoints"] == [[70 / 3, start]]
+
+async def test_search_and_annotations(db):
+    web = await add_server(db, "web-1")
+    db.add_all([
+        Metric(server_id=web.id, metric_type="cpu", metric_name="usage", value=1),
+        Metric(server_id=web.id, metric_type="event", metric_name="deploy", value=1,
+               metric_metadata={"message": "v2", "severity": "info"}, collected_at=datetime(2024, 3, 1, 0, 30)),
+        MaintenanceWindow(name="patching", server_id=web.id, tenant_id="t1", created_by="alice",
+                          starts_at=datetime(2024, 3, 1, 0, 10), ends_at=datetime(2024, 3, 1, 0, 20)),
+    ])
+    await db.commit()
+
+    assert await grafana.grafana_search(grafana.GrafanaSearch(target="hosts"), tenant_id="t1", db=db) == ["web-1"]
+    assert await grafana.grafana_search(grafana.GrafanaSearch(target="CPU"), tenant_id="t1", db=db) == ["cpu.usage"]
+
+    annotations = await grafana.grafana_annotations(
+        grafana.GrafanaAnnotationQuery(
+            range={"from": "2024-03-01T00:00:00Z", "to": "2024-03-01T01:00:00Z"},
+            annotation=grafana.GrafanaAnnotation(query="")
+        ),
+        tenant_id="t1", db=db
+    )
+    assert [annotation["title"] for annotation in annotations] == ["web-1: deploy", "Maintenance: patching"]
+    assert annotations[1]["isRegion"] and annotations[1]["text"] == "patching (web-1, by alice)"
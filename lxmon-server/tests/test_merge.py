@@ -0,0 +1,63 @@
+from datetime import datetime, timedelta
+
+import pytest
+from fastapi import HTTPException
+from sqlalchemy import func, select
+
+from core.schemas import ServerMerge
+from models.models import AuditLog, Command, Metric, Server
+from routers import servers
+from conftest import add_server, make_user
+
+async def merge(db, server_id, source_ids, tenant_id="t1"):
+    return await servers.merge_servers(
+        server_id, ServerMerge(source_ids=source_ids), current_user=make_user("alice"), tenant_id=tenant_id, db=db
+    )
+
+async def test_merge_moves_history_and_takes_latest_agent(db, fake_redis):
+    now = datetime.utcnow()
+    old = await add_server(db, "web-1", agent_id="old-agent", last_heartbeat=now - timedelta(days=2))
+    new = await add_server(db, "web-1.example.com", agent_id="new-agent", last_heartbeat=now)
+    db.add_all([
+        Metric(server_id=old.id, metric_type="cpu", metric_name="usage", value=1),
+        Metric(server_id=new.id, metric_type="cpu", metric_name="usage", value=2),
+        Command(server_id=new.id, command="uptime"),
+    ])
+    await db.commit()
+    await fake_redis.lpush(f"commands:{new.id}", '{"command_id": 1, "command": "uptime"}')
+
+    merged = await merge(db, old.id, [new.id, new.id])
+
+    assert merged.id == old.id and merged.hostname == "web-1"
+    assert merged.agent_id == "new-agent" and merged.last_heartbeat == now
+    assert await db.get(Server, new.id) is None
+    metrics = (await db.execute(select(func.count()).where(Metric.server_id == old.id))).scalar()
+    commands = (await db.execute(select(func.count()).where(Command.server_id == old.id))).scalar()
+    assert (metrics, commands) == (2, 1)
+    # Commands queued for the source go to the merged server's agent
+    assert fake_redis.lists.get(f"commands:{new.id}") in (None, [])
+    assert len(fake_redis.lists[f"commands:{old.id}"]) == 1
+
+    audit = (await db.execute(select(AuditLog).where(AuditLog.action == "server.merged"))).scalar_one()
+    assert audit.details["moved"]["metrics"] == 1
+    assert audit.details["sources"] == [{"id": new.id, "hostname": "web-1.example.com"}]
+
+async def test_merge_keeps_own_agent_when_it_was_seen_last(db, fake_redis):
+    now = datetime.utcnow()
+    target = await add_server(db, "web-1", agent_id="current", last_heartbeat=now)
+    source = await add_server(db, "web-1-old", agent_id="stale", last_heartbeat=now - timedelta(days=1))
+    merged = await merge(db, target.id, [source.id])
+    assert merged.agent_id == "current"
+
+async def test_merge_refuses_itself_and_other_tenants(db, fake_redis):
+    server = await add_server(db, "web-1")
+    other = await add_server(db, "web-1", tenant_id="t2")
+
+    with pytest.raises(HTTPException) as e:
+        await merge(db, server.id, [server.id])
+    assert e.value.status_code == 400
+
+    with pytest.raises(HTTPException) as e:
+        await merge(db, server.id, [other.id])
+    assert e.value.status_code == 404
+    assert await db.get(Server, other.id) is not None
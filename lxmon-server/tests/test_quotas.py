@@ -0,0 +1,58 @@
+import pytest
+
+from core.schemas import MetricsPayload
+from database.redis_client import redis_client
+from routers import agents
+from utils.exceptions import QuotaExceededError
+from conftest import add_server
+
+async def test_track_series_accepts_known_series_over_the_limit(fake_redis):
+    accepted, count = await redis_client.track_series(1, ["a", "b", "c"], 2, 3600)
+    assert accepted == {"a", "b"} and count == 2
+
+    # Known series always pass; new ones wait for room
+    accepted, count = await redis_client.track_series(1, ["a", "c", "b"], 2, 3600)
+    assert accepted == {"a", "b"} and count == 2
+    accepted, count = await redis_client.track_series(1, ["c"], 3, 3600)
+    assert accepted == {"c"} and count == 3
+
+def metric(name, **metadata):
+    return {"metric_type": "disk", "metric_name": name, "value": 1.0, "metric_metadata": metadata or None}
+
+def payload(*metrics):
+    return MetricsPayload(hostname="web-1", api_key="agent-key-1", metrics=list(metrics))
+
+async def submit(db, data):
+    return await agents.submit_metrics(data, agent_id=None, cert_cn=None, db=db)
+
+async def test_series_over_the_limit_are_clipped(db, fake_redis, monkeypatch):
+    monkeypatch.setattr(agents.settings, "SERIES_QUOTA_MODE", "clip")
+    await add_server(db, "web-1", series_limit=2)
+
+    result = await submit(db, payload(metric("used", mount="/"), metric("used", mount="/var"), metric("used", mount="/home")))
+    assert result["status"] == "clipped" and result["metrics_received"] == 2
+    assert result["quota"] == {"quota": "series_per_host", "limit": 2, "series": 2, "dropped": 1}
+
+    # Series already seen still pass
+    result = await submit(db, payload(metric("used", mount="/")))
+    assert result == {"status": "ok", "metrics_received": 1}
+
+async def test_series_over_the_limit_reject_the_payload(db, fake_redis, monkeypatch):
+    monkeypatch.setattr(agents.settings, "SERIES_QUOTA_MODE", "reject")
+    await add_server(db, "web-1", series_limit=1)
+
+    with pytest.raises(QuotaExceededError):
+        await submit(db, payload(metric("used", mount="/"), metric("used", mount="/var")))
+
+async def test_metrics_per_payload_limit(db, fake_redis, monkeypatch):
+    monkeypatch.setattr(agents.settings, "MAX_METRICS_PER_PAYLOAD", 2)
+    await add_server(db, "web-1")
+
+    with pytest.raises(QuotaExceededError):
+        await submit(db, payload(metric("a"), metric("b"), metric("c")))
+
+def test_series_key_ignores_metadata_order():
+    first = payload(metric("used", mount="/", fs="ext4")).metrics[0]
+    second = payload(metric("used", fs="ext4", mount="/")).metrics[0]
+    assert agents.series_key(first) == agents.series_key(second)
+    assert agents.series_key(first) != agents.series_key(payload(metric("used", mount="/var")).metrics[0])
@@ -0,0 +1,61 @@
+import hashlib
+
+import pytest
+from fastapi import HTTPException
+
+from core.schemas import ScriptCreate, ScriptVersionCreate
+from routers import agents, scripts
+from conftest import add_server, make_user
+
+async def create(db, content="#!/bin/sh\necho one\n", tenant_id="t1"):
+    data = ScriptCreate(name="cleanup", content=content, changelog="first")
+    return await scripts.create_script(data, current_user=make_user("alice"), tenant_id=tenant_id, db=db)
+
+async def test_versions_are_numbered_and_hashed(db):
+    created = await create(db)
+    assert created.latest_version == 1
+    assert created.sha256 == hashlib.sha256(b"#!/bin/sh\necho one\n").hexdigest()
+
+    updated = await scripts.create_script_version(
+        created.id, ScriptVersionCreate(content="#!/bin/sh\necho two\n"),
+        current_user=make_user("bob"), tenant_id="t1", db=db
+    )
+    assert updated.latest_version == 2
+    assert [version.version for version in updated.versions] == [1, 2]
+    assert updated.versions[1].created_by == "bob"
+
+    first = await scripts.get_script_version(created.id, 1, tenant_id="t1", db=db)
+    assert first.content == "#!/bin/sh\necho one\n"
+
+async def test_unchanged_content_is_not_a_new_version(db):
+    created = await create(db)
+    with pytest.raises(HTTPException) as e:
+        await scripts.create_script_version(
+            created.id, ScriptVersionCreate(content="#!/bin/sh\necho one\n"),
+            current_user=make_user("alice"), tenant_id="t1", db=db
+        )
+    assert e.value.status_code == 400
+
+async def test_scripts_are_scoped_to_the_tenant(db):
+    created = await create(db)
+    with pytest.raises(HTTPException) as e:
+        await scripts.get_script(created.id, tenant_id="t2", db=db)
+    assert e.value.status_code == 404
+    assert await scripts.get_scripts(tenant_id="t2", db=db) == []
+
+async def test_agents_fetch_by_hash(db):
+    created = await create(db)
+    await add_server(db, "web-1")
+    await add_server(db, "web-2", tenant_id="t2")
+
+    response = await agents.get_script_content(
+        created.id, created.sha256, hostname="web-1", x_api_key="agent-key-1", agent_id=None, cert_cn=None, db=db
+    )
+    assert response.body == b"#!/bin/sh\necho one\n"
+
+    for hostname, sha256 in (("web-1", "0" * 64), ("web-2", created.sha256)):
+        with pytest.raises(HTTPException) as e:
+            await agents.get_script_content(
+                created.id, sha256, hostname=hostname, x_api_key="agent-key-1", agent_id=None, cert_cn=None, db=db
+            )
+        assert e.value.status_code == 404
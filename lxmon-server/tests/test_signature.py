@@ -0,0 +1,31 @@
+from middleware import signature
+
+BODY = b'{"hostname":"web-1"}'
+
+def test_request_signature_matches_the_agent():
+    # Same vector as lxmon-agent/sign_test.go
+    assert signature.request_signature("agent-key-1", "1700000000", "POST", "/api/agent/metrics?hostname=web-1", BODY) == (
+        "7f2c3810f36d8c071a1d668f8644c2296266a3307a1ef2f8b510847fb596adfd"
+    )
+
+def test_signature_valid():
+    valid = "v1=" + signature.request_signature("agent-key-1", "1700000000", "POST", "/api/agent/metrics", BODY)
+    assert signature.signature_valid(valid, "agent-key-1", "1700000000", "POST", "/api/agent/metrics", BODY)
+    assert not signature.signature_valid(valid, "agent-key-1", "1700000000", "POST", "/api/agent/metrics", BODY + b" ")
+    assert not signature.signature_valid(valid, "agent-key-1", "1700000001", "POST", "/api/agent/metrics", BODY)
+    assert not signature.signature_valid(valid[3:], "agent-key-1", "1700000000", "POST", "/api/agent/metrics", BODY)
+    # Only agent API keys sign
+    forged = "v1=" + signature.request_signature("other", "1700000000", "POST", "/api/agent/metrics", BODY)
+    assert not signature.signature_valid(forged, "other", "1700000000", "POST", "/api/agent/metrics", BODY)
+
+def test_signed_path_drops_proxy_prefix():
+    scope = {"path": "/lxmon/api/agent/commands", "raw_path": b"/lxmon/api/agent/commands", "query_string": b"hostname=web%201"}
+    assert signature.signed_path(scope) == "/api/agent/commands?hostname=web%201"
+    assert signature.signed_path({"path": "/api/agent/register"}) == "/api/agent/register"
+
+def test_claimed_identity():
+    headers = {"x-api-key": "agent-key-1"}
+    scope = {"query_string": b"hostname=web-1"}
+    assert signature.claimed_identity(scope, headers, b"") == ("agent-key-1", "web-1")
+    assert signature.claimed_identity({}, {}, b'{"api_key": "agent-key-1", "hostname": "web-2"}') == ("agent-key-1", "web-2")
+    assert signature.claimed_identity({}, {}, b"not json") == (None, None)
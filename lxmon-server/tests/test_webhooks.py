@@ -0,0 +1,121 @@
+import hashlib
+import hmac
+import json
+
+import httpx
+import pytest
+
+from models.models import Webhook
+from utils import webhooks
+
+def test_render_body_fills_placeholders_as_json_string_content():
+    payload = {"alert": {"message": 'disk "/" full', "severity": "critical"}, "value": 97.5}
+    body = webhooks.render_body(
+        '{"text": "{{ alert.message }} ({{alert.severity}}) at {{ value }}", "missing": "{{ nope.x }}"}',
+        payload
+    )
+    assert json.loads(body) == {"text": 'disk "/" full (critical) at 97.5', "missing": ""}
+
+def test_render_body_without_template_sends_payload():
+    assert json.loads(webhooks.render_body(None, {"event": "alert.triggered"})) == {"event": "alert.triggered"}
+
+def test_validate_template_rejects_invalid_json():
+    with pytest.raises(ValueError):
+        webhooks.validate_template('{"text": {{ alert.message }}}')
+    webhooks.validate_template('{"text": "{{ alert.message }}"}')
+
+def test_sign():
+    expected = hmac.new(b"s3cret", b"1700000000.{}", hashlib.sha256).hexdigest()
+    assert webhooks.sign("s3cret", "1700000000", "{}") == f"sha256={expected}"
+
+def test_subscribed_matches_wildcards():
+    webhook = Webhook(events=["alert.triggered", "event.*"])
+    assert webhooks.subscribed(webhook, "event.deploy")
+    assert webhooks.subscribed(webhook, "alert.triggered")
+    assert not webhooks.subscribed(webhook, "alert.resolved")
+    assert not webhooks.subscribed(Webhook(events=None), "alert.triggered")
+
+@pytest.mark.parametrize("address, allowed", [
+    ("93.184.216.34", True),
+    ("127.0.0.1", False),
+    ("10.1.2.3", False),
+    ("169.254.169.254", False),
+    ("::ffff:127.0.0.1", False),
+    ("fe80::1%eth0", False),
+    ("224.0.0.1", False),
+    ("not-an-ip", False),
+])
+def test_allowed_address(address, allowed):
+    assert webhooks.allowed_address(address) is allowed
+
+def test_allowed_networks_setting(monkeypatch):
+    monkeypatch.setattr(webhooks.settings, "WEBHOOK_ALLOWED_NETWORKS_STR", "10.0.0.0/8")
+    assert webhooks.allowed_address("10.1.2.3")
+    assert not webhooks.allowed_address("192.168.1.1")
+
+async def test_check_destination_refuses_private_hosts():
+    assert await webhooks.check_destination("ftp://example.com/") is not None
+    assert "not a public address" in await webhooks.check_destination("http://127.0.0.1:8080/hook")
+
+class Receiver:
+    """Answers webhook deliveries with the given status codes in turn."""
+
+    def __init__(self, *codes):
+        self.codes = list(codes)
+        self.requests = []
+
+    def __call__(self, request):
+        self.requests.append(request)
+        return httpx.Response(self.codes.pop(0) if len(self.codes) > 1 else self.codes[0], text="secret internals")
+
+@pytest.fixture
+def receiver(monkeypatch):
+    """Route deliveries to a Receiver, without resolving or sleeping."""
+    def use(*codes):
+        handler = Receiver(*codes)
+        client = httpx.AsyncClient
+        monkeypatch.setattr(webhooks.httpx, "AsyncClient", lambda **kwargs: client(transport=httpx.MockTransport(handler), **kwargs))
+        return handler
+
+    async def public(url):
+        return None
+
+    async def no_sleep(delay):
+        pass
+
+    monkeypatch.setattr(webhooks, "check_destination", public)
+    monkeypatch.setattr(webhooks.asyncio, "sleep", no_sleep)
+    return use
+
+async def test_deliver_signs_and_retries_server_errors(receiver):
+    handler = receiver(503, 200)
+    webhook = Webhook(url="https://hooks.example.com/x", secret="s3cret", headers={"X-Team": "ops"})
+    outcome = await webhooks.deliver(webhook, "alert.triggered", {"alert": {"id": 1}})
+
+    assert outcome == {"ok": True, "status": 200, "error": None, "attempts": 2}
+    request = handler.requests[-1]
+    assert request.headers["X-Team"] == "ops"
+    assert request.headers["X-Lxmon-Event"] == "alert.triggered"
+    timestamp = request.headers["X-Lxmon-Timestamp"]
+    assert request.headers["X-Lxmon-Signature"] == webhooks.sign("s3cret", timestamp, request.content.decode())
+
+async def test_deliver_does_not_retry_client_errors(receiver):
+    handler = receiver(404)
+    outcome = await webhooks.deliver(Webhook(url="https://hooks.example.com/x"), "alert.resolved", {})
+
+    assert outcome["ok"] is False and outcome["attempts"] == 1 and len(handler.requests) == 1
+    # The receiver's answer is never passed back
+    assert outcome["error"] == "HTTP 404"
+
+async def test_deliver_gives_up_after_retries(receiver):
+    handler = receiver(429)
+    outcome = await webhooks.deliver(Webhook(url="https://hooks.example.com/x"), "alert.resolved", {})
+    assert outcome["attempts"] == len(webhooks.RETRY_DELAYS) + 1 == len(handler.requests)
+
+async def test_deliver_checks_destination_before_each_attempt(monkeypatch):
+    async def private(url):
+        return "hooks.example.com resolves to 10.0.0.1, which is not a public address"
+
+    monkeypatch.setattr(webhooks, "check_destination", private)
+    outcome = await webhooks.deliver(Webhook(url="https://hooks.example.com/x"), "alert.triggered", {})
+    assert outcome["ok"] is False and outcome["status"] is None and "not a public address" in outcome["error"]
@@ -0,0 +1,195 @@
+"""
+Cold tier for metrics past METRICS_RETENTION_DAYS.
+
+Before old metrics are deleted, every whole UTC day of them is downsampled to
+ARCHIVE_RESOLUTION_MINUTES buckets per series (avg, min, max, count) and
+written per tenant to <ARCHIVE_S3_PREFIX><tenant>/metrics/YYYY/MM/DD.jsonl.gz,
+one JSON row per line. Archived days are recorded in archive_exports, and
+only those are deleted from the database, so a failed upload keeps the raw
+data until the next attempt. Queries read the archive for the days they
+cover that are no longer in the database.
+"""
+
+import gzip
+import json
+import logging
+from collections import OrderedDict, defaultdict
+from datetime import date, datetime, time, timedelta
+from typing import Any, Dict, List, Optional
+from sqlalchemy import select, func
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from core.config import settings
+from models.models import Metric, Server, ArchiveExport
+from utils.object_storage import ObjectStorage
+
+logger = logging.getLogger(__name__)
+
+# Metadata that varies per sample rather than identifying a series
+VOLATILE_METADATA = {"error", "message"}
+
+# Archived days kept in memory, by object key
+CACHE_SIZE = 32
+_cache: "OrderedDict[str, List[Dict[str, Any]]]" = OrderedDict()
+
+def archive_enabled() -> bool:
+    return bool(settings.ARCHIVE_S3_BUCKET)
+
+def object_storage() -> ObjectStorage:
+    return ObjectStorage(
+        settings.ARCHIVE_S3_ENDPOINT,
+        settings.ARCHIVE_S3_BUCKET,
+        settings.ARCHIVE_S3_REGION,
+        settings.ARCHIVE_S3_ACCESS_KEY,
+        settings.ARCHIVE_S3_SECRET_KEY
+    )
+
+def object_key(tenant_id: str, day: date) -> str:
+    return f"{settings.ARCHIVE_S3_PREFIX}{tenant_id}/metrics/{day:%Y/%m/%d}.jsonl.gz"
+
+def series_metadata(metadata: Optional[Dict[str, Any]]) -> Dict[str, Any]:
+    return {
+        key: value for key, value in (metadata or {}).items()
+        if key not in VOLATILE_METADATA and not isinstance(value, (dict, list))
+    }
+
+async def export_day(db: AsyncSession, day: date) -> bool:
+    """Archive the metrics of day for every tenant that has not archived it
+    yet. Returns False if any upload failed."""
+    start = datetime.combine(day, time())
+    end = start + timedelta(days=1)
+    resolution = timedelta(minutes=settings.ARCHIVE_RESOLUTION_MINUTES)
+
+    result = await db.execute(select(ArchiveExport.tenant_id).where(ArchiveExport.day == day))
+    done = set(result.scalars().all())
+
+    # tenant -> (series, bucket) -> row
+    rows: Dict[str, Dict[tuple, Dict[str, Any]]] = defaultdict(dict)
+    samples: Dict[str, int] = defaultdict(int)
+    late = 0
+    stream = await db.stream(
+        select(
+            Server.tenant_id, Server.id, Server.hostname, Metric.metric_type,
+            Metric.metric_name, Metric.metric_metadata, Metric.value, Metric.collected_at
+        )
+        .join(Server, Server.id == Metric.server_id)
+        .where(Metric.collected_at >= start, Metric.collected_at < end)
+    )
+    async for tenant_id, server_id, hostname, metric_type, metric_name, metadata, value, collected_at in stream:
+        if tenant_id in done:
+            # Arrived after the day was archived
+            late += 1
+            continue
+        bucket = start + (collected_at - start) // resolution * resolution
+        labels = series_metadata(metadata)
+        key = (server_id, metric_type, metric_name, json.dumps(labels, sort_keys=True, default=str), bucket)
+        row = rows[tenant_id].get(key)
+        if row is None:
+            row = rows[tenant_id][key] = {
+                "server_id": server_id,
+                "hostname": hostname,
+                "metric_type": metric_type,
+                "metric_name": metric_name,
+                "metadata": labels,
+                "t": bucket.isoformat(),
+                "sum": 0.0,
+                "min": value,
+                "max": value,
+                "count": 0,
+            }
+        row["sum"] += value
+        row["min"] = min(row["min"], value)
+        row["max"] = max(row["max"], value)
+        row["count"] += 1
+        samples[tenant_id] += 1
+
+    if late:
+        logger.warning(f"Dropping {late} metrics of {day} that arrived after the day was archived")
+
+    storage = object_storage()
+    for tenant_id, tenant_rows in rows.items():
+        lines = []
+        for row in tenant_rows.values():
+            row["avg"] = row.pop("sum") / row["count"]
+            lines.append(json.dumps(row, default=str))
+        body = gzip.compress(("\n".join(lines) + "\n").encode())
+        key = object_key(tenant_id, day)
+        try:
+            await storage.put(key, body, "application/gzip")
+        except Exception as e:
+            logger.error(f"Failed to archive metrics of {day} for tenant {tenant_id}: {e}")
+            return False
+        db.add(ArchiveExport(
+            tenant_id=tenant_id,
+            day=day,
+            object_key=key,
+            rows=len(lines),
+            samples=samples[tenant_id],
+            size_bytes=len(body)
+        ))
+        await db.commit()
+        logger.info(f"Archived {samples[tenant_id]} metrics of {day} for tenant {tenant_id} as {len(lines)} rows in {key}")
+    return True
+
+async def archive_old_metrics(db: AsyncSession, cutoff: datetime) -> datetime:
+    """Archive every whole day of metrics before cutoff. Returns the time
+    before which all metrics are archived and may be deleted."""
+    boundary = datetime.combine(cutoff.date(), time())
+    oldest = (await db.execute(select(func.min(Metric.collected_at)))).scalar()
+    if oldest is None:
+        return boundary
+    day = oldest.date()
+    while day < boundary.date():
+        if not await export_day(db, day):
+            return datetime.combine(day, time())
+        day += timedelta(days=1)
+    return boundary
+
+async def load_archive(key: str) -> List[Dict[str, Any]]:
+    if key in _cache:
+        _cache.move_to_end(key)
+        return _cache[key]
+    body = await object_storage().get(key)
+    rows = [json.loads(line) for line in gzip.decompress(body).decode().splitlines() if line]
+    for row in rows:
+        row["t"] = datetime.fromisoformat(row["t"])
+    _cache[key] = rows
+    if len(_cache) > CACHE_SIZE:
+        _cache.popitem(last=False)
+    return rows
+
+async def archived_rows(
+    db: AsyncSession,
+    tenant_id: str,
+    since: datetime,
+    until: datetime,
+    metric_type: Optional[str] = None,
+    metric_name: Optional[str] = None,
+    hostname: Optional[str] = None
+) -> List[Dict[str, Any]]:
+    """Archived rows of the tenant between since and until. Days that cannot
+    be read are skipped (and logged)."""
+    if not archive_enabled():
+        return []
+    result = await db.execute(
+        select(ArchiveExport).where(
+            ArchiveExport.tenant_id == tenant_id,
+            ArchiveExport.day >= since.date(),
+            ArchiveExport.day <= until.date()
+        ).order_by(ArchiveExport.day)
+    )
+    matches = []
+    for export in result.scalars().all():
+        try:
+            rows = await load_archive(export.object_key)
+        except Exception as e:
+            logger.warning(f"Failed to read archived metrics {export.object_key}: {e}")
+            continue
+        matches.extend(
+            row for row in rows
+            if since <= row["t"] <= until
+            and (metric_type is None or row["metric_type"] == metric_type)
+            and (metric_name is None or row["metric_name"] == metric_name)
+            and (hostname is None or row["hostname"] == hostname)
+        )
+    return matches
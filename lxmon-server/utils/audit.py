@@ -0,0 +1,31 @@
+"""
+Audit log of security-relevant actions.
+"""
+
+from typing import Any, Dict, Optional
+from sqlalchemy.ext.asyncio import AsyncSession
+import logging
+
+from models.models import AuditLog
+
+logger = logging.getLogger(__name__)
+
+def record_audit(
+    db: AsyncSession,
+    tenant_id: str,
+    actor: str,
+    action: str,
+    target_type: str,
+    target_id: Optional[int] = None,
+    details: Optional[Dict[str, Any]] = None
+):
+    """Add an audit entry to the session; it is saved with the caller's commit."""
+    db.add(AuditLog(
+        actor=actor,
+        action=action,
+        target_type=target_type,
+        target_id=target_id,
+        details=details,
+        tenant_id=tenant_id
+    ))
+    logger.info(f"Audit: {actor} {action} {target_type} {target_id if target_id is not None else ''}".rstrip())
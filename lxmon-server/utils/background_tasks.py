@@ -7,12 +7,16 @@ import logging
 from datetime import datetime, timedelta
 from typing import List, Dict, Any
 from sqlalchemy.ext.asyncio import AsyncSession
-from sqlalchemy import select, and_, func, delete
+from sqlalchemy import Float, and_, case, cast, delete, func, select
 
 from core.database import get_background_db_session
 from models.models import Metric, AlertRule, Alert, Server
 from database.redis_client import redis_client
 from utils.exceptions import ServerConnectionError
+from utils.webhooks import dispatch_webhooks, alert_payload
+from utils.maintenance import active_window
+from utils.archive import archive_enabled, archive_old_metrics
+from core.config import settings
 
 logger = logging.getLogger(__name__)
 
@@ -92,10 +96,10 @@ class BackgroundTaskManager:
         while self.is_running:
             try:
                 await self._update_server_status()
-                await asyncio.sleep(60)  # Update every minute
+                await asyncio.sleep(settings.SERVER_STATUS_CHECK_SECONDS)
             except Exception as e:
                 logger.error(f"Error in server status update: {e}")
-                await asyncio.sleep(60)
+                await asyncio.sleep(settings.SERVER_STATUS_CHECK_SECONDS)
 
     async def _process_metrics_batch(self):
         """Process a batch of recent metrics."""
@@ -202,6 +206,12 @@ class BackgroundTaskManager:
             existing_alert = result.scalar_one_or_none()
 
             if not existing_alert:
+                server = await db.get(Server, latest_violation.server_id)
+                window = await active_window(db, server)
+                if window:
+                    logger.info(f"Alert suppressed for {server.hostname} by maintenance window {window.name}: {rule.name}")
+                    return
+
                 # Create new alert
                 alert = Alert(
                     alert_rule_id=rule.id,
@@ -216,6 +226,8 @@ class BackgroundTaskManager:
 
                 logger.warning(f"Alert triggered: {alert.message}")
 
+                dispatch_webhooks(rule.tenant_id, "alert.triggered", alert_payload(alert, rule, server))
+
     def _check_threshold(self, value: float, threshold: float, condition: str) -> bool:
         """Check if value violates threshold based on condition."""
         if condition == "gt":
@@ -232,17 +244,19 @@ class BackgroundTaskManager:
         """Clean up old metrics to prevent database bloat."""
         db = await get_background_db_session()
         try:
-            # Delete metrics older than 30 days
-            thirty_days_ago = datetime.utcnow() - timedelta(days=30)
+            # Delete metrics older than the retention, once they are archived
+            cutoff = datetime.utcnow() - timedelta(days=settings.METRICS_RETENTION_DAYS)
+            if archive_enabled():
+                cutoff = await archive_old_metrics(db, cutoff)
 
             result = await db.execute(
-                select(func.count(Metric.id)).where(Metric.collected_at < thirty_days_ago)
+                select(func.count(Metric.id)).where(Metric.collected_at < cutoff)
             )
             old_metrics_count = result.scalar()
 
             if old_metrics_count > 0:
                 await db.execute(
-                    delete(Metric).where(Metric.collected_at < thirty_days_ago)
+                    delete(Metric).where(Metric.collected_at < cutoff)
                 )
                 await db.commit()
                 logger.info(f"Cleaned up {old_metrics_count} old metrics")
@@ -254,14 +268,20 @@ class BackgroundTaskManager:
         """Update server status based on heartbeat timestamps."""
         db = await get_background_db_session()
         try:
-            # Mark servers as offline if no heartbeat in last 5 minutes
-            five_minutes_ago = datetime.utcnow() - timedelta(minutes=5)
-
+            # Mark servers as offline once they missed AGENT_HEARTBEAT_MISSES
+            # heartbeats, or sent none for AGENT_OFFLINE_SECONDS (agents
+            # without heartbeats)
+            now = datetime.utcnow()
+            allowed = case(
+                (Server.heartbeat_interval > 0, Server.heartbeat_interval * settings.AGENT_HEARTBEAT_MISSES),
+                else_=settings.AGENT_OFFLINE_SECONDS,
+            )
             result = await db.execute(
                 select(Server).where(
                     and_(
-                        Server.last_heartbeat < five_minutes_ago,
-                        Server.status != "offline"
+                        Server.last_heartbeat < now - func.make_interval(0, 0, 0, 0, 0, 0, cast(allowed, Float)),
+                        # Servers waiting for (or refused) enrollment stay so
+                        Server.status.notin_(["offline", "pending", "rejected"])
                     )
                 )
             )
@@ -0,0 +1,43 @@
+"""
+Bootstrap of tenant admins. Self-registration only creates operators, so the
+first admin of a tenant is made by whoever runs the server: listed in
+BOOTSTRAP_ADMINS, or with `python manage.py make-admin <username>`.
+"""
+
+import logging
+from typing import Optional
+from sqlalchemy import select
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from core.config import settings
+from core.database import async_session
+from models.models import User
+from utils.audit import record_audit
+
+logger = logging.getLogger(__name__)
+
+async def make_admin(db: AsyncSession, username: str, actor: str) -> Optional[User]:
+    """Make the active user username an admin of its tenant and audit it.
+    Returns the user, or None if there is no such user. The caller commits."""
+    result = await db.execute(select(User).where(User.username == username, User.is_active == True))
+    user = result.scalar_one_or_none()
+    if not user or user.role == "admin":
+        return user
+    previous = user.role
+    user.role = "admin"
+    record_audit(
+        db, user.tenant_id, actor, "user.role_changed", "user", user.id,
+        {"username": user.username, "from": previous, "to": "admin", "by": "bootstrap"}
+    )
+    logger.warning(f"User {user.username} made admin of tenant {user.tenant_id} by {actor}")
+    return user
+
+async def bootstrap_admins():
+    """Make the users in BOOTSTRAP_ADMINS admins, on start."""
+    if not settings.BOOTSTRAP_ADMINS:
+        return
+    async with async_session() as db:
+        for username in settings.BOOTSTRAP_ADMINS:
+            if not await make_admin(db, username, "bootstrap:BOOTSTRAP_ADMINS"):
+                logger.warning(f"BOOTSTRAP_ADMINS: no active user {username}")
+        await db.commit()
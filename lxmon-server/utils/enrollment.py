@@ -0,0 +1,65 @@
+"""
+Enrollment of new hosts: tokens they register with and the rules that approve
+them without waiting for an admin.
+"""
+
+import hashlib
+import ipaddress
+import logging
+from datetime import datetime
+from typing import Dict, Optional
+from sqlalchemy import select
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from models.models import EnrollmentToken
+
+logger = logging.getLogger(__name__)
+
+def token_hash(token: str) -> str:
+    return hashlib.sha256(token.encode()).hexdigest()
+
+async def find_enrollment_token(db: AsyncSession, token: Optional[str]) -> Optional[EnrollmentToken]:
+    """The token if it exists, has not expired and has uses left."""
+    if not token:
+        return None
+    result = await db.execute(
+        select(EnrollmentToken).where(EnrollmentToken.token_hash == token_hash(token))
+    )
+    enrollment_token = result.scalar_one_or_none()
+    if not enrollment_token:
+        return None
+    if enrollment_token.expires_at and enrollment_token.expires_at <= datetime.utcnow():
+        return None
+    if enrollment_token.max_uses is not None and enrollment_token.uses >= enrollment_token.max_uses:
+        return None
+    return enrollment_token
+
+def in_subnets(address: Optional[str], subnets) -> bool:
+    if not address:
+        return False
+    try:
+        ip = ipaddress.ip_address(address)
+    except ValueError:
+        return False
+    for subnet in subnets or []:
+        try:
+            if ip in ipaddress.ip_network(subnet, strict=False):
+                return True
+        except ValueError:
+            logger.warning(f"Invalid auto-approve subnet: {subnet}")
+    return False
+
+def auto_approve_reason(
+    enrollment_token: EnrollmentToken, client_ip: Optional[str], tags: Optional[Dict[str, str]]
+) -> Optional[str]:
+    """Why a host enrolling with the token is approved right away, or None if
+    it has to wait for an admin. Subnets match the address the host connects
+    from, not the one it reports. Tags are whatever the host claims, so they
+    only narrow down the hosts a subnet approves and never approve one
+    alone."""
+    if not in_subnets(client_ip, enrollment_token.auto_approve_subnets):
+        return None
+    rules = enrollment_token.auto_approve_tags or {}
+    if not all((tags or {}).get(key) == value for key, value in rules.items()):
+        return None
+    return f"subnet:{client_ip}"
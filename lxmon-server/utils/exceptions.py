@@ -15,10 +15,12 @@ class LxmonException(HTTPException):
         status_code: int,
         detail: str,
         error_code: str = None,
-        headers: Optional[Dict[str, str]] = None
+        headers: Optional[Dict[str, str]] = None,
+        details: Optional[Dict[str, Any]] = None
     ):
         super().__init__(status_code=status_code, detail=detail, headers=headers)
         self.error_code = error_code or f"ERROR_{status_code}"
+        self.details = details
 
 
 class ValidationError(LxmonException):
@@ -115,6 +117,19 @@ class CommandExecutionError(LxmonException):
         )
 
 
+class QuotaExceededError(LxmonException):
+    """Metrics payload over the host's quota. details tell the agent which
+    quota and by how much, so it can report it."""
+
+    def __init__(self, detail: str, details: Dict[str, Any]):
+        super().__init__(
+            status_code=status.HTTP_413_REQUEST_ENTITY_TOO_LARGE,
+            detail=detail,
+            error_code="QUOTA_EXCEEDED",
+            details=details
+        )
+
+
 class ErrorResponse(BaseModel):
     """Standard error response model."""
     error_code: str
@@ -129,5 +144,6 @@ def create_error_response(exception: LxmonException) -> ErrorResponse:
     return ErrorResponse(
         error_code=exception.error_code,
         message=exception.detail,
+        details=exception.details,
         timestamp=datetime.datetime.utcnow().isoformat()
     )
@@ -0,0 +1,40 @@
+"""
+Maintenance windows: which hosts are under maintenance, so alerts for them
+are suppressed.
+"""
+
+from datetime import datetime
+from typing import Optional
+from sqlalchemy import select, or_
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from models.models import MaintenanceWindow, Server
+
+def covers(window: MaintenanceWindow, server: Server) -> bool:
+    """Whether window applies to server (ignoring time)."""
+    if window.server_id is not None:
+        return window.server_id == server.id
+    if window.tag:
+        key, _, value = window.tag.partition("=")
+        return (server.tags or {}).get(key) == value
+    return True
+
+def is_active(window: MaintenanceWindow, at: Optional[datetime] = None) -> bool:
+    at = at or datetime.utcnow()
+    return window.starts_at <= at < window.ends_at
+
+async def active_window(db: AsyncSession, server: Server, at: Optional[datetime] = None) -> Optional[MaintenanceWindow]:
+    """The maintenance window server is in at the given time (default now), if any."""
+    at = at or datetime.utcnow()
+    result = await db.execute(
+        select(MaintenanceWindow).where(
+            MaintenanceWindow.tenant_id == server.tenant_id,
+            MaintenanceWindow.starts_at <= at,
+            MaintenanceWindow.ends_at > at,
+            or_(MaintenanceWindow.server_id == None, MaintenanceWindow.server_id == server.id)
+        )
+    )
+    for window in result.scalars().all():
+        if covers(window, server):
+            return window
+    return None
@@ -0,0 +1,105 @@
+"""
+Minimal client for S3-compatible object storage (AWS S3, MinIO, Ceph RGW,
+...), signing requests with AWS Signature Version 4. Objects are addressed
+path-style (<endpoint>/<bucket>/<key>), which every S3 implementation serves.
+"""
+
+import hashlib
+import hmac
+from datetime import datetime
+from typing import Dict, Optional
+from urllib.parse import quote, urlsplit
+
+import httpx
+
+class ObjectStorageError(Exception):
+    pass
+
+def _hmac(key: bytes, message: str) -> bytes:
+    return hmac.new(key, message.encode(), hashlib.sha256).digest()
+
+def sign_v4(
+    method: str,
+    url: str,
+    headers: Dict[str, str],
+    payload_hash: str,
+    access_key: str,
+    secret_key: str,
+    region: str,
+    now: Optional[datetime] = None,
+    service: str = "s3"
+) -> Dict[str, str]:
+    """Return headers plus Host, X-Amz-Date, X-Amz-Content-Sha256 and the
+    Authorization header signing all of them."""
+    now = now or datetime.utcnow()
+    amz_date = now.strftime("%Y%m%dT%H%M%SZ")
+    date = amz_date[:8]
+    parts = urlsplit(url)
+
+    signed = {name.lower(): value.strip() for name, value in headers.items()}
+    signed["host"] = parts.netloc
+    signed["x-amz-date"] = amz_date
+    signed["x-amz-content-sha256"] = payload_hash
+    names = sorted(signed)
+
+    query = "&".join(
+        sorted(f"{quote(k, safe='-_.~')}={quote(v, safe='-_.~')}" for k, _, v in
+               (pair.partition("=") for pair in parts.query.split("&") if pair))
+    )
+    canonical_request = "\n".join([
+        method,
+        quote(parts.path or "/", safe="/-_.~"),
+        query,
+        "".join(f"{name}:{signed[name]}\n" for name in names),
+        ";".join(names),
+        payload_hash,
+    ])
+    scope = f"{date}/{region}/{service}/aws4_request"
+    string_to_sign = "\n".join([
+        "AWS4-HMAC-SHA256",
+        amz_date,
+        scope,
+        hashlib.sha256(canonical_request.encode()).hexdigest(),
+    ])
+    key = _hmac(f"AWS4{secret_key}".encode(), date)
+    for part in (region, service, "aws4_request"):
+        key = _hmac(key, part)
+    signature = hmac.new(key, string_to_sign.encode(), hashlib.sha256).hexdigest()
+
+    result = {name: signed[name] for name in names}
+    result["authorization"] = (
+        f"AWS4-HMAC-SHA256 Credential={access_key}/{scope}, "
+        f"SignedHeaders={';'.join(names)}, Signature={signature}"
+    )
+    return result
+
+class ObjectStorage:
+    def __init__(self, endpoint: str, bucket: str, region: str, access_key: str, secret_key: str):
+        self.endpoint = endpoint.rstrip("/")
+        self.bucket = bucket
+        self.region = region
+        self.access_key = access_key
+        self.secret_key = secret_key
+
+    def url(self, key: str) -> str:
+        return f"{self.endpoint}/{self.bucket}/{quote(key, safe='/-_.~')}"
+
+    async def request(self, method: str, key: str, body: bytes = b"", headers: Optional[Dict[str, str]] = None) -> httpx.Response:
+        url = self.url(key)
+        signed = sign_v4(
+            method, url, headers or {}, hashlib.sha256(body).hexdigest(),
+            self.access_key, self.secret_key, self.region
+        )
+        async with httpx.AsyncClient(timeout=60.0) as client:
+            return await client.request(method, url, content=body, headers=signed)
+
+    async def put(self, key: str, body: bytes, content_type: str = "application/octet-stream"):
+        response = await self.request("PUT", key, body, {"content-type": content_type})
+        if response.status_code >= 300:
+            raise ObjectStorageError(f"PUT {key} failed with status {response.status_code}: {response.text[:500]}")
+
+    async def get(self, key: str) -> bytes:
+        response = await self.request("GET", key)
+        if response.status_code >= 300:
+            raise ObjectStorageError(f"GET {key} failed with status {response.status_code}: {response.text[:500]}")
+        return response.content
@@ -0,0 +1,219 @@
+"""
+Outgoing webhooks fired on alert state changes and agent events.
+
+Webhooks subscribe to event names ("alert.triggered", "alert.resolved",
+"event.<type>" for agent events such as "event.deploy"; shell-style
+wildcards like "event.*" work). The request body is the event payload as
+JSON, or the webhook's body template with {{ path.to.value }} placeholders
+filled from the payload (as JSON string content, so they belong inside
+quotes). With a secret set, requests carry
+X-Lxmon-Signature: sha256=<HMAC-SHA256 of "<timestamp>.<body>">.
+
+Webhook URLs are set by tenant users, so they may only point at public
+addresses (or WEBHOOK_ALLOWED_NETWORKS), and the receiver's answer is never
+passed back beyond its status code.
+"""
+
+import asyncio
+import fnmatch
+import hashlib
+import hmac
+import ipaddress
+import json
+import logging
+import re
+import socket
+import time
+from datetime import datetime
+from typing import Any, Dict, Optional
+from urllib.parse import urlsplit
+
+import httpx
+from sqlalchemy import select
+
+from core.config import settings
+from core.database import get_background_db_session
+from models.models import Webhook
+
+logger = logging.getLogger(__name__)
+
+# Delays before the second and third attempt
+RETRY_DELAYS = [1, 5]
+
+PLACEHOLDER = re.compile(r"\{\{\s*([\w.]+)\s*\}\}")
+
+# Deliveries in flight, so they are not garbage collected
+_pending = set()
+
+SAMPLE_PAYLOAD = {
+    "event": "alert.triggered",
+    "timestamp": "2024-01-01T00:00:00",
+    "server": {"id": 1, "name": "web-1", "hostname": "web-1"},
+    "alert": {"id": 1, "message": "High CPU: usage_percent is gt 90", "severity": "warning", "status": "active"},
+    "rule": {"id": 1, "name": "High CPU", "metric_type": "cpu", "metric_name": "usage_percent"},
+}
+
+def lookup(payload: Dict[str, Any], path: str) -> Any:
+    value: Any = payload
+    for key in path.split("."):
+        if not isinstance(value, dict):
+            return None
+        value = value.get(key)
+    return value
+
+def render_body(template: Optional[str], payload: Dict[str, Any]) -> str:
+    """Render the request body; raises ValueError if it is not valid JSON."""
+    if not template:
+        return json.dumps(payload, default=str)
+
+    def substitute(match):
+        value = lookup(payload, match.group(1))
+        if value is None:
+            return ""
+        if not isinstance(value, str):
+            value = json.dumps(value, default=str)
+        # JSON string content without the surrounding quotes
+        return json.dumps(value)[1:-1]
+
+    body = PLACEHOLDER.sub(substitute, template)
+    try:
+        json.loads(body)
+    except json.JSONDecodeError as e:
+        raise ValueError(f"body template does not render to valid JSON: {e}")
+    return body
+
+def validate_template(template: Optional[str]):
+    """Raise ValueError if template cannot produce a JSON body."""
+    render_body(template, SAMPLE_PAYLOAD)
+
+def allowed_address(address: str) -> bool:
+    try:
+        ip = ipaddress.ip_address(address.split("%")[0])
+    except ValueError:
+        return False
+    if isinstance(ip, ipaddress.IPv6Address) and ip.ipv4_mapped:
+        ip = ip.ipv4_mapped
+    for network in settings.WEBHOOK_ALLOWED_NETWORKS:
+        try:
+            if ip in ipaddress.ip_network(network, strict=False):
+                return True
+        except ValueError:
+            logger.warning(f"Invalid WEBHOOK_ALLOWED_NETWORKS entry: {network}")
+    return ip.is_global and not ip.is_multicast
+
+async def check_destination(url: str) -> Optional[str]:
+    """Why a webhook may not call url, or None if it may: the URL must be
+    http(s), and every address its host resolves to public or allowed."""
+    parts = urlsplit(url)
+    if parts.scheme not in ("http", "https") or not parts.hostname:
+        return "URL must be http:// or https:// with a host"
+    try:
+        port = parts.port or (443 if parts.scheme == "https" else 80)
+        infos = await asyncio.get_running_loop().getaddrinfo(parts.hostname, port, type=socket.SOCK_STREAM)
+    except (OSError, ValueError) as e:
+        return f"cannot resolve {parts.hostname}: {e}"
+    for info in infos:
+        if not allowed_address(info[4][0]):
+            return f"{parts.hostname} resolves to {info[4][0]}, which is not a public address"
+    return None
+
+def sign(secret: str, timestamp: str, body: str) -> str:
+    digest = hmac.new(secret.encode(), f"{timestamp}.{body}".encode(), hashlib.sha256).hexdigest()
+    return f"sha256={digest}"
+
+def subscribed(webhook: Webhook, event: str) -> bool:
+    return any(fnmatch.fnmatchcase(event, pattern) for pattern in (webhook.events or []))
+
+async def deliver(webhook: Webhook, event: str, payload: Dict[str, Any]) -> Dict[str, Any]:
+    """POST one event to a webhook, retrying network errors, 5xx and 429.
+    Returns the outcome; never raises."""
+    try:
+        body = render_body(webhook.body_template, payload)
+    except ValueError as e:
+        return {"ok": False, "status": None, "error": str(e), "attempts": 0}
+
+    timestamp = str(int(time.time()))
+    headers = {"Content-Type": "application/json", "User-Agent": "lxmon-webhook"}
+    headers.update(webhook.headers or {})
+    headers["X-Lxmon-Event"] = event
+    headers["X-Lxmon-Timestamp"] = timestamp
+    if webhook.secret:
+        headers["X-Lxmon-Signature"] = sign(webhook.secret, timestamp, body)
+
+    outcome = {"ok": False, "status": None, "error": None, "attempts": 0}
+    async with httpx.AsyncClient(timeout=10.0, follow_redirects=False) as client:
+        for attempt in range(len(RETRY_DELAYS) + 1):
+            if attempt:
+                await asyncio.sleep(RETRY_DELAYS[attempt - 1])
+            outcome["attempts"] = attempt + 1
+            # Checked before every attempt, as the name may resolve elsewhere
+            refused = await check_destination(webhook.url)
+            if refused:
+                outcome["error"] = refused
+                break
+            try:
+                response = await client.post(webhook.url, content=body, headers=headers)
+            except httpx.HTTPError as e:
+                outcome["error"] = str(e) or e.__class__.__name__
+                continue
+            outcome["status"] = response.status_code
+            if response.status_code < 300:
+                outcome.update(ok=True, error=None)
+                break
+            outcome["error"] = f"HTTP {response.status_code}"
+            if response.status_code != 429 and response.status_code < 500:
+                break
+    return outcome
+
+async def _dispatch(tenant_id: str, event: str, payload: Dict[str, Any]):
+    db = await get_background_db_session()
+    try:
+        result = await db.execute(
+            select(Webhook).where(Webhook.tenant_id == tenant_id, Webhook.enabled == True)
+        )
+        webhooks = [webhook for webhook in result.scalars().all() if subscribed(webhook, event)]
+        for webhook in webhooks:
+            outcome = await deliver(webhook, event, payload)
+            webhook.last_status = outcome["status"]
+            webhook.last_error = outcome["error"]
+            webhook.last_delivery_at = datetime.utcnow()
+            if not outcome["ok"]:
+                logger.warning(f"Webhook {webhook.name} failed for {event} after {outcome['attempts']} attempts: {outcome['error']}")
+        if webhooks:
+            await db.commit()
+    except Exception as e:
+        logger.error(f"Error dispatching webhooks for {event}: {e}")
+    finally:
+        await db.close()
+
+def dispatch_webhooks(tenant_id: str, event: str, payload: Dict[str, Any]):
+    """Fire the tenant's webhooks subscribed to event in the background."""
+    payload = {"event": event, "timestamp": datetime.utcnow().isoformat(), **payload}
+    task = asyncio.create_task(_dispatch(tenant_id, event, payload))
+    _pending.add(task)
+    task.add_done_callback(_pending.discard)
+
+def server_payload(server) -> Dict[str, Any]:
+    return {"id": server.id, "name": server.name, "hostname": server.hostname}
+
+def alert_payload(alert, rule, server) -> Dict[str, Any]:
+    """Payload for alert.triggered and alert.resolved."""
+    return {
+        "server": server_payload(server),
+        "alert": {
+            "id": alert.id,
+            "message": alert.message,
+            "severity": alert.severity,
+            "status": alert.status,
+            "triggered_at": alert.triggered_at.isoformat() if alert.triggered_at else None,
+            "resolved_at": alert.resolved_at.isoformat() if alert.resolved_at else None,
+        },
+        "rule": {
+            "id": rule.id,
+            "name": rule.name,
+            "metric_type": rule.metric_type,
+            "metric_name": rule.metric_name,
+            "condition": rule.condition,
+            "threshold": rule.threshold,
+        } if rule else None,
+    }